@@ -0,0 +1,385 @@
+package command
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//Every shard can keep a change log: each store transaction writing rows appends one
+//entry holding the rows it wrote, in the same transaction, so the log never misses or
+//invents a change. Entries are numbered per shard without gaps. A consumer reads a shard
+//from a sequence number on and keeps the number of the last entry it applied to resume
+const (
+	CDC_TRIM_BATCH = 1024 //entries deleted per transaction when the log is trimmed
+)
+
+//changeLogPrefix holds the entries of a shard, the row is changeLogPrefix-BE sequence number
+var changeLogPrefix = []byte{KEY_TYPE_SYSTEM, 'c', 'd', 'c'}
+
+var ErrChangeLogTrimmed = errors.New("sequence number is no longer in the change log")
+var ErrChangeLogOff = errors.New("change log is not enabled")
+
+//Change is one row written by an entry
+type Change struct {
+	Phys  uint16 //physical database of the row
+	Key   []byte //key owning the row
+	Row   []byte //row without the database prefix: key type, then the type's encoding
+	Value []byte //value of the row after the write, nil when it was deleted
+
+	system []byte //the whole row when it is an internal one, Phys, Key and Row are unset
+}
+
+//ChangeEntry is what one store transaction wrote to a shard
+type ChangeEntry struct {
+	Seq     uint64
+	Time    int64  //unix milliseconds of the commit
+	Command string //command the transaction ran for, empty for background work
+	Changes []*Change
+}
+
+//changeLog numbers the entries of a shard. The lock is held from the moment an entry
+//takes its number until its transaction commits, so entries become visible in order
+type changeLog struct {
+	db         store.IStore //the shard itself, below countedStore
+	lock       sync.Mutex
+	trimming   sync.Mutex //one trim at a time, first only moves under it
+	first      uint64     //oldest entry kept
+	next       uint64     //number of the next entry
+	maxEntries uint64     //0 keeps any number
+	maxAge     time.Duration
+	wait       chan struct{} //closed when an entry is added
+}
+
+func changeLogKey(seq uint64) []byte {
+	ret := make([]byte, len(changeLogPrefix)+8)
+	copy(ret, changeLogPrefix)
+	binary.BigEndian.PutUint64(ret[len(changeLogPrefix):], seq)
+	return ret
+}
+
+func newChangeLog(db store.IStore, maxEntries int, maxAge time.Duration) *changeLog {
+	l := &changeLog{db: db, maxEntries: uint64(maxEntries), maxAge: maxAge, wait: make(chan struct{})}
+	end := util.PrefixEnd(changeLogPrefix)
+	if rows := db.RangeLimit(changeLogPrefix, end, 1); len(rows) > 0 {
+		l.first = binary.BigEndian.Uint64(rows[0].V0[len(changeLogPrefix):])
+	}
+	if rows := db.RevRangeLimit(changeLogPrefix, end, 1); len(rows) > 0 {
+		l.next = binary.BigEndian.Uint64(rows[0].V0[len(changeLogPrefix):]) + 1
+	}
+	return l
+}
+
+//EnableChangeLog starts logging the changes of every shard, keeping at most maxEntries
+//entries per shard for at most maxAge, 0 disables a bound. Call it before serving commands
+func (c *RedisCommand) EnableChangeLog(maxEntries int, maxAge time.Duration) {
+	for _, db := range c.db {
+		if s, ok := db.(*countedStore); ok {
+			s.changes = newChangeLog(s.IStore, maxEntries, maxAge)
+		}
+	}
+	c.cdc = true
+	go c.trimChangeLogs()
+}
+
+//Origin returns a view of c whose transactions are logged as run by cmd
+func (c *RedisCommand) Origin(cmd string) *RedisCommand {
+	if !c.cdc || c.origin == cmd {
+		return c
+	}
+	v := *c
+	v.origin = cmd
+	return &v
+}
+
+//originStore passes the command a transaction runs for to the change log of its shard
+type originStore struct {
+	*countedStore
+	origin string
+}
+
+func (s *originStore) Transaction(f func(t interface{}) error) error {
+	return s.countedStore.transaction(s.origin, f)
+}
+
+//transaction runs f in a transaction of db logged as run for the origin of c
+func (c *RedisCommand) transaction(db store.IStore, f func(t interface{}) error) error {
+	if s, ok := db.(*countedStore); ok {
+		return s.transaction(c.origin, f)
+	}
+	return db.Transaction(f)
+}
+
+//begin numbers an entry of changes and writes it in t. Unless it fails the caller must
+//call end once t has committed or failed
+func (l *changeLog) begin(t interface{}, origin string, changes []*store.Pair) error {
+	l.lock.Lock()
+	err := l.db.Put(t, changeLogKey(l.next), encodeChangeEntry(origin, changes))
+	if err != nil {
+		l.lock.Unlock()
+	}
+	return err
+}
+
+func (l *changeLog) end(committed bool) {
+	if !committed {
+		l.lock.Unlock()
+		return
+	}
+	l.next++
+	close(l.wait)
+	l.wait = make(chan struct{})
+	over := l.maxEntries > 0 && l.next-l.first > l.maxEntries
+	l.lock.Unlock()
+	if over {
+		l.trim()
+	}
+}
+
+func encodeChangeEntry(origin string, changes []*store.Pair) []byte {
+	size := 8 + binary.MaxVarintLen64*2 + len(origin)
+	for _, v := range changes {
+		size += binary.MaxVarintLen64*2 + 1 + len(v.V0) + len(v.V1)
+	}
+	ret := make([]byte, 8, size)
+	binary.BigEndian.PutUint64(ret, uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	ret = appendChangeBytes(ret, []byte(origin))
+	ret = appendChangeUvarint(ret, uint64(len(changes)))
+	for _, v := range changes {
+		ret = appendChangeBytes(ret, v.V0)
+		if v.V1 == nil {
+			ret = append(ret, 0)
+			continue
+		}
+		ret = append(ret, 1)
+		ret = appendChangeBytes(ret, v.V1)
+	}
+	return ret
+}
+
+func appendChangeUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendChangeBytes(buf, v []byte) []byte {
+	return append(appendChangeUvarint(buf, uint64(len(v))), v...)
+}
+
+//changeReader decodes an entry, the first malformed read sets err
+type changeReader struct {
+	buf []byte
+	err error
+}
+
+var ErrChangeEntry = errors.New("malformed change log entry")
+
+func (r *changeReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err, r.buf = ErrChangeEntry, nil
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *changeReader) bytes() []byte {
+	n := r.uvarint()
+	if uint64(len(r.buf)) < n {
+		r.err, r.buf = ErrChangeEntry, nil
+		return nil
+	}
+	ret := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return ret
+}
+
+func decodeChangeEntry(seq uint64, data []byte) (*ChangeEntry, error) {
+	if len(data) < 8 {
+		return nil, ErrChangeEntry
+	}
+	e := &ChangeEntry{Seq: seq, Time: int64(binary.BigEndian.Uint64(data))}
+	r := &changeReader{buf: data[8:]}
+	e.Command = string(r.bytes())
+	count := r.uvarint()
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		row := r.bytes()
+		if len(r.buf) == 0 || len(row) <= DB_PREFIX_LEN {
+			return nil, ErrChangeEntry
+		}
+		put := r.buf[0] == 1
+		r.buf = r.buf[1:]
+		change := &Change{}
+		if row[0] == KEY_TYPE_SYSTEM {
+			change.system = row
+		} else {
+			change.Phys, change.Row = binary.BigEndian.Uint16(row), row[DB_PREFIX_LEN:]
+			if owner := watchOwner(row); owner != nil {
+				change.Key = owner[DB_PREFIX_LEN:]
+			}
+		}
+		if put {
+			change.Value = r.bytes()
+			if change.Value == nil {
+				change.Value = []byte{}
+			}
+		}
+		e.Changes = append(e.Changes, change)
+	}
+	return e, r.err
+}
+
+//entryTime returns the commit time of an entry in unix milliseconds
+func entryTime(data []byte) int64 {
+	if len(data) < 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(data))
+}
+
+//trim deletes the entries beyond the bounds. The newest entry is always kept, it carries the
+//numbering over a restart. The lock is not held while deleting: a shard transaction appending
+//an entry holds it, and with boltdb it would wait on the transaction of trim
+func (l *changeLog) trim() {
+	l.trimming.Lock()
+	defer l.trimming.Unlock()
+	for {
+		l.lock.Lock()
+		first, next := l.first, l.next
+		l.lock.Unlock()
+		if next-first <= 1 {
+			return
+		}
+		limit := uint64(0)
+		if l.maxEntries > 0 && next-first > l.maxEntries {
+			limit = next - first - l.maxEntries
+		}
+		if l.maxAge > 0 {
+			oldest := time.Now().Add(-l.maxAge).UnixNano() / int64(time.Millisecond)
+			for _, v := range l.db.RangeLimit(changeLogKey(first+limit), changeLogKey(next-1), CDC_TRIM_BATCH) {
+				if entryTime(v.V1) >= oldest || limit >= CDC_TRIM_BATCH {
+					break
+				}
+				limit++
+			}
+		}
+		if limit > CDC_TRIM_BATCH {
+			limit = CDC_TRIM_BATCH
+		}
+		if limit == 0 {
+			return
+		}
+		err := l.db.Transaction(func(t interface{}) error {
+			for seq := first; seq < first+limit; seq++ {
+				if err := l.db.Del(t, changeLogKey(seq)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("trim change log failed, err=%+v", err)
+			return
+		}
+		l.lock.Lock()
+		l.first = first + limit
+		l.lock.Unlock()
+	}
+}
+
+//trimChangeLogs enforces maxAge on shards that see no writes
+func (c *RedisCommand) trimChangeLogs() {
+	for {
+		for _, db := range c.db {
+			if s, ok := db.(*countedStore); ok && s.changes != nil {
+				s.changes.trim()
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+//changeLogOf returns the change log of a shard
+func (c *RedisCommand) changeLogOf(shard int) (*changeLog, error) {
+	if shard < 0 || shard >= len(c.db) {
+		return nil, ErrChangeLogOff
+	}
+	s, ok := c.direct().db[shard].(*countedStore)
+	if !ok || s.changes == nil {
+		return nil, ErrChangeLogOff
+	}
+	return s.changes, nil
+}
+
+//ChangeLogRange returns the oldest entry kept by the change log of shard and the number
+//the next entry will get
+func (c *RedisCommand) ChangeLogRange(shard int) (first, next uint64, err error) {
+	l, err := c.changeLogOf(shard)
+	if err != nil {
+		return 0, 0, err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.first, l.next, nil
+}
+
+//ReadChanges returns up to count entries of the change log of shard from seq on, and
+//a channel closed once more entries are added. A seq already trimmed away fails with
+//ErrChangeLogTrimmed, the consumer has to start over from a copy of the data
+func (c *RedisCommand) ReadChanges(shard int, seq uint64, count int) ([]*ChangeEntry, <-chan struct{}, error) {
+	l, err := c.changeLogOf(shard)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, wait, err := l.read(seq, count)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ret []*ChangeEntry
+	for i, v := range rows {
+		e, err := decodeChangeEntry(seq+uint64(i), v.V1)
+		if err != nil {
+			return nil, nil, err
+		}
+		//system rows only make sense to replicas
+		changes := e.Changes[:0]
+		for _, change := range e.Changes {
+			if change.system == nil {
+				changes = append(changes, change)
+			}
+		}
+		e.Changes = changes
+		ret = append(ret, e)
+	}
+	return ret, wait, nil
+}
+
+//read returns up to count rows of the log from seq on and the channel closed by the next entry
+func (l *changeLog) read(seq uint64, count int) ([]*store.Pair, <-chan struct{}, error) {
+	l.lock.Lock()
+	first, next, wait := l.first, l.next, l.wait
+	l.lock.Unlock()
+	if seq < first {
+		return nil, nil, ErrChangeLogTrimmed
+	}
+	if seq >= next {
+		return nil, wait, nil
+	}
+	rows := l.db.RangeLimit(changeLogKey(seq), changeLogKey(next), count)
+	//a trim between reading the bounds and the rows leaves a gap at the front
+	if len(rows) == 0 || binary.BigEndian.Uint64(rows[0].V0[len(changeLogPrefix):]) != seq {
+		return nil, nil, ErrChangeLogTrimmed
+	}
+	return rows, wait, nil
+}
+
+//IndexOf returns the logical database physical database phys is mapped to, -1 if none is
+func (c *RedisCommand) IndexOf(phys uint16) int {
+	return c.dbs.indexOf(phys)
+}
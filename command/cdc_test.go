@@ -0,0 +1,146 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//newChangeLogCommand serves a new data directory of one shard logging its changes
+func newChangeLogCommand(t *testing.T, path string, maxEntries int) (*RedisCommand, func()) {
+	t.Helper()
+	c, close := openTestCommand(t, path, 1)
+	c.EnableChangeLog(maxEntries, 0)
+	return c, close
+}
+
+//renderChanges lists the entries as "command db:key=value" with "-" for deleted rows, the
+//changes of an entry sorted
+func renderChanges(c *RedisCommand, entries []*ChangeEntry) []string {
+	var ret []string
+	for _, e := range entries {
+		var changes []string
+		for _, v := range e.Changes {
+			value := "-"
+			if v.Value != nil {
+				value = "+"
+			}
+			changes = append(changes, fmt.Sprintf("%d:%s%s", c.IndexOf(v.Phys), v.Key, value))
+		}
+		sort.Strings(changes)
+		ret = append(ret, e.Command+" "+strings.Join(changes, " "))
+	}
+	return ret
+}
+
+func TestChangeLog(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(c *RedisCommand)
+		want []string
+	}{
+		{"set", func(c *RedisCommand) { c.Origin("set").Set([]byte("a"), []byte("v"), 0) }, []string{"set 0:a+"}},
+		{"del", func(c *RedisCommand) { c.Origin("del").Del([]byte("k")) }, []string{"del 0:k-"}},
+		{"del missing", func(c *RedisCommand) { c.Origin("del").Del([]byte("missing")) }, nil},
+		{"read", func(c *RedisCommand) { c.Get([]byte("k")) }, nil},
+		{"hset", func(c *RedisCommand) {
+			c.Origin("hset").HSet([]byte("h"), []byte("f"), []byte("v"), []byte("g"), []byte("v"))
+		}, []string{"hset 0:h+ 0:h+ 0:h+"}},
+		//a rename commits through an intent, the entry clearing it holds internal rows only
+		{"rename", func(c *RedisCommand) { c.Origin("rename").Rename([]byte("k"), []byte("k2"), false) }, []string{"rename 0:k2+", "rename 0:k-", "rename "}},
+		{"failed rename", func(c *RedisCommand) { c.Origin("rename").Rename([]byte("missing"), []byte("k2"), false) }, nil},
+		{"other database", func(c *RedisCommand) {
+			db, _ := c.Select(3)
+			db.Origin("set").Set([]byte("a"), []byte("v"), 0)
+		}, []string{"set 3:a+"}},
+		{"no origin", func(c *RedisCommand) { c.Set([]byte("a"), []byte("v"), 0) }, []string{" 0:a+"}},
+		{"several", func(c *RedisCommand) {
+			c.Origin("set").Set([]byte("a"), []byte("1"), 0)
+			c.Origin("set").Set([]byte("b"), []byte("2"), 0)
+		}, []string{"set 0:a+", "set 0:b+"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newChangeLogCommand(t, t.TempDir(), 0)
+			c.Set([]byte("k"), []byte("v"), 0)
+			_, next, err := c.ChangeLogRange(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.run(c)
+			entries, _, err := c.ReadChanges(0, next, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, e := range entries {
+				if e.Seq != next+uint64(i) {
+					t.Fatalf("entry %d has seq %d, want %d", i, e.Seq, next+uint64(i))
+				}
+			}
+			if got := renderChanges(c, entries); strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Fatalf("changes %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangeLogOff(t *testing.T) {
+	c := newTestCommand(t, 1)
+	if _, _, err := c.ReadChanges(0, 0, 1); err != ErrChangeLogOff {
+		t.Fatalf("ReadChanges() = %v", err)
+	}
+}
+
+//TestChangeLogTrim keeps maxEntries entries, an older seq has to start over
+func TestChangeLogTrim(t *testing.T) {
+	path := t.TempDir()
+	c, close := newChangeLogCommand(t, path, 5)
+	for i := 0; i < 40; i++ {
+		c.Set([]byte(fmt.Sprint("k", i)), []byte("v"), 0)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, _, err := c.ReadChanges(0, 0, 1); err == ErrChangeLogTrimmed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the change log wasn't trimmed")
+		}
+	}
+	_, next, _ := c.ChangeLogRange(0)
+	if next != 40 {
+		t.Fatalf("next = %d after 40 writes", next)
+	}
+	close()
+
+	//the numbering goes on after a restart
+	c, _ = newChangeLogCommand(t, path, 5)
+	if first, next, _ := c.ChangeLogRange(0); next != 40 || first == 0 {
+		t.Fatalf("range [%d, %d) after reopening", first, next)
+	}
+	c.Set([]byte("a"), []byte("v"), 0)
+	if entries, _, err := c.ReadChanges(0, 40, 10); err != nil || len(entries) != 1 || entries[0].Seq != 40 {
+		t.Fatalf("ReadChanges() = %d entries, %v", len(entries), err)
+	}
+}
+
+//TestChangeLogWait wakes a consumer waiting at the end of the log
+func TestChangeLogWait(t *testing.T) {
+	c, _ := newChangeLogCommand(t, t.TempDir(), 0)
+	entries, wait, err := c.ReadChanges(0, 0, 10)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("ReadChanges() = %d entries, %v", len(entries), err)
+	}
+	select {
+	case <-wait:
+		t.Fatal("woken before any write")
+	default:
+	}
+	c.Set([]byte("a"), []byte("v"), 0)
+	select {
+	case <-wait:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not woken by a write")
+	}
+}
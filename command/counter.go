@@ -0,0 +1,238 @@
+package command
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//countedStore keeps the number of meta keys held by a shard up to date,
+//so DBSIZE never has to walk the keyspace. It also reports committed writes of watched keys
+//and appends the rows written to the change log of the shard. In cluster mode it keeps the
+//hash slot index of the keys as well, and it caches the generation rows it writes
+type countedStore struct {
+	store.IStore
+	lock    sync.Mutex
+	create  sync.Mutex       //held by the transaction writing meta or generation rows, see hold
+	keys    map[uint16]int64 //physical database -> number of keys
+	watches *watchTable
+	gens    *generations
+	changes *changeLog //nil unless the change log is enabled
+	slots   int32      //1 while the hash slot index is maintained
+}
+
+//keyCounter is implemented by the stores knowing how many keys each physical database holds
+type keyCounter interface {
+	Keys(phys uint16) int64
+}
+
+//countedTx wraps the transaction of the underlying store and remembers, for every
+//meta key written, whether it existed before the transaction and whether it exists after
+type countedTx struct {
+	tx      interface{}
+	touched map[string]*[2]bool
+	owners  map[string]bool //watched phys-keys written
+	changes []*store.Pair   //rows written for the change log, nil value means deleted
+	gens    []*store.Pair   //generation rows written with the value they replace
+	create  bool            //the transaction holds the create lock of the store
+}
+
+func newCountedStore(db store.IStore, physicals []uint16, watches *watchTable, gens *generations) *countedStore {
+	s := &countedStore{IStore: db, keys: make(map[uint16]int64), watches: watches, gens: gens}
+	for _, phys := range physicals {
+		prefix := encodeDBPrefix(phys)
+		var last []byte
+		for {
+			rows := scanMetaRows(db, prefix, KEY_META_TYPES, last, 1024)
+			s.keys[phys] += int64(len(rows))
+			if len(rows) < 1024 {
+				break
+			}
+			last = rows[len(rows)-1].V0
+		}
+	}
+	return s
+}
+
+func isMetaKey(key []byte) bool {
+	if len(key) <= DB_PREFIX_LEN {
+		return false
+	}
+	for _, tp := range KEY_META_TYPES {
+		if key[DB_PREFIX_LEN] == tp {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *countedStore) unwrap(tx interface{}) (interface{}, *countedTx) {
+	if ct, ok := tx.(*countedTx); ok {
+		return ct.tx, ct
+	}
+	return tx, nil
+}
+
+func (s *countedStore) touch(ct *countedTx, key []byte, exists bool) {
+	if ct == nil {
+		return
+	}
+	if s.watches.active() {
+		if owner := watchOwner(key); owner != nil {
+			if ct.owners == nil {
+				ct.owners = make(map[string]bool)
+			}
+			ct.owners[string(owner)] = true
+		}
+	}
+	if !isMetaKey(key) {
+		return
+	}
+	if ct.touched == nil {
+		ct.touched = make(map[string]*[2]bool)
+	}
+	s.hold(ct)
+	if v, ok := ct.touched[string(key)]; ok {
+		v[1] = exists
+		return
+	}
+	ct.touched[string(key)] = &[2]bool{s.IStore.Get(ct.tx, key) != nil, exists}
+}
+
+//hold takes the create lock of the store for ct until it commits. A LevelDB transaction is
+//a batch reading the committed rows, two of them creating the same key would both see it
+//missing and count it, and a generation row must be cached before another transaction uses it
+func (s *countedStore) hold(ct *countedTx) {
+	if !ct.create {
+		s.create.Lock()
+		ct.create = true
+	}
+}
+
+//holdCreate takes the create lock of db for the transaction t, if db counts its keys
+func holdCreate(db store.IStore, t interface{}) {
+	if s, ok := db.(*countedStore); ok {
+		if ct, ok := t.(*countedTx); ok {
+			s.hold(ct)
+		}
+	}
+}
+
+//generation caches a generation row as ct writes it, so the rest of ct allocates the field
+//rows of the name under it, and keeps the value it replaces to restore if ct fails. ct holds
+//the create lock until it commits, no other transaction creates a collection meanwhile
+func (s *countedStore) generation(ct *countedTx, key, value []byte) {
+	if ct == nil || s.gens == nil || !isGenerationRow(key) {
+		return
+	}
+	s.hold(ct)
+	prev := make([]byte, 4)
+	binary.BigEndian.PutUint32(prev, s.gens.get(key[len(generationPrefix):]))
+	ct.gens = append(ct.gens, &store.Pair{V0: key, V1: prev})
+	s.gens.apply(key, value)
+}
+
+//record keeps a row written by ct for the change log
+func (s *countedStore) record(ct *countedTx, key, value []byte) {
+	if s.changes == nil || ct == nil || len(key) <= DB_PREFIX_LEN || !replicated(key) {
+		return
+	}
+	ct.changes = append(ct.changes, &store.Pair{V0: key, V1: value})
+}
+
+func (s *countedStore) Put(tx interface{}, key, value []byte) error {
+	t, ct := s.unwrap(tx)
+	s.touch(ct, key, true)
+	if value == nil {
+		value = []byte{}
+	}
+	s.generation(ct, key, value)
+	s.record(ct, key, value)
+	return s.IStore.Put(t, key, value)
+}
+
+func (s *countedStore) Get(tx interface{}, key []byte) []byte {
+	t, _ := s.unwrap(tx)
+	return s.IStore.Get(t, key)
+}
+
+func (s *countedStore) Del(tx interface{}, key []byte) error {
+	t, ct := s.unwrap(tx)
+	s.touch(ct, key, false)
+	s.generation(ct, key, nil)
+	s.record(ct, key, nil)
+	return s.IStore.Del(t, key)
+}
+
+func (s *countedStore) Transaction(f func(t interface{}) error) error {
+	return s.transaction("", f)
+}
+
+//transaction runs f, logging its changes as made by the command origin. The transactions of
+//a shard writing meta rows run one at a time, from their first meta row written to their commit
+func (s *countedStore) transaction(origin string, f func(t interface{}) error) error {
+	ct := &countedTx{}
+	defer func() {
+		if ct.create {
+			s.create.Unlock()
+		}
+	}()
+	logged := false
+	err := s.IStore.Transaction(func(t interface{}) error {
+		ct.tx = t
+		if err := f(ct); err != nil {
+			return err
+		}
+		if s.slotIndexed() {
+			if err := s.indexSlots(t, ct); err != nil {
+				return err
+			}
+		}
+		if len(ct.changes) == 0 {
+			return nil
+		}
+		if err := s.changes.begin(t, origin, ct.changes); err != nil {
+			return err
+		}
+		logged = true
+		return nil
+	})
+	if logged {
+		s.changes.end(err == nil)
+	}
+	if err != nil {
+		for i := len(ct.gens) - 1; i >= 0; i-- {
+			s.gens.apply(ct.gens[i].V0, ct.gens[i].V1)
+		}
+		return err
+	}
+	if ct.owners != nil {
+		s.watches.touch(ct.owners)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, v := range ct.touched {
+		phys := binary.BigEndian.Uint16([]byte(k))
+		if !v[0] && v[1] {
+			s.keys[phys]++
+		} else if v[0] && !v[1] {
+			s.keys[phys]--
+		}
+	}
+	return nil
+}
+
+//Keys returns the number of keys of a physical database held by the shard
+func (s *countedStore) Keys(phys uint16) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.keys[phys]
+}
+
+//Reset forgets the count of a physical database that has been dropped
+func (s *countedStore) Reset(phys uint16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.keys, phys)
+}
@@ -0,0 +1,87 @@
+package command
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestDBSize(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(c *RedisCommand)
+		want int64
+	}{
+		{"empty", func(c *RedisCommand) {}, 0},
+		{"set twice", func(c *RedisCommand) {
+			c.Set([]byte("a"), []byte("1"), 0)
+			c.Set([]byte("a"), []byte("2"), 0)
+		}, 1},
+		{"types", func(c *RedisCommand) {
+			c.Set([]byte("s"), []byte("1"), 0)
+			c.HSet([]byte("h"), []byte("f"), []byte("v"), []byte("g"), []byte("v"))
+			c.SAdd([]byte("set"), []byte("m"))
+			c.RPush([]byte("l"), []byte("x"), []byte("y"))
+		}, 4},
+		{"del", func(c *RedisCommand) {
+			c.Set([]byte("a"), []byte("1"), 0)
+			c.HSet([]byte("h"), []byte("f"), []byte("v"))
+			c.Del([]byte("a"))
+			c.Del([]byte("h"))
+			c.Del([]byte("missing"))
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCommand(t, 0)
+			tt.run(c)
+			if got := c.DBSize(); got != tt.want {
+				t.Fatalf("DBSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+//TestDBSizeConcurrent creates and deletes the same keys from several clients at once, each
+//key must be counted once
+func TestDBSizeConcurrent(t *testing.T) {
+	c := newTestCommand(t, 0)
+	const clients, keys = 16, 100
+	run := func(f func(key []byte)) {
+		var wg sync.WaitGroup
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < keys; j++ {
+					f([]byte(fmt.Sprintf("key:%d", j)))
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	for round := 0; round < 10; round++ {
+		run(func(key []byte) { c.Set(key, []byte("v"), 0) })
+		if got := c.DBSize(); got != keys {
+			t.Fatalf("DBSize() after concurrent SET = %d, want %d", got, keys)
+		}
+		run(func(key []byte) { c.Del(key) })
+		if got := c.DBSize(); got != 0 {
+			t.Fatalf("DBSize() after concurrent DEL = %d, want 0", got)
+		}
+	}
+}
+
+func TestDBSizeReopen(t *testing.T) {
+	path := t.TempDir()
+	c, close := openTestCommand(t, path, 0)
+	for i := 0; i < 30; i++ {
+		c.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"), 0)
+	}
+	c.HSet([]byte("h"), []byte("f"), []byte("v"))
+	close()
+	c, _ = openTestCommand(t, path, 0)
+	if got := c.DBSize(); got != 31 {
+		t.Fatalf("DBSize() after reopen = %d, want 31", got)
+	}
+}
@@ -0,0 +1,392 @@
+package command
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+const (
+	DATABASES_DEFAULT = 16
+	DATABASES_MAX     = 0xFF00 //physical ids stay below the system keyspace
+)
+
+var databasesKey = []byte{KEY_TYPE_SYSTEM, 'd', 'b', 'm', 'a', 'p'}
+
+//droppedPrefix marks physical databases detached by an async flush whose keys are still being deleted
+var droppedPrefix = []byte{KEY_TYPE_SYSTEM, 'd', 'r', 'o', 'p'}
+
+//databases maps the logical databases clients SELECT onto the physical ids prefixing
+//their keys, so SWAPDB only has to swap two entries. The table lives in the first shard
+type databases struct {
+	lock     sync.RWMutex
+	db       store.IStore
+	physical []uint16
+	next     uint16          //lowest physical id never handed out
+	dropped  map[uint16]bool //physical ids waiting to be reclaimed
+}
+
+//loadDatabases reads the table, growing it to count databases. A data directory written
+//before databases existed has its keys moved into physical database 0 first
+func loadDatabases(db []store.IStore, count int) (*databases, error) {
+	if count < 1 || count > DATABASES_MAX {
+		return nil, ErrDBIndex
+	}
+	d := &databases{db: db[0], dropped: make(map[uint16]bool)}
+	var data []byte
+	_ = d.db.Transaction(func(t interface{}) error {
+		data = d.db.Get(t, databasesKey)
+		return nil
+	})
+	for _, v := range d.db.Scan(droppedPrefix) {
+		d.dropped[binary.BigEndian.Uint16(v.V0[len(droppedPrefix):])] = true
+	}
+	if data == nil {
+		for _, v := range db {
+			if err := migrateLegacyKeys(v); err != nil {
+				return nil, err
+			}
+		}
+	} else if len(data) >= 2 {
+		d.next = binary.BigEndian.Uint16(data)
+		for i := 2; i+2 <= len(data); i += 2 {
+			d.physical = append(d.physical, binary.BigEndian.Uint16(data[i:]))
+		}
+	}
+	if len(d.physical) > count {
+		d.physical = d.physical[:count]
+	}
+	for len(d.physical) < count {
+		d.physical = append(d.physical, d.next)
+		d.next++
+	}
+	return d, d.save()
+}
+
+//migrateLegacyKeys prefixes the keys of a store written without databases with physical database 0,
+//legacy keys all start with an upper case type letter
+func migrateLegacyKeys(db store.IStore) error {
+	prefix := encodeDBPrefix(0)
+	for {
+		rows := db.RangeLimit([]byte{'A'}, []byte{'Z' + 1}, 1024)
+		if len(rows) == 0 {
+			return nil
+		}
+		err := db.Transaction(func(t interface{}) error {
+			for _, v := range rows {
+				if err := db.Put(t, append(append([]byte{}, prefix...), v.V0...), v.V1); err != nil {
+					return err
+				}
+				if err := db.Del(t, v.V0); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//reload reads the table and the dropped ids again after a replica received them
+func (d *databases) reload() error {
+	var data []byte
+	_ = d.db.Transaction(func(t interface{}) error {
+		data = d.db.Get(t, databasesKey)
+		return nil
+	})
+	dropped := make(map[uint16]bool)
+	for _, v := range d.db.Scan(droppedPrefix) {
+		dropped[binary.BigEndian.Uint16(v.V0[len(droppedPrefix):])] = true
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.dropped = dropped
+	if len(data) < 2 {
+		return nil
+	}
+	d.next = binary.BigEndian.Uint16(data)
+	d.physical = d.physical[:0]
+	for i := 2; i+2 <= len(data); i += 2 {
+		d.physical = append(d.physical, binary.BigEndian.Uint16(data[i:]))
+	}
+	return nil
+}
+
+//save persists the table, the caller holds the lock or owns d exclusively
+func (d *databases) save() error {
+	return d.db.Transaction(func(t interface{}) error {
+		return d.saveTx(t)
+	})
+}
+
+func (d *databases) saveTx(t interface{}) error {
+	data := make([]byte, 2+2*len(d.physical))
+	binary.BigEndian.PutUint16(data, d.next)
+	for k, v := range d.physical {
+		binary.BigEndian.PutUint16(data[2+2*k:], v)
+	}
+	return d.db.Put(t, databasesKey, data)
+}
+
+func droppedKey(phys uint16) []byte {
+	return append(append([]byte{}, droppedPrefix...), encodeDBPrefix(phys)...)
+}
+
+//allocate returns a physical id neither mapped nor waiting to be reclaimed, the caller holds the lock
+func (d *databases) allocate() (uint16, error) {
+	if d.next < DATABASES_MAX {
+		d.next++
+		return d.next - 1, nil
+	}
+	used := make(map[uint16]bool)
+	for _, v := range d.physical {
+		used[v] = true
+	}
+	for id := uint16(0); id < DATABASES_MAX; id++ {
+		if !used[id] && !d.dropped[id] {
+			return id, nil
+		}
+	}
+	return 0, ErrDBIndex
+}
+
+//detach maps the logical databases onto fresh physical ones and records the old ids
+//as dropped in the same transaction, returning them for reclaiming
+func (d *databases) detach(indexes []int) ([]uint16, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	saved, next := append([]uint16{}, d.physical...), d.next
+	var old []uint16
+	rollback := func() {
+		d.physical, d.next = saved, next
+		for _, v := range old {
+			delete(d.dropped, v)
+		}
+	}
+	for _, index := range indexes {
+		phys, err := d.allocate()
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		old = append(old, d.physical[index])
+		d.dropped[d.physical[index]] = true
+		d.physical[index] = phys
+	}
+	err := d.db.Transaction(func(t interface{}) error {
+		for _, v := range old {
+			if err := d.db.Put(t, droppedKey(v), []byte{}); err != nil {
+				return err
+			}
+		}
+		return d.saveTx(t)
+	})
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	return old, nil
+}
+
+func (d *databases) droppedIDs() (ret []uint16) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	for k := range d.dropped {
+		ret = append(ret, k)
+	}
+	return
+}
+
+//reclaimed forgets a dropped id once all its keys are gone
+func (d *databases) reclaimed(phys uint16) error {
+	err := d.db.Transaction(func(t interface{}) error {
+		return d.db.Del(t, droppedKey(phys))
+	})
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.dropped, phys)
+	return nil
+}
+
+func (d *databases) physicals() []uint16 {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return append([]uint16{}, d.physical...)
+}
+
+func (d *databases) count() int {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return len(d.physical)
+}
+
+func (d *databases) physicalOf(index int) uint16 {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.physical[index]
+}
+
+func (d *databases) indexOf(phys uint16) int {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	for i, v := range d.physical {
+		if v == phys {
+			return i
+		}
+	}
+	return -1
+}
+
+//Databases returns the number of logical databases
+func (c *RedisCommand) Databases() int {
+	return c.dbs.count()
+}
+
+//Index returns the logical database c is bound to
+func (c *RedisCommand) Index() int {
+	return c.index
+}
+
+//Select returns a view of logical database index sharing the stores of c
+func (c *RedisCommand) Select(index int) (*RedisCommand, error) {
+	if index < 0 || index >= c.dbs.count() {
+		return nil, ErrDBIndex
+	}
+	return c.view(index, 0), nil
+}
+
+//physicalView addresses a physical database directly, used to finish work recorded
+//before a SWAPDB may have changed the logical mapping
+func (c *RedisCommand) physicalView(phys uint16) *RedisCommand {
+	return c.view(-1, phys)
+}
+
+func (c *RedisCommand) view(index int, phys uint16) *RedisCommand {
+	v := *c
+	v.index, v.phys = index, phys
+	return &v
+}
+
+//SwapDB exchanges two logical databases, connections using either see the other one's keys at once
+func (c *RedisCommand) SwapDB(a, b int) error {
+	if c.readOnly(true) {
+		return ErrReadOnly
+	}
+	d := c.dbs
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if a < 0 || a >= len(d.physical) || b < 0 || b >= len(d.physical) {
+		return ErrDBIndex
+	}
+	d.physical[a], d.physical[b] = d.physical[b], d.physical[a]
+	if err := d.save(); err != nil {
+		d.physical[a], d.physical[b] = d.physical[b], d.physical[a]
+		return err
+	}
+	c.watches.touchDB(d.physical[a], d.physical[b])
+	return nil
+}
+
+//FlushDB deletes every key of the database in bounded batches
+func (c *RedisCommand) FlushDB() error {
+	return c.flushPhysical(c.physical())
+}
+
+//FlushAll deletes every key of every database, async detaches them instead and reclaims the
+//space in the background, writes issued after it returns already land in empty databases
+func (c *RedisCommand) FlushAll(async bool) error {
+	indexes := make([]int, c.Databases())
+	for i := range indexes {
+		indexes[i] = i
+	}
+	//a transaction deletes synchronously so the flush commits together with its other writes
+	if async && c.multi == nil {
+		return c.flushAsync(indexes)
+	}
+	for _, v := range c.dbs.physicals() {
+		if err := c.flushPhysical(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//FlushDBAsync swaps in an empty physical database and reclaims the old one in the background
+func (c *RedisCommand) FlushDBAsync() error {
+	if c.multi != nil {
+		return c.FlushDB()
+	}
+	return c.flushAsync([]int{c.index})
+}
+
+func (c *RedisCommand) flushAsync(indexes []int) error {
+	old, err := c.dbs.detach(indexes)
+	if err != nil {
+		return err
+	}
+	c.watches.touchDB(old...)
+	for _, v := range old {
+		go c.reclaim(v)
+	}
+	return nil
+}
+
+//ReclaimDropped resumes reclaiming the databases detached before a restart
+func (c *RedisCommand) ReclaimDropped() {
+	for _, v := range c.dbs.droppedIDs() {
+		go c.reclaim(v)
+	}
+}
+
+func (c *RedisCommand) reclaim(phys uint16) {
+	if err := c.flushPhysical(phys); err != nil {
+		log.Printf("reclaim database failed, physical=%d, err=%+v", phys, err)
+		return
+	}
+	if err := c.dbs.reclaimed(phys); err != nil {
+		log.Printf("reclaim database failed, physical=%d, err=%+v", phys, err)
+		return
+	}
+	for _, db := range c.db {
+		if s, ok := db.(*countedStore); ok {
+			s.Reset(phys)
+		}
+	}
+}
+
+//flushPhysical deletes the rows of a physical database, with its lazy free records and
+//generation rows
+func (c *RedisCommand) flushPhysical(phys uint16) error {
+	for _, system := range [][]byte{nil, lazyFreePrefix, generationPrefix} {
+		prefix := append(append([]byte{}, system...), encodeDBPrefix(phys)...)
+		end := util.PrefixEnd(prefix)
+		for _, db := range c.db {
+			for {
+				rows := db.RangeLimit(prefix, end, 1024)
+				if len(rows) == 0 {
+					break
+				}
+				err := db.Transaction(func(t interface{}) error {
+					for _, v := range rows {
+						if err := db.Del(t, v.V0); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package command
+
+import (
+	"testing"
+	"time"
+)
+
+//waitReclaimed waits until the databases detached by asynchronous flushes are deleted
+func waitReclaimed(t *testing.T, c *RedisCommand) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); len(c.dbs.droppedIDs()) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("databases %v not reclaimed", c.dbs.droppedIDs())
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	tests := []struct {
+		name  string
+		flush func(c *RedisCommand) error
+		left  int64 //keys left in database 1
+	}{
+		{"flushdb", (*RedisCommand).FlushDB, int64(len(lazyTypes))},
+		{"flushdb async", (*RedisCommand).FlushDBAsync, int64(len(lazyTypes))},
+		{"flushall", func(c *RedisCommand) error { return c.FlushAll(false) }, 0},
+		{"flushall async", func(c *RedisCommand) error { return c.FlushAll(true) }, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir()
+			c, close := openTestCommand(t, path, 0)
+			views := make([]*RedisCommand, 2)
+			for i := range views {
+				var err error
+				if views[i], err = c.Select(i); err != nil {
+					t.Fatal(err)
+				}
+				for _, lt := range lazyTypes {
+					for j := 0; j < LAZYFREE_THRESHOLD*2; j++ {
+						lt.add(views[i], []byte(lt.name), j)
+					}
+				}
+			}
+			if err := tt.flush(views[0]); err != nil {
+				t.Fatal(err)
+			}
+			//the flush is visible at once, keys written next survive the reclaiming
+			if size := views[0].DBSize(); size != 0 {
+				t.Fatalf("DBSize() = %d after the flush", size)
+			}
+			for _, lt := range lazyTypes {
+				lt.add(views[0], []byte(lt.name), 0)
+			}
+			waitReclaimed(t, c)
+			close()
+
+			c, _ = openTestCommand(t, path, 0)
+			for i, want := range []int64{int64(len(lazyTypes)), tt.left} {
+				view, err := c.Select(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if size := view.DBSize(); size != want {
+					t.Fatalf("DBSize() of database %d = %d, want %d", i, size, want)
+				}
+				for _, lt := range lazyTypes {
+					n := 0
+					if i == 0 {
+						n = 1
+					} else if want != 0 {
+						n = LAZYFREE_THRESHOLD * 2
+					}
+					if got := lt.size(view, []byte(lt.name)); got != n {
+						t.Errorf("%s of database %d has %d items, want %d", lt.name, i, got, n)
+					}
+				}
+			}
+		})
+	}
+}
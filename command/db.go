@@ -0,0 +1,460 @@
+package command
+
+import (
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//ScanCursor is a position in the keyspace: the shard being walked and the last
+//encoded meta key returned from it, a nil Last starts the shard from the beginning
+type ScanCursor struct {
+	Shard int
+	Last  []byte
+}
+
+var keyTypeNames = map[byte]string{
+	KEY_TYPE_STRING: "string",
+	KEY_TYPE_HASH:   "hash",
+	KEY_TYPE_LIST:   "list",
+	KEY_TYPE_SET:    "set",
+	KEY_TYPE_ZSET:   "zset",
+	KEY_TYPE_STREAM: "stream",
+}
+
+//KeyTypeName returns the redis name of a meta key type, "none" for 0
+func KeyTypeName(tp byte) string {
+	if name, ok := keyTypeNames[tp]; ok {
+		return name
+	}
+	return "none"
+}
+
+//ParseKeyType maps a redis type name back onto its meta key type, 0 if unknown
+func ParseKeyType(name string) byte {
+	for tp, v := range keyTypeNames {
+		if v == name {
+			return tp
+		}
+	}
+	return 0
+}
+
+//Shards returns the number of stores keys are spread over
+func (c *RedisCommand) Shards() int {
+	return len(c.db)
+}
+
+//Type returns the meta key type of a live key, 0 if it does not exist
+func (c *RedisCommand) Type(key []byte) (tp byte) {
+	db := c.DB(key)
+	_ = db.Transaction(func(t interface{}) error {
+		tp = c.keyType(db, t, key)
+		return nil
+	})
+	return
+}
+
+//Exists counts the keys that exist, a key given twice is counted twice
+func (c *RedisCommand) Exists(keys ...[]byte) (ret int) {
+	for _, v := range keys {
+		if c.Type(v) != 0 {
+			ret++
+		}
+	}
+	return
+}
+
+//Keys walks every shard and returns the keys matching the glob pattern
+func (c *RedisCommand) Keys(match []byte) (ret [][]byte) {
+	cursor := ScanCursor{}
+	for {
+		next, keys, done := c.Scan(cursor, match, 1024, 0)
+		ret = append(ret, keys...)
+		if done {
+			return
+		}
+		cursor = next
+	}
+}
+
+//DBSize returns the number of keys, expired keys not yet removed included
+func (c *RedisCommand) DBSize() (ret int64) {
+	phys := c.physical()
+	for _, v := range c.db {
+		if s, ok := v.(keyCounter); ok {
+			ret += s.Keys(phys)
+		}
+	}
+	return
+}
+
+//RandomKey picks a shard weighted by its key count and returns the first live key
+//found after a random position in it, nil if the database is empty
+func (c *RedisCommand) RandomKey() []byte {
+	phys := c.physical()
+	prefix := encodeDBPrefix(phys)
+	for try := 0; try < 16; try++ {
+		total := c.DBSize()
+		if total <= 0 {
+			return nil
+		}
+		n := rand.Int63n(total)
+		shard := 0
+		for ; shard < len(c.db)-1; shard++ {
+			if s, ok := c.db[shard].(keyCounter); ok {
+				if n < s.Keys(phys) {
+					break
+				}
+				n -= s.Keys(phys)
+			}
+		}
+		db := c.db[shard]
+		start := make([]byte, DB_PREFIX_LEN+1+8)
+		copy(start, prefix)
+		start[DB_PREFIX_LEN] = KEY_META_TYPES[rand.Intn(len(KEY_META_TYPES))]
+		rand.Read(start[DB_PREFIX_LEN+1:])
+		rows := scanMetaRows(db, prefix, KEY_META_TYPES, start, 1)
+		if len(rows) == 0 {
+			rows = scanMetaRows(db, prefix, KEY_META_TYPES, nil, 1)
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		expire, data := c.DecodeValue(rows[0].V1)
+		if !expire && data != nil {
+			return rows[0].V0[DB_PREFIX_LEN+1:]
+		}
+	}
+	return nil
+}
+
+//Scan examines about count meta keys starting at cursor, walking the shards one after another.
+//tp restricts the walk to one key type, match filters the returned keys.
+//done is set once every shard has been walked
+func (c *RedisCommand) Scan(cursor ScanCursor, match []byte, count int, tp byte) (next ScanCursor, keys [][]byte, done bool) {
+	types := KEY_META_TYPES
+	if tp != 0 {
+		types = []byte{tp}
+	}
+	if count < 1 {
+		count = 1
+	}
+
+	prefix := encodeDBPrefix(c.physical())
+	next = cursor
+	for examined := 0; next.Shard < len(c.db) && examined < count; {
+		want := count - examined
+		rows := scanMetaRows(c.db[next.Shard], prefix, types, next.Last, want)
+		examined += len(rows)
+		for _, v := range rows {
+			expire, data := c.DecodeValue(v.V1)
+			if expire || data == nil {
+				continue
+			}
+			key := v.V0[DB_PREFIX_LEN+1:]
+			if match != nil && !util.GlobMatch(match, key) {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		if len(rows) < want {
+			next = ScanCursor{Shard: next.Shard + 1}
+			continue
+		}
+		next.Last = rows[len(rows)-1].V0
+	}
+	return next, keys, next.Shard >= len(c.db)
+}
+
+//scanMetaRows returns up to limit meta rows of the given types in the database with prefix
+//that sort after last, types must be sorted
+func scanMetaRows(db store.IStore, prefix, types []byte, last []byte, limit int) (ret []*store.Pair) {
+	p := len(prefix)
+	if len(last) <= p || string(last[:p]) != string(prefix) {
+		last = nil
+	}
+	for _, tp := range types {
+		start := append(append([]byte{}, prefix...), tp)
+		if last != nil {
+			if last[p] > tp {
+				continue
+			}
+			if last[p] == tp {
+				start = make([]byte, len(last)+1)
+				copy(start, last)
+			}
+		}
+		end := append(append([]byte{}, prefix...), tp+1)
+		ret = append(ret, db.RangeLimit(start, end, limit-len(ret))...)
+		if len(ret) >= limit {
+			break
+		}
+	}
+	return
+}
+
+//scanRows pages through the field rows under prefix, next is nil once the rows are exhausted
+func (c *RedisCommand) scanRows(db store.IStore, prefix, last []byte, count int) (rows []*store.Pair, next []byte) {
+	if count < 1 {
+		count = 1
+	}
+	start := prefix
+	if len(last) > len(prefix) && string(last[:len(prefix)]) == string(prefix) {
+		start = make([]byte, len(last)+1)
+		copy(start, last)
+	}
+	rows = db.RangeLimit(start, util.PrefixEnd(prefix), count)
+	if len(rows) == count {
+		next = rows[len(rows)-1].V0
+	}
+	return
+}
+
+//scanCheck makes sure key either is missing or holds the expected type
+func (c *RedisCommand) scanCheck(db store.IStore, key []byte, tp byte) (bool, error) {
+	var actual byte
+	_ = db.Transaction(func(t interface{}) error {
+		actual = c.keyType(db, t, key)
+		return nil
+	})
+	if actual == 0 {
+		return false, nil
+	}
+	if actual != tp {
+		return false, ErrKeyTypeError
+	}
+	return true, nil
+}
+
+//HScan pages through the fields of a hash, last is the cursor returned by the previous call
+func (c *RedisCommand) HScan(key, last, match []byte, count int) (next []byte, ret []*store.Pair, err error) {
+	db := c.DB(key)
+	ok, err := c.scanCheck(db, key, KEY_TYPE_HASH)
+	if !ok {
+		return nil, nil, err
+	}
+	rows, next := c.scanRows(db, c.HashEncodePrefix(key), last, count)
+	for _, v := range rows {
+		field := c.HashDecodeKey(v.V0)
+		if match != nil && !util.GlobMatch(match, field) {
+			continue
+		}
+		ret = append(ret, &store.Pair{V0: field, V1: v.V1})
+	}
+	return
+}
+
+//SScan pages through the members of a set
+func (c *RedisCommand) SScan(key, last, match []byte, count int) (next []byte, ret [][]byte, err error) {
+	db := c.DB(key)
+	ok, err := c.scanCheck(db, key, KEY_TYPE_SET)
+	if !ok {
+		return nil, nil, err
+	}
+	rows, next := c.scanRows(db, c.SetEncodePrefix(key), last, count)
+	for _, v := range rows {
+		if match != nil && !util.GlobMatch(match, v.V1) {
+			continue
+		}
+		ret = append(ret, v.V1)
+	}
+	return
+}
+
+//ZScan pages through the members of a zset in member order using the score index
+func (c *RedisCommand) ZScan(key, last, match []byte, count int) (next []byte, ret []*ZSetMember, err error) {
+	db := c.DB(key)
+	ok, err := c.scanCheck(db, key, KEY_TYPE_ZSET)
+	if !ok {
+		return nil, nil, err
+	}
+	rows, next := c.scanRows(db, c.ZSetEncodeScoreKeyPrefix(key), last, count)
+	for _, v := range rows {
+		member := c.ZSetDecodeScoreKey(v.V0)
+		if len(v.V1) < 8 || (match != nil && !util.GlobMatch(match, member)) {
+			continue
+		}
+		ret = append(ret, &ZSetMember{Member: member, Score: binary.LittleEndian.Uint64(v.V1)})
+	}
+	return
+}
+
+//keyFieldTypes lists the row types stored under each meta type, they all start with type-key_size-key
+var keyFieldTypes = map[byte][]byte{
+	KEY_TYPE_HASH:   {KEY_TYPE_HASH_FIELD},
+	KEY_TYPE_LIST:   {KEY_TYPE_LIST_FIELD},
+	KEY_TYPE_SET:    {KEY_TYPE_SET_FIELD},
+	KEY_TYPE_ZSET:   {KEY_TYPE_ZSET_FIELD, KEY_TYPE_ZSET_SCORE},
+	KEY_TYPE_STREAM: {KEY_TYPE_STREAM_FIELD, KEY_TYPE_STREAM_GROUP, KEY_TYPE_STREAM_PEL, KEY_TYPE_STREAM_CONSUMER},
+}
+
+func (c *RedisCommand) encodeFieldPrefix(tp byte, key []byte) []byte {
+	buf, _ := c.allocField(tp, key, 0)
+	return buf
+}
+
+//keyRows returns the meta row of a live key followed by all its field rows
+func (c *RedisCommand) keyRows(db store.IStore, t interface{}, key []byte) []*store.Pair {
+	tp := c.keyType(db, t, key)
+	if tp == 0 {
+		return nil
+	}
+	metaKey := c.EncodeKey(tp, key)
+	ret := []*store.Pair{{V0: metaKey, V1: db.Get(t, metaKey)}}
+	for _, ft := range keyFieldTypes[tp] {
+		ret = append(ret, db.Scan(c.encodeFieldPrefix(ft, key))...)
+	}
+	return ret
+}
+
+//rekey moves an encoded meta or field row of key under newKey in the database of c
+func (c *RedisCommand) rekey(row, key, newKey []byte) []byte {
+	tp := row[DB_PREFIX_LEN]
+	if isMetaKey(row) {
+		return c.EncodeKey(tp, newKey)
+	}
+	_, header, _ := fieldKey(row)
+	rest := row[header:]
+	prefix := c.encodeFieldPrefix(tp, newKey)
+	ret := make([]byte, len(prefix)+len(rest))
+	copy(ret, prefix)
+	copy(ret[len(prefix):], rest)
+	return ret
+}
+
+//putRows replaces dst in the database of c with the rows of key, the records freeing the
+//collections of the old dst must be passed to lazy.add once t commits
+func (c *RedisCommand) putRows(db store.IStore, t interface{}, key, dst []byte, rows []*store.Pair) ([][]byte, error) {
+	_, records := c.freeTx(db, t, dst, LAZYFREE_THRESHOLD)
+	for _, v := range rows {
+		if err := db.Put(t, c.rekey(v.V0, key, dst), v.V1); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+func (c *RedisCommand) loadKeyRows(key []byte) (rows []*store.Pair, err error) {
+	db := c.DB(key)
+	err = db.Transaction(func(t interface{}) error {
+		rows = c.keyRows(db, t, key)
+		return nil
+	})
+	if err == nil && rows == nil {
+		err = ErrNoSuchKey
+	}
+	return
+}
+
+//Rename moves key with every row and its ttl to dst. With nx set nothing happens when dst exists.
+//When the names live in different shards dst is written first together with an intent
+//to delete key, so a crash in between is completed by Recover
+func (c *RedisCommand) Rename(key, dst []byte, nx bool) (bool, error) {
+	rows, err := c.loadKeyRows(key)
+	if err != nil {
+		return false, err
+	}
+	if string(key) == string(dst) {
+		return !nx, nil
+	}
+	src, db := c.DB(key), c.DB(dst)
+	done := false
+	var intent, value []byte
+	var records [][]byte
+	err = db.Transaction(func(t interface{}) error {
+		if nx && c.keyType(db, t, dst) != 0 {
+			return nil
+		}
+		done = true
+		var err error
+		if records, err = c.putRows(db, t, key, dst, rows); err != nil {
+			return err
+		}
+		if src == db {
+			_, freed := c.freeTx(db, t, key, LAZYFREE_THRESHOLD)
+			records = append(records, freed...)
+			return nil
+		}
+		intent, value, err = c.putIntent(db, t, INTENT_DEL_KEY, key)
+		return err
+	})
+	if err == nil {
+		c.lazy.add(records)
+	}
+	if err == nil && intent != nil {
+		err = c.rollForward(db, intent, value)
+	}
+	if err == nil && done {
+		c.notify(NOTIFY_GENERIC, "rename_from", key)
+		c.notify(NOTIFY_GENERIC, "rename_to", dst)
+	}
+	return done, err
+}
+
+//Copy writes a copy of key with its ttl under dst in the database of to,
+//an existing dst is only overwritten with replace
+func (c *RedisCommand) Copy(key []byte, to *RedisCommand, dst []byte, replace bool) (done bool, err error) {
+	if string(key) == string(dst) && c.physical() == to.physical() {
+		return false, ErrSameObject
+	}
+	rows, err := c.loadKeyRows(key)
+	if err == ErrNoSuchKey {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	db := to.DB(dst)
+	var records [][]byte
+	err = db.Transaction(func(t interface{}) error {
+		if !replace && to.keyType(db, t, dst) != 0 {
+			return nil
+		}
+		done = true
+		var err error
+		records, err = to.putRows(db, t, key, dst, rows)
+		return err
+	})
+	if err == nil {
+		to.lazy.add(records)
+	}
+	if err == nil && done {
+		to.notify(NOTIFY_GENERIC, "copy_to", dst)
+	}
+	return
+}
+
+//Move moves key into the database of to unless it already exists there,
+//a key lives in the same shard in every database so one transaction does it
+func (c *RedisCommand) Move(key []byte, to *RedisCommand) (done bool, err error) {
+	if c.physical() == to.physical() {
+		return false, ErrSameObject
+	}
+	db := c.DB(key)
+	var records [][]byte
+	err = db.Transaction(func(t interface{}) error {
+		rows := c.keyRows(db, t, key)
+		if rows == nil || to.keyType(db, t, key) != 0 {
+			return nil
+		}
+		done = true
+		var err error
+		if records, err = to.putRows(db, t, key, key, rows); err != nil {
+			return err
+		}
+		_, freed := c.freeTx(db, t, key, LAZYFREE_THRESHOLD)
+		records = append(records, freed...)
+		return nil
+	})
+	if err == nil {
+		c.lazy.add(records)
+	}
+	if err == nil && done {
+		c.notify(NOTIFY_GENERIC, "move_from", key)
+		to.notify(NOTIFY_GENERIC, "move_to", key)
+	}
+	return
+}
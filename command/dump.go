@@ -0,0 +1,725 @@
+package command
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+const (
+	STREAM_ITEM_FLAG_NONE       = 0
+	STREAM_ITEM_FLAG_DELETED    = 1
+	STREAM_ITEM_FLAG_SAMEFIELDS = 2
+
+	STREAM_NODE_MAX_ENTRIES = 100 //entries per listpack node written by DUMP
+)
+
+var (
+	ErrBusyKey     = errors.New("Target key name already exists.")
+	ErrDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+)
+
+//dumpObject is a key decoded from or about to be encoded into an RDB object
+type dumpObject struct {
+	tp      byte     //tacodb key type
+	value   []byte   //string value
+	items   [][]byte //list elements, set members or hash field value pairs
+	members []*ZSetMember
+	stream  *dumpStream
+}
+
+type dumpStream struct {
+	meta    StreamMeta
+	entries []*StreamEntry
+	groups  []*dumpStreamGroup
+}
+
+type dumpStreamGroup struct {
+	name      []byte
+	group     streamGroup
+	pending   []*StreamPendingEntry
+	consumers []*StreamConsumerInfo
+}
+
+//Dump serializes key the way redis DUMP does: an RDB object, the RDB version
+//and a crc64 of both. nil means the key does not exist
+func (c *RedisCommand) Dump(key []byte) (ret []byte, err error) {
+	var obj *dumpObject
+	db := c.DB(key)
+	err = db.Transaction(func(t interface{}) error {
+		obj = c.dumpLoad(db, t, key)
+		return nil
+	})
+	if err != nil || obj == nil {
+		return nil, err
+	}
+	return obj.encode(), nil
+}
+
+//ExpireAt returns the unix time in seconds key expires at, 0 when it never expires or does not exist
+func (c *RedisCommand) ExpireAt(key []byte) (ret int64) {
+	db := c.DB(key)
+	_ = db.Transaction(func(t interface{}) error {
+		if tp := c.keyType(db, t, key); tp != 0 {
+			ret = int64(binary.LittleEndian.Uint32(db.Get(t, c.EncodeKey(tp, key))))
+		}
+		return nil
+	})
+	return
+}
+
+func (c *RedisCommand) dumpLoad(db store.IStore, t interface{}, key []byte) *dumpObject {
+	tp := c.keyType(db, t, key)
+	if tp == 0 {
+		return nil
+	}
+	_, meta := c.DecodeValue(db.Get(t, c.EncodeKey(tp, key)))
+	obj := &dumpObject{tp: tp}
+	switch tp {
+	case KEY_TYPE_STRING:
+		obj.value = meta
+	case KEY_TYPE_HASH:
+		for _, v := range db.Scan(c.HashEncodePrefix(key)) {
+			obj.items = append(obj.items, c.HashDecodeKey(v.V0), v.V1)
+		}
+	case KEY_TYPE_LIST:
+		for _, v := range db.Scan(c.ListEncodePrefix(key)) {
+			obj.items = append(obj.items, v.V1)
+		}
+	case KEY_TYPE_SET:
+		for _, v := range db.Scan(c.SetEncodePrefix(key)) {
+			obj.items = append(obj.items, v.V1)
+		}
+	case KEY_TYPE_ZSET:
+		for _, v := range db.Scan(c.encodeFieldPrefix(KEY_TYPE_ZSET_FIELD, key)) {
+			score, member := c.ZSetDecodeKey(v.V0)
+			obj.members = append(obj.members, &ZSetMember{Member: member, Score: score})
+		}
+	case KEY_TYPE_STREAM:
+		obj.stream = c.dumpLoadStream(db, t, key, c.StreamDecodeMeta(meta))
+	}
+	return obj
+}
+
+func (c *RedisCommand) dumpLoadStream(db store.IStore, t interface{}, key []byte, meta *StreamMeta) *dumpStream {
+	s := &dumpStream{meta: *meta, entries: c.streamEntries(db.Scan(c.StreamEncodePrefix(key)))}
+	for _, v := range db.Scan(c.StreamEncodeGroupPrefix(key)) {
+		name, _ := streamDecodeGroupRow(v.V0)
+		g := streamDecodeGroup(v.V1)
+		if g == nil {
+			continue
+		}
+		group := &dumpStreamGroup{name: name, group: *g}
+		known := make(map[string]bool)
+		for _, row := range db.Scan(c.StreamEncodeConsumerPrefix(key, name)) {
+			_, rest := streamDecodeGroupRow(row.V0)
+			if len(rest) < 4 || len(row.V1) < 16 {
+				continue
+			}
+			known[string(rest[4:])] = true
+			group.consumers = append(group.consumers, &StreamConsumerInfo{
+				Name:       rest[4:],
+				SeenTime:   binary.LittleEndian.Uint64(row.V1),
+				ActiveTime: binary.LittleEndian.Uint64(row.V1[8:]),
+			})
+		}
+		for _, row := range db.Scan(c.StreamEncodePelPrefix(key, name)) {
+			p := c.streamDecodePending(row)
+			if p == nil {
+				continue
+			}
+			group.pending = append(group.pending, p)
+			//every pending entry must belong to a consumer of the payload
+			if !known[string(p.Consumer)] {
+				known[string(p.Consumer)] = true
+				group.consumers = append(group.consumers, &StreamConsumerInfo{Name: p.Consumer})
+			}
+		}
+		s.groups = append(s.groups, group)
+	}
+	return s
+}
+
+func (obj *dumpObject) encode() []byte {
+	w := &rdbWriter{}
+	version := uint16(RDB_VERSION_DUMP)
+	switch obj.tp {
+	case KEY_TYPE_STRING:
+		w.writeByte(RDB_TYPE_STRING)
+		w.writeString(obj.value)
+	case KEY_TYPE_LIST, KEY_TYPE_SET:
+		if obj.tp == KEY_TYPE_LIST {
+			w.writeByte(RDB_TYPE_LIST)
+		} else {
+			w.writeByte(RDB_TYPE_SET)
+		}
+		w.writeLen(uint64(len(obj.items)))
+		for _, v := range obj.items {
+			w.writeString(v)
+		}
+	case KEY_TYPE_HASH:
+		w.writeByte(RDB_TYPE_HASH)
+		w.writeLen(uint64(len(obj.items) / 2))
+		for _, v := range obj.items {
+			w.writeString(v)
+		}
+	case KEY_TYPE_ZSET:
+		w.writeByte(RDB_TYPE_ZSET_2)
+		w.writeLen(uint64(len(obj.members)))
+		for _, v := range obj.members {
+			w.writeString(v.Member)
+			w.writeDouble(float64(v.Score))
+		}
+	case KEY_TYPE_STREAM:
+		w.writeByte(RDB_TYPE_STREAM_LISTPACKS_3)
+		obj.stream.encode(w)
+		version = RDB_VERSION_STREAM
+	}
+	w.buf = append(w.buf, 0, 0)
+	binary.LittleEndian.PutUint16(w.buf[len(w.buf)-2:], version)
+	w.writeUint64(util.CRC64(0, w.buf))
+	return w.buf
+}
+
+func encodeRawStreamID(id StreamID) []byte {
+	ret := make([]byte, 16)
+	binary.BigEndian.PutUint64(ret, id.Ms)
+	binary.BigEndian.PutUint64(ret[8:], id.Seq)
+	return ret
+}
+
+//encode writes the stream as STREAM_LISTPACKS_3, entries are packed into nodes keyed by
+//the id of their first entry whose field names become the master fields of the node
+func (s *dumpStream) encode(w *rdbWriter) {
+	nodes := (len(s.entries) + STREAM_NODE_MAX_ENTRIES - 1) / STREAM_NODE_MAX_ENTRIES
+	w.writeLen(uint64(nodes))
+	for i := 0; i < len(s.entries); i += STREAM_NODE_MAX_ENTRIES {
+		end := i + STREAM_NODE_MAX_ENTRIES
+		if end > len(s.entries) {
+			end = len(s.entries)
+		}
+		master := s.entries[i]
+		w.writeString(encodeRawStreamID(master.ID))
+		w.writeString(encodeStreamNode(master, s.entries[i:end]))
+	}
+	first := STREAM_ID_MIN
+	if len(s.entries) > 0 {
+		first = s.entries[0].ID
+	}
+	w.writeLen(uint64(len(s.entries)))
+	for _, id := range []StreamID{s.meta.lastID, first, s.meta.maxDeletedID} {
+		w.writeLen(id.Ms)
+		w.writeLen(id.Seq)
+	}
+	w.writeLen(s.meta.entriesAdded)
+	w.writeLen(uint64(len(s.groups)))
+	for _, g := range s.groups {
+		w.writeString(g.name)
+		w.writeLen(g.group.lastID.Ms)
+		w.writeLen(g.group.lastID.Seq)
+		w.writeLen(g.group.entriesRead)
+		w.writeLen(uint64(len(g.pending)))
+		for _, p := range g.pending {
+			w.writeRaw(encodeRawStreamID(p.ID))
+			w.writeUint64(p.DeliveryTime)
+			w.writeLen(p.DeliveryCount)
+		}
+		w.writeLen(uint64(len(g.consumers)))
+		for _, consumer := range g.consumers {
+			w.writeString(consumer.Name)
+			w.writeUint64(consumer.SeenTime)
+			w.writeUint64(consumer.ActiveTime)
+			var ids []StreamID
+			for _, p := range g.pending {
+				if bytes.Equal(p.Consumer, consumer.Name) {
+					ids = append(ids, p.ID)
+				}
+			}
+			w.writeLen(uint64(len(ids)))
+			for _, id := range ids {
+				w.writeRaw(encodeRawStreamID(id))
+			}
+		}
+	}
+}
+
+func streamSameFields(master, entry *StreamEntry) bool {
+	if len(master.Fields) != len(entry.Fields) {
+		return false
+	}
+	for i := 0; i < len(master.Fields); i += 2 {
+		if !bytes.Equal(master.Fields[i], entry.Fields[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//encodeStreamNode builds the listpack of one node:
+//count-deleted-master_fields-field...-0 followed by flags-ms_diff-seq_diff-[num_fields]-...-lp_count per entry
+func encodeStreamNode(master *StreamEntry, entries []*StreamEntry) []byte {
+	lp := newListpackWriter()
+	lp.appendInt(int64(len(entries)))
+	lp.appendInt(0)
+	lp.appendInt(int64(len(master.Fields) / 2))
+	for i := 0; i < len(master.Fields); i += 2 {
+		lp.appendString(master.Fields[i])
+	}
+	lp.appendInt(0)
+	for _, e := range entries {
+		fields := len(e.Fields) / 2
+		same := streamSameFields(master, e)
+		if same {
+			lp.appendInt(STREAM_ITEM_FLAG_SAMEFIELDS)
+		} else {
+			lp.appendInt(STREAM_ITEM_FLAG_NONE)
+		}
+		lp.appendInt(int64(e.ID.Ms - master.ID.Ms))
+		lp.appendInt(int64(e.ID.Seq - master.ID.Seq))
+		if same {
+			for i := 1; i < len(e.Fields); i += 2 {
+				lp.appendString(e.Fields[i])
+			}
+			lp.appendInt(int64(fields + 3))
+			continue
+		}
+		lp.appendInt(int64(fields))
+		for _, v := range e.Fields {
+			lp.appendString(v)
+		}
+		lp.appendInt(int64(fields*2 + 4))
+	}
+	return lp.bytes()
+}
+
+//VerifyDumpPayload checks the version and checksum footer of a DUMP payload
+func VerifyDumpPayload(payload []byte) error {
+	if len(payload) < 10 {
+		return ErrDumpPayload
+	}
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > RDB_VERSION {
+		return ErrDumpPayload
+	}
+	if binary.LittleEndian.Uint64(footer[2:]) != util.CRC64(0, payload[:len(payload)-8]) {
+		return ErrDumpPayload
+	}
+	return nil
+}
+
+//decodeDumpObject parses the RDB object of a verified payload
+func decodeDumpObject(payload []byte) (*dumpObject, error) {
+	r := &rdbReader{data: payload[:len(payload)-10]}
+	obj := &dumpObject{}
+	rdbType := r.readByte()
+	var err error
+	switch rdbType {
+	case RDB_TYPE_STRING:
+		obj.tp, obj.value = KEY_TYPE_STRING, r.readString()
+	case RDB_TYPE_LIST, RDB_TYPE_SET:
+		obj.tp = KEY_TYPE_LIST
+		if rdbType == RDB_TYPE_SET {
+			obj.tp = KEY_TYPE_SET
+		}
+		for n := r.readLen(); n > 0 && r.err == nil; n-- {
+			obj.items = append(obj.items, r.readString())
+		}
+	case RDB_TYPE_HASH:
+		obj.tp = KEY_TYPE_HASH
+		for n := r.readLen(); n > 0 && r.err == nil; n-- {
+			obj.items = append(obj.items, r.readString(), r.readString())
+		}
+	case RDB_TYPE_ZSET, RDB_TYPE_ZSET_2:
+		obj.tp = KEY_TYPE_ZSET
+		for n := r.readLen(); n > 0 && r.err == nil; n-- {
+			member := r.readString()
+			var score float64
+			if rdbType == RDB_TYPE_ZSET {
+				score = r.readStringDouble()
+			} else {
+				score = r.readDouble()
+			}
+			obj.members, err = appendDumpMember(obj.members, member, score)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case RDB_TYPE_LIST_ZIPLIST, RDB_TYPE_LIST_QUICKLIST, RDB_TYPE_LIST_QUICKLIST_2:
+		obj.tp = KEY_TYPE_LIST
+		obj.items, err = decodeDumpList(r, rdbType)
+	case RDB_TYPE_SET_INTSET, RDB_TYPE_SET_LISTPACK:
+		obj.tp = KEY_TYPE_SET
+		if rdbType == RDB_TYPE_SET_INTSET {
+			obj.items, err = intsetEntries(r.readString())
+		} else {
+			obj.items, err = listpackEntries(r.readString())
+		}
+	case RDB_TYPE_HASH_ZIPLIST, RDB_TYPE_HASH_LISTPACK:
+		obj.tp = KEY_TYPE_HASH
+		obj.items, err = decodeDumpPacked(r.readString(), rdbType == RDB_TYPE_HASH_ZIPLIST)
+		if err == nil && len(obj.items)%2 != 0 {
+			err = ErrBadDataFormat
+		}
+	case RDB_TYPE_ZSET_ZIPLIST, RDB_TYPE_ZSET_LISTPACK:
+		obj.tp = KEY_TYPE_ZSET
+		var items [][]byte
+		items, err = decodeDumpPacked(r.readString(), rdbType == RDB_TYPE_ZSET_ZIPLIST)
+		if err == nil && len(items)%2 != 0 {
+			err = ErrBadDataFormat
+		}
+		for i := 0; err == nil && i < len(items); i += 2 {
+			var score float64
+			if score, err = strconv.ParseFloat(string(items[i+1]), 64); err != nil {
+				return nil, ErrBadDataFormat
+			}
+			obj.members, err = appendDumpMember(obj.members, items[i], score)
+		}
+	case RDB_TYPE_STREAM_LISTPACKS, RDB_TYPE_STREAM_LISTPACKS_2, RDB_TYPE_STREAM_LISTPACKS_3:
+		obj.tp = KEY_TYPE_STREAM
+		obj.stream, err = decodeDumpStream(r, rdbType)
+	default:
+		return nil, ErrBadDataFormat
+	}
+	if err != nil {
+		return nil, ErrBadDataFormat
+	}
+	if r.err != nil || len(r.data) != 0 {
+		return nil, ErrBadDataFormat
+	}
+	//redis never holds empty collections
+	if obj.tp != KEY_TYPE_STRING && obj.tp != KEY_TYPE_STREAM && len(obj.items) == 0 && len(obj.members) == 0 {
+		return nil, ErrBadDataFormat
+	}
+	return obj, nil
+}
+
+//appendDumpMember converts a redis score, tacodb only keeps non negative integer scores
+func appendDumpMember(members []*ZSetMember, member []byte, score float64) ([]*ZSetMember, error) {
+	if math.IsNaN(score) || score < 0 || score >= math.MaxUint64 || score != math.Trunc(score) {
+		return nil, ErrBadDataFormat
+	}
+	return append(members, &ZSetMember{Member: member, Score: uint64(score)}), nil
+}
+
+func decodeDumpPacked(data []byte, ziplist bool) ([][]byte, error) {
+	if ziplist {
+		return ziplistEntries(data)
+	}
+	return listpackEntries(data)
+}
+
+func decodeDumpList(r *rdbReader, rdbType byte) (ret [][]byte, err error) {
+	if rdbType == RDB_TYPE_LIST_ZIPLIST {
+		return ziplistEntries(r.readString())
+	}
+	for n := r.readLen(); n > 0 && r.err == nil; n-- {
+		container := uint64(quicklistNodePacked)
+		if rdbType == RDB_TYPE_LIST_QUICKLIST_2 {
+			container = r.readLen()
+		}
+		data := r.readString()
+		if r.err != nil {
+			break
+		}
+		var items [][]byte
+		switch {
+		case container == quicklistNodePlain:
+			items = [][]byte{data}
+		case container != quicklistNodePacked:
+			return nil, ErrBadDataFormat
+		case rdbType == RDB_TYPE_LIST_QUICKLIST:
+			items, err = ziplistEntries(data)
+		default:
+			items, err = listpackEntries(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, items...)
+	}
+	return ret, r.err
+}
+
+func decodeRawStreamID(data []byte) (StreamID, error) {
+	if len(data) != 16 {
+		return STREAM_ID_MIN, ErrBadDataFormat
+	}
+	return StreamID{binary.BigEndian.Uint64(data), binary.BigEndian.Uint64(data[8:])}, nil
+}
+
+func parseDumpInt(data []byte) (int64, error) {
+	v, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, ErrBadDataFormat
+	}
+	return v, nil
+}
+
+//decodeStreamNode returns the live entries of one listpack node
+func decodeStreamNode(master StreamID, data []byte) (ret []*StreamEntry, err error) {
+	lp, err := listpackEntries(data)
+	if err != nil {
+		return nil, err
+	}
+	//next pops one integer off the listpack
+	next := func() int64 {
+		if err != nil || len(lp) == 0 {
+			err = ErrBadDataFormat
+			return 0
+		}
+		var v int64
+		v, err = parseDumpInt(lp[0])
+		lp = lp[1:]
+		return v
+	}
+	count, deleted, masterCount := next(), next(), next()
+	if err != nil || masterCount < 0 || int64(len(lp)) < masterCount+1 {
+		return nil, ErrBadDataFormat
+	}
+	masterFields := lp[:masterCount]
+	lp = lp[masterCount:]
+	if next() != 0 {
+		return nil, ErrBadDataFormat
+	}
+	for i := int64(0); i < count+deleted && err == nil; i++ {
+		flags := next()
+		id := StreamID{master.Ms + uint64(next()), master.Seq + uint64(next())}
+		var fields [][]byte
+		if flags&STREAM_ITEM_FLAG_SAMEFIELDS != 0 {
+			if int64(len(lp)) < masterCount {
+				return nil, ErrBadDataFormat
+			}
+			for j, name := range masterFields {
+				fields = append(fields, name, lp[j])
+			}
+			lp = lp[masterCount:]
+		} else {
+			n := next()
+			if err != nil || n < 0 || int64(len(lp)) < 2*n {
+				return nil, ErrBadDataFormat
+			}
+			fields = lp[:2*n]
+			lp = lp[2*n:]
+		}
+		next() //lp-count
+		if flags&STREAM_ITEM_FLAG_DELETED == 0 {
+			ret = append(ret, &StreamEntry{ID: id, Fields: fields})
+		}
+	}
+	if err != nil || len(lp) != 0 {
+		return nil, ErrBadDataFormat
+	}
+	return ret, nil
+}
+
+func decodeDumpStream(r *rdbReader, rdbType byte) (*dumpStream, error) {
+	s := &dumpStream{}
+	for n := r.readLen(); n > 0 && r.err == nil; n-- {
+		master, err := decodeRawStreamID(r.readString())
+		if err != nil {
+			return nil, err
+		}
+		entries, err := decodeStreamNode(master, r.readString())
+		if err != nil {
+			return nil, err
+		}
+		s.entries = append(s.entries, entries...)
+	}
+	for i := 1; i < len(s.entries); i++ {
+		if !s.entries[i-1].ID.Less(s.entries[i].ID) {
+			return nil, ErrBadDataFormat
+		}
+	}
+	r.readLen()
+	s.meta.len = uint64(len(s.entries))
+	s.meta.lastID = StreamID{r.readLen(), r.readLen()}
+	if rdbType >= RDB_TYPE_STREAM_LISTPACKS_2 {
+		r.readLen() //first id
+		r.readLen()
+		s.meta.maxDeletedID = StreamID{r.readLen(), r.readLen()}
+		s.meta.entriesAdded = r.readLen()
+	} else {
+		s.meta.entriesAdded = s.meta.len
+	}
+	for n := r.readLen(); n > 0 && r.err == nil; n-- {
+		g := &dumpStreamGroup{name: r.readString()}
+		g.group.lastID = StreamID{r.readLen(), r.readLen()}
+		if rdbType >= RDB_TYPE_STREAM_LISTPACKS_2 {
+			g.group.entriesRead = r.readLen()
+		} else {
+			g.group.entriesRead = streamEntriesRead(&s.meta, g.group.lastID, -1)
+		}
+		pending := make(map[StreamID]*StreamPendingEntry)
+		for m := r.readLen(); m > 0 && r.err == nil; m-- {
+			id, err := decodeRawStreamID(r.readRaw(16))
+			if err != nil {
+				return nil, err
+			}
+			p := &StreamPendingEntry{ID: id, DeliveryTime: r.readUint64(), DeliveryCount: r.readLen()}
+			pending[id] = p
+			g.pending = append(g.pending, p)
+		}
+		for m := r.readLen(); m > 0 && r.err == nil; m-- {
+			consumer := &StreamConsumerInfo{Name: r.readString(), SeenTime: r.readUint64()}
+			consumer.ActiveTime = consumer.SeenTime
+			if rdbType >= RDB_TYPE_STREAM_LISTPACKS_3 {
+				consumer.ActiveTime = r.readUint64()
+			}
+			for k := r.readLen(); k > 0 && r.err == nil; k-- {
+				id, err := decodeRawStreamID(r.readRaw(16))
+				if err != nil {
+					return nil, err
+				}
+				p := pending[id]
+				if p == nil || p.Consumer != nil {
+					return nil, ErrBadDataFormat
+				}
+				p.Consumer = consumer.Name
+			}
+			g.consumers = append(g.consumers, consumer)
+		}
+		for _, p := range g.pending {
+			if p.Consumer == nil {
+				return nil, ErrBadDataFormat
+			}
+		}
+		s.groups = append(s.groups, g)
+	}
+	return s, r.err
+}
+
+//Restore creates key from a DUMP payload. ttl is in milliseconds, relative or with absTTL a
+//unix time, 0 means no expire. An existing key is only overwritten with replace.
+//Expire times are kept in whole seconds and a key lives through its last second, so the
+//deadline is rounded down to its second: the key never expires early and at most a second late
+func (c *RedisCommand) Restore(key []byte, ttl int64, payload []byte, replace, absTTL bool) error {
+	if err := VerifyDumpPayload(payload); err != nil {
+		return err
+	}
+	obj, err := decodeDumpObject(payload)
+	if err != nil {
+		return err
+	}
+	timestamp := uint32(0)
+	now := c.now().UnixNano() / int64(time.Millisecond)
+	if ttl > 0 {
+		if !absTTL {
+			ttl += now
+		}
+		timestamp = uint32(ttl / 1000)
+	}
+	db := c.DB(key)
+	var records [][]byte
+	err = db.Transaction(func(t interface{}) error {
+		if c.keyType(db, t, key) != 0 {
+			if !replace {
+				return ErrBusyKey
+			}
+			_, records = c.freeTx(db, t, key, LAZYFREE_THRESHOLD)
+		}
+		//an absolute ttl in the past behaves like an immediate expire
+		if ttl > 0 && ttl <= now {
+			return nil
+		}
+		meta, err := c.restoreRows(db, t, key, obj)
+		if err != nil {
+			return err
+		}
+		return db.Put(t, c.EncodeKey(obj.tp, key), c.encodeValueAt(meta, timestamp))
+	})
+	if err == nil {
+		c.lazy.add(records)
+	}
+	return c.notifyOn(err, NOTIFY_GENERIC, "restore", key)
+}
+
+//restoreRows writes the field rows of obj and returns the value of its meta row
+func (c *RedisCommand) restoreRows(db store.IStore, t interface{}, key []byte, obj *dumpObject) ([]byte, error) {
+	var err error
+	count := uint32(0)
+	switch obj.tp {
+	case KEY_TYPE_STRING:
+		return obj.value, nil
+	case KEY_TYPE_LIST:
+		meta := NewListMeta()
+		for _, v := range obj.items {
+			if err = db.Put(t, c.ListEncodeKey(key, meta.rightIndex), v); err != nil {
+				return nil, err
+			}
+			meta.len++
+			meta.rightIndex++
+		}
+		return c.ListEncodeMeta(meta), nil
+	case KEY_TYPE_SET:
+		seen := make(map[string]bool)
+		for _, v := range obj.items {
+			if seen[string(v)] {
+				continue
+			}
+			seen[string(v)] = true
+			if err = db.Put(t, c.SetEncodeKey(key, v), v); err != nil {
+				return nil, err
+			}
+			count++
+		}
+	case KEY_TYPE_HASH:
+		seen := make(map[string]bool)
+		for i := 0; i+1 < len(obj.items); i += 2 {
+			if !seen[string(obj.items[i])] {
+				seen[string(obj.items[i])] = true
+				count++
+			}
+			if err = db.Put(t, c.HashEncodeKey(key, obj.items[i]), obj.items[i+1]); err != nil {
+				return nil, err
+			}
+		}
+	case KEY_TYPE_ZSET:
+		scores := make(map[string]uint64)
+		for _, v := range obj.members {
+			scores[string(v.Member)] = v.Score
+		}
+		members := zsetSortMembers(scores)
+		if err = c.zsetPutMembers(db, t, key, members); err != nil {
+			return nil, err
+		}
+		count = uint32(len(members))
+	case KEY_TYPE_STREAM:
+		return c.restoreStreamRows(db, t, key, obj.stream)
+	}
+	meta := make([]byte, 4)
+	binary.LittleEndian.PutUint32(meta, count)
+	return meta, nil
+}
+
+func (c *RedisCommand) restoreStreamRows(db store.IStore, t interface{}, key []byte, s *dumpStream) ([]byte, error) {
+	for _, e := range s.entries {
+		if err := db.Put(t, c.StreamEncodeKey(key, e.ID), streamEncodeFields(e.Fields)); err != nil {
+			return nil, err
+		}
+	}
+	for _, g := range s.groups {
+		if err := db.Put(t, c.StreamEncodeGroupKey(key, g.name), streamEncodeGroup(&g.group)); err != nil {
+			return nil, err
+		}
+		for _, p := range g.pending {
+			if err := db.Put(t, c.StreamEncodePelKey(key, g.name, p.ID), streamEncodePending(p)); err != nil {
+				return nil, err
+			}
+		}
+		for _, consumer := range g.consumers {
+			value := make([]byte, 16)
+			binary.LittleEndian.PutUint64(value, consumer.SeenTime)
+			binary.LittleEndian.PutUint64(value[8:], consumer.ActiveTime)
+			if err := db.Put(t, c.StreamEncodeConsumerKey(key, g.name, consumer.Name), value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c.StreamEncodeMeta(&s.meta), nil
+}
@@ -0,0 +1,177 @@
+package command
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//dumpPayload appends the version and checksum footer to an RDB object
+func dumpPayload(object string, version uint16) string {
+	buf := append([]byte(object), 0, 0)
+	binary.LittleEndian.PutUint16(buf[len(buf)-2:], version)
+	buf = binary.LittleEndian.AppendUint64(buf, util.CRC64(0, buf))
+	return string(buf)
+}
+
+//restoredValue renders the value of key for comparison
+func restoredValue(t *testing.T, c *RedisCommand, key []byte) string {
+	t.Helper()
+	switch c.Type(key) {
+	case KEY_TYPE_STRING:
+		return "string " + string(c.Get(key))
+	case KEY_TYPE_HASH:
+		pairs, err := c.HGetAll(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields []string
+		for _, p := range pairs {
+			fields = append(fields, string(p.V0)+"="+string(p.V1))
+		}
+		sort.Strings(fields)
+		return "hash " + strings.Join(fields, " ")
+	case KEY_TYPE_SET:
+		members, err := c.SMembers(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(members, func(i, j int) bool { return string(members[i]) < string(members[j]) })
+		return fmt.Sprintf("set %s", members)
+	case KEY_TYPE_LIST:
+		return fmt.Sprintf("list %s", c.LRange(key, 0, -1))
+	case KEY_TYPE_ZSET:
+		return fmt.Sprintf("zset %s", c.ZRange(key, []byte("0"), []byte("-1"), []byte("WITHSCORES")))
+	}
+	return ""
+}
+
+func TestRestorePayload(t *testing.T) {
+	listpack := "\x0d\x00\x00\x00\x02\x00\x81f\x02\x81v\x02\xff"
+	intset := "\x02\x00\x00\x00\x02\x00\x00\x00\x01\x00\x02\x00"
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+		err     error
+	}{
+		//DUMP of SET mykey 10 in the redis documentation
+		{"redis int string", "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n", "string 10", nil},
+		{"raw string", dumpPayload("\x00\x03bar", 9), "string bar", nil},
+		{"int16 string", dumpPayload("\x00\xc1\x39\x30", 9), "string 12345", nil},
+		{"lzf string", dumpPayload("\x00\xc3\x05\x14\x00a\xe0\x0a\x00", 9), "string " + strings.Repeat("a", 20), nil},
+		{"list", dumpPayload("\x01\x02\x01a\x01b", 9), "list [a b]", nil},
+		{"set", dumpPayload("\x02\x02\x01a\x01b", 9), "set [a b]", nil},
+		{"intset", dumpPayload("\x0b\x0c"+intset, 9), "set [1 2]", nil},
+		{"hash", dumpPayload("\x04\x01\x01f\x01v", 9), "hash f=v", nil},
+		{"hash listpack", dumpPayload("\x10\x0d"+listpack, 11), "hash f=v", nil},
+		{"zset old score", dumpPayload("\x03\x01\x01m\x013", 9), "zset [m 3]", nil},
+		{"newest version", dumpPayload("\x00\x03bar", RDB_VERSION), "string bar", nil},
+		{"newer version", dumpPayload("\x00\x03bar", RDB_VERSION+1), "", ErrDumpPayload},
+		{"wrong checksum", "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\x0b", "", ErrDumpPayload},
+		{"too short", "\t\x00\xbem\x06\x89Z(\x00", "", ErrDumpPayload},
+		{"trailing bytes", dumpPayload("\x00\x03barx", 9), "", ErrBadDataFormat},
+		{"truncated lzf", dumpPayload("\x00\xc3\x05\x14\x00a\xe0", 9), "", ErrBadDataFormat},
+		{"empty set", dumpPayload("\x02\x00", 9), "", ErrBadDataFormat},
+		{"negative score", dumpPayload("\x03\x01\x01m\x02-1", 9), "", ErrBadDataFormat},
+		{"unknown type", dumpPayload("\x07\x00", 9), "", ErrBadDataFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCommand(t, 0)
+			key := []byte("k")
+			if err := c.Restore(key, 0, []byte(tt.payload), false, false); err != tt.err {
+				t.Fatalf("Restore() = %v, want %v", err, tt.err)
+			}
+			if got := restoredValue(t, c, key); got != tt.want {
+				t.Fatalf("restored %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+//TestDumpRoundTrip restores the DUMP of every type and dumps it again
+func TestDumpRoundTrip(t *testing.T) {
+	c := newTestCommand(t, 0)
+	c.Set([]byte("string"), []byte("v"), 0)
+	c.HSet([]byte("hash"), []byte("f"), []byte("v"), []byte("g"), []byte("w"))
+	c.SAdd([]byte("set"), []byte("a"), []byte("b"))
+	c.ZAdd([]byte("zset"), 1, []byte("a"))
+	c.ZAdd([]byte("zset"), 2, []byte("b"))
+	c.RPush([]byte("list"), []byte("a"), []byte("b"), []byte("a"))
+	c.XAdd([]byte("stream"), &StreamAddOption{ID: []byte("1-1")}, [][]byte{[]byte("f"), []byte("v")})
+	for _, key := range []string{"string", "hash", "set", "zset", "list", "stream"} {
+		payload, err := c.Dump([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyDumpPayload(payload); err != nil {
+			t.Fatalf("VerifyDumpPayload(%s) = %v", key, err)
+		}
+		dst := []byte(key + "-copy")
+		if err := c.Restore(dst, 0, payload, false, false); err != nil {
+			t.Fatalf("Restore(%s) = %v", key, err)
+		}
+		if err := c.Restore(dst, 0, payload, false, false); err != ErrBusyKey {
+			t.Fatalf("second Restore(%s) = %v", key, err)
+		}
+		if got, want := restoredValue(t, c, dst), restoredValue(t, c, []byte(key)); got != want {
+			t.Fatalf("restored %s = %q, want %q", key, got, want)
+		}
+		if again, _ := c.Dump(dst); string(again) != string(payload) {
+			t.Fatalf("DUMP of restored %s = %q, want %q", key, again, payload)
+		}
+	}
+}
+
+//TestRestoreTTL restores a hash with a ttl at a clock in the middle of a second and reads it
+//back at later times, the key must live until its deadline and at most a second longer
+func TestRestoreTTL(t *testing.T) {
+	const base = int64(1700000000500) //unix milliseconds of the clock
+	tests := []struct {
+		name   string
+		ttl    int64
+		absTTL bool
+		live   []int64 //milliseconds after base the key is read and still there
+		gone   int64   //milliseconds after base it has expired
+	}{
+		{"relative", 1200, false, []int64{0, 1199, 1499}, 1500},
+		{"within the second", 100, false, []int64{0, 100, 499}, 500},
+		{"whole seconds", 1500, false, []int64{0, 1500, 2499}, 2500},
+		{"absolute", base + 3000, true, []int64{0, 3000, 3499}, 3500},
+		{"absolute past", base - 1, true, nil, 0},
+		{"absolute now", base, true, nil, 0},
+	}
+	for _, engine := range []string{"leveldb", "boltdb"} {
+		for _, tt := range tests {
+			t.Run(engine+"/"+tt.name, func(t *testing.T) {
+				c := newEngineCommand(t, engine)
+				key, src := []byte("h"), []byte("src")
+				c.HSet(src, []byte("f"), []byte("v"))
+				payload, err := c.Dump(src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := c.WithClock(base).Restore(key, tt.ttl, payload, false, tt.absTTL); err != nil {
+					t.Fatal(err)
+				}
+				for _, ms := range append(tt.live, tt.gone) {
+					ret, err := c.WithClock(base + ms).HGetAll(key)
+					want := 0
+					for _, v := range tt.live {
+						if v == ms {
+							want = 1
+						}
+					}
+					if err != nil && err != ErrKeyNotFound || len(ret) != want {
+						t.Fatalf("HGetAll() %dms after base = %d fields, %v, want %d", ms, len(ret), err, want)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package command
+
+import (
+	"time"
+
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//Keys with a ttl are deleted when a command finds them expired. The expire cycle deletes the
+//ones nobody reads: every period it samples EXPIRE_CYCLE_KEYS meta rows of each shard of each
+//non empty database, walking the keyspace with a cursor, and samples again a shard where more
+//than EXPIRE_CYCLE_REPEAT percent of the sample had expired. A cycle should stop once it ran for
+//EXPIRE_CYCLE_TIME percent of the period. There is no index of the keys with a ttl, the rows of
+//keys without one are walked too
+const (
+	EXPIRE_CYCLE_KEYS   = 20
+	EXPIRE_CYCLE_REPEAT = 25
+	EXPIRE_CYCLE_TIME   = 25
+)
+
+type ExpireCycle struct {
+	c     *RedisCommand
+	last  map[[2]int][]byte //physical database, shard -> last meta row sampled
+	index int               //logical database the next cycle starts with
+}
+
+//NewExpireCycle returns the expire cycle of c, the caller runs it every period with the
+//other commands kept from the keys it deletes like for any write
+func (c *RedisCommand) NewExpireCycle() *ExpireCycle {
+	return &ExpireCycle{c: c, last: make(map[[2]int][]byte)}
+}
+
+//Run samples the databases until deadline and returns the number of keys deleted, the next
+//run resumes after the last database sampled
+func (e *ExpireCycle) Run(deadline time.Time) (expired int) {
+	c := e.c
+	count := c.dbs.count()
+	for i := 0; i < count; i++ {
+		index := (e.index + i) % count
+		view, err := c.Select(index)
+		if err != nil {
+			break
+		}
+		expired += e.sample(view, deadline)
+		if time.Now().After(deadline) {
+			e.index = (index + 1) % count
+			return
+		}
+	}
+	return
+}
+
+func (e *ExpireCycle) sample(c *RedisCommand, deadline time.Time) (expired int) {
+	phys := c.physical()
+	prefix := encodeDBPrefix(phys)
+	for shard, db := range c.db {
+		if counter, ok := db.(keyCounter); ok && counter.Keys(phys) == 0 {
+			continue
+		}
+		id := [2]int{int(phys), shard}
+		for {
+			rows := scanMetaRows(db, prefix, KEY_META_TYPES, e.last[id], EXPIRE_CYCLE_KEYS)
+			if len(rows) < EXPIRE_CYCLE_KEYS {
+				delete(e.last, id)
+			} else {
+				e.last[id] = rows[len(rows)-1].V0
+			}
+			n := 0
+			for _, v := range rows {
+				if expire, _ := c.DecodeValue(v.V1); expire && c.expireRow(db, v.V0) {
+					n++
+				}
+			}
+			expired += n
+			if n*100 <= len(rows)*EXPIRE_CYCLE_REPEAT || time.Now().After(deadline) {
+				break
+			}
+		}
+	}
+	return
+}
+
+//expireRow deletes the key of the meta row if it is still expired once read again inside
+//the transaction deleting it, and notifies "expired"
+func (c *RedisCommand) expireRow(db store.IStore, row []byte) bool {
+	key := row[DB_PREFIX_LEN+1:]
+	deleted := false
+	var records [][]byte
+	err := db.Transaction(func(t interface{}) error {
+		if expire, _ := c.DecodeValue(db.Get(t, row)); expire {
+			deleted, records = c.unlinkTx(db, t, key, LAZYFREE_THRESHOLD)
+		}
+		return nil
+	})
+	if err != nil || !deleted {
+		return false
+	}
+	c.lazy.add(records)
+	c.notify(NOTIFY_EXPIRED, "expired", key)
+	return true
+}
+
+//expiredKey is the error a transaction function returns once expireTx deleted the expired key
+//it read, update commits the deletion and returns ErrKeyNotFound in its place
+type expiredKey struct {
+	key     []byte
+	records [][]byte
+	err     error //returned by update instead of ErrKeyNotFound
+}
+
+func (e *expiredKey) Error() string {
+	return ErrKeyNotFound.Error()
+}
+
+//expireTx deletes the expired key inside the transaction t of its shard. Its collections are
+//all left to the lazy free task, so the rest of t no longer reads their rows on the engines
+//whose transactions only read the committed ones
+func (c *RedisCommand) expireTx(db store.IStore, t interface{}, key []byte) *expiredKey {
+	_, records := c.freeTx(db, t, key, 0)
+	return &expiredKey{key: key, records: records}
+}
+
+//expired frees the collections of a key deleted by expireTx and notifies "expired", once the
+//transaction deleting it committed. A nil e does nothing
+func (c *RedisCommand) expired(e *expiredKey) {
+	if e == nil {
+		return
+	}
+	c.lazy.add(e.records)
+	c.notify(NOTIFY_EXPIRED, "expired", e.key)
+}
+
+//update runs f in a transaction of db. f stops at an expired key by returning the error of
+//expireTx, the deletion commits all the same and update returns ErrKeyNotFound
+func (c *RedisCommand) update(db store.IStore, f func(t interface{}) error) error {
+	var expired *expiredKey
+	err := db.Transaction(func(t interface{}) error {
+		expired = nil
+		err := f(t)
+		if e, ok := err.(*expiredKey); ok {
+			expired = e
+			return nil
+		}
+		return err
+	})
+	if err != nil || expired == nil {
+		return err
+	}
+	c.expired(expired)
+	if expired.err != nil {
+		return expired.err
+	}
+	return ErrKeyNotFound
+}
+
+//expireKey deletes key, if its meta row of type tp exists, like a command finding it expired
+func (c *RedisCommand) expireKey(tp byte, key []byte) error {
+	db := c.DB(key)
+	var expired *expiredKey
+	err := db.Transaction(func(t interface{}) error {
+		if db.Get(t, c.EncodeKey(tp, key)) == nil {
+			return ErrKeyNotFound
+		}
+		expired = c.expireTx(db, t, key)
+		return nil
+	})
+	if err == nil {
+		c.expired(expired)
+	}
+	return err
+}
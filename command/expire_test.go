@@ -0,0 +1,351 @@
+package command
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+//expireNow rewrites the meta row of key with an expire time in the past
+func expireNow(t *testing.T, c *RedisCommand, key []byte) {
+	t.Helper()
+	db := c.DB(key)
+	err := db.Transaction(func(tx interface{}) error {
+		tp := c.keyType(db, tx, key)
+		if tp == 0 {
+			return ErrKeyNotFound
+		}
+		meta := append([]byte{}, db.Get(tx, c.EncodeKey(tp, key))...)
+		binary.LittleEndian.PutUint32(meta, uint32(time.Now().Unix())-10)
+		return db.Put(tx, c.EncodeKey(tp, key), meta)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpireCycle(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    int //keys written to database 0
+		expired int //of which expire
+		db      int //database holding an expired key as well
+	}{
+		{"nothing expired", 50, 0, 0},
+		{"few expired", 100, 3, 0},
+		{"most expired", 300, 280, 0},
+		{"other database", 10, 0, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCommand(t, 0)
+			var events []string
+			c.SetNotify(NOTIFY_KEYEVENT|NOTIFY_EXPIRED, func(ch, msg []byte) int {
+				events = append(events, string(ch)+" "+string(msg))
+				return 0
+			})
+			for i := 0; i < tt.keys; i++ {
+				key := []byte(fmt.Sprint("k", i))
+				if i%2 == 0 {
+					c.Set(key, []byte("v"), 0)
+				} else {
+					c.HSet(key, []byte("f"), []byte("v"))
+				}
+				if i < tt.expired {
+					expireNow(t, c, key)
+				}
+			}
+			want := tt.expired
+			if tt.db != 0 {
+				other, _ := c.Select(tt.db)
+				other.SAdd([]byte("s"), []byte("m"))
+				expireNow(t, other, []byte("s"))
+				want++
+			}
+
+			e := c.NewExpireCycle()
+			deleted := 0
+			for i := 0; i < 100 && deleted < want; i++ {
+				deleted += e.Run(time.Now().Add(time.Second))
+			}
+			if deleted != want || len(events) != want {
+				t.Fatalf("deleted %d keys with %d events, want %d", deleted, len(events), want)
+			}
+			if n := c.DBSize(); n != int64(tt.keys-tt.expired) {
+				t.Fatalf("DBSize() = %d, want %d", n, tt.keys-tt.expired)
+			}
+			if tt.db != 0 && events[len(events)-1] != fmt.Sprintf("__keyevent@%d__:expired s", tt.db) {
+				t.Fatalf("event %q", events[len(events)-1])
+			}
+		})
+	}
+}
+
+//TestExpireCycleBounded checks a run past its deadline samples no more than one batch per shard
+func TestExpireCycleBounded(t *testing.T) {
+	c := newTestCommand(t, 0)
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprint("k", i))
+		c.Set(key, []byte("v"), 0)
+		expireNow(t, c, key)
+	}
+	e := c.NewExpireCycle()
+	if n := e.Run(time.Now()); n == 0 || n > EXPIRE_CYCLE_KEYS*c.Shards() {
+		t.Fatalf("Run() past its deadline deleted %d keys", n)
+	}
+}
+
+//TestExpireRowLiveKey checks a row is read again before its key is deleted
+func TestExpireRowLiveKey(t *testing.T) {
+	c := newTestCommand(t, 0)
+	key := []byte("k")
+	c.Set(key, []byte("v"), 0)
+	if c.expireRow(c.DB(key), c.EncodeKey(KEY_TYPE_STRING, key)) {
+		t.Fatal("expireRow() deleted a key without a ttl")
+	}
+	if string(c.Get(key)) != "v" {
+		t.Fatal("key lost")
+	}
+}
+
+//bounded fails the test unless f returns within a few seconds
+func bounded(t *testing.T, name string, f func() error) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s did not return", name)
+	}
+	return nil
+}
+
+//waitFreed waits for the lazy free task to delete the field rows of key under generation 0
+func waitFreed(t *testing.T, c *RedisCommand, tp byte, key []byte) {
+	t.Helper()
+	for i := 0; generationRows(c, tp, key, 0) != 0; i++ {
+		if i == 500 {
+			t.Fatalf("%d rows of the expired key left", generationRows(c, tp, key, 0))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//TestExpiredZSet runs commands on an expired zset, the expired key is deleted inside the
+//transaction of the command, which must not wait on a transaction of its own
+func TestExpiredZSet(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(c *RedisCommand, key []byte) error
+		err  error
+		want []string //members afterwards
+	}{
+		{"zpopmin", func(c *RedisCommand, key []byte) error {
+			_, err := c.ZPopMin(key, 1)
+			return err
+		}, ErrKeyNotFound, nil},
+		{"zremrangebyrank", func(c *RedisCommand, key []byte) error {
+			_, err := c.ZRemRangeByRank(key, 0, -1)
+			return err
+		}, ErrKeyNotFound, nil},
+		{"zremrangebyscore", func(c *RedisCommand, key []byte) error {
+			_, err := c.ZRemRangeByScore(key, []byte("-inf"), []byte("+inf"))
+			return err
+		}, ErrKeyNotFound, nil},
+		{"zcard", func(c *RedisCommand, key []byte) error {
+			_, err := c.ZCard(key)
+			return err
+		}, ErrKeyNotFound, nil},
+		{"zrank", func(c *RedisCommand, key []byte) error {
+			_, err := c.ZRank(key, []byte("m0"))
+			return err
+		}, ErrKeyNotFound, nil},
+		{"zincrby", func(c *RedisCommand, key []byte) error {
+			_, err := c.ZIncrby(key, []byte("1"), []byte("m0"))
+			return err
+		}, ErrKeyNotFound, nil},
+		{"zadd", func(c *RedisCommand, key []byte) error {
+			return c.ZAdd(key, 100, []byte("m0"))
+		}, nil, []string{"m0"}},
+		{"zadd members", func(c *RedisCommand, key []byte) error {
+			added, _, err := c.ZAddMembers(key, false, false, []*ZSetMember{{Member: []byte("m1"), Score: 7}, {Member: []byte("new"), Score: 8}})
+			if err == nil && added != 2 {
+				err = fmt.Errorf("added %d members", added)
+			}
+			return err
+		}, nil, []string{"m1", "new"}},
+	}
+	for _, engine := range []string{"leveldb", "boltdb"} {
+		for _, size := range []int{3, LAZYFREE_THRESHOLD * 2} {
+			for _, tt := range tests {
+				t.Run(fmt.Sprintf("%s/%d/%s", engine, size, tt.name), func(t *testing.T) {
+					c := newEngineCommand(t, engine)
+					var events []string
+					c.SetNotify(NOTIFY_KEYEVENT|NOTIFY_EXPIRED, func(ch, msg []byte) int {
+						events = append(events, string(ch)+" "+string(msg))
+						return 0
+					})
+					key := []byte("z")
+					for i := 0; i < size; i++ {
+						c.ZAdd(key, uint64(i), []byte(fmt.Sprint("m", i)))
+					}
+					expireNow(t, c, key)
+					if err := bounded(t, tt.name, func() error { return tt.op(c, key) }); err != tt.err {
+						t.Fatalf("%s = %v, want %v", tt.name, err, tt.err)
+					}
+					got := c.ZRange(key, []byte("0"), []byte("-1"))
+					if fmt.Sprintf("%s", got) != fmt.Sprintf("%s", tt.want) {
+						t.Fatalf("members %s, want %s", got, tt.want)
+					}
+					if len(events) != 1 || events[0] != "__keyevent@0__:expired z" {
+						t.Fatalf("events %q", events)
+					}
+					keys := int64(0)
+					if len(tt.want) > 0 {
+						keys = 1
+					}
+					if n := c.DBSize(); n != keys {
+						t.Fatalf("DBSize() = %d, want %d", n, keys)
+					}
+					waitFreed(t, c, KEY_TYPE_ZSET, key)
+				})
+			}
+		}
+	}
+}
+
+//TestExpiredCollections runs commands on expired hashes, sets, lists and streams like
+//TestExpiredZSet
+func TestExpiredCollections(t *testing.T) {
+	tests := []struct {
+		tp   string //name in lazyTypes
+		name string
+		op   func(c *RedisCommand, key []byte) error
+		err  error
+		size int   //size of the collection afterwards
+		keys int64 //keys left
+	}{
+		{"hash", "hget", func(c *RedisCommand, key []byte) error {
+			_, err := c.HGet(key, []byte("f0"))
+			return err
+		}, ErrKeyNotFound, 0, 0},
+		{"hash", "hlen", func(c *RedisCommand, key []byte) error {
+			_, err := c.HLen(key)
+			return err
+		}, ErrKeyNotFound, 0, 0},
+		{"hash", "hdel", func(c *RedisCommand, key []byte) error {
+			_, err := c.HDel(key, []byte("f0"))
+			return err
+		}, ErrKeyNotFound, 0, 0},
+		{"hash", "hexists", func(c *RedisCommand, key []byte) error {
+			_, err := c.HExists(key, []byte("f0"))
+			return err
+		}, ErrKeyNotFound, 0, 0},
+		{"hash", "hset", func(c *RedisCommand, key []byte) error {
+			return c.HSet(key, []byte("f0"), []byte("v"))
+		}, nil, 1, 1},
+		{"set", "srem", func(c *RedisCommand, key []byte) error {
+			return c.SRem(key, []byte("m0"))
+		}, ErrKeyNotFound, 0, 0},
+		{"set", "scard", func(c *RedisCommand, key []byte) error {
+			_, err := c.SCard(key)
+			return err
+		}, ErrKeyNotFound, 0, 0},
+		{"set", "sadd", func(c *RedisCommand, key []byte) error {
+			return c.SAdd(key, []byte("m0"), []byte("new"))
+		}, nil, 2, 1},
+		{"list", "lpop", func(c *RedisCommand, key []byte) error {
+			if v := c.LPop(key); v != nil {
+				return fmt.Errorf("popped %q", v)
+			}
+			return nil
+		}, nil, 0, 0},
+		{"list", "ltrim", func(c *RedisCommand, key []byte) error {
+			return c.LTrim(key, 0, 1)
+		}, ErrKeyNotFound, 0, 0},
+		{"list", "llen", func(c *RedisCommand, key []byte) error {
+			if n := c.LLen(key); n != 0 {
+				return fmt.Errorf("length %d", n)
+			}
+			return nil
+		}, nil, 0, 0},
+		{"list", "lpush", func(c *RedisCommand, key []byte) error {
+			return c.LPush(key, []byte("new"))
+		}, nil, 1, 1},
+		{"list", "rpush", func(c *RedisCommand, key []byte) error {
+			return c.RPush(key, []byte("new"))
+		}, nil, 1, 1},
+		{"stream", "xlen", func(c *RedisCommand, key []byte) error {
+			_, err := c.XLen(key)
+			return err
+		}, nil, 0, 0},
+		{"stream", "xdel", func(c *RedisCommand, key []byte) error {
+			_, err := c.XDel(key, StreamID{1, 0})
+			return err
+		}, nil, 0, 0},
+		{"stream", "xack", func(c *RedisCommand, key []byte) error {
+			_, err := c.XAck(key, []byte("g"), StreamID{1, 0})
+			return err
+		}, nil, 0, 0},
+		{"stream", "xpending", func(c *RedisCommand, key []byte) error {
+			_, _, _, _, err := c.XPendingSummary(key, []byte("g"))
+			return err
+		}, ErrStreamNoGroup, 0, 0},
+		{"stream", "xgroup create", func(c *RedisCommand, key []byte) error {
+			return c.XGroupCreate(key, []byte("g"), []byte("$"), false, -1)
+		}, ErrStreamNoKey, 0, 0},
+		{"stream", "xgroup create mkstream", func(c *RedisCommand, key []byte) error {
+			return c.XGroupCreate(key, []byte("g"), []byte("$"), true, -1)
+		}, nil, 0, 1},
+		{"stream", "xadd nomkstream", func(c *RedisCommand, key []byte) error {
+			_, err := c.XAdd(key, &StreamAddOption{NoMkStream: true, ID: []byte("*")}, [][]byte{[]byte("f"), []byte("v")})
+			return err
+		}, ErrKeyNotFound, 0, 0},
+		{"stream", "xadd", func(c *RedisCommand, key []byte) error {
+			_, err := c.XAdd(key, &StreamAddOption{ID: []byte("*")}, [][]byte{[]byte("f"), []byte("v")})
+			return err
+		}, nil, 1, 1},
+	}
+	types := make(map[string]lazyType)
+	for _, v := range lazyTypes {
+		types[v.name] = v
+	}
+	for _, engine := range []string{"leveldb", "boltdb"} {
+		for _, size := range []int{3, LAZYFREE_THRESHOLD * 2} {
+			for _, tt := range tests {
+				t.Run(fmt.Sprintf("%s/%d/%s", engine, size, tt.name), func(t *testing.T) {
+					c := newEngineCommand(t, engine)
+					var events []string
+					c.SetNotify(NOTIFY_KEYEVENT|NOTIFY_EXPIRED, func(ch, msg []byte) int {
+						events = append(events, string(ch)+" "+string(msg))
+						return 0
+					})
+					lt, key := types[tt.tp], []byte("k")
+					for i := 0; i < size; i++ {
+						lt.add(c, key, i)
+					}
+					if tt.tp == "stream" {
+						c.XGroupCreate(key, []byte("g"), []byte("0"), false, -1)
+					}
+					expireNow(t, c, key)
+					if err := bounded(t, tt.name, func() error { return tt.op(c, key) }); err != tt.err {
+						t.Fatalf("%s = %v, want %v", tt.name, err, tt.err)
+					}
+					if n := lt.size(c, key); n != tt.size {
+						t.Fatalf("size %d, want %d", n, tt.size)
+					}
+					if len(events) != 1 || events[0] != "__keyevent@0__:expired k" {
+						t.Fatalf("events %q", events)
+					}
+					if n := c.DBSize(); n != tt.keys {
+						t.Fatalf("DBSize() = %d, want %d", n, tt.keys)
+					}
+					waitFreed(t, c, lt.tp, key)
+				})
+			}
+		}
+	}
+}
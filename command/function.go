@@ -0,0 +1,85 @@
+package command
+
+import (
+	"encoding/binary"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//functionPrefix keys the code of the libraries loaded by FUNCTION LOAD by library name,
+//they live in the first shard so every restart loads them again
+var functionPrefix = []byte{KEY_TYPE_SYSTEM, 'f', 'u', 'n', 'c'}
+
+func functionKey(library []byte) []byte {
+	return append(append([]byte{}, functionPrefix...), library...)
+}
+
+//Libraries returns the persisted function libraries, V0 is the name and V1 the code
+func (c *RedisCommand) Libraries() []*store.Pair {
+	ret := c.direct().db[0].Scan(functionPrefix)
+	for _, v := range ret {
+		v.V0 = v.V0[len(functionPrefix):]
+	}
+	return ret
+}
+
+//SaveLibraries changes the persisted libraries in one transaction: with flush every library is
+//removed first, then the ones named in drop are removed and the ones in put are written
+func (c *RedisCommand) SaveLibraries(flush bool, drop [][]byte, put []*store.Pair) error {
+	db := c.direct().db[0]
+	var old []*store.Pair
+	if flush {
+		old = db.Scan(functionPrefix)
+	}
+	return db.Transaction(func(t interface{}) error {
+		for _, v := range old {
+			if err := db.Del(t, v.V0); err != nil {
+				return err
+			}
+		}
+		for _, v := range drop {
+			if err := db.Del(t, functionKey(v)); err != nil {
+				return err
+			}
+		}
+		for _, v := range put {
+			if err := db.Put(t, functionKey(v.V0), v.V1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//EncodeFunctionDump builds the payload of FUNCTION DUMP, which redis loads as well
+func EncodeFunctionDump(codes [][]byte) []byte {
+	w := &rdbWriter{}
+	for _, v := range codes {
+		w.writeByte(RDB_OPCODE_FUNCTION2)
+		w.writeString(v)
+	}
+	w.buf = append(w.buf, 0, 0)
+	binary.LittleEndian.PutUint16(w.buf[len(w.buf)-2:], RDB_VERSION_FUNC)
+	w.writeUint64(util.CRC64(0, w.buf))
+	return w.buf
+}
+
+//DecodeFunctionDump returns the library codes of a FUNCTION DUMP payload
+func DecodeFunctionDump(payload []byte) ([][]byte, error) {
+	if err := VerifyDumpPayload(payload); err != nil {
+		return nil, err
+	}
+	r := &rdbReader{data: payload[:len(payload)-10]}
+	var ret [][]byte
+	for r.err == nil && len(r.data) > 0 {
+		if r.readByte() != RDB_OPCODE_FUNCTION2 {
+			return nil, ErrBadDataFormat
+		}
+		ret = append(ret, r.readString())
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return ret, nil
+}
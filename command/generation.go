@@ -0,0 +1,127 @@
+package command
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//A collection freed in the background keeps its field rows until the lazy free task reaches
+//them, so a new collection created under the same name writes its field rows under the next
+//generation of the name. The field rows of a generation above 0 have FIELD_GENERATION_FLAG
+//set in their key size and the BE generation after the key:
+//
+//	phys | type | LE key_size|FIELD_GENERATION_FLAG | key | BE generation | ...
+//
+//generation 0 is the layout of a name never freed in the background. The generation of a
+//name is kept in generationPrefix-phys-key in the shard of the key while it is above 0
+const FIELD_GENERATION_FLAG = 1 << 31
+
+var generationPrefix = []byte{KEY_TYPE_SYSTEM, 'g', 'e', 'n'}
+
+//generations caches the generation rows of every shard, written by countedStore as they commit
+type generations struct {
+	lock  sync.RWMutex
+	gens  map[string]uint32 //phys-key -> generation, names at generation 0 are left out
+	count int32             //len(gens), lookups skip the table while it is zero
+}
+
+func newGenerations(db []store.IStore) *generations {
+	g := &generations{gens: make(map[string]uint32)}
+	for _, v := range db {
+		for _, row := range v.Scan(generationPrefix) {
+			if len(row.V1) == 4 {
+				g.gens[string(row.V0[len(generationPrefix):])] = binary.BigEndian.Uint32(row.V1)
+			}
+		}
+	}
+	g.count = int32(len(g.gens))
+	return g
+}
+
+func generationRow(id []byte) []byte {
+	return append(append([]byte{}, generationPrefix...), id...)
+}
+
+func isGenerationRow(row []byte) bool {
+	return bytes.HasPrefix(row, generationPrefix)
+}
+
+//get returns the generation of a name given as phys-key
+func (g *generations) get(id []byte) uint32 {
+	if atomic.LoadInt32(&g.count) == 0 {
+		return 0
+	}
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.gens[string(id)]
+}
+
+//apply caches a generation row written with value, nil when deleted
+func (g *generations) apply(row, value []byte) {
+	id := string(row[len(generationPrefix):])
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if len(value) == 4 && binary.BigEndian.Uint32(value) != 0 {
+		g.gens[id] = binary.BigEndian.Uint32(value)
+	} else {
+		delete(g.gens, id)
+	}
+	atomic.StoreInt32(&g.count, int32(len(g.gens)))
+}
+
+//generation returns the generation the field rows of key are written under
+func (c *RedisCommand) generation(key []byte) uint32 {
+	if c.gens == nil || atomic.LoadInt32(&c.gens.count) == 0 {
+		return 0
+	}
+	id := make([]byte, DB_PREFIX_LEN+len(key))
+	binary.BigEndian.PutUint16(id, c.physical())
+	copy(id[DB_PREFIX_LEN:], key)
+	return c.gens.get(id)
+}
+
+//allocField allocates a field row of key for the type tp, with size bytes after the key
+//returned as body
+func (c *RedisCommand) allocField(tp byte, key []byte, size int) (row, body []byte) {
+	return c.allocFieldAt(tp, key, c.generation(key), size)
+}
+
+//allocFieldAt is allocField for the generation gen
+func (c *RedisCommand) allocFieldAt(tp byte, key []byte, gen uint32, size int) (row, body []byte) {
+	header := 1 + 4 + len(key)
+	if gen != 0 {
+		header += 4
+	}
+	row, ret := c.allocKey(header + size)
+	ret[0] = tp
+	keySize := uint32(len(key))
+	if gen != 0 {
+		keySize |= FIELD_GENERATION_FLAG
+		binary.BigEndian.PutUint32(ret[1+4+len(key):], gen)
+	}
+	binary.LittleEndian.PutUint32(ret[1:], keySize)
+	copy(ret[1+4:], key)
+	return row, ret[header:]
+}
+
+//fieldKey returns the key a field row belongs to and the size of the row up to the field,
+//ok is false for a row too short to be a field row
+func fieldKey(row []byte) (key []byte, header int, ok bool) {
+	if len(row) < DB_PREFIX_LEN+1+4 {
+		return nil, 0, false
+	}
+	keySize := binary.LittleEndian.Uint32(row[DB_PREFIX_LEN+1:])
+	n := int(keySize &^ FIELD_GENERATION_FLAG)
+	header = DB_PREFIX_LEN + 1 + 4 + n
+	if keySize&FIELD_GENERATION_FLAG != 0 {
+		header += 4
+	}
+	if len(row) < header {
+		return nil, 0, false
+	}
+	return row[DB_PREFIX_LEN+1+4 : DB_PREFIX_LEN+1+4+n], header, true
+}
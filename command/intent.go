@@ -0,0 +1,115 @@
+package command
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//Operations touching two shards can not commit in one store transaction. The first
+//shard commits its writes together with an intent record describing the work left on
+//the other shard, the intent is removed once that work has committed, and Recover
+//rolls forward whatever a crash left in between
+const (
+	INTENT_DEL_KEY = 'D' //delete every row of a key
+	INTENT_APPLY   = 'A' //apply the writes a MULTI transaction made to another shard
+)
+
+//an intent whose first transaction committed is retried INTENT_RETRIES times, waiting up to
+//INTENT_RETRY_WAIT between two attempts, before its caller is told
+const (
+	INTENT_RETRIES    = 10
+	INTENT_RETRY_WAIT = time.Second
+)
+
+var intentPrefix = []byte{KEY_TYPE_SYSTEM, 'i', 'n', 't', 'e', 'n', 't'}
+
+var intentSeq uint32
+
+func (*RedisCommand) intentKey() []byte {
+	ret := make([]byte, len(intentPrefix)+8+4)
+	copy(ret, intentPrefix)
+	binary.BigEndian.PutUint64(ret[len(intentPrefix):], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(ret[len(intentPrefix)+8:], atomic.AddUint32(&intentSeq, 1))
+	return ret
+}
+
+//putIntent records op on key of the database of c inside transaction t
+func (c *RedisCommand) putIntent(db store.IStore, t interface{}, op byte, key []byte) (intent, value []byte, err error) {
+	intent = c.intentKey()
+	value = make([]byte, 1+DB_PREFIX_LEN+len(key))
+	value[0] = op
+	binary.BigEndian.PutUint16(value[1:], c.physical())
+	copy(value[1+DB_PREFIX_LEN:], key)
+	return intent, value, db.Put(t, intent, value)
+}
+
+//finishIntent applies the recorded op and removes the intent from db
+func (c *RedisCommand) finishIntent(db store.IStore, intent, value []byte) error {
+	if len(value) > 1+DB_PREFIX_LEN {
+		var target store.IStore
+		var apply func(t interface{}) error
+		var records [][]byte
+		switch value[0] {
+		case INTENT_DEL_KEY:
+			view := c.physicalView(binary.BigEndian.Uint16(value[1:]))
+			key := value[1+DB_PREFIX_LEN:]
+			target = view.DB(key)
+			apply = func(t interface{}) error {
+				_, records = view.unlinkTx(target, t, key, LAZYFREE_THRESHOLD)
+				return nil
+			}
+		case INTENT_APPLY:
+			if shard := int(binary.BigEndian.Uint16(value[1:])); shard < len(c.db) {
+				target = c.db[shard]
+				apply = func(t interface{}) error {
+					return applyWrites(target, t, value[1+DB_PREFIX_LEN:])
+				}
+			}
+		}
+		if apply != nil {
+			if err := c.transaction(target, apply); err != nil {
+				return err
+			}
+			c.lazy.add(records)
+		}
+	}
+	return db.Transaction(func(t interface{}) error {
+		return db.Del(t, intent)
+	})
+}
+
+//rollForward finishes an intent whose first transaction committed. The operation is durable
+//from then on, so a failed attempt is retried rather than handed to the caller with only
+//part of the shards written; an error means the intent is left to Recover
+func (c *RedisCommand) rollForward(db store.IStore, intent, value []byte) error {
+	wait := time.Millisecond
+	var err error
+	for i := 0; i < INTENT_RETRIES; i++ {
+		if err = c.finishIntent(db, intent, value); err == nil {
+			return nil
+		}
+		log.Printf("roll forward intent failed, intent=%q, err=%+v", intent, err)
+		time.Sleep(wait)
+		if wait *= 2; wait > INTENT_RETRY_WAIT {
+			wait = INTENT_RETRY_WAIT
+		}
+	}
+	return fmt.Errorf("committed, but not applied to every shard until restart: %v", err)
+}
+
+//Recover completes the cross shard operations interrupted by a crash
+func (c *RedisCommand) Recover() error {
+	for _, db := range c.db {
+		for _, v := range db.Scan(intentPrefix) {
+			if err := c.finishIntent(db, v.V0, v.V1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Zealous-w/tacodb/store"
+)
+
+var errInjected = errors.New("injected failure")
+
+//failingStore fails its next fail transactions
+type failingStore struct {
+	store.IStore
+	fail int32
+}
+
+func (s *failingStore) Transaction(f func(t interface{}) error) error {
+	if atomic.AddInt32(&s.fail, -1) >= 0 {
+		return errInjected
+	}
+	return s.IStore.Transaction(f)
+}
+
+//twoShardKeys returns two keys of different shards, the first of the lower shard
+func twoShardKeys(c *RedisCommand) (low, high []byte) {
+	low = []byte("k0")
+	for i := 1; ; i++ {
+		high = []byte(fmt.Sprint("k", i))
+		if a, b := c.Shard(low), c.Shard(high); a != b {
+			if a > b {
+				low, high = high, low
+			}
+			return low, high
+		}
+	}
+}
+
+//TestCommitRollForward fails the transactions of the second shard of a MULTI transaction
+//after the first one committed, Commit must retry them before returning
+func TestCommitRollForward(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    int32
+		applied bool
+	}{
+		{"no failure", 0, true},
+		{"transient failure", 3, true},
+		{"persistent failure", INTENT_RETRIES, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir()
+			db, closeDB := store.NewDBStore("leveldb", path, 0)
+			failing := make([]*failingStore, 0, len(db))
+			wrapped := make([]store.IStore, 0, len(db))
+			for _, v := range db {
+				s := &failingStore{IStore: v}
+				failing, wrapped = append(failing, s), append(wrapped, s)
+			}
+			c := NewRedisCommand(wrapped, DATABASES_DEFAULT, "")
+			low, high := twoShardKeys(c)
+
+			m := c.Multi()
+			m.Set(low, []byte("1"), 0)
+			m.Set(high, []byte("2"), 0)
+			atomic.StoreInt32(&failing[c.Shard(high)].fail, tt.fail)
+			err := m.Commit()
+			if (err == nil) != tt.applied {
+				t.Fatalf("Commit() = %v, want applied %v", err, tt.applied)
+			}
+			if string(c.Get(low)) != "1" {
+				t.Fatal("the first shard lost its writes")
+			}
+			if got := string(c.Get(high)); (got == "2") != tt.applied {
+				t.Fatalf("Get() of the second shard = %q, want applied %v", got, tt.applied)
+			}
+			closeDB()
+
+			//whatever Commit could not apply is rolled forward on restart
+			c, _ = openTestCommand(t, path, 0)
+			if string(c.Get(low)) != "1" || string(c.Get(high)) != "2" {
+				t.Fatalf("after restart %q, %q", c.Get(low), c.Get(high))
+			}
+			for _, v := range c.db {
+				if rows := v.Scan(intentPrefix); len(rows) != 0 {
+					t.Fatalf("intent left: %q", rows[0].V0)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package command
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"time"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+const (
+	LAZYFREE_THRESHOLD  = 64          //DEL frees collections with more field rows in the background
+	LAZYFREE_BATCH      = 1024        //field rows deleted per transaction by the background task
+	LAZYFREE_RETRY_WAIT = time.Second //longest wait of the background task between two failed rounds
+)
+
+//lazyFreePrefix marks collections whose meta is gone but whose field rows of a generation
+//are still being deleted, the record is lazyFreePrefix-physical-key-BE generation and lives
+//in the shard of the key, its value lists the types of the collections
+var lazyFreePrefix = []byte{KEY_TYPE_SYSTEM, 'g', 'c'}
+
+//lazyFree deletes the field rows of unlinked collections in bounded batches. A collection
+//created under the name meanwhile writes under the next generation, see generation.go, so
+//it never sees the old rows and nothing but the background task waits for their deletion
+type lazyFree struct {
+	wake chan struct{}
+}
+
+func newLazyFree() *lazyFree {
+	return &lazyFree{wake: make(chan struct{}, 1)}
+}
+
+func lazyFreeRecord(phys uint16, key []byte, gen uint32) []byte {
+	ret := make([]byte, len(lazyFreePrefix)+DB_PREFIX_LEN+len(key)+4)
+	n := copy(ret, lazyFreePrefix)
+	binary.BigEndian.PutUint16(ret[n:], phys)
+	copy(ret[n+DB_PREFIX_LEN:], key)
+	binary.BigEndian.PutUint32(ret[len(ret)-4:], gen)
+	return ret
+}
+
+//decodeLazyFreeRecord returns the physical database, key and generation of a record
+func decodeLazyFreeRecord(record []byte) (phys uint16, key []byte, gen uint32, ok bool) {
+	body := record[len(lazyFreePrefix):]
+	if len(body) < DB_PREFIX_LEN+4 {
+		return 0, nil, 0, false
+	}
+	return binary.BigEndian.Uint16(body), body[DB_PREFIX_LEN : len(body)-4], binary.BigEndian.Uint32(body[len(body)-4:]), true
+}
+
+func (l *lazyFree) start(c *RedisCommand) {
+	go l.run(c)
+}
+
+//add wakes the background task once records committed
+func (l *lazyFree) add(records [][]byte) {
+	if len(records) == 0 {
+		return
+	}
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+//collect deletes up to LAZYFREE_BATCH field rows of a record and drops the record once no
+//row is left, done reports whether it is gone
+func (l *lazyFree) collect(c *RedisCommand, db store.IStore, record, tp []byte) (done bool, err error) {
+	phys, key, gen, ok := decodeLazyFreeRecord(record)
+	if !ok {
+		return true, db.Transaction(func(t interface{}) error {
+			return db.Del(t, record)
+		})
+	}
+	view := c.physicalView(phys)
+	var types []byte
+	for _, v := range tp {
+		types = append(types, keyFieldTypes[v]...)
+	}
+	var rows []*store.Pair
+	for _, ft := range types {
+		prefix, _ := view.allocFieldAt(ft, key, gen, 0)
+		rows = append(rows, db.RangeLimit(prefix, util.PrefixEnd(prefix), LAZYFREE_BATCH-len(rows))...)
+		if len(rows) >= LAZYFREE_BATCH {
+			break
+		}
+	}
+	done = len(rows) < LAZYFREE_BATCH
+	err = db.Transaction(func(t interface{}) error {
+		for _, v := range rows {
+			if err := db.Del(t, v.V0); err != nil {
+				return err
+			}
+		}
+		if !done {
+			return nil
+		}
+		if err := db.Del(t, record); err != nil {
+			return err
+		}
+		return view.dropGeneration(db, t, key, record)
+	})
+	return done, err
+}
+
+//dropGeneration deletes the generation row of key once the last record of its older
+//generations is gone and no collection lives under it, the name starts over at generation 0
+func (c *RedisCommand) dropGeneration(db store.IStore, t interface{}, key, record []byte) error {
+	id := append(encodeDBPrefix(c.physical()), key...)
+	if c.gens.get(id) == 0 {
+		return nil
+	}
+	//a collection created meanwhile commits its meta row before or after the check
+	holdCreate(db, t)
+	for _, tp := range KEY_META_TYPES {
+		if db.Get(t, c.EncodeKey(tp, key)) != nil {
+			return nil
+		}
+	}
+	prefix := record[:len(record)-4]
+	for _, v := range db.Scan(prefix) {
+		if len(v.V0) == len(record) && !bytes.Equal(v.V0, record) {
+			return nil
+		}
+	}
+	return db.Del(t, generationRow(id))
+}
+
+//run collects the records until none is left, then waits for add. A round with a failed
+//record waits before the next one, doubling the wait up to LAZYFREE_RETRY_WAIT while the
+//failures go on, so a record that keeps failing does not spin the task
+func (l *lazyFree) run(c *RedisCommand) {
+	wait := time.Millisecond
+	for {
+		found, failed := false, false
+		for _, db := range c.db {
+			for _, v := range db.RangeLimit(lazyFreePrefix, util.PrefixEnd(lazyFreePrefix), 64) {
+				found = true
+				if _, err := l.collect(c, db, v.V0, v.V1); err != nil {
+					failed = true
+					log.Printf("lazy free failed, record=%q, err=%+v", v.V0, err)
+				}
+			}
+		}
+		if failed {
+			time.Sleep(wait)
+			if wait *= 2; wait > LAZYFREE_RETRY_WAIT {
+				wait = LAZYFREE_RETRY_WAIT
+			}
+			continue
+		}
+		wait = time.Millisecond
+		if !found {
+			<-l.wake
+		}
+	}
+}
+
+//large reports whether a collection holds more than threshold field rows
+func (c *RedisCommand) large(db store.IStore, tp byte, key []byte, threshold int) bool {
+	n := 0
+	for _, ft := range keyFieldTypes[tp] {
+		prefix := c.encodeFieldPrefix(ft, key)
+		n += len(db.RangeLimit(prefix, util.PrefixEnd(prefix), threshold+1-n))
+		if n > threshold {
+			return true
+		}
+	}
+	return false
+}
+
+//unlinkTx deletes key like delTx, but collections with more than threshold field rows only
+//lose their meta and get a lazy free record. The records must be passed to lazy.add once t commits
+func (c *RedisCommand) unlinkTx(db store.IStore, t interface{}, key []byte, threshold int) (deleted bool, records [][]byte) {
+	//every collection of the name shares its generation, those left to the background task
+	//get one record listing their types
+	gen := c.generation(key)
+	var types []byte
+	for _, tp := range KEY_META_TYPES {
+		metaKey := c.EncodeKey(tp, key)
+		if db.Get(t, metaKey) == nil {
+			continue
+		}
+		deleted = true
+		if len(keyFieldTypes[tp]) == 0 || !c.large(db, tp, key, threshold) {
+			c.delTypeTx(db, t, tp, key)
+			continue
+		}
+		_ = db.Del(t, metaKey)
+		types = append(types, tp)
+	}
+	if len(types) == 0 {
+		return
+	}
+	//the rows stay under the current generation, a new collection takes the next one
+	record := lazyFreeRecord(c.physical(), key, gen)
+	_ = db.Put(t, record, types)
+	next := make([]byte, 4)
+	binary.BigEndian.PutUint32(next, gen+1)
+	_ = db.Put(t, generationRow(append(encodeDBPrefix(c.physical()), key...)), next)
+	return deleted, [][]byte{record}
+}
+
+//freeTx deletes key inside t with unlinkTx. A MULTI transaction view deletes it like delTx
+//instead: the commands queued after it took the generation of the name when they ran, so a
+//lazy free record committed with them could free the rows they write
+func (c *RedisCommand) freeTx(db store.IStore, t interface{}, key []byte, threshold int) (deleted bool, records [][]byte) {
+	if c.multi != nil {
+		return c.delTx(db, t, key), nil
+	}
+	return c.unlinkTx(db, t, key, threshold)
+}
+
+//Unlink removes keys at once and frees their collections in the background
+func (c *RedisCommand) Unlink(keys ...[]byte) (ret int) {
+	for _, key := range keys {
+		if c.del(key, 0) {
+			c.notify(NOTIFY_GENERIC, "del", key)
+			ret++
+		}
+	}
+	return
+}
+
+func (c *RedisCommand) del(key []byte, threshold int) bool {
+	db := c.DB(key)
+	deleted := false
+	var records [][]byte
+	err := db.Transaction(func(t interface{}) error {
+		deleted, records = c.freeTx(db, t, key, threshold)
+		return nil
+	})
+	if err != nil {
+		return false
+	}
+	c.lazy.add(records)
+	return deleted
+}
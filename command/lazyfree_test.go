@@ -0,0 +1,301 @@
+package command
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//newPausedCommand serves a new data directory without starting the lazy free task, the
+//test runs it with collectAll
+func newPausedCommand(t *testing.T) *RedisCommand {
+	t.Helper()
+	db, closeDB := store.NewDBStore("leveldb", t.TempDir(), 0)
+	t.Cleanup(closeDB)
+	c, err := openRedisCommand(db, DATABASES_DEFAULT, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+//collectAll runs the lazy free task until no record is left
+func collectAll(t *testing.T, c *RedisCommand) {
+	t.Helper()
+	for found := true; found; {
+		found = false
+		for _, db := range c.db {
+			for _, v := range db.Scan(lazyFreePrefix) {
+				found = true
+				if _, err := c.lazy.collect(c, db, v.V0, v.V1); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+//generationRows counts the field rows of key under the generation gen
+func generationRows(c *RedisCommand, tp byte, key []byte, gen uint32) int {
+	db := c.DB(key)
+	n := 0
+	for _, ft := range keyFieldTypes[tp] {
+		prefix, _ := c.allocFieldAt(ft, key, gen, 0)
+		n += len(db.Range(prefix, util.PrefixEnd(prefix)))
+	}
+	return n
+}
+
+type lazyType struct {
+	name string
+	tp   byte
+	add  func(c *RedisCommand, key []byte, i int)
+	size func(c *RedisCommand, key []byte) int
+}
+
+var lazyTypes = []lazyType{
+	{"hash", KEY_TYPE_HASH,
+		func(c *RedisCommand, key []byte, i int) {
+			c.HSet(key, []byte(fmt.Sprint("f", i)), []byte("v"))
+		},
+		func(c *RedisCommand, key []byte) int {
+			ret, _ := c.HGetAll(key)
+			return len(ret)
+		}},
+	{"set", KEY_TYPE_SET,
+		func(c *RedisCommand, key []byte, i int) {
+			c.SAdd(key, []byte(fmt.Sprint("m", i)))
+		},
+		func(c *RedisCommand, key []byte) int {
+			ret, _ := c.SMembers(key)
+			return len(ret)
+		}},
+	{"zset", KEY_TYPE_ZSET,
+		func(c *RedisCommand, key []byte, i int) {
+			c.ZAdd(key, uint64(i+1), []byte(fmt.Sprint("m", i)))
+		},
+		func(c *RedisCommand, key []byte) int {
+			return len(c.ZRange(key, []byte("0"), []byte("-1")))
+		}},
+	{"list", KEY_TYPE_LIST,
+		func(c *RedisCommand, key []byte, i int) {
+			c.RPush(key, []byte(fmt.Sprint(i)))
+		},
+		func(c *RedisCommand, key []byte) int {
+			return len(c.LRange(key, 0, -1))
+		}},
+	{"stream", KEY_TYPE_STREAM,
+		func(c *RedisCommand, key []byte, i int) {
+			c.XAdd(key, &StreamAddOption{ID: []byte("*")}, [][]byte{[]byte("f"), []byte("v")})
+		},
+		func(c *RedisCommand, key []byte) int {
+			n, _ := c.XLen(key)
+			return int(n)
+		}},
+}
+
+//TestUnlinkRecreate creates a collection under the name of one still being freed, it must
+//only see its own rows while the old ones are deleted in the background
+func TestUnlinkRecreate(t *testing.T) {
+	for _, tt := range lazyTypes {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newPausedCommand(t)
+			key := []byte("big")
+			for i := 0; i < LAZYFREE_THRESHOLD*3; i++ {
+				tt.add(c, key, i)
+			}
+			if n := c.Unlink(key); n != 1 {
+				t.Fatalf("Unlink() = %d, want 1", n)
+			}
+			if n := tt.size(c, key); n != 0 {
+				t.Fatalf("size after Unlink = %d, want 0", n)
+			}
+			tt.add(c, key, -1)
+			if n := tt.size(c, key); n != 1 {
+				t.Fatalf("size of the new collection = %d, want 1", n)
+			}
+			if got := c.generation(key); got != 1 {
+				t.Fatalf("generation() = %d, want 1", got)
+			}
+			if n := generationRows(c, tt.tp, key, 0); n < LAZYFREE_THRESHOLD {
+				t.Fatalf("old rows = %d, Unlink deleted them synchronously", n)
+			}
+			collectAll(t, c)
+			if n := generationRows(c, tt.tp, key, 0); n != 0 {
+				t.Fatalf("old rows after the lazy free = %d, want 0", n)
+			}
+			if n := tt.size(c, key); n != 1 {
+				t.Fatalf("size after the lazy free = %d, want 1", n)
+			}
+			if got := c.generation(key); got != 1 {
+				t.Fatalf("generation() of a live collection = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestLazyFreeDropsGeneration(t *testing.T) {
+	c := newPausedCommand(t)
+	key := []byte("big")
+	for round := 0; round < 3; round++ {
+		for i := 0; i < LAZYFREE_THRESHOLD*2; i++ {
+			c.SAdd(key, []byte(fmt.Sprint(i)))
+		}
+		c.Unlink(key)
+	}
+	if got := c.generation(key); got != 3 {
+		t.Fatalf("generation() = %d, want 3", got)
+	}
+	collectAll(t, c)
+	if got := c.generation(key); got != 0 {
+		t.Fatalf("generation() once freed = %d, want 0", got)
+	}
+	if rows := c.DB(key).Scan(generationPrefix); len(rows) != 0 {
+		t.Fatalf("generation rows left: %q", rows[0].V0)
+	}
+	c.SAdd(key, []byte("x"))
+	if n := generationRows(c, KEY_TYPE_SET, key, 0); n != 1 {
+		t.Fatalf("rows at generation 0 = %d, want 1", n)
+	}
+}
+
+//TestReplaceLazyFree replaces or moves away a large zset, its rows must be left to the lazy
+//free task instead of being deleted by the command
+func TestReplaceLazyFree(t *testing.T) {
+	big, src, n := []byte("big"), []byte("src"), LAZYFREE_THRESHOLD*3
+	tests := []struct {
+		name string
+		op   func(c *RedisCommand) error
+		key  func(c *RedisCommand) (*RedisCommand, []byte) //database and key holding the result
+		size int
+	}{
+		{"rename onto", func(c *RedisCommand) error {
+			_, err := c.Rename(src, big, false)
+			return err
+		}, func(c *RedisCommand) (*RedisCommand, []byte) { return c, big }, 1},
+		{"rename away", func(c *RedisCommand) error {
+			_, err := c.Rename(big, []byte("dst"), false)
+			return err
+		}, func(c *RedisCommand) (*RedisCommand, []byte) { return c, []byte("dst") }, n},
+		{"copy replace", func(c *RedisCommand) error {
+			_, err := c.Copy(src, c, big, true)
+			return err
+		}, func(c *RedisCommand) (*RedisCommand, []byte) { return c, big }, 1},
+		{"move", func(c *RedisCommand) error {
+			to, err := c.Select(1)
+			if err != nil {
+				return err
+			}
+			_, err = c.Move(big, to)
+			return err
+		}, func(c *RedisCommand) (*RedisCommand, []byte) {
+			to, _ := c.Select(1)
+			return to, big
+		}, n},
+		{"restore replace", func(c *RedisCommand) error {
+			payload, err := c.Dump(src)
+			if err != nil {
+				return err
+			}
+			return c.Restore(big, 0, payload, true, false)
+		}, func(c *RedisCommand) (*RedisCommand, []byte) { return c, big }, 1},
+		{"zstore", func(c *RedisCommand) error {
+			return c.ZStore(big, []*ZSetMember{{Member: []byte("x"), Score: 1}}, "zunionstore")
+		}, func(c *RedisCommand) (*RedisCommand, []byte) { return c, big }, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newPausedCommand(t)
+			for i := 0; i < n; i++ {
+				c.ZAdd(big, uint64(i), []byte(fmt.Sprint("m", i)))
+			}
+			c.ZAdd(src, 1, []byte("x"))
+			if err := tt.op(c); err != nil {
+				t.Fatal(err)
+			}
+			if rows := generationRows(c, KEY_TYPE_ZSET, big, 0); rows < n {
+				t.Fatalf("old rows = %d, the command deleted them synchronously", rows)
+			}
+			collectAll(t, c)
+			if rows := generationRows(c, KEY_TYPE_ZSET, big, 0); rows != 0 {
+				t.Fatalf("old rows after the lazy free = %d, want 0", rows)
+			}
+			view, key := tt.key(c)
+			if size, err := view.ZCard(key); err != nil || size != tt.size {
+				t.Fatalf("ZCard() = %d, %v, want %d", size, err, tt.size)
+			}
+		})
+	}
+}
+
+func TestGenerationReopen(t *testing.T) {
+	path := t.TempDir()
+	db, closeDB := store.NewDBStore("leveldb", path, 0)
+	c, err := openRedisCommand(db, DATABASES_DEFAULT, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("h")
+	for i := 0; i < LAZYFREE_THRESHOLD*2; i++ {
+		c.HSet(key, []byte(fmt.Sprint(i)), []byte("old"))
+	}
+	c.Unlink(key)
+	c.HSet(key, []byte("f"), []byte("new"))
+	closeDB()
+
+	c, _ = openTestCommand(t, path, 0)
+	ret, err := c.HGetAll(key)
+	if err != nil || len(ret) != 1 || string(ret[0].V0) != "f" || string(ret[0].V1) != "new" {
+		t.Fatalf("HGetAll() after reopen = %v, %v", ret, err)
+	}
+}
+
+func TestFlushDropsGenerations(t *testing.T) {
+	c := newPausedCommand(t)
+	key := []byte("l")
+	for i := 0; i < LAZYFREE_THRESHOLD*2; i++ {
+		c.RPush(key, []byte("x"))
+	}
+	c.Unlink(key)
+	c.RPush(key, []byte("y"))
+	if err := c.FlushDB(); err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range [][]byte{generationPrefix, lazyFreePrefix} {
+		if rows := c.DB(key).Scan(prefix); len(rows) != 0 {
+			t.Fatalf("rows left by FLUSHDB: %q", rows[0].V0)
+		}
+	}
+	if got := c.generation(key); got != 0 {
+		t.Fatalf("generation() after FLUSHDB = %d, want 0", got)
+	}
+}
+
+func TestFieldKey(t *testing.T) {
+	c := newPausedCommand(t)
+	gen0, _ := c.allocFieldAt(KEY_TYPE_HASH_FIELD, []byte("key"), 0, 2)
+	gen5, _ := c.allocFieldAt(KEY_TYPE_HASH_FIELD, []byte("key"), 5, 2)
+	tests := []struct {
+		name   string
+		row    []byte
+		key    string
+		header int
+		ok     bool
+	}{
+		{"generation 0", gen0, "key", DB_PREFIX_LEN + 1 + 4 + 3, true},
+		{"generation 5", gen5, "key", DB_PREFIX_LEN + 1 + 4 + 3 + 4, true},
+		{"short", gen5[:DB_PREFIX_LEN+1+4+3], "", 0, false},
+		{"no key size", gen0[:DB_PREFIX_LEN+2], "", 0, false},
+	}
+	for _, tt := range tests {
+		key, header, ok := fieldKey(tt.row)
+		if string(key) != tt.key || header != tt.header || ok != tt.ok {
+			t.Errorf("%s: fieldKey() = %q, %d, %v, want %q, %d, %v", tt.name, key, header, ok, tt.key, tt.header, tt.ok)
+		}
+	}
+	if owner := watchOwner(gen5); string(owner) != "\x00\x00key" {
+		t.Errorf("watchOwner() = %q, want the key without its generation", owner)
+	}
+}
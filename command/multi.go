@@ -0,0 +1,379 @@
+package command
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//A MULTI transaction runs its commands against multiStores, which keep every write in
+//memory and answer reads from those writes on top of the shard. Commit then writes them:
+//
+//  - writes to a single shard commit in one store transaction, all or nothing
+//  - with several shards the first one commits its writes together with one INTENT_APPLY
+//    intent per other shard holding that shard's writes. Once this transaction is durable
+//    the whole transaction is. Each intent is then applied in its shard and removed,
+//    and Recover applies the intents a crash left behind
+//
+//Applying the writes of an intent twice is harmless as long as nothing else wrote to the
+//shard in between, which holds because the caller keeps other commands out until Commit
+//returns and Recover runs before any command is served
+type multiStore struct {
+	store.IStore
+	writes   map[string][]byte //nil value means deleted
+	keys     []string          //keys of writes, sorted
+	readOnly bool              //refuse every write with ErrReadOnly
+	denied   bool              //a write was refused
+}
+
+var ErrReadOnly = errors.New("Write commands are not allowed from read-only scripts.")
+
+//multiTx collects the writes of one command, they reach the multiStore only if it succeeds
+type multiTx struct {
+	writes map[string][]byte
+}
+
+func newMultiStore(db store.IStore) *multiStore {
+	return &multiStore{IStore: db, writes: make(map[string][]byte)}
+}
+
+//Multi returns a view of c whose writes stay buffered until Commit, views taken
+//from it by Select share the buffers
+func (c *RedisCommand) Multi() *RedisCommand {
+	v := *c
+	v.db = make([]store.IStore, 0, len(c.db))
+	v.multi = make([]*multiStore, 0, len(c.db))
+	for _, db := range c.db {
+		s := newMultiStore(db)
+		v.db = append(v.db, s)
+		v.multi = append(v.multi, s)
+	}
+	return &v
+}
+
+//ReadOnly returns a transaction view of c that refuses writes, it is never committed
+func (c *RedisCommand) ReadOnly() *RedisCommand {
+	v := c.Multi()
+	for _, s := range v.multi {
+		s.readOnly = true
+	}
+	return v
+}
+
+//readOnly reports whether c refuses writes, refusing one if write is set
+func (c *RedisCommand) readOnly(write bool) bool {
+	if len(c.multi) == 0 || !c.multi[0].readOnly {
+		return false
+	}
+	if write {
+		c.multi[0].denied = true
+	}
+	return true
+}
+
+//WriteDenied reports whether the read only view c refused a write since it was last asked
+func (c *RedisCommand) WriteDenied() bool {
+	ret := false
+	for _, s := range c.multi {
+		ret = ret || s.denied
+		s.denied = false
+	}
+	return ret
+}
+
+//direct returns c addressing the shards themselves instead of the buffers of a transaction
+func (c *RedisCommand) direct() *RedisCommand {
+	if c.multi == nil {
+		return c
+	}
+	v := *c
+	v.db = make([]store.IStore, 0, len(c.multi))
+	for _, s := range c.multi {
+		v.db = append(v.db, s.IStore)
+	}
+	v.multi = nil
+	return &v
+}
+
+//Commit writes everything buffered by the transaction view c
+func (c *RedisCommand) Commit() error {
+	var dirty []int
+	for i, s := range c.multi {
+		if len(s.writes) > 0 {
+			dirty = append(dirty, i)
+		}
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+	base := c.direct()
+	first := c.multi[dirty[0]]
+	db := first.IStore
+	var intents, values [][]byte
+	err := c.transaction(db, func(t interface{}) error {
+		if err := first.apply(t); err != nil {
+			return err
+		}
+		for _, shard := range dirty[1:] {
+			intent := base.intentKey()
+			value := c.multi[shard].encodeWrites(uint16(shard))
+			if err := db.Put(t, intent, value); err != nil {
+				return err
+			}
+			intents, values = append(intents, intent), append(values, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	//the transaction is committed, every shard is attempted even if one of them fails
+	for i := range intents {
+		if e := base.rollForward(db, intents[i], values[i]); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *multiStore) apply(t interface{}) error {
+	for _, k := range s.keys {
+		var err error
+		if v := s.writes[k]; v != nil {
+			err = s.IStore.Put(t, []byte(k), v)
+		} else {
+			err = s.IStore.Del(t, []byte(k))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//encodeWrites builds the value of an INTENT_APPLY intent:
+//op-shard-[key_size-key-flag-value_size-value]..., flag 0 deletes the key
+func (s *multiStore) encodeWrites(shard uint16) []byte {
+	ret := []byte{INTENT_APPLY, 0, 0}
+	binary.BigEndian.PutUint16(ret[1:], shard)
+	size := make([]byte, 4)
+	for _, k := range s.keys {
+		v := s.writes[k]
+		binary.LittleEndian.PutUint32(size, uint32(len(k)))
+		ret = append(ret, size...)
+		ret = append(ret, k...)
+		if v == nil {
+			ret = append(ret, 0)
+			continue
+		}
+		ret = append(ret, 1)
+		binary.LittleEndian.PutUint32(size, uint32(len(v)))
+		ret = append(ret, size...)
+		ret = append(ret, v...)
+	}
+	return ret
+}
+
+//applyWrites replays the writes recorded by encodeWrites in transaction t of db
+func applyWrites(db store.IStore, t interface{}, data []byte) error {
+	for len(data) >= 4 {
+		n := int(binary.LittleEndian.Uint32(data))
+		if len(data) < 4+n+1 {
+			return ErrKeyTypeError
+		}
+		key, put := data[4:4+n], data[4+n] == 1
+		data = data[4+n+1:]
+		if !put {
+			if err := db.Del(t, key); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(data) < 4 || len(data) < 4+int(binary.LittleEndian.Uint32(data)) {
+			return ErrKeyTypeError
+		}
+		n = int(binary.LittleEndian.Uint32(data))
+		if err := db.Put(t, key, data[4:4+n]); err != nil {
+			return err
+		}
+		data = data[4+n:]
+	}
+	return nil
+}
+
+func (s *multiStore) set(key string, value []byte) {
+	if _, ok := s.writes[key]; !ok {
+		i := sort.SearchStrings(s.keys, key)
+		s.keys = append(s.keys, "")
+		copy(s.keys[i+1:], s.keys[i:])
+		s.keys[i] = key
+	}
+	s.writes[key] = value
+}
+
+func (s *multiStore) Transaction(f func(t interface{}) error) error {
+	tx := &multiTx{writes: make(map[string][]byte)}
+	if err := f(tx); err != nil {
+		return err
+	}
+	if s.readOnly && len(tx.writes) > 0 {
+		s.denied = true
+		return ErrReadOnly
+	}
+	for k, v := range tx.writes {
+		s.set(k, v)
+	}
+	return nil
+}
+
+func (s *multiStore) Put(tx interface{}, key, value []byte) error {
+	tx.(*multiTx).writes[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *multiStore) Del(tx interface{}, key []byte) error {
+	tx.(*multiTx).writes[string(key)] = nil
+	return nil
+}
+
+func (s *multiStore) Get(tx interface{}, key []byte) []byte {
+	if t, ok := tx.(*multiTx); ok {
+		if v, ok := t.writes[string(key)]; ok {
+			return v
+		}
+	}
+	if v, ok := s.writes[string(key)]; ok {
+		return v
+	}
+	var ret []byte
+	_ = s.IStore.Transaction(func(t interface{}) error {
+		ret = s.IStore.Get(t, key)
+		return nil
+	})
+	return ret
+}
+
+//between returns the buffered keys in [start, end), a nil end has no upper bound
+func (s *multiStore) between(start, end []byte) []string {
+	lo := sort.SearchStrings(s.keys, string(start))
+	hi := len(s.keys)
+	if end != nil {
+		hi = sort.SearchStrings(s.keys, string(end))
+	}
+	if hi < lo {
+		return nil
+	}
+	return s.keys[lo:hi]
+}
+
+//merge overlays the buffered writes on rows read from the shard. rows holds every shard row
+//of the range unless it was cut at limit, in which case buffered keys past its last row are
+//left out since rows of the shard may precede them
+func (s *multiStore) merge(rows []*store.Pair, buffered []string, cut bool, limit int, rev bool) []*store.Pair {
+	if rev {
+		for i, j := 0, len(buffered)-1; i < j; i, j = i+1, j-1 {
+			buffered[i], buffered[j] = buffered[j], buffered[i]
+		}
+	}
+	//before reports whether a sorts before b in the walking direction
+	before := func(a, b string) bool {
+		if rev {
+			return a > b
+		}
+		return a < b
+	}
+	ret := make([]*store.Pair, 0, len(rows)+len(buffered))
+	i := 0
+	for _, k := range buffered {
+		for ; i < len(rows) && before(string(rows[i].V0), k); i++ {
+			ret = append(ret, rows[i])
+		}
+		if i == len(rows) && cut {
+			break
+		}
+		if i < len(rows) && string(rows[i].V0) == k {
+			i++
+		}
+		if v := s.writes[k]; v != nil {
+			ret = append(ret, &store.Pair{V0: []byte(k), V1: v})
+		}
+	}
+	ret = append(ret, rows[i:]...)
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret
+}
+
+func (s *multiStore) rangeLimit(start, end []byte, limit int, rev bool) []*store.Pair {
+	buffered := s.between(start, end)
+	if len(buffered) == 0 {
+		if rev {
+			return s.IStore.RevRangeLimit(start, end, limit)
+		}
+		return s.IStore.RangeLimit(start, end, limit)
+	}
+	//every buffered key may hide a row of the shard, read that many more
+	fetch := limit
+	if limit > 0 {
+		fetch += len(buffered)
+	}
+	var rows []*store.Pair
+	if rev {
+		rows = s.IStore.RevRangeLimit(start, end, fetch)
+	} else {
+		rows = s.IStore.RangeLimit(start, end, fetch)
+	}
+	cut := limit > 0 && len(rows) >= fetch
+	return s.merge(rows, append([]string{}, buffered...), cut, limit, rev)
+}
+
+func (s *multiStore) Scan(key []byte) []*store.Pair {
+	buffered := s.between(key, util.PrefixEnd(key))
+	rows := s.IStore.Scan(key)
+	if len(buffered) == 0 {
+		return rows
+	}
+	return s.merge(rows, append([]string{}, buffered...), false, 0, false)
+}
+
+func (s *multiStore) Range(start, end []byte) []*store.Pair {
+	return s.rangeLimit(start, end, 0, false)
+}
+
+func (s *multiStore) RangeLimit(start, end []byte, limit int) []*store.Pair {
+	return s.rangeLimit(start, end, limit, false)
+}
+
+func (s *multiStore) RevRangeLimit(start, end []byte, limit int) []*store.Pair {
+	return s.rangeLimit(start, end, limit, true)
+}
+
+//Keys returns the number of keys of a physical database counting the buffered writes
+func (s *multiStore) Keys(phys uint16) int64 {
+	var ret int64
+	if counter, ok := s.IStore.(keyCounter); ok {
+		ret = counter.Keys(phys)
+	}
+	prefix := encodeDBPrefix(phys)
+	for _, k := range s.between(prefix, encodeDBPrefix(phys+1)) {
+		if !isMetaKey([]byte(k)) {
+			continue
+		}
+		var existed bool
+		_ = s.IStore.Transaction(func(t interface{}) error {
+			existed = s.IStore.Get(t, []byte(k)) != nil
+			return nil
+		})
+		exists := s.writes[k] != nil
+		if exists && !existed {
+			ret++
+		} else if existed && !exists {
+			ret--
+		}
+	}
+	return ret
+}
@@ -0,0 +1,140 @@
+package command
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+//event classes of keyspace notifications, selected like notify-keyspace-events of redis
+const (
+	NOTIFY_KEYSPACE = 1 << iota //K, __keyspace@<db>__:<key> channels receive the event
+	NOTIFY_KEYEVENT             //E, __keyevent@<db>__:<event> channels receive the key
+	NOTIFY_GENERIC              //g, del, rename_from, copy_to, restore...
+	NOTIFY_STRING               //$
+	NOTIFY_LIST                 //l
+	NOTIFY_SET                  //s
+	NOTIFY_HASH                 //h
+	NOTIFY_ZSET                 //z
+	NOTIFY_EXPIRED              //x
+	NOTIFY_EVICTED              //e, never emitted, nothing is evicted
+	NOTIFY_STREAM               //t
+	NOTIFY_KEY_MISS             //m, never emitted
+	NOTIFY_MODULE               //d, never emitted
+	NOTIFY_NEW                  //n, never emitted
+
+	NOTIFY_ALL = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH |
+		NOTIFY_ZSET | NOTIFY_EXPIRED | NOTIFY_EVICTED | NOTIFY_STREAM | NOTIFY_MODULE //A
+)
+
+var ErrNotifyFlags = errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+
+//notifyFlagChars maps the characters of notify-keyspace-events to event classes, A excluded
+var notifyFlagChars = []struct {
+	char  byte
+	class int
+}{
+	{'g', NOTIFY_GENERIC},
+	{'$', NOTIFY_STRING},
+	{'l', NOTIFY_LIST},
+	{'s', NOTIFY_SET},
+	{'h', NOTIFY_HASH},
+	{'z', NOTIFY_ZSET},
+	{'x', NOTIFY_EXPIRED},
+	{'e', NOTIFY_EVICTED},
+	{'K', NOTIFY_KEYSPACE},
+	{'E', NOTIFY_KEYEVENT},
+	{'t', NOTIFY_STREAM},
+	{'m', NOTIFY_KEY_MISS},
+	{'d', NOTIFY_MODULE},
+	{'n', NOTIFY_NEW},
+}
+
+//ParseNotifyFlags parses a notify-keyspace-events value like "Ex" or "KA"
+func ParseNotifyFlags(s string) (int, error) {
+	flags := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= NOTIFY_ALL
+			continue
+		}
+		found := false
+		for _, v := range notifyFlagChars {
+			if v.char == s[i] {
+				flags |= v.class
+				found = true
+			}
+		}
+		if !found {
+			return 0, ErrNotifyFlags
+		}
+	}
+	return flags, nil
+}
+
+//NotifyFlagsString formats flags back into a notify-keyspace-events value
+func NotifyFlagsString(flags int) string {
+	var b strings.Builder
+	if flags&NOTIFY_ALL == NOTIFY_ALL {
+		b.WriteByte('A')
+	}
+	for _, v := range notifyFlagChars {
+		if flags&v.class != 0 && (flags&NOTIFY_ALL != NOTIFY_ALL || v.class&NOTIFY_ALL == 0) {
+			b.WriteByte(v.char)
+		}
+	}
+	return b.String()
+}
+
+//notifier publishes keyspace notifications, all views of a RedisCommand share it
+type notifier struct {
+	flags   int32
+	publish func(channel, message []byte) int
+}
+
+//SetNotify selects the event classes notified and how they are published,
+//publish must be set before commands run, flags may change at any time
+func (c *RedisCommand) SetNotify(flags int, publish func(channel, message []byte) int) {
+	if publish != nil {
+		c.events.publish = publish
+	}
+	atomic.StoreInt32(&c.events.flags, int32(flags))
+}
+
+//NotifyFlags returns the event classes notified
+func (c *RedisCommand) NotifyFlags() int {
+	return int(atomic.LoadInt32(&c.events.flags))
+}
+
+//notify publishes event of key if its class is selected. Internal views addressing a
+//physical database only have no database number and never notify
+func (c *RedisCommand) notify(class int, event string, key []byte) {
+	flags := c.NotifyFlags()
+	if flags&class == 0 || flags&(NOTIFY_KEYSPACE|NOTIFY_KEYEVENT) == 0 || c.events.publish == nil || c.index < 0 {
+		return
+	}
+	db := strconv.Itoa(c.index)
+	if flags&NOTIFY_KEYSPACE != 0 {
+		c.events.publish([]byte("__keyspace@"+db+"__:"+string(key)), []byte(event))
+	}
+	if flags&NOTIFY_KEYEVENT != 0 {
+		c.events.publish([]byte("__keyevent@"+db+"__:"+event), key)
+	}
+}
+
+//notifyRemoved notifies event of key, followed by del when the removal emptied the key
+func (c *RedisCommand) notifyRemoved(class int, event string, key []byte, emptied bool) {
+	c.notify(class, event, key)
+	if emptied {
+		c.notify(NOTIFY_GENERIC, "del", key)
+	}
+}
+
+//notifyOn notifies event of key when err is nil and returns err
+func (c *RedisCommand) notifyOn(err error, class int, event string, key []byte) error {
+	if err == nil {
+		c.notify(class, event, key)
+	}
+	return err
+}
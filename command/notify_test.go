@@ -0,0 +1,92 @@
+package command
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNotifyFlags(t *testing.T) {
+	tests := []struct {
+		value string
+		flags int
+		str   string //formatted back, "" when value is invalid
+	}{
+		{"", 0, ""},
+		{"Ex", NOTIFY_KEYEVENT | NOTIFY_EXPIRED, "xE"},
+		{"KA", NOTIFY_KEYSPACE | NOTIFY_ALL, "AK"},
+		{"KEA", NOTIFY_KEYSPACE | NOTIFY_KEYEVENT | NOTIFY_ALL, "AKE"},
+		{"AA", NOTIFY_ALL, "A"},
+		{"g$lshzxetd", NOTIFY_ALL, "A"},
+		{"Kzmn", NOTIFY_KEYSPACE | NOTIFY_ZSET | NOTIFY_KEY_MISS | NOTIFY_NEW, "zKmn"},
+		{"KEAmn", NOTIFY_KEYSPACE | NOTIFY_KEYEVENT | NOTIFY_ALL | NOTIFY_KEY_MISS | NOTIFY_NEW, "AKEmn"},
+		{"Kq", 0, ""},
+		{"a", 0, ""},
+	}
+	for _, tt := range tests {
+		flags, err := ParseNotifyFlags(tt.value)
+		if tt.str == "" && tt.value != "" {
+			if err != ErrNotifyFlags {
+				t.Fatalf("ParseNotifyFlags(%q) = %d, %v, want ErrNotifyFlags", tt.value, flags, err)
+			}
+			continue
+		}
+		if err != nil || flags != tt.flags {
+			t.Fatalf("ParseNotifyFlags(%q) = %d, %v, want %d", tt.value, flags, err, tt.flags)
+		}
+		str := NotifyFlagsString(flags)
+		if str != tt.str {
+			t.Fatalf("NotifyFlagsString(%d) = %q, want %q", flags, str, tt.str)
+		}
+		if again, err := ParseNotifyFlags(str); err != nil || again != flags {
+			t.Fatalf("ParseNotifyFlags(%q) = %d, %v, want %d", str, again, err, flags)
+		}
+	}
+}
+
+//TestNotifyRemoved checks a removal notifies del after its event when it empties the key
+func TestNotifyRemoved(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(c *RedisCommand, key []byte)
+		event  string
+		list   bool
+	}{
+		{"zrem", func(c *RedisCommand, key []byte) { c.ZRem(key, []byte("a"), []byte("b")) }, "zrem", false},
+		{"zremrangebyscore", func(c *RedisCommand, key []byte) { c.ZRemRangeByScore(key, []byte("-inf"), []byte("+inf")) }, "zremrangebyscore", false},
+		{"zremrangebyrank", func(c *RedisCommand, key []byte) { c.ZRemRangeByRank(key, 0, -1) }, "zremrangebyrank", false},
+		{"zremrangebylex", func(c *RedisCommand, key []byte) { c.ZRemRangeByLex(key, []byte("-"), []byte("+")) }, "zremrangebylex", false},
+		{"zpopmin", func(c *RedisCommand, key []byte) { c.ZPopMin(key, 2) }, "zpopmin", false},
+		{"zpopmax", func(c *RedisCommand, key []byte) { c.ZPopMax(key, 2) }, "zpopmax", false},
+		{"lpop", func(c *RedisCommand, key []byte) { c.LPop(key); c.LPop(key) }, "lpop", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCommand(t, 0)
+			var events []string
+			c.SetNotify(NOTIFY_KEYEVENT|NOTIFY_ALL, func(ch, msg []byte) int {
+				events = append(events, string(ch)+" "+string(msg))
+				return 0
+			})
+			key := []byte("k")
+			if tt.list {
+				c.LPush(key, []byte("a"), []byte("b"))
+			} else {
+				c.ZAdd(key, 0, []byte("a"))
+				c.ZAdd(key, 0, []byte("b"))
+			}
+			events = nil
+			tt.remove(c, key)
+			want := []string{"__keyevent@0__:" + tt.event + " k", "__keyevent@0__:del k"}
+			if tt.list {
+				//lpop pops one element at a time
+				want = []string{"__keyevent@0__:lpop k", "__keyevent@0__:lpop k", "__keyevent@0__:del k"}
+			}
+			if !reflect.DeepEqual(events, want) {
+				t.Fatalf("events = %q, want %q", events, want)
+			}
+			if c.Exists(key) != 0 {
+				t.Fatal("the emptied key still exists")
+			}
+		})
+	}
+}
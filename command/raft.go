@@ -0,0 +1,46 @@
+package command
+
+import (
+	"encoding/binary"
+)
+
+//In raft mode every write is a command of the raft log, applied on each member through a
+//transaction view. raftAppliedKey commits with the writes, so the shards always hold the
+//state of one position of the log, and are the snapshot a lagging member is sent
+
+//raftAppliedKey holds the index and term, BE, of the last raft entry applied to the shards
+var raftAppliedKey = []byte{KEY_TYPE_SYSTEM, 'r', 'a', 'f', 't'}
+
+//RaftApplied returns the position of the raft log the shards hold
+func (c *RedisCommand) RaftApplied() (index, term uint64) {
+	db := c.direct().db[0]
+	var data []byte
+	_ = db.Transaction(func(t interface{}) error {
+		data = db.Get(t, raftAppliedKey)
+		return nil
+	})
+	if len(data) != 16 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(data), binary.BigEndian.Uint64(data[8:])
+}
+
+//SetRaftApplied records the position of the raft log, a transaction view commits it with
+//its writes
+func (c *RedisCommand) SetRaftApplied(index, term uint64) error {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, index)
+	binary.BigEndian.PutUint64(data[8:], term)
+	db := c.db[0]
+	return db.Transaction(func(t interface{}) error {
+		return db.Put(t, raftAppliedKey, data)
+	})
+}
+
+//FinishRaftSnapshot records the position a snapshot restored by ApplySnapshot was taken at
+func (c *RedisCommand) FinishRaftSnapshot(index, term uint64) error {
+	if err := c.direct().SetRaftApplied(index, term); err != nil {
+		return err
+	}
+	return c.dbs.reload()
+}
@@ -0,0 +1,491 @@
+package command
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//object types of the redis RDB format
+const (
+	RDB_TYPE_STRING             = 0
+	RDB_TYPE_LIST               = 1
+	RDB_TYPE_SET                = 2
+	RDB_TYPE_ZSET               = 3
+	RDB_TYPE_HASH               = 4
+	RDB_TYPE_ZSET_2             = 5
+	RDB_TYPE_LIST_ZIPLIST       = 10
+	RDB_TYPE_SET_INTSET         = 11
+	RDB_TYPE_ZSET_ZIPLIST       = 12
+	RDB_TYPE_HASH_ZIPLIST       = 13
+	RDB_TYPE_LIST_QUICKLIST     = 14
+	RDB_TYPE_STREAM_LISTPACKS   = 15
+	RDB_TYPE_HASH_LISTPACK      = 16
+	RDB_TYPE_ZSET_LISTPACK      = 17
+	RDB_TYPE_LIST_QUICKLIST_2   = 18
+	RDB_TYPE_STREAM_LISTPACKS_2 = 19
+	RDB_TYPE_SET_LISTPACK       = 20
+	RDB_TYPE_STREAM_LISTPACKS_3 = 21
+)
+
+//RDB_OPCODE_FUNCTION2 precedes the code of a function library
+const RDB_OPCODE_FUNCTION2 = 245
+
+const (
+	RDB_VERSION        = 12 //newest payload version RESTORE accepts
+	RDB_VERSION_DUMP   = 9  //version DUMP writes, loadable since redis 5
+	RDB_VERSION_STREAM = 11 //version DUMP writes for streams, STREAM_LISTPACKS_3 needs redis 7.2
+	RDB_VERSION_FUNC   = 10 //version FUNCTION DUMP writes, loadable since redis 7.0
+)
+
+const (
+	rdbLen6Bit  = 0
+	rdbLen14Bit = 1
+	rdbLen32Bit = 0x80
+	rdbLen64Bit = 0x81
+	rdbEncVal   = 3
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+var ErrBadDataFormat = errors.New("Bad data format")
+
+//rdbWriter appends RDB encoded values to buf
+type rdbWriter struct {
+	buf []byte
+}
+
+func (w *rdbWriter) writeByte(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+func (w *rdbWriter) writeRaw(data []byte) {
+	w.buf = append(w.buf, data...)
+}
+
+func (w *rdbWriter) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		w.buf = append(w.buf, byte(n))
+	case n < 1<<14:
+		w.buf = append(w.buf, byte(n>>8)|rdbLen14Bit<<6, byte(n))
+	case n <= math.MaxUint32:
+		w.buf = append(w.buf, rdbLen32Bit, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(w.buf[len(w.buf)-4:], uint32(n))
+	default:
+		w.buf = append(w.buf, rdbLen64Bit, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(w.buf[len(w.buf)-8:], n)
+	}
+}
+
+func (w *rdbWriter) writeString(s []byte) {
+	w.writeLen(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+//writeDouble writes the binary double of ZSET_2
+func (w *rdbWriter) writeDouble(f float64) {
+	w.writeUint64(math.Float64bits(f))
+}
+
+//writeUint64 writes a raw little endian integer, used for millisecond times
+func (w *rdbWriter) writeUint64(v uint64) {
+	w.buf = append(w.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(w.buf[len(w.buf)-8:], v)
+}
+
+//rdbReader decodes RDB values, the first failure sticks in err and every later read returns zero values
+type rdbReader struct {
+	data []byte
+	err  error
+}
+
+func (r *rdbReader) readRaw(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = ErrBadDataFormat
+		return nil
+	}
+	ret := r.data[:n]
+	r.data = r.data[n:]
+	return ret
+}
+
+func (r *rdbReader) readByte() byte {
+	if b := r.readRaw(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+//readLenEnc returns a length or, with encoded set, the special encoding of a string
+func (r *rdbReader) readLenEnc() (n uint64, encoded bool) {
+	b := r.readByte()
+	switch b >> 6 {
+	case rdbLen6Bit:
+		return uint64(b & 0x3F), false
+	case rdbLen14Bit:
+		return uint64(b&0x3F)<<8 | uint64(r.readByte()), false
+	case rdbEncVal:
+		return uint64(b & 0x3F), true
+	}
+	switch b {
+	case rdbLen32Bit:
+		if v := r.readRaw(4); v != nil {
+			return uint64(binary.BigEndian.Uint32(v)), false
+		}
+	case rdbLen64Bit:
+		if v := r.readRaw(8); v != nil {
+			return binary.BigEndian.Uint64(v), false
+		}
+	default:
+		r.err = ErrBadDataFormat
+	}
+	return 0, false
+}
+
+func (r *rdbReader) readLen() uint64 {
+	n, encoded := r.readLenEnc()
+	if encoded {
+		r.err = ErrBadDataFormat
+	}
+	return n
+}
+
+func (r *rdbReader) readString() []byte {
+	n, encoded := r.readLenEnc()
+	if !encoded {
+		if n > uint64(len(r.data)) {
+			r.err = ErrBadDataFormat
+			return nil
+		}
+		return r.readRaw(int(n))
+	}
+	switch n {
+	case rdbEncInt8:
+		return strconv.AppendInt(nil, int64(int8(r.readByte())), 10)
+	case rdbEncInt16:
+		if v := r.readRaw(2); v != nil {
+			return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(v))), 10)
+		}
+	case rdbEncInt32:
+		if v := r.readRaw(4); v != nil {
+			return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(v))), 10)
+		}
+	case rdbEncLZF:
+		clen, size := r.readLen(), r.readLen()
+		if r.err != nil || clen > uint64(len(r.data)) || size > math.MaxInt32 {
+			r.err = ErrBadDataFormat
+			return nil
+		}
+		ret, err := util.LZFDecompress(r.readRaw(int(clen)), int(size))
+		if err != nil {
+			r.err = ErrBadDataFormat
+		}
+		return ret
+	default:
+		r.err = ErrBadDataFormat
+	}
+	return nil
+}
+
+//readStringDouble reads the textual double of the old ZSET type
+func (r *rdbReader) readStringDouble() float64 {
+	n := r.readByte()
+	switch n {
+	case 253:
+		return math.NaN()
+	case 254:
+		return math.Inf(1)
+	case 255:
+		return math.Inf(-1)
+	}
+	f, err := strconv.ParseFloat(string(r.readRaw(int(n))), 64)
+	if err != nil && r.err == nil {
+		r.err = ErrBadDataFormat
+	}
+	return f
+}
+
+func (r *rdbReader) readDouble() float64 {
+	return math.Float64frombits(r.readUint64())
+}
+
+func (r *rdbReader) readUint64() uint64 {
+	if v := r.readRaw(8); v != nil {
+		return binary.LittleEndian.Uint64(v)
+	}
+	return 0
+}
+
+//ziplistEntries returns the entries of a ziplist, integers formatted as decimal strings
+func ziplistEntries(data []byte) ([][]byte, error) {
+	if len(data) < 11 || int(binary.LittleEndian.Uint32(data)) != len(data) || data[len(data)-1] != 0xFF {
+		return nil, ErrBadDataFormat
+	}
+	var ret [][]byte
+	p := data[10 : len(data)-1]
+	for len(p) > 0 {
+		//skip prevlen
+		if p[0] < 0xFE {
+			p = p[1:]
+		} else if len(p) >= 5 {
+			p = p[5:]
+		} else {
+			return nil, ErrBadDataFormat
+		}
+		if len(p) == 0 {
+			return nil, ErrBadDataFormat
+		}
+		enc := p[0]
+		var size, header int
+		var value int64
+		isInt := true
+		switch {
+		case enc>>6 == 0:
+			size, header, isInt = int(enc&0x3F), 1, false
+		case enc>>6 == 1:
+			if len(p) < 2 {
+				return nil, ErrBadDataFormat
+			}
+			size, header, isInt = int(enc&0x3F)<<8|int(p[1]), 2, false
+		case enc == 0x80:
+			if len(p) < 5 {
+				return nil, ErrBadDataFormat
+			}
+			size, header, isInt = int(binary.BigEndian.Uint32(p[1:])), 5, false
+		case enc == 0xC0:
+			size, header = 2, 1
+		case enc == 0xD0:
+			size, header = 4, 1
+		case enc == 0xE0:
+			size, header = 8, 1
+		case enc == 0xF0:
+			size, header = 3, 1
+		case enc == 0xFE:
+			size, header = 1, 1
+		case enc >= 0xF1 && enc <= 0xFD:
+			size, header, value = 0, 1, int64(enc&0x0F)-1
+		default:
+			return nil, ErrBadDataFormat
+		}
+		if size < 0 || len(p) < header+size {
+			return nil, ErrBadDataFormat
+		}
+		v := p[header : header+size]
+		p = p[header+size:]
+		if !isInt {
+			ret = append(ret, v)
+			continue
+		}
+		switch size {
+		case 1:
+			value = int64(int8(v[0]))
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(v)))
+		case 3:
+			value = int64(int32(uint32(v[0])<<8|uint32(v[1])<<16|uint32(v[2])<<24) >> 8)
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(v)))
+		case 8:
+			value = int64(binary.LittleEndian.Uint64(v))
+		}
+		ret = append(ret, strconv.AppendInt(nil, value, 10))
+	}
+	return ret, nil
+}
+
+//listpackEntries returns the entries of a listpack, integers formatted as decimal strings
+func listpackEntries(data []byte) ([][]byte, error) {
+	if len(data) < 7 || int(binary.LittleEndian.Uint32(data)) != len(data) || data[len(data)-1] != 0xFF {
+		return nil, ErrBadDataFormat
+	}
+	var ret [][]byte
+	p := data[6 : len(data)-1]
+	for len(p) > 0 {
+		enc := p[0]
+		var size, header int
+		var value int64
+		isInt := true
+		switch {
+		case enc&0x80 == 0:
+			size, header, value = 0, 1, int64(enc&0x7F)
+		case enc&0xC0 == 0x80:
+			size, header, isInt = int(enc&0x3F), 1, false
+		case enc&0xE0 == 0xC0:
+			if len(p) < 2 {
+				return nil, ErrBadDataFormat
+			}
+			size, header = 0, 2
+			value = int64(uint64(enc&0x1F)<<8 | uint64(p[1]))
+			if value >= 1<<12 {
+				value -= 1 << 13
+			}
+		case enc&0xF0 == 0xE0:
+			if len(p) < 2 {
+				return nil, ErrBadDataFormat
+			}
+			size, header, isInt = int(enc&0x0F)<<8|int(p[1]), 2, false
+		case enc == 0xF0:
+			if len(p) < 5 {
+				return nil, ErrBadDataFormat
+			}
+			size, header, isInt = int(binary.LittleEndian.Uint32(p[1:])), 5, false
+		case enc >= 0xF1 && enc <= 0xF4:
+			size, header = []int{2, 3, 4, 8}[enc-0xF1], 1
+		default:
+			return nil, ErrBadDataFormat
+		}
+		if size < 0 || len(p) < header+size {
+			return nil, ErrBadDataFormat
+		}
+		v := p[header : header+size]
+		backlen := listpackBacklenSize(header + size)
+		if len(p) < header+size+backlen {
+			return nil, ErrBadDataFormat
+		}
+		p = p[header+size+backlen:]
+		if !isInt {
+			ret = append(ret, v)
+			continue
+		}
+		if size > 0 {
+			//sign extend the little endian integer of size bytes
+			u := uint64(0)
+			for i := size - 1; i >= 0; i-- {
+				u = u<<8 | uint64(v[i])
+			}
+			shift := uint(64 - 8*size)
+			value = int64(u<<shift) >> shift
+		}
+		ret = append(ret, strconv.AppendInt(nil, value, 10))
+	}
+	return ret, nil
+}
+
+func listpackBacklenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	}
+	return 5
+}
+
+//intsetEntries returns the members of an intset as decimal strings
+func intsetEntries(data []byte) ([][]byte, error) {
+	if len(data) < 8 {
+		return nil, ErrBadDataFormat
+	}
+	width := int(binary.LittleEndian.Uint32(data))
+	count := int(binary.LittleEndian.Uint32(data[4:]))
+	if (width != 2 && width != 4 && width != 8) || count < 0 || len(data) != 8+width*count {
+		return nil, ErrBadDataFormat
+	}
+	ret := make([][]byte, 0, count)
+	for p := data[8:]; len(p) > 0; p = p[width:] {
+		var value int64
+		switch width {
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			value = int64(binary.LittleEndian.Uint64(p))
+		}
+		ret = append(ret, strconv.AppendInt(nil, value, 10))
+	}
+	return ret, nil
+}
+
+//listpackWriter builds a listpack, values are written as strings or integers the way redis encodes them
+type listpackWriter struct {
+	buf   []byte
+	count int
+}
+
+func newListpackWriter() *listpackWriter {
+	return &listpackWriter{buf: make([]byte, 6)}
+}
+
+func (w *listpackWriter) appendInt(v int64) {
+	start := len(w.buf)
+	switch {
+	case v >= 0 && v <= 127:
+		w.buf = append(w.buf, byte(v))
+	case v >= -4096 && v <= 4095:
+		u := uint64(v) & 0x1FFF
+		w.buf = append(w.buf, 0xC0|byte(u>>8), byte(u))
+	default:
+		enc, size := byte(0xF4), 8
+		switch {
+		case v >= math.MinInt16 && v <= math.MaxInt16:
+			enc, size = 0xF1, 2
+		case v >= -1<<23 && v < 1<<23:
+			enc, size = 0xF2, 3
+		case v >= math.MinInt32 && v <= math.MaxInt32:
+			enc, size = 0xF3, 4
+		}
+		w.buf = append(w.buf, enc)
+		for i := 0; i < size; i++ {
+			w.buf = append(w.buf, byte(uint64(v)>>(8*uint(i))))
+		}
+	}
+	w.appendBacklen(len(w.buf) - start)
+}
+
+func (w *listpackWriter) appendString(s []byte) {
+	if v, err := strconv.ParseInt(string(s), 10, 64); err == nil && string(strconv.AppendInt(nil, v, 10)) == string(s) {
+		w.appendInt(v)
+		return
+	}
+	start := len(w.buf)
+	switch {
+	case len(s) < 64:
+		w.buf = append(w.buf, 0x80|byte(len(s)))
+	case len(s) < 4096:
+		w.buf = append(w.buf, 0xE0|byte(len(s)>>8), byte(len(s)))
+	default:
+		w.buf = append(w.buf, 0xF0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(w.buf[len(w.buf)-4:], uint32(len(s)))
+	}
+	w.buf = append(w.buf, s...)
+	w.appendBacklen(len(w.buf) - start)
+}
+
+//appendBacklen writes the length of the entry so the listpack can be walked backwards
+func (w *listpackWriter) appendBacklen(n int) {
+	size := listpackBacklenSize(n)
+	for i := size - 1; i >= 0; i-- {
+		b := byte(n>>(7*uint(i))) & 0x7F
+		if i != size-1 {
+			b |= 0x80
+		}
+		w.buf = append(w.buf, b)
+	}
+	w.count++
+}
+
+func (w *listpackWriter) bytes() []byte {
+	w.buf = append(w.buf, 0xFF)
+	binary.LittleEndian.PutUint32(w.buf, uint32(len(w.buf)))
+	count := w.count
+	if count > math.MaxUint16 {
+		count = math.MaxUint16
+	}
+	binary.LittleEndian.PutUint16(w.buf[4:], uint16(count))
+	return w.buf
+}
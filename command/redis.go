@@ -3,71 +3,198 @@ package command
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/Zealous-w/tacodb/store"
-	"github.com/Zealous-w/tacodb/util"
 	"time"
 )
 
 const (
-	KEY_TYPE_STRING     = 'C' //string
-	KEY_TYPE_HASH       = 'H' //hash
-	KEY_TYPE_HASH_FIELD = 'I' //hash field
-	KEY_TYPE_LIST       = 'L' //list
-	KEY_TYPE_LIST_FIELD = 'M' //list field
-	KEY_TYPE_SET        = 'S' //set
-	KEY_TYPE_SET_FIELD  = 'T' //set field
-	KEY_TYPE_ZSET       = 'Z' //zset
-	KEY_TYPE_ZSET_FIELD = 'A' //zset field
-	KEY_TYPE_ZSET_SCORE = 'B' //zset score field
+	KEY_TYPE_STRING          = 'C' //string
+	KEY_TYPE_HASH            = 'H' //hash
+	KEY_TYPE_HASH_FIELD      = 'I' //hash field
+	KEY_TYPE_LIST            = 'L' //list
+	KEY_TYPE_LIST_FIELD      = 'M' //list field
+	KEY_TYPE_SET             = 'S' //set
+	KEY_TYPE_SET_FIELD       = 'T' //set field
+	KEY_TYPE_ZSET            = 'Z' //zset
+	KEY_TYPE_ZSET_FIELD      = 'A' //zset field
+	KEY_TYPE_ZSET_SCORE      = 'B' //zset score field
+	KEY_TYPE_STREAM          = 'X' //stream
+	KEY_TYPE_STREAM_FIELD    = 'Y' //stream entry
+	KEY_TYPE_STREAM_GROUP    = 'G' //stream consumer group
+	KEY_TYPE_STREAM_PEL      = 'P' //stream group pending entry
+	KEY_TYPE_STREAM_CONSUMER = 'Q' //stream group consumer
+	KEY_TYPE_SLOT            = 'K' //cluster hash slot index
+)
+
+const (
+	KEY_TYPE_SYSTEM = 0xFF //internal records, never visible as keys
 )
 
 const (
 	VALUE_META_LEN = 4
+	DB_PREFIX_LEN  = 2 //every key starts with the big endian id of its physical database
 )
 
+//KEY_META_TYPES lists the key types holding a top level key, in byte order
+var KEY_META_TYPES = []byte{KEY_TYPE_STRING, KEY_TYPE_HASH, KEY_TYPE_LIST, KEY_TYPE_SET, KEY_TYPE_STREAM, KEY_TYPE_ZSET}
+
 var (
 	ErrKeyTypeError = errors.New("key type is invalid")
 	ErrKeyNotFound  = errors.New("key not found")
+	ErrScoreRange   = errors.New("min or max is not an unsigned integer")
+	ErrLexRange     = errors.New("min or max not valid string range item")
+	ErrSyntax       = errors.New("syntax error")
+	ErrNotInteger   = errors.New("value is not an integer or out of range")
+	ErrNoSuchKey    = errors.New("no such key")
+	ErrSameObject   = errors.New("source and destination objects are the same")
+	ErrDBIndex      = errors.New("DB index is out of range")
 )
 
+//RedisCommand runs commands against one logical database, Select returns views of the
+//other databases sharing the same stores
 type RedisCommand struct {
-	db     []store.IStore
+	db       []store.IStore
+	dbs      *databases
+	index    int    //selected logical database, -1 to address phys directly
+	phys     uint16 //physical database used when index is -1
+	lazy     *lazyFree
+	gens     *generations
+	watches  *watchTable
+	events   *notifier     //keyspace notifications, shared by all views
+	multi    []*multiStore //write buffers of a MULTI transaction, nil outside one
+	cdc      bool          //the shards keep a change log
+	origin   string        //command the transactions of c are logged as
+	sharding string        //name of the function mapping keys to shards
+	shard    shardFunc
+	clock    int64 //unix milliseconds the view reads the time from, 0 for the system clock
 }
 
-func NewRedisCommand(db []store.IStore) *RedisCommand {
-	return &RedisCommand{
-		db: db,
+//NewRedisCommand serves the shards db, sharding is the function spreading keys over them in
+//a new data directory, empty for SHARDING_DEFAULT
+func NewRedisCommand(db []store.IStore, databases int, sharding string) *RedisCommand {
+	c, err := openRedisCommand(db, databases, sharding)
+	if err != nil {
+		panic(err.Error())
+	}
+	c.ReclaimDropped()
+	c.lazy.start(c)
+	return c
+}
+
+//openRedisCommand loads the tables of the shards db and completes the operations a crash
+//interrupted, without starting the background tasks
+func openRedisCommand(db []store.IStore, databases int, sharding string) (*RedisCommand, error) {
+	sharding, err := loadSharding(db, sharding)
+	if err != nil {
+		return nil, fmt.Errorf("load sharding failed, err=%+v", err)
+	}
+	dbs, err := loadDatabases(db, databases)
+	if err != nil {
+		return nil, fmt.Errorf("load databases failed, err=%+v", err)
+	}
+	watches := newWatchTable()
+	gens := newGenerations(db)
+	counted := make([]store.IStore, 0, len(db))
+	for _, v := range db {
+		counted = append(counted, newCountedStore(v, dbs.physicals(), watches, gens))
 	}
+	//the table is written through the counted store too, so it reaches the change log
+	dbs.db = counted[0]
+	c := &RedisCommand{
+		db:       counted,
+		dbs:      dbs,
+		lazy:     newLazyFree(),
+		gens:     gens,
+		watches:  watches,
+		events:   &notifier{},
+		sharding: sharding,
+		shard:    shardFuncs[sharding],
+	}
+	if err := c.Recover(); err != nil {
+		return nil, fmt.Errorf("recover interrupted operations failed, err=%+v", err)
+	}
+	return c, nil
 }
 
 func (c *RedisCommand) DB(key []byte) store.IStore {
 	if len(c.db) == 0 {
 		return nil
 	}
-	//index := util.BKDRHash(key) & uint32(len(c.db) - 1)
-	index := util.BKDRHash(key) % uint32(len(c.db))
+	index := c.Shard(key)
+	if c.origin != "" {
+		if s, ok := c.db[index].(*countedStore); ok {
+			return &originStore{countedStore: s, origin: c.origin}
+		}
+	}
 	return c.db[index]
 }
 
-func (*RedisCommand) EncodeKey(tp byte, key []byte) []byte {
-	ret := make([]byte, len(key)+1)
+//Shard returns the index of the shard key is stored in
+func (c *RedisCommand) Shard(key []byte) int {
+	return c.shard(key, len(c.db))
+}
+
+//physical returns the id of the physical database all keys of c are prefixed with
+func (c *RedisCommand) physical() uint16 {
+	if c.index < 0 {
+		return c.phys
+	}
+	return c.dbs.physicalOf(c.index)
+}
+
+//WithClock returns a view of c reading the time from the unix milliseconds ms instead of the
+//system clock, so expiry, ttls and stream IDs come out the same wherever the view runs
+func (c *RedisCommand) WithClock(ms int64) *RedisCommand {
+	v := *c
+	v.clock = ms
+	return &v
+}
+
+func (c *RedisCommand) now() time.Time {
+	if c.clock != 0 {
+		return time.Unix(c.clock/1000, c.clock%1000*int64(time.Millisecond))
+	}
+	return time.Now()
+}
+
+func encodeDBPrefix(phys uint16) []byte {
+	ret := make([]byte, DB_PREFIX_LEN)
+	binary.BigEndian.PutUint16(ret, phys)
+	return ret
+}
+
+//allocKey allocates an encoded key starting with the database prefix, body is the part after it
+func (c *RedisCommand) allocKey(size int) (key, body []byte) {
+	key = make([]byte, DB_PREFIX_LEN+size)
+	binary.BigEndian.PutUint16(key, c.physical())
+	return key, key[DB_PREFIX_LEN:]
+}
+
+func (c *RedisCommand) EncodeKey(tp byte, key []byte) []byte {
+	buf, ret := c.allocKey(len(key) + 1)
 	ret[0] = tp
 	copy(ret[1:], key)
-	return ret
+	return buf
 }
 
-func (*RedisCommand) EncodeValue(value []byte, ttl uint32) []byte {
-	ret := make([]byte, len(value)+VALUE_META_LEN)
+func (c *RedisCommand) EncodeValue(value []byte, ttl uint32) []byte {
 	timestamp := uint32(0)
 	if ttl > 0 {
-		timestamp = uint32(time.Now().Unix()) + ttl
+		timestamp = uint32(c.now().Unix()) + ttl
 	}
+	return c.encodeValueAt(value, timestamp)
+}
+
+//encodeValueAt prefixes value with an absolute unix expire time, 0 means it never expires
+func (*RedisCommand) encodeValueAt(value []byte, timestamp uint32) []byte {
+	ret := make([]byte, len(value)+VALUE_META_LEN)
 	binary.LittleEndian.PutUint32(ret, timestamp)
 	copy(ret[4:], value)
 	return ret
 }
 
-func (*RedisCommand) DecodeValue(value []byte) (bool, []byte) {
+func (c *RedisCommand) DecodeValue(value []byte) (bool, []byte) {
 	if len(value) == 0 {
 		return false, nil
 	}
@@ -76,8 +203,19 @@ func (*RedisCommand) DecodeValue(value []byte) (bool, []byte) {
 		return false, value[4:]
 	}
 
-	if timestamp < uint32(time.Now().Unix()) {
+	if timestamp < uint32(c.now().Unix()) {
 		return true, nil
 	}
 	return false, value[4:]
 }
+
+//keyType returns the type of a live key, 0 if it does not exist or has expired
+func (c *RedisCommand) keyType(db store.IStore, t interface{}, key []byte) byte {
+	for _, tp := range KEY_META_TYPES {
+		expire, data := c.DecodeValue(db.Get(t, c.EncodeKey(tp, key)))
+		if data != nil && !expire {
+			return tp
+		}
+	}
+	return 0
+}
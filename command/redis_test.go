@@ -0,0 +1,51 @@
+package command
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//openTestCommand serves the LevelDB data directory path, the returned function closes it
+func openTestCommand(t *testing.T, path string, shards int) (*RedisCommand, func()) {
+	t.Helper()
+	db, closeDB := store.NewDBStore("leveldb", path, shards)
+	var once sync.Once
+	close := func() { once.Do(closeDB) }
+	t.Cleanup(close)
+	return NewRedisCommand(db, DATABASES_DEFAULT, ""), close
+}
+
+//newTestCommand serves a new data directory of shards shards, 0 for the default
+func newTestCommand(t *testing.T, shards int) *RedisCommand {
+	t.Helper()
+	c, _ := openTestCommand(t, t.TempDir(), shards)
+	return c
+}
+
+//newEngineCommand serves a new data directory of the storage engine
+func newEngineCommand(t *testing.T, engine string) *RedisCommand {
+	t.Helper()
+	db, closeDB := store.NewDBStore(engine, t.TempDir(), 0)
+	t.Cleanup(closeDB)
+	return NewRedisCommand(db, DATABASES_DEFAULT, "")
+}
+
+func TestEncodeKey(t *testing.T) {
+	c := newTestCommand(t, 0)
+	tests := []struct {
+		tp   byte
+		key  string
+		want string
+	}{
+		{KEY_TYPE_STRING, "k", "\x00\x00Ck"},
+		{KEY_TYPE_HASH, "", "\x00\x00H"},
+		{KEY_TYPE_ZSET, "a:b", "\x00\x00Za:b"},
+	}
+	for _, tt := range tests {
+		if got := string(c.EncodeKey(tt.tp, []byte(tt.key))); got != tt.want {
+			t.Errorf("EncodeKey(%c, %q) = %q, want %q", tt.tp, tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package command
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//A replica copies the rows of the primary shard by shard. A full sync notes where the change
+//log of every shard ends, then copies the rows while writes go on and replays the log from
+//the noted positions. Replaying sets every row to its value after each write, so rows copied
+//late come out right as well. Afterwards the replica keeps applying entries as they are logged,
+//each in one transaction with the position reached, so a reconnect resumes where it stopped
+const (
+	REPL_SNAPSHOT_BATCH = 1024 //rows per snapshot batch
+)
+
+//replOffsetKey holds the replication id of the primary and the next entry of the shard to apply,
+//it is local to the replica and never logged
+var replOffsetKey = []byte{KEY_TYPE_SYSTEM, 'r', 'e', 'p', 'l'}
+
+var ErrReplGap = errors.New("change log entry out of order")
+
+//replicated reports whether a row is copied to replicas
+func replicated(row []byte) bool {
+	return !bytes.HasPrefix(row, changeLogPrefix) && !bytes.Equal(row, replOffsetKey) && !bytes.Equal(row, raftAppliedKey) &&
+		!isSlotRow(row) && !bytes.Equal(row, slotIndexKey) && !bytes.Equal(row, shardingKey)
+}
+
+//ReadChangeLog returns the encoded entries of the change log of shard from seq on, like ReadChanges
+func (c *RedisCommand) ReadChangeLog(shard int, seq uint64, count int) ([][]byte, <-chan struct{}, error) {
+	l, err := c.changeLogOf(shard)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, wait, err := l.read(seq, count)
+	if err != nil {
+		return nil, nil, err
+	}
+	ret := make([][]byte, 0, len(rows))
+	for _, v := range rows {
+		ret = append(ret, v.V1)
+	}
+	return ret, wait, nil
+}
+
+//SnapshotRows returns up to count replicated rows of shard stored after the row after, all
+//from the first one when after is nil
+func (c *RedisCommand) SnapshotRows(shard int, after []byte, count int) []*store.Pair {
+	db := c.direct().db[shard]
+	start := []byte{}
+	if after != nil {
+		start = append(append(start, after...), 0)
+	}
+	var ret []*store.Pair
+	for len(ret) < count {
+		want := count - len(ret)
+		rows := db.RangeLimit(start, nil, want)
+		for _, v := range rows {
+			if replicated(v.V0) {
+				ret = append(ret, v)
+			}
+		}
+		if len(rows) < want {
+			break
+		}
+		start = append(append([]byte{}, rows[len(rows)-1].V0...), 0)
+	}
+	return ret
+}
+
+//ReplicationOffsets returns the primary the data was copied from and the next entry to apply
+//per shard. The id is empty when some shard never finished a full sync from it
+func (c *RedisCommand) ReplicationOffsets() (replid string, offsets []uint64) {
+	for i, db := range c.direct().db {
+		var data []byte
+		_ = db.Transaction(func(t interface{}) error {
+			data = db.Get(t, replOffsetKey)
+			return nil
+		})
+		if len(data) < 8 || (i > 0 && string(data[8:]) != replid) {
+			return "", nil
+		}
+		replid = string(data[8:])
+		offsets = append(offsets, binary.BigEndian.Uint64(data))
+	}
+	return
+}
+
+func encodeReplOffset(replid string, offset uint64) []byte {
+	ret := make([]byte, 8+len(replid))
+	binary.BigEndian.PutUint64(ret, offset)
+	copy(ret[8:], replid)
+	return ret
+}
+
+//ResetReplica deletes every row before a full sync, the change log of the replica itself is kept
+func (c *RedisCommand) ResetReplica() error {
+	for _, db := range c.direct().db {
+		var last []byte
+		for {
+			rows := c.snapshotAfter(db, last)
+			if len(rows) == 0 {
+				break
+			}
+			last = rows[len(rows)-1].V0
+			err := db.Transaction(func(t interface{}) error {
+				for _, v := range rows {
+					if bytes.HasPrefix(v.V0, changeLogPrefix) || bytes.Equal(v.V0, slotIndexKey) || bytes.Equal(v.V0, shardingKey) {
+						continue
+					}
+					if err := db.Del(t, v.V0); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return c.dbs.reload()
+}
+
+func (c *RedisCommand) snapshotAfter(db store.IStore, last []byte) []*store.Pair {
+	start := []byte{}
+	if last != nil {
+		start = append(append(start, last...), 0)
+	}
+	return db.RangeLimit(start, nil, REPL_SNAPSHOT_BATCH)
+}
+
+//ApplySnapshot writes rows of a full sync into shard
+func (c *RedisCommand) ApplySnapshot(shard int, rows []*store.Pair) error {
+	db := c.direct().db[shard]
+	return c.transaction(db, func(t interface{}) error {
+		for _, v := range rows {
+			if err := db.Put(t, v.V0, v.V1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//FinishSnapshot records where replaying the change log of each shard starts after a full sync
+func (c *RedisCommand) FinishSnapshot(replid string, offsets []uint64) error {
+	for i, db := range c.direct().db {
+		err := db.Transaction(func(t interface{}) error {
+			return db.Put(t, replOffsetKey, encodeReplOffset(replid, offsets[i]))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return c.dbs.reload()
+}
+
+//ApplyChangeEntry applies the entry seq of the change log of shard on the primary replid. It
+//returns the keys written by logical database, and whether function libraries were, so they can be reloaded
+func (c *RedisCommand) ApplyChangeEntry(replid string, shard int, seq uint64, data []byte) (keys map[int][][]byte, functions bool, err error) {
+	e, err := decodeChangeEntry(seq, data)
+	if err != nil {
+		return nil, false, err
+	}
+	db := c.direct().db[shard]
+	databases := false
+	err = c.Origin(e.Command).transaction(db, func(t interface{}) error {
+		current := db.Get(t, replOffsetKey)
+		if len(current) < 8 || string(current[8:]) != replid || binary.BigEndian.Uint64(current) != seq {
+			return ErrReplGap
+		}
+		for _, v := range e.Changes {
+			row := v.row()
+			var err error
+			if v.Value == nil {
+				err = db.Del(t, row)
+			} else {
+				err = db.Put(t, row, v.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return db.Put(t, replOffsetKey, encodeReplOffset(replid, seq+1))
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	for _, v := range e.Changes {
+		row := v.row()
+		switch {
+		case bytes.Equal(row, databasesKey) || bytes.HasPrefix(row, droppedPrefix):
+			databases = true
+		case bytes.HasPrefix(row, functionPrefix):
+			functions = true
+		}
+	}
+	if databases {
+		err = c.dbs.reload()
+	}
+	keys = make(map[int][][]byte)
+	for _, v := range e.Changes {
+		if v.Key == nil {
+			continue
+		}
+		if index := c.IndexOf(v.Phys); index >= 0 {
+			keys[index] = append(keys[index], v.Key)
+		}
+	}
+	return keys, functions, err
+}
+
+//row returns the row as stored, with its database prefix
+func (v *Change) row() []byte {
+	if v.Row == nil {
+		return v.system
+	}
+	ret := make([]byte, DB_PREFIX_LEN+len(v.Row))
+	binary.BigEndian.PutUint16(ret, v.Phys)
+	copy(ret[DB_PREFIX_LEN:], v.Row)
+	return ret
+}
@@ -0,0 +1,172 @@
+package command
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//Keys are spread over the shards by a sharding function chosen when the data directory is
+//created. It is recorded in shardingKey of shard 0, reading the directory with another one
+//would lose its keys. Every function but legacy only hashes the {tag} of a key having one,
+//like redis cluster, so keys sharing a tag share a shard: a transaction or a command on them
+//commits in one store transaction. legacy is bkdr without tags, the mapping of directories
+//created before the function could be chosen. The shard of a key depends on the number of
+//shards as well, recorded by the store, Reshard moves the keys when either changes
+const (
+	SHARDING_DEFAULT = "bkdr"
+	SHARDING_LEGACY  = "legacy"
+)
+
+var shardingKey = []byte{KEY_TYPE_SYSTEM, 's', 'h', 'a', 'r', 'd'}
+
+var ErrSharding = errors.New("unknown sharding function")
+
+//shardFunc returns the shard of key among n
+type shardFunc func(key []byte, n int) int
+
+var shardFuncs = map[string]shardFunc{
+	SHARDING_LEGACY: func(key []byte, n int) int {
+		return int(util.BKDRHash(key) % uint32(n))
+	},
+	"bkdr": func(key []byte, n int) int {
+		return int(util.BKDRHash(util.HashTag(key)) % uint32(n))
+	},
+	"crc16": func(key []byte, n int) int {
+		return util.HashSlot(key) % n
+	},
+	"xxhash": func(key []byte, n int) int {
+		return int(util.XXHash64(util.HashTag(key)) % uint64(n))
+	},
+	"jump": func(key []byte, n int) int {
+		return util.JumpHash(util.XXHash64(util.HashTag(key)), n)
+	},
+}
+
+//loadSharding returns the sharding function of the directory of db. name is recorded for a
+//new directory, an empty name takes the one of the directory or SHARDING_DEFAULT
+func loadSharding(db []store.IStore, name string) (string, error) {
+	if _, ok := shardFuncs[name]; name != "" && !ok {
+		return "", ErrSharding
+	}
+	var current []byte
+	_ = db[0].Transaction(func(t interface{}) error {
+		current = db[0].Get(t, shardingKey)
+		return nil
+	})
+	if current == nil {
+		current = []byte(name)
+		if name == "" {
+			current = []byte(SHARDING_DEFAULT)
+		}
+		for _, v := range db {
+			if len(v.RangeLimit([]byte{}, nil, 1)) > 0 {
+				current = []byte(SHARDING_LEGACY)
+				break
+			}
+		}
+		err := db[0].Transaction(func(t interface{}) error {
+			return db[0].Put(t, shardingKey, current)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, ok := shardFuncs[string(current)]; !ok {
+		return "", ErrSharding
+	}
+	if name != "" && name != string(current) {
+		return "", fmt.Errorf("the data directory is sharded by %s, not %s", current, name)
+	}
+	return string(current), nil
+}
+
+//Sharding returns the name of the function mapping keys to shards
+func (c *RedisCommand) Sharding() string {
+	return c.sharding
+}
+
+//Reshard copies the rows of the shards from into the shards to, the meta and field rows of a
+//key to the shard the sharding function maps it to among len(to). sharding replaces the
+//function of from, empty keeps it. Interrupted cross shard operations are completed first.
+//The change logs, replication offsets and hash slot index are kept per shard and not copied:
+//replicas and CDC consumers start over from a full sync, cluster mode rebuilds the index
+func Reshard(from, to []store.IStore, databases int, sharding string) error {
+	if _, ok := shardFuncs[sharding]; sharding != "" && !ok {
+		return ErrSharding
+	}
+	c, err := openRedisCommand(from, databases, "")
+	if err != nil {
+		return err
+	}
+	if sharding == "" {
+		sharding = c.sharding
+	}
+	shard := shardFuncs[sharding]
+	for _, db := range from {
+		start := []byte{}
+		for {
+			rows := db.RangeLimit(start, nil, REPL_SNAPSHOT_BATCH)
+			if len(rows) == 0 {
+				break
+			}
+			batch := make([][]*store.Pair, len(to))
+			for _, v := range rows {
+				if i, ok := reshardRow(shard, v.V0, len(to)); ok {
+					batch[i] = append(batch[i], v)
+				}
+			}
+			for i, v := range batch {
+				if err := putRows(to[i], v); err != nil {
+					return err
+				}
+			}
+			start = append(append([]byte{}, rows[len(rows)-1].V0...), 0)
+		}
+	}
+	return to[0].Transaction(func(t interface{}) error {
+		return to[0].Put(t, shardingKey, []byte(sharding))
+	})
+}
+
+//reshardRow returns the shard of row among n, false for a row not copied
+func reshardRow(shard shardFunc, row []byte, n int) (int, bool) {
+	switch {
+	case isSlotRow(row), bytes.Equal(row, slotIndexKey), bytes.HasPrefix(row, changeLogPrefix),
+		bytes.Equal(row, replOffsetKey), bytes.Equal(row, shardingKey):
+		return 0, false
+	case bytes.HasPrefix(row, lazyFreePrefix):
+		_, key, _, ok := decodeLazyFreeRecord(row)
+		if !ok {
+			return 0, false
+		}
+		return shard(key, n), true
+	case isGenerationRow(row):
+		if len(row) < len(generationPrefix)+DB_PREFIX_LEN {
+			return 0, false
+		}
+		return shard(row[len(generationPrefix)+DB_PREFIX_LEN:], n), true
+	}
+	if owner := watchOwner(row); owner != nil {
+		return shard(owner[DB_PREFIX_LEN:], n), true
+	}
+	//the databases table, the functions and the raft position live in the first shard
+	return 0, true
+}
+
+func putRows(db store.IStore, rows []*store.Pair) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	return db.Transaction(func(t interface{}) error {
+		for _, v := range rows {
+			if err := db.Put(t, v.V0, v.V1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
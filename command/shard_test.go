@@ -0,0 +1,247 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//fillReshard writes keys of every type to the databases 0 and 2 of c
+func fillReshard(t *testing.T, c *RedisCommand) {
+	t.Helper()
+	for _, index := range []int{0, 2} {
+		db, err := c.Select(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("s%d", i))
+			if err := db.Set(key, key, uint32(i%2)*3600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("{tag}%d", i))
+			var err error
+			switch i % 5 {
+			case 0:
+				err = db.HSet(key, []byte("f"), key, []byte("g"), []byte("v"))
+			case 1:
+				err = db.SAdd(key, []byte("a"), []byte("b"), key)
+			case 2:
+				err = db.ZAdd(key, uint64(i), key)
+			case 3:
+				err = db.RPush(key, []byte("a"), key)
+			case 4:
+				_, err = db.XAdd(key, &StreamAddOption{ID: []byte("*")}, [][]byte{[]byte("f"), key})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		//a collection recreated after UNLINK has field rows of a later generation
+		if err := db.HSet([]byte("recreated"), []byte("old"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		db.Unlink([]byte("recreated"))
+		if err := db.HSet([]byte("recreated"), []byte("new"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//dumpAll returns the DUMP payload and expire time of every key of every database by name
+func dumpAll(t *testing.T, c *RedisCommand) map[string]string {
+	t.Helper()
+	ret := make(map[string]string)
+	for index := 0; index < DATABASES_DEFAULT; index++ {
+		db, err := c.Select(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := db.Keys([]byte("*"))
+		sort.Slice(keys, func(i, j int) bool { return string(keys[i]) < string(keys[j]) })
+		for _, k := range keys {
+			payload, err := db.Dump(k)
+			if err != nil || payload == nil {
+				t.Fatalf("Dump(%s) = %v", k, err)
+			}
+			ret[fmt.Sprintf("%d/%s", index, k)] = fmt.Sprintf("%q %d", payload, db.ExpireAt(k))
+		}
+		if size := db.DBSize(); size != int64(len(keys)) {
+			t.Fatalf("DBSize() = %d of database %d, %d keys", size, index, len(keys))
+		}
+	}
+	return ret
+}
+
+func TestReshardRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		shards   []int //the first is the count of the new directory
+		sharding string
+	}{
+		{"grow", []int{4, 7}, ""},
+		{"shrink", []int{8, 3}, ""},
+		{"round trip", []int{4, 9, 4}, ""},
+		{"through one shard", []int{5, 1, 5}, ""},
+		{"change function", []int{4, 4}, "jump"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir()
+			c, close := openTestCommand(t, path, tt.shards[0])
+			fillReshard(t, c)
+			want := dumpAll(t, c)
+			sharding := c.Sharding()
+			close()
+
+			for _, n := range tt.shards[1:] {
+				err := store.Reshard("leveldb", path, n, func(from, to []store.IStore) error {
+					return Reshard(from, to, DATABASES_DEFAULT, tt.sharding)
+				})
+				if err != nil {
+					t.Fatalf("Reshard(%d) = %v", n, err)
+				}
+				if tt.sharding != "" {
+					sharding = tt.sharding
+				}
+				c, close := openTestCommand(t, path, 0)
+				if c.Shards() != n || c.Sharding() != sharding {
+					t.Fatalf("%d shards sharded by %s, want %d by %s", c.Shards(), c.Sharding(), n, sharding)
+				}
+				got := dumpAll(t, c)
+				if len(got) != len(want) {
+					t.Fatalf("%d keys after resharding to %d, want %d", len(got), n, len(want))
+				}
+				for k, v := range want {
+					if got[k] != v {
+						t.Fatalf("%s = %s after resharding to %d, want %s", k, got[k], n, v)
+					}
+				}
+				//the keys are written where the new layout looks for them
+				if err := c.HSet([]byte("recreated"), []byte("added"), []byte("v")); err != nil {
+					t.Fatal(err)
+				}
+				if fields, err := c.HGetAll([]byte("recreated")); err != nil || len(fields) != 2 {
+					t.Fatalf("HGETALL recreated = %d fields, %v", len(fields), err)
+				}
+				if _, err := c.HDel([]byte("recreated"), []byte("added")); err != nil {
+					t.Fatal(err)
+				}
+				close()
+			}
+		})
+	}
+}
+
+func TestReshardUnknownSharding(t *testing.T) {
+	path := t.TempDir()
+	_, close := openTestCommand(t, path, 2)
+	close()
+	err := store.Reshard("leveldb", path, 3, func(from, to []store.IStore) error {
+		return Reshard(from, to, DATABASES_DEFAULT, "nosuchfunction")
+	})
+	if err != ErrSharding {
+		t.Fatalf("Reshard() = %v", err)
+	}
+	c, _ := openTestCommand(t, path, 0)
+	if c.Shards() != 2 {
+		t.Fatalf("%d shards after a failed reshard", c.Shards())
+	}
+}
+
+func TestShardFuncs(t *testing.T) {
+	keys := []string{"", "a", "user1000", "{user1000}.following", "{user1000}.followers", "foo{}{bar}", "x{y"}
+	for name, shard := range shardFuncs {
+		for _, n := range []int{1, 3, 16} {
+			for _, k := range keys {
+				if i := shard([]byte(k), n); i < 0 || i >= n {
+					t.Fatalf("%s(%q, %d) = %d", name, k, n, i)
+				}
+			}
+		}
+	}
+	tests := []struct {
+		sharding string
+		a, b     string
+		same     bool
+	}{
+		//keys sharing a tag share a shard
+		{"bkdr", "{user1000}.following", "{user1000}.followers", true},
+		{"crc16", "{user1000}.following", "{user1000}.followers", true},
+		{"xxhash", "{user1000}.following", "{user1000}.followers", true},
+		{"jump", "{user1000}.following", "{user1000}.followers", true},
+		{"bkdr", "{user1000}.following", "user1000", true},
+		{"jump", "a{x}b", "c{x}d", true},
+		//legacy hashes the whole key
+		{SHARDING_LEGACY, "{user1000}.following", "{user1000}.followers", false},
+		//an empty tag does not count
+		{"xxhash", "{}a", "{}b", false},
+	}
+	for _, tt := range tests {
+		shard := shardFuncs[tt.sharding]
+		a, b := shard([]byte(tt.a), 64), shard([]byte(tt.b), 64)
+		if (a == b) != tt.same {
+			t.Errorf("%s: %q in shard %d, %q in shard %d", tt.sharding, tt.a, a, tt.b, b)
+		}
+	}
+	if got, want := shardFuncs[SHARDING_LEGACY]([]byte("{a}b"), 7), int(util.BKDRHash([]byte("{a}b"))%7); got != want {
+		t.Errorf("legacy({a}b, 7) = %d, want %d", got, want)
+	}
+	if got, want := shardFuncs["crc16"]([]byte("foo{hello}zz"), 16), 866%16; got != want {
+		t.Errorf("crc16(foo{hello}zz, 16) = %d, want %d", got, want)
+	}
+}
+
+func TestLoadSharding(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     bool     //a row is written before the function is recorded
+		sharding []string //the functions the directory is opened with in turn
+		want     string
+		err      string
+	}{
+		{"default", false, []string{""}, SHARDING_DEFAULT, ""},
+		{"chosen", false, []string{"jump"}, "jump", ""},
+		{"kept", false, []string{"xxhash", ""}, "xxhash", ""},
+		{"same", false, []string{"crc16", "crc16"}, "crc16", ""},
+		{"other", false, []string{"crc16", "jump"}, "", "the data directory is sharded by crc16, not jump"},
+		{"unknown", false, []string{"nosuchfunction"}, "", ErrSharding.Error()},
+		{"existing rows", true, []string{""}, SHARDING_LEGACY, ""},
+		{"existing rows chosen", true, []string{"bkdr"}, "", "the data directory is sharded by legacy, not bkdr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, closeDB := store.NewDBStore("leveldb", t.TempDir(), 3)
+			t.Cleanup(closeDB)
+			if tt.data {
+				err := db[2].Transaction(func(t interface{}) error {
+					return db[2].Put(t, []byte("row"), []byte("v"))
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got string
+			var err error
+			for _, v := range tt.sharding {
+				if got, err = loadSharding(db, v); err != nil {
+					break
+				}
+			}
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("loadSharding() = %q, %v, want %s", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("loadSharding() = %q, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
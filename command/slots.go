@@ -0,0 +1,189 @@
+package command
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//In cluster mode every key has an index row phys | KEY_TYPE_SLOT | BE hash slot | key written
+//with its meta row, so the keys of a slot are counted and listed without walking the keyspace.
+//The index is local to each node and never replicated. slotIndexKey records that it is
+//complete, it is removed when the index is turned off so turning it on again rebuilds it
+
+var slotIndexKey = []byte{KEY_TYPE_SYSTEM, 's', 'l', 'o', 't'}
+
+func isSlotRow(row []byte) bool {
+	return len(row) > DB_PREFIX_LEN && row[0] != KEY_TYPE_SYSTEM && row[DB_PREFIX_LEN] == KEY_TYPE_SLOT
+}
+
+//slotRow returns the index row of a key given as phys-key
+func slotRow(id []byte) []byte {
+	key := id[DB_PREFIX_LEN:]
+	ret := make([]byte, DB_PREFIX_LEN+3+len(key))
+	copy(ret, id[:DB_PREFIX_LEN])
+	ret[DB_PREFIX_LEN] = KEY_TYPE_SLOT
+	binary.BigEndian.PutUint16(ret[DB_PREFIX_LEN+1:], uint16(util.HashSlot(key)))
+	copy(ret[DB_PREFIX_LEN+3:], key)
+	return ret
+}
+
+//metaOwner returns phys-key of a meta row
+func metaOwner(row []byte) []byte {
+	ret := make([]byte, 0, len(row)-1)
+	ret = append(ret, row[:DB_PREFIX_LEN]...)
+	return append(ret, row[DB_PREFIX_LEN+1:]...)
+}
+
+//indexSlots adds the index rows of the keys ct created and removes those of the keys it
+//deleted, a key only changing its type keeps its row
+func (s *countedStore) indexSlots(t interface{}, ct *countedTx) error {
+	exists := make(map[string]*[2]bool)
+	for k, v := range ct.touched {
+		id := string(metaOwner([]byte(k)))
+		e := exists[id]
+		if e == nil {
+			e = &[2]bool{}
+			exists[id] = e
+		}
+		e[0], e[1] = e[0] || v[0], e[1] || v[1]
+	}
+	for id, e := range exists {
+		var err error
+		if !e[0] && e[1] {
+			err = s.IStore.Put(t, slotRow([]byte(id)), []byte{})
+		} else if e[0] && !e[1] {
+			err = s.IStore.Del(t, slotRow([]byte(id)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *countedStore) slotIndexed() bool {
+	return atomic.LoadInt32(&s.slots) == 1
+}
+
+//buildSlotIndex drops the index rows left from an earlier run, then writes one per meta row
+func (s *countedStore) buildSlotIndex() error {
+	err := s.walkRows(func(t interface{}, row []byte) error {
+		if isSlotRow(row) {
+			return s.IStore.Del(t, row)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = s.walkRows(func(t interface{}, row []byte) error {
+		if isMetaKey(row) {
+			return s.IStore.Put(t, slotRow(metaOwner(row)), []byte{})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.IStore.Transaction(func(t interface{}) error {
+		return s.IStore.Put(t, slotIndexKey, []byte{})
+	})
+}
+
+//walkRows calls f on every row of the databases, a transaction per batch
+func (s *countedStore) walkRows(f func(t interface{}, row []byte) error) error {
+	start, end := []byte{}, []byte{KEY_TYPE_SYSTEM}
+	for {
+		rows := s.IStore.RangeLimit(start, end, 1024)
+		if len(rows) == 0 {
+			return nil
+		}
+		err := s.IStore.Transaction(func(t interface{}) error {
+			for _, v := range rows {
+				if err := f(t, v.V0); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		start = append(append([]byte{}, rows[len(rows)-1].V0...), 0)
+	}
+}
+
+//SetSlotIndex turns the hash slot index on or off, it is built first if it isn't complete
+func (c *RedisCommand) SetSlotIndex(enabled bool) error {
+	for _, db := range c.direct().db {
+		s, ok := db.(*countedStore)
+		if !ok {
+			continue
+		}
+		var built bool
+		_ = s.IStore.Transaction(func(t interface{}) error {
+			built = s.IStore.Get(t, slotIndexKey) != nil
+			return nil
+		})
+		if !enabled {
+			atomic.StoreInt32(&s.slots, 0)
+			if built {
+				err := s.IStore.Transaction(func(t interface{}) error {
+					return s.IStore.Del(t, slotIndexKey)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		atomic.StoreInt32(&s.slots, 1)
+		if !built {
+			if err := s.buildSlotIndex(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//slotPrefix returns the first index row of slot in the database of c
+func (c *RedisCommand) slotPrefix(slot int) []byte {
+	ret, body := c.allocKey(3)
+	body[0] = KEY_TYPE_SLOT
+	binary.BigEndian.PutUint16(body[1:], uint16(slot))
+	return ret
+}
+
+//CountKeysInSlot returns the number of keys of the hash slot, expired keys not yet removed included
+func (c *RedisCommand) CountKeysInSlot(slot int) (ret int64) {
+	start, end := c.slotPrefix(slot), c.slotPrefix(slot+1)
+	for _, db := range c.direct().db {
+		for {
+			rows := db.RangeLimit(start, end, 1024)
+			ret += int64(len(rows))
+			if len(rows) < 1024 {
+				break
+			}
+			start = append(append([]byte{}, rows[len(rows)-1].V0...), 0)
+		}
+		start = c.slotPrefix(slot)
+	}
+	return
+}
+
+//GetKeysInSlot returns up to count keys of the hash slot
+func (c *RedisCommand) GetKeysInSlot(slot, count int) (ret [][]byte) {
+	start, end := c.slotPrefix(slot), c.slotPrefix(slot+1)
+	for _, db := range c.direct().db {
+		if len(ret) >= count {
+			break
+		}
+		for _, v := range db.RangeLimit(start, end, count-len(ret)) {
+			ret = append(ret, v.V0[len(start):])
+		}
+	}
+	return
+}
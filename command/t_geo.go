@@ -0,0 +1,312 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//geo indexes are plain zsets whose score is the 52 bits geohash of the member
+
+var (
+	ErrGeoUnit   = errors.New("unsupported unit provided. please use M, KM, FT, MI")
+	ErrGeoMember = errors.New("could not decode requested zset member")
+)
+
+type GeoPoint struct {
+	Member []byte
+	Long   float64
+	Lat    float64
+	Hash   uint64
+	Dist   float64 //distance to the search center, in the unit of the query
+}
+
+type GeoSearchOption struct {
+	FromMember []byte
+	Long, Lat  float64
+	ByBox      bool
+	Radius     float64 //meters, BYRADIUS
+	Width      float64 //meters, BYBOX
+	Height     float64
+	Unit       float64 //meters per unit
+	Sort       int     //0 unsorted, 1 ASC, -1 DESC
+	Count      int
+	Any        bool
+	WithCoord  bool
+	WithDist   bool
+	WithHash   bool
+	StoreDist  bool
+}
+
+func GeoParseUnit(arg []byte) (float64, error) {
+	switch strings.ToLower(string(arg)) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, ErrGeoUnit
+}
+
+func GeoParseLongLat(long, lat []byte) (float64, float64, error) {
+	x, err := strconv.ParseFloat(string(long), 64)
+	if err != nil {
+		return 0, 0, errors.New("value is not a valid float")
+	}
+	y, err := strconv.ParseFloat(string(lat), 64)
+	if err != nil {
+		return 0, 0, errors.New("value is not a valid float")
+	}
+	if !util.GeoValid(x, y) {
+		return 0, 0, fmt.Errorf("invalid longitude,latitude pair %f,%f", x, y)
+	}
+	return x, y, nil
+}
+
+//GeoParseSearchOption parses the GEOSEARCH arguments following the key, store is set for GEOSEARCHSTORE
+func GeoParseSearchOption(args [][]byte, store bool) (*GeoSearchOption, error) {
+	opt := &GeoSearchOption{}
+	var err error
+	from, by := false, false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "FROMMEMBER":
+			if from || i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+			opt.FromMember = args[i+1]
+			from = true
+			i++
+		case "FROMLONLAT":
+			if from || i+2 >= len(args) {
+				return nil, ErrSyntax
+			}
+			opt.Long, opt.Lat, err = GeoParseLongLat(args[i+1], args[i+2])
+			if err != nil {
+				return nil, err
+			}
+			from = true
+			i += 2
+		case "BYRADIUS":
+			if by || i+2 >= len(args) {
+				return nil, ErrSyntax
+			}
+			radius, err := strconv.ParseFloat(string(args[i+1]), 64)
+			if err != nil || radius < 0 {
+				return nil, errors.New("radius cannot be negative")
+			}
+			opt.Unit, err = GeoParseUnit(args[i+2])
+			if err != nil {
+				return nil, err
+			}
+			opt.Radius = radius * opt.Unit
+			by = true
+			i += 2
+		case "BYBOX":
+			if by || i+3 >= len(args) {
+				return nil, ErrSyntax
+			}
+			width, err := strconv.ParseFloat(string(args[i+1]), 64)
+			if err != nil || width < 0 {
+				return nil, errors.New("width cannot be negative")
+			}
+			height, err := strconv.ParseFloat(string(args[i+2]), 64)
+			if err != nil || height < 0 {
+				return nil, errors.New("height cannot be negative")
+			}
+			opt.Unit, err = GeoParseUnit(args[i+3])
+			if err != nil {
+				return nil, err
+			}
+			opt.Width, opt.Height = width*opt.Unit, height*opt.Unit
+			opt.ByBox = true
+			by = true
+			i += 3
+		case "ASC":
+			opt.Sort = 1
+		case "DESC":
+			opt.Sort = -1
+		case "COUNT":
+			if i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+			opt.Count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || opt.Count <= 0 {
+				return nil, errors.New("COUNT must be > 0")
+			}
+			i++
+		case "ANY":
+			opt.Any = true
+		case "WITHCOORD":
+			opt.WithCoord = true
+		case "WITHDIST":
+			opt.WithDist = true
+		case "WITHHASH":
+			opt.WithHash = true
+		case "STOREDIST":
+			if !store {
+				return nil, ErrSyntax
+			}
+			opt.StoreDist = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	if !from {
+		return nil, errors.New("exactly one of FROMMEMBER or FROMLONLAT can be specified")
+	}
+	if !by {
+		return nil, errors.New("exactly one of BYRADIUS and BYBOX can be specified")
+	}
+	if store && (opt.WithCoord || opt.WithDist || opt.WithHash) {
+		return nil, errors.New("STORE option in GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+	}
+	if opt.Any && opt.Count == 0 {
+		return nil, errors.New("the ANY argument requires COUNT argument")
+	}
+	if opt.Count > 0 && opt.Sort == 0 && !opt.Any {
+		opt.Sort = 1
+	}
+	return opt, nil
+}
+
+//GeoAdd adds members given as long-lat-member triples, returns added (or changed with ch) members
+func (c *RedisCommand) GeoAdd(key []byte, nx, xx, ch bool, args ...[]byte) (int, error) {
+	if len(args) == 0 || len(args)%3 != 0 {
+		return 0, ErrSyntax
+	}
+	members := make([]*ZSetMember, 0, len(args)/3)
+	for i := 0; i < len(args); i += 3 {
+		long, lat, err := GeoParseLongLat(args[i], args[i+1])
+		if err != nil {
+			return 0, err
+		}
+		members = append(members, &ZSetMember{Member: args[i+2], Score: util.GeoEncode(long, lat, util.GEO_STEP_MAX)})
+	}
+	added, changed, err := c.ZAddMembers(key, nx, xx, members)
+	if ch {
+		return added + changed, err
+	}
+	return added, err
+}
+
+func geoPoint(member []byte, hash uint64) *GeoPoint {
+	long, lat := util.GeoDecode(hash)
+	return &GeoPoint{Member: member, Long: long, Lat: lat, Hash: hash}
+}
+
+//GeoPos returns nil for members that are missing
+func (c *RedisCommand) GeoPos(key []byte, members ...[]byte) ([]*GeoPoint, error) {
+	scores, err := c.ZMScore(key, members...)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*GeoPoint, len(members))
+	for k, v := range scores {
+		if v == nil {
+			continue
+		}
+		hash, _ := strconv.ParseUint(string(v), 10, 64)
+		ret[k] = geoPoint(members[k], hash)
+	}
+	return ret, nil
+}
+
+//GeoDist returns the distance in meters, ok is false when a member is missing
+func (c *RedisCommand) GeoDist(key, member1, member2 []byte) (dist float64, ok bool, err error) {
+	points, err := c.GeoPos(key, member1, member2)
+	if err != nil || points[0] == nil || points[1] == nil {
+		return 0, false, err
+	}
+	return util.GeoDistance(points[0].Long, points[0].Lat, points[1].Long, points[1].Lat), true, nil
+}
+
+//GeoSearch scans the few score ranges covering the search area and filters the candidates by shape
+func (c *RedisCommand) GeoSearch(key []byte, opt *GeoSearchOption) (ret []*GeoPoint, err error) {
+	long, lat := opt.Long, opt.Lat
+	if opt.FromMember != nil {
+		points, err := c.GeoPos(key, opt.FromMember)
+		if err != nil {
+			return nil, err
+		}
+		if points[0] == nil {
+			return nil, ErrGeoMember
+		}
+		long, lat = points[0].Long, points[0].Lat
+	}
+	width, height := opt.Radius*2, opt.Radius*2
+	if opt.ByBox {
+		width, height = opt.Width, opt.Height
+	}
+
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, err := c.zsetLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		for _, cell := range util.GeoSearchCells(long, lat, width, height) {
+			for _, v := range c.zsetRangeByScore(db, key, cell[0], cell[1]-1) {
+				score, member := c.ZSetDecodeKey(v.V0)
+				p := geoPoint(member, score)
+				dist := util.GeoDistance(long, lat, p.Long, p.Lat)
+				if opt.ByBox {
+					if !util.GeoInBox(long, lat, p.Long, p.Lat, opt.Width, opt.Height) {
+						continue
+					}
+				} else if dist > opt.Radius {
+					continue
+				}
+				p.Dist = dist / opt.Unit
+				ret = append(ret, p)
+				if opt.Any && len(ret) >= opt.Count {
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opt.Sort != 0 {
+		sort.SliceStable(ret, func(i, j int) bool {
+			if opt.Sort > 0 {
+				return ret[i].Dist < ret[j].Dist
+			}
+			return ret[i].Dist > ret[j].Dist
+		})
+	}
+	if opt.Count > 0 && len(ret) > opt.Count {
+		ret = ret[:opt.Count]
+	}
+	return ret, nil
+}
+
+//GeoSearchStore writes the search result into dest, scored by geohash or rounded distance with StoreDist
+func (c *RedisCommand) GeoSearchStore(dest, key []byte, opt *GeoSearchOption) (int, error) {
+	points, err := c.GeoSearch(key, opt)
+	if err != nil {
+		return 0, err
+	}
+	scores := make(map[string]uint64, len(points))
+	for _, p := range points {
+		if opt.StoreDist {
+			scores[string(p.Member)] = uint64(p.Dist + 0.5)
+		} else {
+			scores[string(p.Member)] = p.Hash
+		}
+	}
+	return len(scores), c.ZStore(dest, zsetSortMembers(scores), "geosearchstore")
+}
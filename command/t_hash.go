@@ -6,62 +6,51 @@ import (
 )
 
 //hash
-func (*RedisCommand) HashEncodeKey(key, field []byte) []byte {
-	ret := make([]byte, 1+4+len(key)+4+len(field)) //type-key_size-key-field
-	ret[0] = KEY_TYPE_HASH_FIELD
-	binary.LittleEndian.PutUint32(ret[1:], uint32(len(key)))
-	copy(ret[5:], key)
-	binary.LittleEndian.PutUint32(ret[5+len(key):], uint32(len(field)))
-	copy(ret[5+len(key)+4:], field)
-	return ret
+func (c *RedisCommand) HashEncodeKey(key, field []byte) []byte {
+	buf, ret := c.allocField(KEY_TYPE_HASH_FIELD, key, 4+len(field)) //type-key_size-key-field
+	binary.LittleEndian.PutUint32(ret, uint32(len(field)))
+	copy(ret[4:], field)
+	return buf
 }
 
-func (*RedisCommand) HashEncodePrefix(key []byte) []byte {
-	ret := make([]byte, 1+4+len(key)) //type-key_size-key-field
-	ret[0] = KEY_TYPE_HASH_FIELD
-	binary.LittleEndian.PutUint32(ret[1:], uint32(len(key)))
-	copy(ret[5:], key)
-	return ret
+func (c *RedisCommand) HashEncodePrefix(key []byte) []byte {
+	buf, _ := c.allocField(KEY_TYPE_HASH_FIELD, key, 0) //type-key_size-key-field
+	return buf
 }
 
 func (*RedisCommand) HashDecodeKey(key []byte) []byte {
-	if len(key) < 1 {
+	if len(key) < DB_PREFIX_LEN+1 || key[DB_PREFIX_LEN] != KEY_TYPE_HASH_FIELD {
 		return nil
 	}
-	tp := key[0]
-	if tp != KEY_TYPE_HASH_FIELD {
+	_, header, ok := fieldKey(key)
+	if !ok || len(key) < header+4 {
 		return nil
 	}
-	if len(key[1:]) < 4 {
-		return nil
-	}
-	kLen := binary.LittleEndian.Uint32(key[1:])
-	if len(key[5:]) < int(kLen) {
-		return nil
-	}
-	//fLen := binary.LittleEndian.Uint32(key[5+kLen:])
-	return key[5+kLen+4:]
+	return key[header+4:]
 }
 
+//HashDel deletes the expired hash key, its collections are freed in the background
 func (c *RedisCommand) HashDel(key []byte) error {
-	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
-		data := db.Get(t, c.EncodeKey(KEY_TYPE_HASH, key))
-		if data == nil {
-			return ErrKeyNotFound
-		}
-		_ = db.Del(t, c.EncodeKey(KEY_TYPE_HASH, key))
-		slcRet := db.Scan(c.HashEncodeKey(key, []byte{}))
-		for _, v := range slcRet {
-			_ = db.Del(t, c.HashEncodeKey(key, v.V0))
-		}
-		return nil
-	})
+	return c.expireKey(KEY_TYPE_HASH, key)
+}
+
+func (c *RedisCommand) hashDelTx(db store.IStore, t interface{}, key []byte) bool {
+	data := db.Get(t, c.EncodeKey(KEY_TYPE_HASH, key))
+	if data == nil {
+		return false
+	}
+	_ = db.Del(t, c.EncodeKey(KEY_TYPE_HASH, key))
+	slcRet := db.Scan(c.HashEncodePrefix(key))
+	for _, v := range slcRet {
+		_ = db.Del(t, v.V0)
+	}
+	return true
 }
 
 func (c *RedisCommand) HSet(key []byte, args ...[]byte) error {
 	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
+	var expired *expiredKey
+	err := db.Transaction(func(t interface{}) error {
 		var err error
 		expire, v := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_HASH, key)))
 		hLen := uint32(0)
@@ -70,6 +59,7 @@ func (c *RedisCommand) HSet(key []byte, args ...[]byte) error {
 		}
 		if expire {
 			hLen = uint32(0)
+			expired = c.expireTx(db, t, key)
 		}
 		add := uint32(0)
 		for i := 0; i < len(args) && i+1 < len(args); i += 2 {
@@ -92,15 +82,18 @@ func (c *RedisCommand) HSet(key []byte, args ...[]byte) error {
 		}
 		return nil
 	})
+	if err == nil {
+		c.expired(expired)
+	}
+	return c.notifyOn(err, NOTIFY_HASH, "hset", key)
 }
 
 func (c *RedisCommand) HGet(key []byte, field ...[]byte) (ret [][]byte, err error) {
 	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
+	err = c.update(db, func(t interface{}) error {
 		expire, v := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_HASH, key)))
 		if expire {
-			c.HashDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 		if v == nil {
 			return ErrKeyNotFound
@@ -121,11 +114,10 @@ func (c *RedisCommand) HGet(key []byte, field ...[]byte) (ret [][]byte, err erro
 
 func (c *RedisCommand) HLen(key []byte) (ret uint32, err error) {
 	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
+	err = c.update(db, func(t interface{}) error {
 		expire, value := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_HASH, key)))
 		if expire {
-			c.HashDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 		ret = binary.LittleEndian.Uint32(value)
 		return nil
@@ -135,11 +127,10 @@ func (c *RedisCommand) HLen(key []byte) (ret uint32, err error) {
 
 func (c *RedisCommand) HDel(key []byte, args ...[]byte) (ret uint32, err error) {
 	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
+	err = c.update(db, func(t interface{}) error {
 		expire, _ := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_HASH, key)))
 		if expire {
-			c.HashDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 
 		for _, v := range args {
@@ -151,16 +142,18 @@ func (c *RedisCommand) HDel(key []byte, args ...[]byte) (ret uint32, err error)
 		}
 		return nil
 	})
+	if err == nil && ret > 0 {
+		c.notify(NOTIFY_HASH, "hdel", key)
+	}
 	return
 }
 
 func (c *RedisCommand) HGetAll(key []byte) (ret []*store.Pair, err error) {
 	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
+	err = c.update(db, func(t interface{}) error {
 		expire, _ := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_HASH, key)))
 		if expire {
-			c.HashDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 
 		var field []byte
@@ -176,11 +169,10 @@ func (c *RedisCommand) HGetAll(key []byte) (ret []*store.Pair, err error) {
 
 func (c *RedisCommand) HExists(key, field []byte) (ret int, err error) {
 	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
+	err = c.update(db, func(t interface{}) error {
 		expire, _ := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_HASH, key)))
 		if expire {
-			c.HashDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 
 		value := db.Get(t, c.HashEncodeKey(key, field))
@@ -194,10 +186,10 @@ func (c *RedisCommand) HExists(key, field []byte) (ret int, err error) {
 
 func (c *RedisCommand) HKeys(key []byte) (ret [][]byte) {
 	db := c.DB(key)
-	err := db.Transaction(func(t interface{}) error {
+	err := c.update(db, func(t interface{}) error {
 		expire, _ := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_HASH, key)))
 		if expire {
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 
 		var field []byte
@@ -216,10 +208,10 @@ func (c *RedisCommand) HKeys(key []byte) (ret [][]byte) {
 
 func (c *RedisCommand) HTtl(key []byte) (ret [][]byte) {
 	db := c.DB(key)
-	err := db.Transaction(func(t interface{}) error {
+	err := c.update(db, func(t interface{}) error {
 		expire, _ := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_HASH, key)))
 		if expire {
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 
 		var field []byte
@@ -1,6 +1,10 @@
 package command
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+
+	"github.com/Zealous-w/tacodb/store"
+)
 
 const (
 	LIST_LEFT_INDEX  uint64 = 9223372036854775807
@@ -9,21 +13,15 @@ const (
 
 //list
 //type-key_size-key-index, value
-func (*RedisCommand) ListEncodeKey(key []byte, index uint64) []byte {
-	ret := make([]byte, 1+4+len(key)+8)
-	ret[0] = KEY_TYPE_LIST_FIELD
-	binary.LittleEndian.PutUint32(ret[1:], uint32(len(key)))
-	copy(ret[1+4:], key)
-	binary.BigEndian.PutUint64(ret[1+4+len(key):], index)
-	return ret
+func (c *RedisCommand) ListEncodeKey(key []byte, index uint64) []byte {
+	buf, ret := c.allocField(KEY_TYPE_LIST_FIELD, key, 8)
+	binary.BigEndian.PutUint64(ret, index)
+	return buf
 }
 
-func (*RedisCommand) ListEncodePrefix(key []byte) []byte {
-	ret := make([]byte, 1+4+len(key))
-	ret[0] = KEY_TYPE_LIST_FIELD
-	binary.LittleEndian.PutUint32(ret[1:], uint32(len(key)))
-	copy(ret[1+4:], key)
-	return ret
+func (c *RedisCommand) ListEncodePrefix(key []byte) []byte {
+	buf, _ := c.allocField(KEY_TYPE_LIST_FIELD, key, 0)
+	return buf
 }
 
 func (*RedisCommand) ListDecodeKey(key []byte) []byte {
@@ -69,25 +67,28 @@ func (*RedisCommand) ListDecodeMeta(meta []byte) *ListMeta {
 	}
 }
 
+//ListDel deletes the expired list key, its collections are freed in the background
 func (c *RedisCommand) ListDel(key []byte) error {
-	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
-		data := db.Get(t, c.EncodeKey(KEY_TYPE_LIST, key))
-		if data == nil {
-			return ErrKeyNotFound
-		}
-		_ = db.Del(t, c.EncodeKey(KEY_TYPE_LIST, key))
-		slcRet := db.Scan(c.ListEncodePrefix(key))
-		for _, v := range slcRet {
-			_ = db.Del(t, v.V0)
-		}
-		return nil
-	})
+	return c.expireKey(KEY_TYPE_LIST, key)
+}
+
+func (c *RedisCommand) listDelTx(db store.IStore, t interface{}, key []byte) bool {
+	data := db.Get(t, c.EncodeKey(KEY_TYPE_LIST, key))
+	if data == nil {
+		return false
+	}
+	_ = db.Del(t, c.EncodeKey(KEY_TYPE_LIST, key))
+	slcRet := db.Scan(c.ListEncodePrefix(key))
+	for _, v := range slcRet {
+		_ = db.Del(t, v.V0)
+	}
+	return true
 }
 
 func (c *RedisCommand) LPush(key []byte, args ...[]byte) error {
 	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
+	var expired *expiredKey
+	err := db.Transaction(func(t interface{}) error {
 		var err error
 		metaKey := c.EncodeKey(KEY_TYPE_LIST, key)
 		expire, meta := c.DecodeValue(db.Get(t, metaKey))
@@ -96,7 +97,7 @@ func (c *RedisCommand) LPush(key []byte, args ...[]byte) error {
 			metaInfo = NewListMeta()
 		}
 		if expire {
-			c.ListDel(key)
+			expired = c.expireTx(db, t, key)
 			metaInfo.reset()
 		}
 
@@ -112,16 +113,20 @@ func (c *RedisCommand) LPush(key []byte, args ...[]byte) error {
 		}
 		return db.Put(t, metaKey, c.EncodeValue(c.ListEncodeMeta(metaInfo), 0))
 	})
+	if err == nil {
+		c.expired(expired)
+	}
+	return c.notifyOn(err, NOTIFY_LIST, "lpush", key)
 }
 
 func (c *RedisCommand) LPop(key []byte) (ret []byte) {
 	db := c.DB(key)
-	err := db.Transaction(func(t interface{}) error {
+	emptied := false
+	err := c.update(db, func(t interface{}) error {
 		metaKey := c.EncodeKey(KEY_TYPE_LIST, key)
 		expire, meta := c.DecodeValue(db.Get(t, metaKey))
 		if expire {
-			c.ListDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 		metaInfo := c.ListDecodeMeta(meta)
 		popKey := c.ListEncodeKey(key, metaInfo.leftIndex+1)
@@ -135,22 +140,27 @@ func (c *RedisCommand) LPop(key []byte) (ret []byte) {
 		if err != nil {
 			return err
 		}
+		//the list goes with its last element
+		if metaInfo.len == 0 {
+			emptied = true
+			return db.Del(t, metaKey)
+		}
 		return db.Put(t, metaKey, c.EncodeValue(c.ListEncodeMeta(metaInfo), 0))
 	})
 	if err != nil {
 		return nil
 	}
+	c.notifyRemoved(NOTIFY_LIST, "lpop", key, emptied)
 	return
 }
 
 func (c *RedisCommand) LRange(key []byte, start, end int) (ret [][]byte) {
 	db := c.DB(key)
-	_ = db.Transaction(func(t interface{}) error {
+	_ = c.update(db, func(t interface{}) error {
 		ret = nil
 		expire, meta := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_LIST, key)))
 		if expire {
-			c.ListDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 
 		metaInfo := c.ListDecodeMeta(meta)
@@ -197,12 +207,11 @@ func (c *RedisCommand) LRange(key []byte, start, end int) (ret [][]byte) {
 //[left, right)
 func (c *RedisCommand) LTrim(key []byte, start, end int) error {
 	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
+	err := c.update(db, func(t interface{}) error {
 		var err error
 		expire, meta := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_LIST, key)))
 		if expire {
-			c.ListDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 
 		metaInfo := c.ListDecodeMeta(meta)
@@ -258,11 +267,13 @@ func (c *RedisCommand) LTrim(key []byte, start, end int) error {
 
 		return db.Put(t, c.EncodeKey(KEY_TYPE_LIST, key), c.EncodeValue(c.ListEncodeMeta(metaInfo), 0))
 	})
+	return c.notifyOn(err, NOTIFY_LIST, "ltrim", key)
 }
 
 func (c *RedisCommand) RPush(key []byte, args ...[]byte) error {
 	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
+	var expired *expiredKey
+	err := db.Transaction(func(t interface{}) error {
 		var err error
 		metaKey := c.EncodeKey(KEY_TYPE_LIST, key)
 		expire, meta := c.DecodeValue(db.Get(t, metaKey))
@@ -271,7 +282,7 @@ func (c *RedisCommand) RPush(key []byte, args ...[]byte) error {
 			metaInfo = NewListMeta()
 		}
 		if expire {
-			c.ListDel(key)
+			expired = c.expireTx(db, t, key)
 			metaInfo.reset()
 		}
 
@@ -287,16 +298,19 @@ func (c *RedisCommand) RPush(key []byte, args ...[]byte) error {
 		}
 		return db.Put(t, metaKey, c.EncodeValue(c.ListEncodeMeta(metaInfo), 0))
 	})
+	if err == nil {
+		c.expired(expired)
+	}
+	return c.notifyOn(err, NOTIFY_LIST, "rpush", key)
 }
 
 func (c *RedisCommand) RPop(key []byte) (ret []byte) {
 	db := c.DB(key)
-	err := db.Transaction(func(t interface{}) error {
+	err := c.update(db, func(t interface{}) error {
 		metaKey := c.EncodeKey(KEY_TYPE_LIST, key)
 		expire, meta := c.DecodeValue(db.Get(t, metaKey))
 		if expire {
-			c.ListDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 		metaInfo := c.ListDecodeMeta(meta)
 		popKey := c.ListEncodeKey(key, metaInfo.leftIndex)
@@ -315,23 +329,23 @@ func (c *RedisCommand) RPop(key []byte) (ret []byte) {
 	if err != nil {
 		return nil
 	}
+	c.notify(NOTIFY_LIST, "rpop", key)
 	return
 }
 
 func (c *RedisCommand) LLen(key []byte) (ret uint32) {
 	db := c.DB(key)
-	_ = db.Transaction(func(t interface{}) error {
+	_ = c.update(db, func(t interface{}) error {
 		ret = 0
 		metaKey := c.EncodeKey(KEY_TYPE_LIST, key)
 		expire, meta := c.DecodeValue(db.Get(t, metaKey))
+		if expire {
+			return c.expireTx(db, t, key)
+		}
 		metaInfo := c.ListDecodeMeta(meta)
 		if metaInfo == nil {
 			return nil
 		}
-		if expire {
-			c.ListDel(key)
-			return nil
-		}
 		ret = uint32(metaInfo.rightIndex-metaInfo.leftIndex) - 1
 		return nil
 	})
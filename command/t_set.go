@@ -1,50 +1,51 @@
 package command
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+
+	"github.com/Zealous-w/tacodb/store"
+)
 
 //set
 //type-k_size-key-m_size-member
-func (*RedisCommand) SetEncodeKey(key, member []byte) []byte {
-	ret := make([]byte, 1+4+len(key)+4+len(member))
-	ret[0] = KEY_TYPE_SET_FIELD
-	binary.LittleEndian.PutUint32(ret[1:], uint32(len(key)))
-	copy(ret[1+4:], key)
-	binary.LittleEndian.PutUint32(ret[1+4+len(key):], uint32(len(member)))
-	copy(ret[1+4+len(key)+4:], member)
-	return ret
+func (c *RedisCommand) SetEncodeKey(key, member []byte) []byte {
+	buf, ret := c.allocField(KEY_TYPE_SET_FIELD, key, 4+len(member))
+	binary.LittleEndian.PutUint32(ret, uint32(len(member)))
+	copy(ret[4:], member)
+	return buf
 }
 
-func (*RedisCommand) SetEncodePrefix(key []byte) []byte {
-	ret := make([]byte, 1+4+len(key))
-	ret[0] = KEY_TYPE_SET_FIELD
-	binary.LittleEndian.PutUint32(ret[1:], uint32(len(key)))
-	copy(ret[1+4:], key)
-	return ret
+func (c *RedisCommand) SetEncodePrefix(key []byte) []byte {
+	buf, _ := c.allocField(KEY_TYPE_SET_FIELD, key, 0)
+	return buf
 }
 
 func (*RedisCommand) SetDecodeKey(key []byte) []byte {
 	return nil
 }
 
+//SetDel deletes the expired set key, its collections are freed in the background
 func (c *RedisCommand) SetDel(key []byte) error {
-	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
-		data := db.Get(t, c.EncodeKey(KEY_TYPE_SET, key))
-		if data == nil {
-			return ErrKeyNotFound
-		}
-		_ = db.Del(t, c.EncodeKey(KEY_TYPE_SET, key))
-		slcRet := db.Scan(c.SetEncodePrefix(key))
-		for _, v := range slcRet {
-			_ = db.Del(t, c.SetEncodeKey(key, v.V0))
-		}
-		return nil
-	})
+	return c.expireKey(KEY_TYPE_SET, key)
+}
+
+func (c *RedisCommand) setDelTx(db store.IStore, t interface{}, key []byte) bool {
+	data := db.Get(t, c.EncodeKey(KEY_TYPE_SET, key))
+	if data == nil {
+		return false
+	}
+	_ = db.Del(t, c.EncodeKey(KEY_TYPE_SET, key))
+	slcRet := db.Scan(c.SetEncodePrefix(key))
+	for _, v := range slcRet {
+		_ = db.Del(t, v.V0)
+	}
+	return true
 }
 
 func (c *RedisCommand) SAdd(key []byte, args ...[]byte) error {
 	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
+	var expired *expiredKey
+	err := db.Transaction(func(t interface{}) error {
 		var err error
 		sLen := uint32(0)
 		metaKey := c.EncodeKey(KEY_TYPE_SET, key)
@@ -53,7 +54,7 @@ func (c *RedisCommand) SAdd(key []byte, args ...[]byte) error {
 			sLen = binary.LittleEndian.Uint32(meta)
 		}
 		if expire {
-			c.SetDel(key)
+			expired = c.expireTx(db, t, key)
 			sLen = 0
 		}
 
@@ -82,11 +83,15 @@ func (c *RedisCommand) SAdd(key []byte, args ...[]byte) error {
 		binary.LittleEndian.PutUint32(metaData, sLen)
 		return db.Put(t, metaKey, c.EncodeValue(metaData, 0))
 	})
+	if err == nil {
+		c.expired(expired)
+	}
+	return c.notifyOn(err, NOTIFY_SET, "sadd", key)
 }
 
 func (c *RedisCommand) SRem(key []byte, args ...[]byte) error {
 	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
+	err := c.update(db, func(t interface{}) error {
 		var err error
 		sLen := uint32(0)
 		expire, meta := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_SET, key)))
@@ -94,8 +99,7 @@ func (c *RedisCommand) SRem(key []byte, args ...[]byte) error {
 			sLen = binary.LittleEndian.Uint32(meta)
 		}
 		if expire {
-			c.SetDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 
 		for _, m := range args {
@@ -110,15 +114,15 @@ func (c *RedisCommand) SRem(key []byte, args ...[]byte) error {
 		binary.LittleEndian.PutUint32(metaData, sLen)
 		return db.Put(t, c.EncodeKey(KEY_TYPE_SET, key), c.EncodeValue(metaData, 0))
 	})
+	return c.notifyOn(err, NOTIFY_SET, "srem", key)
 }
 
 func (c *RedisCommand) SMembers(key []byte, args ...[]byte) (ret [][]byte, err error) {
 	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
+	err = c.update(db, func(t interface{}) error {
 		expire, _ := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_SET, key)))
 		if expire {
-			c.SetDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 
 		slc := db.Scan(c.SetEncodePrefix(key))
@@ -132,11 +136,10 @@ func (c *RedisCommand) SMembers(key []byte, args ...[]byte) (ret [][]byte, err e
 
 func (c *RedisCommand) SCard(key []byte) (ret uint32, err error) {
 	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
+	err = c.update(db, func(t interface{}) error {
 		expire, meta := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_SET, key)))
 		if expire {
-			c.SetDel(key)
-			return ErrKeyNotFound
+			return c.expireTx(db, t, key)
 		}
 
 		if len(meta) > 0 {
@@ -0,0 +1,553 @@
+package command
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+var (
+	ErrStreamID      = errors.New("Invalid stream ID specified as stream command argument")
+	ErrStreamIDSmall = errors.New("The ID specified in XADD is equal or smaller than the target stream top item")
+	ErrStreamIDZero  = errors.New("The ID specified in XADD must be greater than 0-0")
+	ErrStreamExhaust = errors.New("The stream has exhausted the last possible ID, unable to add more items")
+)
+
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+var (
+	STREAM_ID_MIN = StreamID{0, 0}
+	STREAM_ID_MAX = StreamID{math.MaxUint64, math.MaxUint64}
+)
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+func (id StreamID) Less(o StreamID) bool {
+	return id.Ms < o.Ms || (id.Ms == o.Ms && id.Seq < o.Seq)
+}
+
+//Next returns the smallest id greater than id, false on overflow
+func (id StreamID) Next() (StreamID, bool) {
+	if id.Seq < math.MaxUint64 {
+		return StreamID{id.Ms, id.Seq + 1}, true
+	}
+	if id.Ms < math.MaxUint64 {
+		return StreamID{id.Ms + 1, 0}, true
+	}
+	return id, false
+}
+
+//Prev returns the greatest id smaller than id, false on underflow
+func (id StreamID) Prev() (StreamID, bool) {
+	if id.Seq > 0 {
+		return StreamID{id.Ms, id.Seq - 1}, true
+	}
+	if id.Ms > 0 {
+		return StreamID{id.Ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+//ParseStreamID parses "ms-seq" or "ms", missingSeq is used for the latter, "-" and "+" are the min and max ids
+func ParseStreamID(arg []byte, missingSeq uint64) (StreamID, error) {
+	s := string(arg)
+	switch s {
+	case "-":
+		return STREAM_ID_MIN, nil
+	case "+":
+		return STREAM_ID_MAX, nil
+	}
+	var err error
+	id := StreamID{Seq: missingSeq}
+	ms, seq := s, ""
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		ms, seq = s[:i], s[i+1:]
+	}
+	id.Ms, err = strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return id, ErrStreamID
+	}
+	if strings.IndexByte(s, '-') >= 0 {
+		id.Seq, err = strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			return id, ErrStreamID
+		}
+	}
+	return id, nil
+}
+
+//ParseStreamRangeID parses an XRANGE boundary, "(" makes it exclusive, ok is false if nothing can match
+func ParseStreamRangeID(arg []byte, start bool) (id StreamID, ok bool, err error) {
+	missingSeq := uint64(0)
+	if !start {
+		missingSeq = math.MaxUint64
+	}
+	if len(arg) > 0 && arg[0] == '(' {
+		id, err = ParseStreamID(arg[1:], missingSeq)
+		if err != nil {
+			return
+		}
+		if start {
+			id, ok = id.Next()
+		} else {
+			id, ok = id.Prev()
+		}
+		return
+	}
+	id, err = ParseStreamID(arg, missingSeq)
+	return id, err == nil, err
+}
+
+type StreamEntry struct {
+	ID     StreamID
+	Fields [][]byte //field, value, field, value...
+}
+
+//len-last_id-max_deleted_id-entries_added
+type StreamMeta struct {
+	len          uint64
+	lastID       StreamID
+	maxDeletedID StreamID
+	entriesAdded uint64
+}
+
+func (*RedisCommand) StreamEncodeMeta(meta *StreamMeta) []byte {
+	ret := make([]byte, 48)
+	binary.LittleEndian.PutUint64(ret, meta.len)
+	binary.LittleEndian.PutUint64(ret[8:], meta.lastID.Ms)
+	binary.LittleEndian.PutUint64(ret[16:], meta.lastID.Seq)
+	binary.LittleEndian.PutUint64(ret[24:], meta.maxDeletedID.Ms)
+	binary.LittleEndian.PutUint64(ret[32:], meta.maxDeletedID.Seq)
+	binary.LittleEndian.PutUint64(ret[40:], meta.entriesAdded)
+	return ret
+}
+
+func (*RedisCommand) StreamDecodeMeta(data []byte) *StreamMeta {
+	if len(data) < 48 {
+		return nil
+	}
+	return &StreamMeta{
+		len:          binary.LittleEndian.Uint64(data),
+		lastID:       StreamID{binary.LittleEndian.Uint64(data[8:]), binary.LittleEndian.Uint64(data[16:])},
+		maxDeletedID: StreamID{binary.LittleEndian.Uint64(data[24:]), binary.LittleEndian.Uint64(data[32:])},
+		entriesAdded: binary.LittleEndian.Uint64(data[40:]),
+	}
+}
+
+//stream
+//type-key_size-key-ms-seq, ms and seq are big endian so entries are ordered by id
+func (c *RedisCommand) StreamEncodeKey(key []byte, id StreamID) []byte {
+	buf, ret := c.allocField(KEY_TYPE_STREAM_FIELD, key, 16)
+	binary.BigEndian.PutUint64(ret, id.Ms)
+	binary.BigEndian.PutUint64(ret[8:], id.Seq)
+	return buf
+}
+
+func (c *RedisCommand) StreamEncodePrefix(key []byte) []byte {
+	buf, _ := c.allocField(KEY_TYPE_STREAM_FIELD, key, 0)
+	return buf
+}
+
+func (*RedisCommand) StreamDecodeKey(data []byte) StreamID {
+	if len(data) < 16 {
+		return STREAM_ID_MIN
+	}
+	return StreamID{binary.BigEndian.Uint64(data[len(data)-16:]), binary.BigEndian.Uint64(data[len(data)-8:])}
+}
+
+//streamRangeEnd returns the exclusive bound covering every id <= end
+func (c *RedisCommand) streamRangeEnd(key []byte, end StreamID) []byte {
+	if next, ok := end.Next(); ok {
+		return c.StreamEncodeKey(key, next)
+	}
+	return util.PrefixEnd(c.StreamEncodePrefix(key))
+}
+
+//size-field-size-value...
+func streamEncodeFields(fields [][]byte) []byte {
+	n := 0
+	for _, v := range fields {
+		n += 4 + len(v)
+	}
+	ret := make([]byte, 0, n)
+	size := make([]byte, 4)
+	for _, v := range fields {
+		binary.LittleEndian.PutUint32(size, uint32(len(v)))
+		ret = append(ret, size...)
+		ret = append(ret, v...)
+	}
+	return ret
+}
+
+func streamDecodeFields(data []byte) (ret [][]byte) {
+	for len(data) >= 4 {
+		size := int(binary.LittleEndian.Uint32(data))
+		if len(data) < 4+size {
+			break
+		}
+		ret = append(ret, data[4:4+size])
+		data = data[4+size:]
+	}
+	return
+}
+
+func (c *RedisCommand) streamEntries(rows []*store.Pair) []*StreamEntry {
+	ret := make([]*StreamEntry, 0, len(rows))
+	for _, v := range rows {
+		ret = append(ret, &StreamEntry{ID: c.StreamDecodeKey(v.V0), Fields: streamDecodeFields(v.V1)})
+	}
+	return ret
+}
+
+//StreamDel deletes the expired stream key, its collections are freed in the background
+func (c *RedisCommand) StreamDel(key []byte) error {
+	return c.expireKey(KEY_TYPE_STREAM, key)
+}
+
+func (c *RedisCommand) streamDelTx(db store.IStore, t interface{}, key []byte) bool {
+	metaKey := c.EncodeKey(KEY_TYPE_STREAM, key)
+	if db.Get(t, metaKey) == nil {
+		return false
+	}
+	_ = db.Del(t, metaKey)
+	for _, v := range db.Scan(c.StreamEncodePrefix(key)) {
+		_ = db.Del(t, v.V0)
+	}
+	c.streamGroupsDelTx(db, t, key)
+	return true
+}
+
+func (c *RedisCommand) streamLoadMeta(db store.IStore, t interface{}, key []byte) (*StreamMeta, error) {
+	expire, data := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_STREAM, key)))
+	if expire {
+		return nil, c.expireTx(db, t, key)
+	}
+	meta := c.StreamDecodeMeta(data)
+	if meta == nil {
+		return nil, ErrKeyNotFound
+	}
+	return meta, nil
+}
+
+type StreamTrimOption struct {
+	MaxLen    bool //MAXLEN, otherwise MINID
+	Threshold uint64
+	MinID     StreamID
+	Approx    bool
+	Limit     int
+}
+
+//ParseStreamTrimOption parses "MAXLEN|MINID [=|~] threshold [LIMIT count]", returns the number of consumed args
+func ParseStreamTrimOption(args [][]byte) (*StreamTrimOption, int, error) {
+	if len(args) < 2 {
+		return nil, 0, ErrSyntax
+	}
+	opt := &StreamTrimOption{}
+	switch strings.ToUpper(string(args[0])) {
+	case "MAXLEN":
+		opt.MaxLen = true
+	case "MINID":
+	default:
+		return nil, 0, ErrSyntax
+	}
+	i := 1
+	switch string(args[i]) {
+	case "~":
+		opt.Approx = true
+		i++
+	case "=":
+		i++
+	}
+	if i >= len(args) {
+		return nil, 0, ErrSyntax
+	}
+	var err error
+	if opt.MaxLen {
+		opt.Threshold, err = strconv.ParseUint(string(args[i]), 10, 64)
+		if err != nil {
+			return nil, 0, errors.New("The MAXLEN argument must be >= 0.")
+		}
+	} else {
+		opt.MinID, err = ParseStreamID(args[i], 0)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	i++
+	if i+1 < len(args) && strings.ToUpper(string(args[i])) == "LIMIT" {
+		if !opt.Approx {
+			return nil, 0, errors.New("syntax error, LIMIT cannot be used without the special ~ option")
+		}
+		opt.Limit, err = strconv.Atoi(string(args[i+1]))
+		if err != nil || opt.Limit < 0 {
+			return nil, 0, errors.New("The LIMIT argument must be >= 0.")
+		}
+		i += 2
+	}
+	return opt, i, nil
+}
+
+func (c *RedisCommand) streamTrimTx(db store.IStore, t interface{}, key []byte, meta *StreamMeta, opt *StreamTrimOption) (int, error) {
+	var rows []*store.Pair
+	if opt.MaxLen {
+		if meta.len <= opt.Threshold {
+			return 0, nil
+		}
+		n := int(meta.len - opt.Threshold)
+		if opt.Limit > 0 && n > opt.Limit {
+			n = opt.Limit
+		}
+		rows = db.RangeLimit(c.StreamEncodePrefix(key), util.PrefixEnd(c.StreamEncodePrefix(key)), n)
+	} else {
+		rows = db.RangeLimit(c.StreamEncodePrefix(key), c.StreamEncodeKey(key, opt.MinID), opt.Limit)
+	}
+	for _, v := range rows {
+		err := db.Del(t, v.V0)
+		if err != nil {
+			return 0, err
+		}
+	}
+	meta.len -= uint64(len(rows))
+	return len(rows), nil
+}
+
+type StreamAddOption struct {
+	NoMkStream bool
+	Trim       *StreamTrimOption
+	ID         []byte
+}
+
+//XAdd appends an entry, the id may be "*", "ms-*" or explicit and must be greater than the last one
+func (c *RedisCommand) XAdd(key []byte, opt *StreamAddOption, fields [][]byte) (id StreamID, err error) {
+	db := c.DB(key)
+	var expired *expiredKey
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.streamLoadMeta(db, t, key)
+		if e, ok := err.(*expiredKey); ok {
+			if opt.NoMkStream {
+				return e
+			}
+			expired, err = e, ErrKeyNotFound
+		}
+		if err == ErrKeyNotFound {
+			if opt.NoMkStream {
+				return err
+			}
+			meta, err = &StreamMeta{}, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		id, err = streamNextID(meta.lastID, opt.ID, c.streamNowMs())
+		if err != nil {
+			return err
+		}
+		err = db.Put(t, c.StreamEncodeKey(key, id), streamEncodeFields(fields))
+		if err != nil {
+			return err
+		}
+		meta.lastID = id
+		meta.len++
+		meta.entriesAdded++
+		if opt.Trim != nil {
+			_, err = c.streamTrimTx(db, t, key, meta, opt.Trim)
+			if err != nil {
+				return err
+			}
+		}
+		return db.Put(t, c.EncodeKey(KEY_TYPE_STREAM, key), c.EncodeValue(c.StreamEncodeMeta(meta), 0))
+	})
+	if err == nil {
+		c.expired(expired)
+		c.notify(NOTIFY_STREAM, "xadd", key)
+	}
+	return
+}
+
+//streamNextID returns the ID given by arg for an entry added after last, now is the time in
+//milliseconds an ID of * is made of
+func streamNextID(last StreamID, arg []byte, now uint64) (StreamID, error) {
+	s := string(arg)
+	if s == "*" {
+		if now > last.Ms {
+			return StreamID{now, 0}, nil
+		}
+		id, ok := last.Next()
+		if !ok {
+			return id, ErrStreamExhaust
+		}
+		return id, nil
+	}
+	if strings.HasSuffix(s, "-*") {
+		ms, err := strconv.ParseUint(s[:len(s)-2], 10, 64)
+		if err != nil {
+			return STREAM_ID_MIN, ErrStreamID
+		}
+		switch {
+		case ms > last.Ms:
+			return StreamID{ms, 0}, nil
+		case ms == last.Ms && last.Seq < math.MaxUint64:
+			return StreamID{ms, last.Seq + 1}, nil
+		}
+		return STREAM_ID_MIN, ErrStreamIDSmall
+	}
+	id, err := ParseStreamID(arg, 0)
+	if err != nil {
+		return id, err
+	}
+	if id == STREAM_ID_MIN {
+		return id, ErrStreamIDZero
+	}
+	if !last.Less(id) {
+		return id, ErrStreamIDSmall
+	}
+	return id, nil
+}
+
+func (c *RedisCommand) XTrim(key []byte, opt *StreamTrimOption) (ret int, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.streamLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		ret, err = c.streamTrimTx(db, t, key, meta, opt)
+		if err != nil || ret == 0 {
+			return err
+		}
+		return db.Put(t, c.EncodeKey(KEY_TYPE_STREAM, key), c.EncodeValue(c.StreamEncodeMeta(meta), 0))
+	})
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err == nil && ret > 0 {
+		c.notify(NOTIFY_STREAM, "xtrim", key)
+	}
+	return
+}
+
+func (c *RedisCommand) XDel(key []byte, ids ...StreamID) (ret int, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.streamLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		seen := make(map[StreamID]bool, len(ids))
+		for _, id := range ids {
+			entryKey := c.StreamEncodeKey(key, id)
+			if seen[id] || db.Get(t, entryKey) == nil {
+				continue
+			}
+			seen[id] = true
+			err = db.Del(t, entryKey)
+			if err != nil {
+				return err
+			}
+			if meta.maxDeletedID.Less(id) {
+				meta.maxDeletedID = id
+			}
+			meta.len--
+			ret++
+		}
+		if ret == 0 {
+			return nil
+		}
+		return db.Put(t, c.EncodeKey(KEY_TYPE_STREAM, key), c.EncodeValue(c.StreamEncodeMeta(meta), 0))
+	})
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err == nil && ret > 0 {
+		c.notify(NOTIFY_STREAM, "xdel", key)
+	}
+	return
+}
+
+func (c *RedisCommand) XLen(key []byte) (ret uint64, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.streamLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		ret = meta.len
+		return nil
+	})
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	return
+}
+
+//XLastID returns the id of the last entry ever added, 0-0 for a missing stream
+func (c *RedisCommand) XLastID(key []byte) (ret StreamID, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.streamLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		ret = meta.lastID
+		return nil
+	})
+	if err == ErrKeyNotFound {
+		return STREAM_ID_MIN, nil
+	}
+	return
+}
+
+//XRange returns entries with start <= id <= end, from end to start when rev is set
+func (c *RedisCommand) XRange(key []byte, start, end StreamID, count int, rev bool) (ret []*StreamEntry, err error) {
+	if end.Less(start) {
+		return nil, nil
+	}
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, err := c.streamLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		var rows []*store.Pair
+		if rev {
+			rows = db.RevRangeLimit(c.StreamEncodeKey(key, start), c.streamRangeEnd(key, end), count)
+		} else {
+			rows = db.RangeLimit(c.StreamEncodeKey(key, start), c.streamRangeEnd(key, end), count)
+		}
+		ret = c.streamEntries(rows)
+		return nil
+	})
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	return
+}
+
+//XRead returns, for each stream, up to count entries with an id greater than the given one
+func (c *RedisCommand) XRead(keys [][]byte, ids []StreamID, count int) ([][]*StreamEntry, error) {
+	ret := make([][]*StreamEntry, len(keys))
+	for k, key := range keys {
+		start, ok := ids[k].Next()
+		if !ok {
+			continue
+		}
+		entries, err := c.XRange(key, start, STREAM_ID_MAX, count, false)
+		if err != nil {
+			return nil, err
+		}
+		ret[k] = entries
+	}
+	return ret, nil
+}
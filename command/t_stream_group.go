@@ -0,0 +1,710 @@
+package command
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//consumer groups are persisted next to the stream entries:
+//group:    type-key_size-key-group_size-group, last_delivered_id-entries_read
+//pending:  type-key_size-key-group_size-group-ms-seq, delivery_time-delivery_count-consumer
+//consumer: type-key_size-key-group_size-group-consumer_size-consumer, seen_time-active_time
+
+var (
+	ErrStreamNoGroup   = errors.New("NOGROUP No such key or consumer group")
+	ErrStreamBusyGroup = errors.New("BUSYGROUP Consumer Group name already exists")
+	ErrStreamNoKey     = errors.New("The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+)
+
+//STREAM_ENTRIES_READ_UNKNOWN marks a group whose read counter can not be derived, e.g. after SETID to an arbitrary id
+const STREAM_ENTRIES_READ_UNKNOWN = math.MaxUint64
+
+type StreamGroupInfo struct {
+	Name        []byte
+	LastID      StreamID
+	EntriesRead uint64
+	Consumers   int
+	Pending     int
+	Lag         int64 //-1 when unknown
+}
+
+type StreamConsumerInfo struct {
+	Name       []byte
+	Pending    int
+	SeenTime   uint64 //unix ms of the last attempted interaction
+	ActiveTime uint64 //unix ms of the last successful interaction
+}
+
+type StreamPendingEntry struct {
+	ID            StreamID
+	Consumer      []byte
+	DeliveryTime  uint64
+	DeliveryCount uint64
+}
+
+type StreamClaimOption struct {
+	Idle       int64 //-1 when unset
+	Time       int64 //-1 when unset
+	RetryCount int64 //-1 when unset
+	Force      bool
+	JustID     bool
+	LastID     *StreamID
+}
+
+type StreamInfo struct {
+	Length       uint64
+	LastID       StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+	Groups       int
+	First        *StreamEntry
+	Last         *StreamEntry
+}
+
+func (c *RedisCommand) streamNowMs() uint64 {
+	return uint64(c.now().UnixNano() / int64(time.Millisecond))
+}
+
+func (c *RedisCommand) streamEncodeGroupRow(tp byte, key, group []byte, extra int) []byte {
+	buf, ret := c.allocField(tp, key, 4+len(group)+extra)
+	binary.LittleEndian.PutUint32(ret, uint32(len(group)))
+	copy(ret[4:], group)
+	return buf[:len(buf)-extra]
+}
+
+func (c *RedisCommand) StreamEncodeGroupKey(key, group []byte) []byte {
+	return c.streamEncodeGroupRow(KEY_TYPE_STREAM_GROUP, key, group, 0)
+}
+
+func (c *RedisCommand) StreamEncodeGroupPrefix(key []byte) []byte {
+	return c.encodeFieldPrefix(KEY_TYPE_STREAM_GROUP, key)
+}
+
+func (c *RedisCommand) StreamEncodePelKey(key, group []byte, id StreamID) []byte {
+	ret := c.streamEncodeGroupRow(KEY_TYPE_STREAM_PEL, key, group, 16)
+	ret = ret[:len(ret)+16]
+	binary.BigEndian.PutUint64(ret[len(ret)-16:], id.Ms)
+	binary.BigEndian.PutUint64(ret[len(ret)-8:], id.Seq)
+	return ret
+}
+
+func (c *RedisCommand) StreamEncodePelPrefix(key, group []byte) []byte {
+	return c.streamEncodeGroupRow(KEY_TYPE_STREAM_PEL, key, group, 0)
+}
+
+func (c *RedisCommand) StreamEncodeConsumerKey(key, group, consumer []byte) []byte {
+	ret := c.streamEncodeGroupRow(KEY_TYPE_STREAM_CONSUMER, key, group, 4+len(consumer))
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(consumer)))
+	ret = append(ret, size...)
+	return append(ret, consumer...)
+}
+
+func (c *RedisCommand) StreamEncodeConsumerPrefix(key, group []byte) []byte {
+	return c.streamEncodeGroupRow(KEY_TYPE_STREAM_CONSUMER, key, group, 0)
+}
+
+//streamDecodeGroupRow returns what follows the key segment: group name and the remaining bytes
+func streamDecodeGroupRow(data []byte) ([]byte, []byte) {
+	_, header, ok := fieldKey(data)
+	if !ok || len(data) < header+4 {
+		return nil, nil
+	}
+	data = data[header:]
+	groupLen := int(binary.LittleEndian.Uint32(data))
+	if len(data) < 4+groupLen {
+		return nil, nil
+	}
+	return data[4 : 4+groupLen], data[4+groupLen:]
+}
+
+type streamGroup struct {
+	lastID      StreamID
+	entriesRead uint64
+}
+
+func streamEncodeGroup(g *streamGroup) []byte {
+	ret := make([]byte, 24)
+	binary.LittleEndian.PutUint64(ret, g.lastID.Ms)
+	binary.LittleEndian.PutUint64(ret[8:], g.lastID.Seq)
+	binary.LittleEndian.PutUint64(ret[16:], g.entriesRead)
+	return ret
+}
+
+func streamDecodeGroup(data []byte) *streamGroup {
+	if len(data) < 24 {
+		return nil
+	}
+	return &streamGroup{
+		lastID:      StreamID{binary.LittleEndian.Uint64(data), binary.LittleEndian.Uint64(data[8:])},
+		entriesRead: binary.LittleEndian.Uint64(data[16:]),
+	}
+}
+
+func streamEncodePending(p *StreamPendingEntry) []byte {
+	ret := make([]byte, 16+len(p.Consumer))
+	binary.LittleEndian.PutUint64(ret, p.DeliveryTime)
+	binary.LittleEndian.PutUint64(ret[8:], p.DeliveryCount)
+	copy(ret[16:], p.Consumer)
+	return ret
+}
+
+func (c *RedisCommand) streamDecodePending(row *store.Pair) *StreamPendingEntry {
+	if len(row.V1) < 16 {
+		return nil
+	}
+	return &StreamPendingEntry{
+		ID:            c.StreamDecodeKey(row.V0),
+		DeliveryTime:  binary.LittleEndian.Uint64(row.V1),
+		DeliveryCount: binary.LittleEndian.Uint64(row.V1[8:]),
+		Consumer:      row.V1[16:],
+	}
+}
+
+func (c *RedisCommand) streamTouchConsumer(db store.IStore, t interface{}, key, group, consumer []byte, active bool) error {
+	consumerKey := c.StreamEncodeConsumerKey(key, group, consumer)
+	now := c.streamNowMs()
+	value := make([]byte, 16)
+	binary.LittleEndian.PutUint64(value, now)
+	if active {
+		binary.LittleEndian.PutUint64(value[8:], now)
+	} else if old := db.Get(t, consumerKey); len(old) >= 16 {
+		copy(value[8:], old[8:16])
+	}
+	return db.Put(t, consumerKey, value)
+}
+
+func (c *RedisCommand) streamLoadGroup(db store.IStore, t interface{}, key, group []byte) (*StreamMeta, *streamGroup, error) {
+	meta, err := c.streamLoadMeta(db, t, key)
+	if e, ok := err.(*expiredKey); ok {
+		e.err = ErrStreamNoGroup
+		return nil, nil, e
+	}
+	if err != nil {
+		return nil, nil, ErrStreamNoGroup
+	}
+	g := streamDecodeGroup(db.Get(t, c.StreamEncodeGroupKey(key, group)))
+	if g == nil {
+		return nil, nil, ErrStreamNoGroup
+	}
+	return meta, g, nil
+}
+
+func (c *RedisCommand) streamGroupsDelTx(db store.IStore, t interface{}, key []byte) {
+	for _, tp := range []byte{KEY_TYPE_STREAM_GROUP, KEY_TYPE_STREAM_PEL, KEY_TYPE_STREAM_CONSUMER} {
+		for _, v := range db.Scan(c.encodeFieldPrefix(tp, key)) {
+			_ = db.Del(t, v.V0)
+		}
+	}
+}
+
+//streamGroupID resolves "$" to the last id of the stream
+func streamGroupID(meta *StreamMeta, arg []byte) (StreamID, error) {
+	if string(arg) == "$" {
+		return meta.lastID, nil
+	}
+	return ParseStreamID(arg, 0)
+}
+
+//streamEntriesRead guesses the read counter of a group positioned at id
+func streamEntriesRead(meta *StreamMeta, id StreamID, entriesRead int64) uint64 {
+	switch {
+	case entriesRead >= 0:
+		return uint64(entriesRead)
+	case id == meta.lastID:
+		return meta.entriesAdded
+	case id == STREAM_ID_MIN && meta.maxDeletedID == STREAM_ID_MIN:
+		return 0
+	}
+	return STREAM_ENTRIES_READ_UNKNOWN
+}
+
+//XGroupCreate creates a group delivering entries after id, entriesRead < 0 lets tacodb derive it
+func (c *RedisCommand) XGroupCreate(key, group, id []byte, mkStream bool, entriesRead int64) error {
+	db := c.DB(key)
+	var expired *expiredKey
+	err := c.update(db, func(t interface{}) error {
+		meta, err := c.streamLoadMeta(db, t, key)
+		if e, ok := err.(*expiredKey); ok {
+			if !mkStream {
+				e.err = ErrStreamNoKey
+				return e
+			}
+			expired, err = e, ErrKeyNotFound
+		}
+		if err == ErrKeyNotFound {
+			if !mkStream {
+				return ErrStreamNoKey
+			}
+			meta, err = &StreamMeta{}, db.Put(t, c.EncodeKey(KEY_TYPE_STREAM, key), c.EncodeValue(c.StreamEncodeMeta(&StreamMeta{}), 0))
+		}
+		if err != nil {
+			return err
+		}
+		groupKey := c.StreamEncodeGroupKey(key, group)
+		if db.Get(t, groupKey) != nil {
+			return ErrStreamBusyGroup
+		}
+		lastID, err := streamGroupID(meta, id)
+		if err != nil {
+			return err
+		}
+		return db.Put(t, groupKey, streamEncodeGroup(&streamGroup{lastID: lastID, entriesRead: streamEntriesRead(meta, lastID, entriesRead)}))
+	})
+	if err == nil {
+		c.expired(expired)
+	}
+	return c.notifyOn(err, NOTIFY_STREAM, "xgroup-create", key)
+}
+
+func (c *RedisCommand) XGroupSetID(key, group, id []byte, entriesRead int64) error {
+	db := c.DB(key)
+	err := c.update(db, func(t interface{}) error {
+		meta, _, err := c.streamLoadGroup(db, t, key, group)
+		if err != nil {
+			return err
+		}
+		lastID, err := streamGroupID(meta, id)
+		if err != nil {
+			return err
+		}
+		return db.Put(t, c.StreamEncodeGroupKey(key, group), streamEncodeGroup(&streamGroup{lastID: lastID, entriesRead: streamEntriesRead(meta, lastID, entriesRead)}))
+	})
+	return c.notifyOn(err, NOTIFY_STREAM, "xgroup-setid", key)
+}
+
+func (c *RedisCommand) XGroupDestroy(key, group []byte) (ret int, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, _, err := c.streamLoadGroup(db, t, key, group)
+		if err != nil {
+			return err
+		}
+		_ = db.Del(t, c.StreamEncodeGroupKey(key, group))
+		for _, prefix := range [][]byte{c.StreamEncodePelPrefix(key, group), c.StreamEncodeConsumerPrefix(key, group)} {
+			for _, v := range db.Scan(prefix) {
+				_ = db.Del(t, v.V0)
+			}
+		}
+		ret = 1
+		return nil
+	})
+	if err == ErrStreamNoGroup {
+		return 0, nil
+	}
+	if err == nil && ret > 0 {
+		c.notify(NOTIFY_STREAM, "xgroup-destroy", key)
+	}
+	return
+}
+
+func (c *RedisCommand) XGroupCreateConsumer(key, group, consumer []byte) (ret int, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, _, err := c.streamLoadGroup(db, t, key, group)
+		if err != nil {
+			return err
+		}
+		if db.Get(t, c.StreamEncodeConsumerKey(key, group, consumer)) != nil {
+			return nil
+		}
+		ret = 1
+		return c.streamTouchConsumer(db, t, key, group, consumer, false)
+	})
+	if err == nil && ret > 0 {
+		c.notify(NOTIFY_STREAM, "xgroup-createconsumer", key)
+	}
+	return
+}
+
+//XGroupDelConsumer removes a consumer and its pending entries, returns how many were pending
+func (c *RedisCommand) XGroupDelConsumer(key, group, consumer []byte) (ret int, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, _, err := c.streamLoadGroup(db, t, key, group)
+		if err != nil {
+			return err
+		}
+		for _, v := range db.Scan(c.StreamEncodePelPrefix(key, group)) {
+			p := c.streamDecodePending(v)
+			if p != nil && bytes.Equal(p.Consumer, consumer) {
+				_ = db.Del(t, v.V0)
+				ret++
+			}
+		}
+		return db.Del(t, c.StreamEncodeConsumerKey(key, group, consumer))
+	})
+	if err == nil {
+		c.notify(NOTIFY_STREAM, "xgroup-delconsumer", key)
+	}
+	return
+}
+
+//XReadGroup delivers entries never delivered to the group when id is ">", otherwise it returns the
+//consumer's own pending entries after id, entries deleted in the meantime come back with nil fields
+func (c *RedisCommand) XReadGroup(key, group, consumer, id []byte, count int, noAck bool) (ret []*StreamEntry, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		meta, g, err := c.streamLoadGroup(db, t, key, group)
+		if err != nil {
+			return err
+		}
+		if string(id) != ">" {
+			start, err := ParseStreamID(id, 0)
+			if err != nil {
+				return err
+			}
+			if start, ok := start.Next(); ok {
+				for _, v := range db.Scan(c.StreamEncodePelPrefix(key, group)) {
+					p := c.streamDecodePending(v)
+					if p == nil || p.ID.Less(start) || !bytes.Equal(p.Consumer, consumer) {
+						continue
+					}
+					entry := &StreamEntry{ID: p.ID}
+					if data := db.Get(t, c.StreamEncodeKey(key, p.ID)); data != nil {
+						entry.Fields = streamDecodeFields(data)
+					}
+					ret = append(ret, entry)
+					if count > 0 && len(ret) >= count {
+						break
+					}
+				}
+			}
+			return c.streamTouchConsumer(db, t, key, group, consumer, false)
+		}
+
+		start, ok := g.lastID.Next()
+		if ok {
+			ret = c.streamEntries(db.RangeLimit(c.StreamEncodeKey(key, start), util.PrefixEnd(c.StreamEncodePrefix(key)), count))
+		}
+		if len(ret) == 0 {
+			return c.streamTouchConsumer(db, t, key, group, consumer, false)
+		}
+		now := c.streamNowMs()
+		if !noAck {
+			for _, v := range ret {
+				err = db.Put(t, c.StreamEncodePelKey(key, group, v.ID), streamEncodePending(&StreamPendingEntry{Consumer: consumer, DeliveryTime: now, DeliveryCount: 1}))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		g.lastID = ret[len(ret)-1].ID
+		if g.entriesRead != STREAM_ENTRIES_READ_UNKNOWN {
+			g.entriesRead += uint64(len(ret))
+		} else if g.lastID == meta.lastID {
+			g.entriesRead = meta.entriesAdded
+		}
+		err = db.Put(t, c.StreamEncodeGroupKey(key, group), streamEncodeGroup(g))
+		if err != nil {
+			return err
+		}
+		return c.streamTouchConsumer(db, t, key, group, consumer, true)
+	})
+	return
+}
+
+func (c *RedisCommand) XAck(key, group []byte, ids ...StreamID) (ret int, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, _, err := c.streamLoadGroup(db, t, key, group)
+		if err != nil {
+			return err
+		}
+		seen := make(map[StreamID]bool, len(ids))
+		for _, id := range ids {
+			pelKey := c.StreamEncodePelKey(key, group, id)
+			if seen[id] || db.Get(t, pelKey) == nil {
+				continue
+			}
+			seen[id] = true
+			err = db.Del(t, pelKey)
+			if err != nil {
+				return err
+			}
+			ret++
+		}
+		return nil
+	})
+	if err == ErrStreamNoGroup {
+		return 0, nil
+	}
+	return
+}
+
+//XPendingSummary returns the pending count, the smallest and greatest pending ids and per consumer counts
+func (c *RedisCommand) XPendingSummary(key, group []byte) (count int, min, max StreamID, consumers []*StreamConsumerInfo, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, _, err := c.streamLoadGroup(db, t, key, group)
+		if err != nil {
+			return err
+		}
+		index := make(map[string]*StreamConsumerInfo)
+		for _, v := range db.Scan(c.StreamEncodePelPrefix(key, group)) {
+			p := c.streamDecodePending(v)
+			if p == nil {
+				continue
+			}
+			if count == 0 {
+				min = p.ID
+			}
+			max = p.ID
+			count++
+			info, ok := index[string(p.Consumer)]
+			if !ok {
+				info = &StreamConsumerInfo{Name: p.Consumer}
+				index[string(p.Consumer)] = info
+				consumers = append(consumers, info)
+			}
+			info.Pending++
+		}
+		return nil
+	})
+	return
+}
+
+//XPending lists pending entries with start <= id <= end, idle for at least minIdle ms, optionally of one consumer
+func (c *RedisCommand) XPending(key, group []byte, start, end StreamID, count int, consumer []byte, minIdle uint64) (ret []*StreamPendingEntry, err error) {
+	if end.Less(start) || count <= 0 {
+		return nil, nil
+	}
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, _, err := c.streamLoadGroup(db, t, key, group)
+		if err != nil {
+			return err
+		}
+		now := c.streamNowMs()
+		rangeEnd := util.PrefixEnd(c.StreamEncodePelPrefix(key, group))
+		if next, ok := end.Next(); ok {
+			rangeEnd = c.StreamEncodePelKey(key, group, next)
+		}
+		for _, v := range db.Range(c.StreamEncodePelKey(key, group, start), rangeEnd) {
+			p := c.streamDecodePending(v)
+			if p == nil || (consumer != nil && !bytes.Equal(p.Consumer, consumer)) {
+				continue
+			}
+			if minIdle > 0 && (now < p.DeliveryTime || now-p.DeliveryTime < minIdle) {
+				continue
+			}
+			ret = append(ret, p)
+			if len(ret) >= count {
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+//streamClaimTx hands a pending entry over to consumer, entries deleted from the stream are dropped
+//from the pending list and reported with a nil entry
+func (c *RedisCommand) streamClaimTx(db store.IStore, t interface{}, key, group, consumer []byte, p *StreamPendingEntry, now uint64, opt *StreamClaimOption) (*StreamEntry, error) {
+	pelKey := c.StreamEncodePelKey(key, group, p.ID)
+	data := db.Get(t, c.StreamEncodeKey(key, p.ID))
+	if data == nil {
+		return nil, db.Del(t, pelKey)
+	}
+	p.Consumer = consumer
+	p.DeliveryTime = now
+	if opt.Idle >= 0 && uint64(opt.Idle) <= now {
+		p.DeliveryTime = now - uint64(opt.Idle)
+	}
+	if opt.Time >= 0 {
+		p.DeliveryTime = uint64(opt.Time)
+	}
+	if opt.RetryCount >= 0 {
+		p.DeliveryCount = uint64(opt.RetryCount)
+	} else if !opt.JustID {
+		p.DeliveryCount++
+	}
+	err := db.Put(t, pelKey, streamEncodePending(p))
+	if err != nil {
+		return nil, err
+	}
+	return &StreamEntry{ID: p.ID, Fields: streamDecodeFields(data)}, nil
+}
+
+func streamIdle(p *StreamPendingEntry, now uint64) uint64 {
+	if now < p.DeliveryTime {
+		return 0
+	}
+	return now - p.DeliveryTime
+}
+
+//XClaim changes the owner of pending entries idle for at least minIdle ms
+func (c *RedisCommand) XClaim(key, group, consumer []byte, minIdle uint64, ids []StreamID, opt *StreamClaimOption) (ret []*StreamEntry, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, g, err := c.streamLoadGroup(db, t, key, group)
+		if err != nil {
+			return err
+		}
+		if opt.LastID != nil && g.lastID.Less(*opt.LastID) {
+			g.lastID = *opt.LastID
+			err = db.Put(t, c.StreamEncodeGroupKey(key, group), streamEncodeGroup(g))
+			if err != nil {
+				return err
+			}
+		}
+		now := c.streamNowMs()
+		seen := make(map[StreamID]bool, len(ids))
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			p := c.streamDecodePending(&store.Pair{V0: c.StreamEncodePelKey(key, group, id), V1: db.Get(t, c.StreamEncodePelKey(key, group, id))})
+			if p == nil {
+				if !opt.Force || db.Get(t, c.StreamEncodeKey(key, id)) == nil {
+					continue
+				}
+				p = &StreamPendingEntry{ID: id, DeliveryTime: now}
+			} else if minIdle > 0 && streamIdle(p, now) < minIdle {
+				continue
+			}
+			entry, err := c.streamClaimTx(db, t, key, group, consumer, p, now, opt)
+			if err != nil {
+				return err
+			}
+			if entry != nil {
+				ret = append(ret, entry)
+			}
+		}
+		return c.streamTouchConsumer(db, t, key, group, consumer, len(ret) > 0)
+	})
+	return
+}
+
+//XAutoClaim claims up to count entries idle for at least minIdle ms starting at start, returns the id to
+//continue from (0-0 when the whole pending list was scanned), the claimed entries and the deleted ids
+func (c *RedisCommand) XAutoClaim(key, group, consumer []byte, minIdle uint64, start StreamID, count int, justID bool) (next StreamID, ret []*StreamEntry, deleted []StreamID, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, _, err := c.streamLoadGroup(db, t, key, group)
+		if err != nil {
+			return err
+		}
+		now := c.streamNowMs()
+		opt := &StreamClaimOption{Idle: -1, Time: -1, RetryCount: -1, JustID: justID}
+		rows := db.RangeLimit(c.StreamEncodePelKey(key, group, start), util.PrefixEnd(c.StreamEncodePelPrefix(key, group)), count*10+1)
+		attempts := count * 10
+		next = STREAM_ID_MIN
+		for k, v := range rows {
+			if k >= attempts || len(ret)+len(deleted) >= count {
+				next = c.StreamDecodeKey(v.V0)
+				break
+			}
+			p := c.streamDecodePending(v)
+			if p == nil || (minIdle > 0 && streamIdle(p, now) < minIdle) {
+				continue
+			}
+			entry, err := c.streamClaimTx(db, t, key, group, consumer, p, now, opt)
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				deleted = append(deleted, p.ID)
+				continue
+			}
+			ret = append(ret, entry)
+		}
+		return c.streamTouchConsumer(db, t, key, group, consumer, len(ret) > 0)
+	})
+	return
+}
+
+func (c *RedisCommand) XInfoStream(key []byte) (ret *StreamInfo, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.streamLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		ret = &StreamInfo{
+			Length:       meta.len,
+			LastID:       meta.lastID,
+			MaxDeletedID: meta.maxDeletedID,
+			EntriesAdded: meta.entriesAdded,
+			Groups:       len(db.Scan(c.StreamEncodeGroupPrefix(key))),
+		}
+		prefix := c.StreamEncodePrefix(key)
+		if first := c.streamEntries(db.RangeLimit(prefix, util.PrefixEnd(prefix), 1)); len(first) > 0 {
+			ret.First = first[0]
+		}
+		if last := c.streamEntries(db.RevRangeLimit(prefix, util.PrefixEnd(prefix), 1)); len(last) > 0 {
+			ret.Last = last[0]
+		}
+		return nil
+	})
+	return
+}
+
+func (c *RedisCommand) XInfoGroups(key []byte) (ret []*StreamGroupInfo, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.streamLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		for _, v := range db.Scan(c.StreamEncodeGroupPrefix(key)) {
+			name, _ := streamDecodeGroupRow(v.V0)
+			g := streamDecodeGroup(v.V1)
+			if g == nil {
+				continue
+			}
+			info := &StreamGroupInfo{
+				Name:        name,
+				LastID:      g.lastID,
+				EntriesRead: g.entriesRead,
+				Consumers:   len(db.Scan(c.StreamEncodeConsumerPrefix(key, name))),
+				Pending:     len(db.Scan(c.StreamEncodePelPrefix(key, name))),
+				Lag:         -1,
+			}
+			if g.entriesRead != STREAM_ENTRIES_READ_UNKNOWN && g.entriesRead <= meta.entriesAdded {
+				info.Lag = int64(meta.entriesAdded - g.entriesRead)
+			}
+			ret = append(ret, info)
+		}
+		return nil
+	})
+	return
+}
+
+func (c *RedisCommand) XInfoConsumers(key, group []byte) (ret []*StreamConsumerInfo, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, _, err := c.streamLoadGroup(db, t, key, group)
+		if err != nil {
+			return err
+		}
+		pending := make(map[string]int)
+		for _, v := range db.Scan(c.StreamEncodePelPrefix(key, group)) {
+			if p := c.streamDecodePending(v); p != nil {
+				pending[string(p.Consumer)]++
+			}
+		}
+		for _, v := range db.Scan(c.StreamEncodeConsumerPrefix(key, group)) {
+			_, rest := streamDecodeGroupRow(v.V0)
+			if len(rest) < 4 || len(v.V1) < 16 {
+				continue
+			}
+			name := rest[4:]
+			ret = append(ret, &StreamConsumerInfo{
+				Name:       name,
+				Pending:    pending[string(name)],
+				SeenTime:   binary.LittleEndian.Uint64(v.V1),
+				ActiveTime: binary.LittleEndian.Uint64(v.V1[8:]),
+			})
+		}
+		return nil
+	})
+	return
+}
@@ -1,11 +1,14 @@
 package command
 
+import "github.com/Zealous-w/tacodb/store"
+
 //string
 func (c *RedisCommand) Set(key, value []byte, ttl uint32) error {
 	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
+	err := db.Transaction(func(t interface{}) error {
 		return db.Put(t, c.EncodeKey(KEY_TYPE_STRING, key), c.EncodeValue(value, ttl))
 	})
+	return c.notifyOn(err, NOTIFY_STRING, "set", key)
 }
 
 func (c *RedisCommand) Get(key []byte) (ret []byte) {
@@ -13,7 +16,9 @@ func (c *RedisCommand) Get(key []byte) (ret []byte) {
 	err := db.Transaction(func(t interface{}) error {
 		expire, value := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_STRING, key)))
 		if expire {
-			_ = c.Del(key)
+			if c.del(key, LAZYFREE_THRESHOLD) {
+				c.notify(NOTIFY_EXPIRED, "expired", key)
+			}
 			return ErrKeyNotFound
 		}
 		ret = value
@@ -25,34 +30,49 @@ func (c *RedisCommand) Get(key []byte) (ret []byte) {
 	return
 }
 
-func (c *RedisCommand) Del(key []byte) int {
-	var err error
-	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
-		data := db.Get(t, c.EncodeKey(KEY_TYPE_STRING, key))
-		if data == nil {
-			return ErrKeyNotFound
-		}
-		return db.Del(t, c.EncodeKey(KEY_TYPE_STRING, key))
-	})
-	if err == nil {
-		return 1
-	}
-	err = c.HashDel(key)
-	if err == nil {
-		return 1
+//Del removes key, collections with many field rows are freed in the background
+func (c *RedisCommand) Del(key []byte) (ret int) {
+	if c.del(key, LAZYFREE_THRESHOLD) {
+		c.notify(NOTIFY_GENERIC, "del", key)
+		ret = 1
 	}
-	err = c.ListDel(key)
-	if err == nil {
-		return 1
-	}
-	err = c.ZSetDel(key)
-	if err == nil {
-		return 1
+	return
+}
+
+//delTx removes key of whatever type inside the transaction t
+func (c *RedisCommand) delTx(db store.IStore, t interface{}, key []byte) bool {
+	deleted := false
+	if db.Get(t, c.EncodeKey(KEY_TYPE_STRING, key)) != nil {
+		_ = db.Del(t, c.EncodeKey(KEY_TYPE_STRING, key))
+		deleted = true
 	}
-	err = c.SetDel(key)
-	if err == nil {
-		return 1
+	deleted = c.hashDelTx(db, t, key) || deleted
+	deleted = c.listDelTx(db, t, key) || deleted
+	deleted = c.zsetDelTx(db, t, key) || deleted
+	deleted = c.setDelTx(db, t, key) || deleted
+	deleted = c.streamDelTx(db, t, key) || deleted
+	return deleted
+}
+
+//delTypeTx removes the meta and field rows of key for one meta type
+func (c *RedisCommand) delTypeTx(db store.IStore, t interface{}, tp byte, key []byte) bool {
+	switch tp {
+	case KEY_TYPE_STRING:
+		if db.Get(t, c.EncodeKey(KEY_TYPE_STRING, key)) == nil {
+			return false
+		}
+		_ = db.Del(t, c.EncodeKey(KEY_TYPE_STRING, key))
+		return true
+	case KEY_TYPE_HASH:
+		return c.hashDelTx(db, t, key)
+	case KEY_TYPE_LIST:
+		return c.listDelTx(db, t, key)
+	case KEY_TYPE_ZSET:
+		return c.zsetDelTx(db, t, key)
+	case KEY_TYPE_SET:
+		return c.setDelTx(db, t, key)
+	case KEY_TYPE_STREAM:
+		return c.streamDelTx(db, t, key)
 	}
-	return 0
+	return false
 }
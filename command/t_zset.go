@@ -3,11 +3,34 @@ package command
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+const (
+	ZSET_SCORE_MIN uint64 = 0
+	ZSET_SCORE_MAX uint64 = math.MaxUint64
 )
 
+const (
+	ZSET_AGGREGATE_SUM = iota
+	ZSET_AGGREGATE_MIN
+	ZSET_AGGREGATE_MAX
+)
+
+type ZSetMember struct {
+	Member []byte
+	Score  uint64
+}
+
 type ZSetMeta struct {
 	len uint32
 }
@@ -26,86 +49,85 @@ func (m *ZSetMeta) Decode() []byte {
 }
 
 //type-key_size-key-score
-func (*RedisCommand) ZSetEncodeKey(key []byte, score uint64, value []byte) []byte {
-	ret := make([]byte, 1+4+len(key)+8+len(value))
-	ret[0] = KEY_TYPE_ZSET_FIELD
-	binary.LittleEndian.PutUint32(ret[1:], uint32(len(key)))
-	copy(ret[1+4:], key)
-	binary.BigEndian.PutUint64(ret[1+4+len(key):], score)
-	copy(ret[1+4+len(key)+8:], value)
-	return ret
+func (c *RedisCommand) ZSetEncodeKey(key []byte, score uint64, value []byte) []byte {
+	buf, ret := c.allocField(KEY_TYPE_ZSET_FIELD, key, 8+len(value))
+	binary.BigEndian.PutUint64(ret, score)
+	copy(ret[8:], value)
+	return buf
 }
 
 func (*RedisCommand) ZSetDecodeKey(data []byte) (uint64, []byte) {
-	if len(data) > 1 && data[0] != KEY_TYPE_ZSET_FIELD {
+	if len(data) < DB_PREFIX_LEN+1 || data[DB_PREFIX_LEN] != KEY_TYPE_ZSET_FIELD {
 		return 0, nil
 	}
-	if len(data[1:]) < 4 {
+	_, header, ok := fieldKey(data)
+	if !ok || len(data) < header+8 {
 		return 0, nil
 	}
-	keyLen := binary.LittleEndian.Uint32(data[1:])
-	if len(data) < int(1+4+keyLen+8) {
-		return 0, nil
-	}
-	return binary.BigEndian.Uint64(data[1+4+keyLen:]), data[1+4+keyLen+8:]
+	return binary.BigEndian.Uint64(data[header:]), data[header+8:]
 }
 
-func (*RedisCommand) ZSetEncodeKeyPrefix(key []byte, score uint64) []byte {
-	ret := make([]byte, 1+4+len(key)+8)
-	ret[0] = KEY_TYPE_ZSET_FIELD
-	binary.LittleEndian.PutUint32(ret[1:], uint32(len(key)))
-	copy(ret[1+4:], key)
-	binary.BigEndian.PutUint64(ret[1+4+len(key):], score)
-	return ret
+func (c *RedisCommand) ZSetEncodeKeyPrefix(key []byte, score uint64) []byte {
+	buf, ret := c.allocField(KEY_TYPE_ZSET_FIELD, key, 8)
+	binary.BigEndian.PutUint64(ret, score)
+	return buf
 }
 
-func (*RedisCommand) ZSetEncodeScoreKey(key, value []byte) []byte {
-	ret := make([]byte, 1+4+len(key)+4+len(value))
-	ret[0] = KEY_TYPE_ZSET_SCORE
-	binary.LittleEndian.PutUint32(ret[1:], uint32(len(key)))
-	copy(ret[1+4:], key)
-	binary.LittleEndian.PutUint32(ret[1+4+len(key):], uint32(len(value)))
-	copy(ret[1+4+len(key)+4:], value)
-	return ret
+func (c *RedisCommand) ZSetEncodeScoreKey(key, value []byte) []byte {
+	buf, ret := c.allocField(KEY_TYPE_ZSET_SCORE, key, 4+len(value))
+	binary.LittleEndian.PutUint32(ret, uint32(len(value)))
+	copy(ret[4:], value)
+	return buf
 }
 
-func (*RedisCommand) ZSetEncodeScoreKeyPrefix(key []byte) []byte {
-	ret := make([]byte, 1+4+len(key))
-	ret[0] = KEY_TYPE_ZSET_SCORE
-	binary.LittleEndian.PutUint32(ret[1:], uint32(len(key)))
-	copy(ret[1+4:], key)
-	return ret
+func (*RedisCommand) ZSetDecodeScoreKey(data []byte) []byte {
+	if len(data) < DB_PREFIX_LEN+1 || data[DB_PREFIX_LEN] != KEY_TYPE_ZSET_SCORE {
+		return nil
+	}
+	_, header, ok := fieldKey(data)
+	if !ok || len(data) < header+4 {
+		return nil
+	}
+	return data[header+4:]
 }
 
+func (c *RedisCommand) ZSetEncodeScoreKeyPrefix(key []byte) []byte {
+	buf, _ := c.allocField(KEY_TYPE_ZSET_SCORE, key, 0)
+	return buf
+}
+
+//ZSetDel deletes the expired zset key, its collections are freed in the background
 func (c *RedisCommand) ZSetDel(key []byte) error {
-	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
-		metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
-		ret := db.Get(t, metaKey)
-		if ret == nil {
-			return ErrKeyNotFound
-		}
-		_ = db.Del(t, metaKey)
-		fields := db.Range(c.ZSetEncodeKeyPrefix(key, 0), c.ZSetEncodeKeyPrefix(key, 2<<63-1))
-		for _, v := range fields {
-			_ = db.Del(t, v.V0)
-		}
-		scores := db.Scan(c.ZSetEncodeScoreKeyPrefix(key))
-		for _, v := range scores {
-			_ = db.Del(t, v.V0)
-		}
-		return nil
-	})
+	return c.expireKey(KEY_TYPE_ZSET, key)
+}
+
+func (c *RedisCommand) zsetDelTx(db store.IStore, t interface{}, key []byte) bool {
+	metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
+	ret := db.Get(t, metaKey)
+	if ret == nil {
+		return false
+	}
+	_ = db.Del(t, metaKey)
+	fields := db.Scan(c.zsetFieldPrefix(key))
+	for _, v := range fields {
+		_ = db.Del(t, v.V0)
+	}
+	scores := db.Scan(c.ZSetEncodeScoreKeyPrefix(key))
+	for _, v := range scores {
+		_ = db.Del(t, v.V0)
+	}
+	return true
 }
 
 func (c *RedisCommand) ZAdd(key []byte, score uint64, value []byte) error {
 	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
+	var expired *expiredKey
+	err := db.Transaction(func(t interface{}) error {
 		meta := &ZSetMeta{}
 		metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
 		expire, data := c.DecodeValue(db.Get(t, metaKey))
 		if expire {
-			_ = c.ZSetDel(key)
+			expired = c.expireTx(db, t, key)
 		}
 
 		oldScore := db.Get(t, c.ZSetEncodeScoreKey(key, value))
@@ -135,76 +157,186 @@ func (c *RedisCommand) ZAdd(key []byte, score uint64, value []byte) error {
 		}
 		return db.Put(t, c.ZSetEncodeKey(key, score, value), value)
 	})
+	if err == nil {
+		c.expired(expired)
+	}
+	return c.notifyOn(err, NOTIFY_ZSET, "zadd", key)
 }
 
-func (c *RedisCommand) ZRem(key []byte, args ...[]byte) error {
+//ZAddMembers adds or updates members in a single transaction, nx only adds new members and xx only
+//updates existing ones, returns the number of added members and of changed scores
+func (c *RedisCommand) ZAddMembers(key []byte, nx, xx bool, members []*ZSetMember) (added, changed int, err error) {
 	db := c.DB(key)
-	return db.Transaction(func(t interface{}) error {
-		meta := &ZSetMeta{}
-		metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
-		expire, data := c.DecodeValue(db.Get(t, metaKey))
-		if data == nil {
-			return ErrKeyNotFound
+	var expired *expiredKey
+	err = db.Transaction(func(t interface{}) error {
+		meta, err := c.zsetLoadMeta(db, t, key)
+		if e, ok := err.(*expiredKey); ok {
+			expired, err = e, ErrKeyNotFound
 		}
-		if expire {
-			_ = c.ZSetDel(key)
-			return ErrKeyNotFound
+		if err == ErrKeyNotFound {
+			meta, err = &ZSetMeta{}, nil
 		}
-		meta.Encode(data)
-
-		var err error
-		for _, field := range args {
-			meta.len--
-			scoreKey := c.ZSetEncodeScoreKey(key, field)
-			data := db.Get(t, scoreKey)
-			if len(data) <= 0 {
-				return ErrKeyTypeError
+		if err != nil {
+			return err
+		}
+		latest := make(map[string]*ZSetMember, len(members))
+		for _, m := range members {
+			latest[string(m.Member)] = m
+		}
+		for _, m := range latest {
+			scoreKey := c.ZSetEncodeScoreKey(key, m.Member)
+			old := db.Get(t, scoreKey)
+			if len(old) >= 8 {
+				oldScore := binary.LittleEndian.Uint64(old)
+				if nx || oldScore == m.Score {
+					continue
+				}
+				err = db.Del(t, c.ZSetEncodeKey(key, oldScore, m.Member))
+				if err != nil {
+					return err
+				}
+				changed++
+			} else {
+				if xx {
+					continue
+				}
+				added++
 			}
-			err = db.Del(t, scoreKey)
+			scoreByte := make([]byte, 8)
+			binary.LittleEndian.PutUint64(scoreByte, m.Score)
+			err = db.Put(t, scoreKey, scoreByte)
 			if err != nil {
 				return err
 			}
-			err = db.Del(t, c.ZSetEncodeKey(key, binary.LittleEndian.Uint64(data), field))
+			err = db.Put(t, c.ZSetEncodeKey(key, m.Score, m.Member), m.Member)
 			if err != nil {
 				return err
 			}
 		}
+		if added == 0 && changed == 0 {
+			return nil
+		}
+		meta.len += uint32(added)
+		return db.Put(t, c.EncodeKey(KEY_TYPE_ZSET, key), c.EncodeValue(meta.Decode(), 0))
+	})
+	if err == nil {
+		c.expired(expired)
+	}
+	if err == nil && added+changed > 0 {
+		c.notify(NOTIFY_ZSET, "zadd", key)
+	}
+	return
+}
+
+func (c *RedisCommand) ZRem(key []byte, args ...[]byte) (ret int, err error) {
+	db := c.DB(key)
+	emptied := false
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.zsetLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
 
-		return db.Put(t, metaKey, meta.Decode())
+		var rows []*store.Pair
+		seen := make(map[string]bool, len(args))
+		for _, field := range args {
+			if seen[string(field)] {
+				continue
+			}
+			seen[string(field)] = true
+			data := db.Get(t, c.ZSetEncodeScoreKey(key, field))
+			if len(data) < 8 {
+				continue
+			}
+			rows = append(rows, &store.Pair{V0: c.ZSetEncodeKey(key, binary.LittleEndian.Uint64(data), field), V1: field})
+		}
+		ret = len(rows)
+		err = c.zsetRemoveRows(db, t, key, meta, rows)
+		emptied = len(rows) > 0 && meta.len == 0
+		return err
 	})
+	if err == nil && ret > 0 {
+		c.notifyRemoved(NOTIFY_ZSET, "zrem", key, emptied)
+	}
+	return
 }
 
-func (c *RedisCommand) ZScore(key, value []byte) (ret []byte) {
+func (c *RedisCommand) ZScore(key, value []byte) []byte {
+	ret, err := c.ZMScore(key, value)
+	if err != nil {
+		return nil
+	}
+	return ret[0]
+}
+
+//ZMScore looks members up in the score index, missing members get a nil score
+func (c *RedisCommand) ZMScore(key []byte, members ...[]byte) (ret [][]byte, err error) {
 	db := c.DB(key)
-	err := db.Transaction(func(t interface{}) error {
-		metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
-		expire, data := c.DecodeValue(db.Get(t, metaKey))
-		if data == nil {
-			return ErrKeyNotFound
+	err = c.update(db, func(t interface{}) error {
+		ret = make([][]byte, len(members))
+		_, err := c.zsetLoadMeta(db, t, key)
+		if err != nil {
+			return err
 		}
-		if expire {
-			_ = c.ZSetDel(key)
-			return ErrKeyNotFound
+		for k, v := range members {
+			data := db.Get(t, c.ZSetEncodeScoreKey(key, v))
+			if len(data) < 8 {
+				continue
+			}
+			ret[k] = []byte(strconv.FormatUint(binary.LittleEndian.Uint64(data), 10))
 		}
-		ret = db.Get(t, c.ZSetEncodeScoreKey(key, value))
 		return nil
 	})
-	if err != nil {
+	if err == ErrKeyNotFound {
+		return ret, nil
+	}
+	return
+}
+
+//ZRandMember picks count distinct members, a negative count allows the same member to be picked repeatedly
+func (c *RedisCommand) ZRandMember(key []byte, count int) (ret []*ZSetMember, err error) {
+	db := c.DB(key)
+	err = c.update(db, func(t interface{}) error {
+		_, err := c.zsetLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		slc := db.Scan(c.ZSetEncodeScoreKeyPrefix(key))
+		if len(slc) == 0 || count == 0 {
+			return nil
+		}
+		pick := func(v *store.Pair) {
+			ret = append(ret, &ZSetMember{Member: c.ZSetDecodeScoreKey(v.V0), Score: binary.LittleEndian.Uint64(v.V1)})
+		}
+		if count < 0 {
+			for i := 0; i < -count; i++ {
+				pick(slc[rand.Intn(len(slc))])
+			}
+			return nil
+		}
+		for k, i := range rand.Perm(len(slc)) {
+			if k >= count {
+				break
+			}
+			pick(slc[i])
+		}
 		return nil
+	})
+	if err == ErrKeyNotFound {
+		return nil, nil
 	}
 	return
 }
 
 func (c *RedisCommand) ZIncrby(key []byte, args ...[]byte) (ret []byte, err error) {
 	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
+	err = c.update(db, func(t interface{}) error {
 		metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
 		expire, data := c.DecodeValue(db.Get(t, metaKey))
-		if data == nil {
-			return ErrKeyNotFound
-		}
 		if expire {
-			_ = c.ZSetDel(key)
+			return c.expireTx(db, t, key)
+		}
+		if data == nil {
 			return ErrKeyNotFound
 		}
 		addScore, err := strconv.ParseUint(string(args[0]), 10, 64)
@@ -227,19 +359,21 @@ func (c *RedisCommand) ZIncrby(key []byte, args ...[]byte) (ret []byte, err erro
 		ret = []byte(fmt.Sprintf("%d", score+addScore))
 		return db.Put(t, c.ZSetEncodeScoreKey(key, args[1]), byteScore)
 	})
+	if err == nil {
+		c.notify(NOTIFY_ZSET, "zincr", key)
+	}
 	return
 }
 
 func (c *RedisCommand) ZRange(key []byte, args ...[]byte) (ret [][]byte) {
 	db := c.DB(key)
-	err := db.Transaction(func(t interface{}) error {
+	err := c.update(db, func(t interface{}) error {
 		metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
 		expire, data := c.DecodeValue(db.Get(t, metaKey))
-		if data == nil {
-			return ErrKeyNotFound
-		}
 		if expire {
-			_ = c.ZSetDel(key)
+			return c.expireTx(db, t, key)
+		}
+		if data == nil {
 			return ErrKeyNotFound
 		}
 		showScore := false
@@ -264,14 +398,13 @@ func (c *RedisCommand) ZRange(key []byte, args ...[]byte) (ret [][]byte) {
 
 func (c *RedisCommand) ZRank(key, value []byte) (ret int, err error) {
 	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
+	err = c.update(db, func(t interface{}) error {
 		metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
 		expire, data := c.DecodeValue(db.Get(t, metaKey))
-		if data == nil {
-			return ErrKeyNotFound
-		}
 		if expire {
-			_ = c.ZSetDel(key)
+			return c.expireTx(db, t, key)
+		}
+		if data == nil {
 			return ErrKeyNotFound
 		}
 
@@ -293,14 +426,13 @@ func (c *RedisCommand) ZRank(key, value []byte) (ret int, err error) {
 
 func (c *RedisCommand) ZCount(key []byte, args ...[]byte) (ret int, err error) {
 	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
+	err = c.update(db, func(t interface{}) error {
 		metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
 		expire, data := c.DecodeValue(db.Get(t, metaKey))
-		if data == nil {
-			return ErrKeyNotFound
-		}
 		if expire {
-			_ = c.ZSetDel(key)
+			return c.expireTx(db, t, key)
+		}
+		if data == nil {
 			return ErrKeyNotFound
 		}
 
@@ -326,14 +458,13 @@ func (c *RedisCommand) ZCount(key []byte, args ...[]byte) (ret int, err error) {
 
 func (c *RedisCommand) ZRevRange(key []byte, args ...[]byte) (ret [][]byte) {
 	db := c.DB(key)
-	err := db.Transaction(func(t interface{}) error {
+	err := c.update(db, func(t interface{}) error {
 		metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
 		expire, data := c.DecodeValue(db.Get(t, metaKey))
-		if data == nil {
-			return ErrKeyNotFound
-		}
 		if expire {
-			_ = c.ZSetDel(key)
+			return c.expireTx(db, t, key)
+		}
+		if data == nil {
 			return ErrKeyNotFound
 		}
 		showScore := false
@@ -359,14 +490,13 @@ func (c *RedisCommand) ZRevRange(key []byte, args ...[]byte) (ret [][]byte) {
 
 func (c *RedisCommand) ZCard(key []byte) (ret int, err error) {
 	db := c.DB(key)
-	err = db.Transaction(func(t interface{}) error {
+	err = c.update(db, func(t interface{}) error {
 		metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
 		expire, data := c.DecodeValue(db.Get(t, metaKey))
-		if data == nil {
-			return ErrKeyNotFound
-		}
 		if expire {
-			_ = c.ZSetDel(key)
+			return c.expireTx(db, t, key)
+		}
+		if data == nil {
 			return ErrKeyNotFound
 		}
 		meta := &ZSetMeta{}
@@ -379,3 +509,539 @@ func (c *RedisCommand) ZCard(key []byte) (ret int, err error) {
 	}
 	return
 }
+
+func (c *RedisCommand) zsetFieldPrefix(key []byte) []byte {
+	ret := c.ZSetEncodeKeyPrefix(key, 0)
+	return ret[:len(ret)-8]
+}
+
+func (c *RedisCommand) zsetLoadMeta(db store.IStore, t interface{}, key []byte) (*ZSetMeta, error) {
+	expire, data := c.DecodeValue(db.Get(t, c.EncodeKey(KEY_TYPE_ZSET, key)))
+	if expire {
+		return nil, c.expireTx(db, t, key)
+	}
+	if data == nil {
+		return nil, ErrKeyNotFound
+	}
+	meta := &ZSetMeta{}
+	meta.Encode(data)
+	return meta, nil
+}
+
+//zsetRemoveRows deletes field rows together with their score index and rewrites the meta,
+//a zset left without members is removed
+func (c *RedisCommand) zsetRemoveRows(db store.IStore, t interface{}, key []byte, meta *ZSetMeta, rows []*store.Pair) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	var err error
+	for _, v := range rows {
+		_, member := c.ZSetDecodeKey(v.V0)
+		err = db.Del(t, v.V0)
+		if err != nil {
+			return err
+		}
+		err = db.Del(t, c.ZSetEncodeScoreKey(key, member))
+		if err != nil {
+			return err
+		}
+		if meta.len > 0 {
+			meta.len--
+		}
+	}
+	metaKey := c.EncodeKey(KEY_TYPE_ZSET, key)
+	if meta.len == 0 {
+		return db.Del(t, metaKey)
+	}
+	return db.Put(t, metaKey, c.EncodeValue(meta.Decode(), 0))
+}
+
+//zsetRangeByScore returns field rows with min <= score <= max, ordered by score
+func (c *RedisCommand) zsetRangeByScore(db store.IStore, key []byte, min, max uint64) []*store.Pair {
+	if min > max {
+		return nil
+	}
+	end := util.PrefixEnd(c.zsetFieldPrefix(key))
+	if max < ZSET_SCORE_MAX {
+		end = c.ZSetEncodeKeyPrefix(key, max+1)
+	}
+	return db.Range(c.ZSetEncodeKeyPrefix(key, min), end)
+}
+
+func zsetParseScore(arg []byte) (score uint64, exclusive bool, err error) {
+	s := strings.ToLower(string(arg))
+	if strings.HasPrefix(s, "(") {
+		exclusive = true
+		s = s[1:]
+	}
+	switch s {
+	case "-inf":
+		return ZSET_SCORE_MIN, exclusive, nil
+	case "+inf", "inf":
+		return ZSET_SCORE_MAX, exclusive, nil
+	}
+	score, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false, ErrScoreRange
+	}
+	return
+}
+
+//ZSetParseScoreRange parses redis style min/max ("(" exclusive, -inf, +inf) into an inclusive range,
+//min > max means the range is empty
+func ZSetParseScoreRange(min, max []byte) (uint64, uint64, error) {
+	lo, loEx, err := zsetParseScore(min)
+	if err != nil {
+		return 0, 0, err
+	}
+	hi, hiEx, err := zsetParseScore(max)
+	if err != nil {
+		return 0, 0, err
+	}
+	if (loEx && lo == ZSET_SCORE_MAX) || (hiEx && hi == ZSET_SCORE_MIN) {
+		return ZSET_SCORE_MAX, ZSET_SCORE_MIN, nil
+	}
+	if loEx {
+		lo++
+	}
+	if hiEx {
+		hi--
+	}
+	return lo, hi, nil
+}
+
+//zsetRankRange converts redis style start/stop ranks into slice bounds [start, stop)
+func zsetRankRange(length, start, stop int) (int, int) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		return 0, 0
+	}
+	return start, stop + 1
+}
+
+type zsetLexBound struct {
+	value     []byte
+	inf       int //-1 means "-", 1 means "+"
+	exclusive bool
+}
+
+func zsetParseLex(arg []byte) (*zsetLexBound, error) {
+	if len(arg) == 0 {
+		return nil, ErrLexRange
+	}
+	switch arg[0] {
+	case '-':
+		if len(arg) == 1 {
+			return &zsetLexBound{inf: -1}, nil
+		}
+	case '+':
+		if len(arg) == 1 {
+			return &zsetLexBound{inf: 1}, nil
+		}
+	case '(':
+		return &zsetLexBound{value: arg[1:], exclusive: true}, nil
+	case '[':
+		return &zsetLexBound{value: arg[1:]}, nil
+	}
+	return nil, ErrLexRange
+}
+
+func (b *zsetLexBound) aboveMin(member []byte) bool {
+	if b.inf != 0 {
+		return b.inf < 0
+	}
+	cmp := bytes.Compare(member, b.value)
+	return cmp > 0 || (cmp == 0 && !b.exclusive)
+}
+
+func (b *zsetLexBound) belowMax(member []byte) bool {
+	if b.inf != 0 {
+		return b.inf > 0
+	}
+	cmp := bytes.Compare(member, b.value)
+	return cmp < 0 || (cmp == 0 && !b.exclusive)
+}
+
+func (c *RedisCommand) ZRemRangeByScore(key, min, max []byte) (ret int, err error) {
+	lo, hi, err := ZSetParseScoreRange(min, max)
+	if err != nil {
+		return 0, err
+	}
+	db := c.DB(key)
+	emptied := false
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.zsetLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		rows := c.zsetRangeByScore(db, key, lo, hi)
+		ret = len(rows)
+		err = c.zsetRemoveRows(db, t, key, meta, rows)
+		emptied = len(rows) > 0 && meta.len == 0
+		return err
+	})
+	if err == nil && ret > 0 {
+		c.notifyRemoved(NOTIFY_ZSET, "zremrangebyscore", key, emptied)
+	}
+	return
+}
+
+func (c *RedisCommand) ZRemRangeByRank(key []byte, start, stop int) (ret int, err error) {
+	db := c.DB(key)
+	emptied := false
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.zsetLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		rows := db.Scan(c.zsetFieldPrefix(key))
+		from, to := zsetRankRange(len(rows), start, stop)
+		rows = rows[from:to]
+		ret = len(rows)
+		err = c.zsetRemoveRows(db, t, key, meta, rows)
+		emptied = len(rows) > 0 && meta.len == 0
+		return err
+	})
+	if err == nil && ret > 0 {
+		c.notifyRemoved(NOTIFY_ZSET, "zremrangebyrank", key, emptied)
+	}
+	return
+}
+
+func (c *RedisCommand) ZRemRangeByLex(key, min, max []byte) (ret int, err error) {
+	lo, err := zsetParseLex(min)
+	if err != nil {
+		return 0, err
+	}
+	hi, err := zsetParseLex(max)
+	if err != nil {
+		return 0, err
+	}
+	db := c.DB(key)
+	emptied := false
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.zsetLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		var rows []*store.Pair
+		for _, v := range db.Scan(c.zsetFieldPrefix(key)) {
+			_, member := c.ZSetDecodeKey(v.V0)
+			if lo.aboveMin(member) && hi.belowMax(member) {
+				rows = append(rows, v)
+			}
+		}
+		ret = len(rows)
+		err = c.zsetRemoveRows(db, t, key, meta, rows)
+		emptied = len(rows) > 0 && meta.len == 0
+		return err
+	})
+	if err == nil && ret > 0 {
+		c.notifyRemoved(NOTIFY_ZSET, "zremrangebylex", key, emptied)
+	}
+	return
+}
+
+//ZPopMin removes up to count members with the lowest scores, returns member-score pairs
+func (c *RedisCommand) ZPopMin(key []byte, count int) ([]*store.Pair, error) {
+	return c.zsetPop(key, count, false)
+}
+
+//ZPopMax removes up to count members with the highest scores, returns member-score pairs
+func (c *RedisCommand) ZPopMax(key []byte, count int) ([]*store.Pair, error) {
+	return c.zsetPop(key, count, true)
+}
+
+func (c *RedisCommand) zsetPop(key []byte, count int, reverse bool) (ret []*store.Pair, err error) {
+	db := c.DB(key)
+	emptied := false
+	err = c.update(db, func(t interface{}) error {
+		meta, err := c.zsetLoadMeta(db, t, key)
+		if err != nil {
+			return err
+		}
+		rows := db.Scan(c.zsetFieldPrefix(key))
+		if reverse {
+			for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+				rows[i], rows[j] = rows[j], rows[i]
+			}
+		}
+		if count < len(rows) {
+			rows = rows[:count]
+		}
+		for _, v := range rows {
+			score, member := c.ZSetDecodeKey(v.V0)
+			ret = append(ret, &store.Pair{V0: member, V1: []byte(strconv.FormatUint(score, 10))})
+		}
+		err = c.zsetRemoveRows(db, t, key, meta, rows)
+		emptied = len(rows) > 0 && meta.len == 0
+		return err
+	})
+	if err == nil && len(ret) > 0 {
+		event := "zpopmin"
+		if reverse {
+			event = "zpopmax"
+		}
+		c.notifyRemoved(NOTIFY_ZSET, event, key, emptied)
+	}
+	return
+}
+
+//ZSetAggregateOption holds the parsed arguments of ZUNION/ZINTER/ZDIFF and their STORE variants
+type ZSetAggregateOption struct {
+	Keys       [][]byte
+	Weights    []uint64
+	Aggregate  int
+	WithScores bool
+}
+
+//ZSetParseAggregateOption parses "numkeys key [key ...] [WEIGHTS w [w ...]] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]",
+//weights and aggregate are only accepted when aggregate is set, withscores only when withScores is set
+func ZSetParseAggregateOption(args [][]byte, aggregate, withScores bool) (*ZSetAggregateOption, error) {
+	if len(args) < 1 {
+		return nil, ErrSyntax
+	}
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return nil, ErrNotInteger
+	}
+	if numKeys < 1 {
+		return nil, errors.New("at least 1 input key is needed")
+	}
+	if numKeys > len(args)-1 {
+		return nil, ErrSyntax
+	}
+	opt := &ZSetAggregateOption{
+		Keys:      args[1 : 1+numKeys],
+		Aggregate: ZSET_AGGREGATE_SUM,
+	}
+	for i := 1 + numKeys; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "WEIGHTS":
+			if !aggregate || i+numKeys >= len(args) {
+				return nil, ErrSyntax
+			}
+			opt.Weights = make([]uint64, numKeys)
+			for k := range opt.Weights {
+				i++
+				opt.Weights[k], err = strconv.ParseUint(string(args[i]), 10, 64)
+				if err != nil {
+					return nil, errors.New("weight value is not an unsigned integer")
+				}
+			}
+		case "AGGREGATE":
+			if !aggregate || i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+			i++
+			switch strings.ToUpper(string(args[i])) {
+			case "SUM":
+				opt.Aggregate = ZSET_AGGREGATE_SUM
+			case "MIN":
+				opt.Aggregate = ZSET_AGGREGATE_MIN
+			case "MAX":
+				opt.Aggregate = ZSET_AGGREGATE_MAX
+			default:
+				return nil, ErrSyntax
+			}
+		case "WITHSCORES":
+			if !withScores {
+				return nil, ErrSyntax
+			}
+			opt.WithScores = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	return opt, nil
+}
+
+func (o *ZSetAggregateOption) weight(i int) uint64 {
+	if o.Weights == nil {
+		return 1
+	}
+	return o.Weights[i]
+}
+
+func zsetMulScore(score, weight uint64) uint64 {
+	if weight != 0 && score > ZSET_SCORE_MAX/weight {
+		return ZSET_SCORE_MAX
+	}
+	return score * weight
+}
+
+func zsetAggregateScore(aggregate int, a, b uint64) uint64 {
+	switch aggregate {
+	case ZSET_AGGREGATE_MIN:
+		if b < a {
+			return b
+		}
+		return a
+	case ZSET_AGGREGATE_MAX:
+		if b > a {
+			return b
+		}
+		return a
+	}
+	if a > ZSET_SCORE_MAX-b {
+		return ZSET_SCORE_MAX
+	}
+	return a + b
+}
+
+//zsetLoadScores reads a zset, or a set whose members all score 1, from the shard owning key
+func (c *RedisCommand) zsetLoadScores(key []byte) (ret map[string]uint64, err error) {
+	db := c.DB(key)
+	err = db.Transaction(func(t interface{}) error {
+		ret = make(map[string]uint64)
+		switch c.keyType(db, t, key) {
+		case 0:
+		case KEY_TYPE_ZSET:
+			for _, v := range db.Scan(c.zsetFieldPrefix(key)) {
+				score, member := c.ZSetDecodeKey(v.V0)
+				ret[string(member)] = score
+			}
+		case KEY_TYPE_SET:
+			for _, v := range db.Scan(c.SetEncodePrefix(key)) {
+				ret[string(v.V1)] = 1
+			}
+		default:
+			return ErrKeyTypeError
+		}
+		return nil
+	})
+	return
+}
+
+func zsetSortMembers(scores map[string]uint64) []*ZSetMember {
+	ret := make([]*ZSetMember, 0, len(scores))
+	for m, s := range scores {
+		ret = append(ret, &ZSetMember{Member: []byte(m), Score: s})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Score != ret[j].Score {
+			return ret[i].Score < ret[j].Score
+		}
+		return bytes.Compare(ret[i].Member, ret[j].Member) < 0
+	})
+	return ret
+}
+
+//ZUnion merges the sources, they may live in different shards
+func (c *RedisCommand) ZUnion(opt *ZSetAggregateOption) ([]*ZSetMember, error) {
+	ret := make(map[string]uint64)
+	for i, key := range opt.Keys {
+		scores, err := c.zsetLoadScores(key)
+		if err != nil {
+			return nil, err
+		}
+		for m, s := range scores {
+			s = zsetMulScore(s, opt.weight(i))
+			if old, ok := ret[m]; ok {
+				s = zsetAggregateScore(opt.Aggregate, old, s)
+			}
+			ret[m] = s
+		}
+	}
+	return zsetSortMembers(ret), nil
+}
+
+//ZInter keeps the members present in every source
+func (c *RedisCommand) ZInter(opt *ZSetAggregateOption) ([]*ZSetMember, error) {
+	var ret map[string]uint64
+	for i, key := range opt.Keys {
+		scores, err := c.zsetLoadScores(key)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			ret = make(map[string]uint64, len(scores))
+			for m, s := range scores {
+				ret[m] = zsetMulScore(s, opt.weight(i))
+			}
+			continue
+		}
+		for m, old := range ret {
+			s, ok := scores[m]
+			if !ok {
+				delete(ret, m)
+				continue
+			}
+			ret[m] = zsetAggregateScore(opt.Aggregate, old, zsetMulScore(s, opt.weight(i)))
+		}
+	}
+	return zsetSortMembers(ret), nil
+}
+
+//ZDiff keeps the members of the first source missing from the others
+func (c *RedisCommand) ZDiff(opt *ZSetAggregateOption) ([]*ZSetMember, error) {
+	var ret map[string]uint64
+	for i, key := range opt.Keys {
+		scores, err := c.zsetLoadScores(key)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			ret = scores
+			continue
+		}
+		for m := range scores {
+			delete(ret, m)
+		}
+	}
+	return zsetSortMembers(ret), nil
+}
+
+//ZStore replaces dest, whatever its type, with members in a single transaction of the shard owning dest,
+//event names the storing command in keyspace notifications
+func (c *RedisCommand) ZStore(dest []byte, members []*ZSetMember, event string) error {
+	db := c.DB(dest)
+	deleted := false
+	var records [][]byte
+	err := db.Transaction(func(t interface{}) error {
+		deleted, records = c.freeTx(db, t, dest, LAZYFREE_THRESHOLD)
+		return c.zsetPutMembers(db, t, dest, members)
+	})
+	if err == nil {
+		c.lazy.add(records)
+	}
+	if err == nil && len(members) > 0 {
+		c.notify(NOTIFY_ZSET, event, dest)
+	} else if err == nil && deleted {
+		c.notify(NOTIFY_GENERIC, "del", dest)
+	}
+	return err
+}
+
+//zsetPutMembers writes members into a zset that does not exist yet
+func (c *RedisCommand) zsetPutMembers(db store.IStore, t interface{}, key []byte, members []*ZSetMember) error {
+	if len(members) == 0 {
+		return nil
+	}
+	var err error
+	for _, v := range members {
+		scoreByte := make([]byte, 8)
+		binary.LittleEndian.PutUint64(scoreByte, v.Score)
+		err = db.Put(t, c.ZSetEncodeScoreKey(key, v.Member), scoreByte)
+		if err != nil {
+			return err
+		}
+		err = db.Put(t, c.ZSetEncodeKey(key, v.Score, v.Member), v.Member)
+		if err != nil {
+			return err
+		}
+	}
+	meta := &ZSetMeta{len: uint32(len(members))}
+	return db.Put(t, c.EncodeKey(KEY_TYPE_ZSET, key), c.EncodeValue(meta.Decode(), 0))
+}
@@ -0,0 +1,203 @@
+package command
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+//Watch holds the keys a connection watches. Instead of keeping a version in every key,
+//the shards report each committed write of a watched key to the watchTable, which marks
+//the Watch dirty. Expiry writes nothing, so whether each key was alive is remembered too
+type Watch struct {
+	dirty int32
+	keys  map[string]bool //phys-key -> alive when watched
+}
+
+//watchTable maps watched keys to the Watches interested in them
+type watchTable struct {
+	lock    sync.Mutex
+	watches map[string]map[*Watch]bool
+	count   int32 //number of watched keys, writes skip the table while it is zero
+}
+
+func newWatchTable() *watchTable {
+	return &watchTable{watches: make(map[string]map[*Watch]bool)}
+}
+
+//watchOwner returns phys-key of the key a meta or field row belongs to, nil for system and index rows
+func watchOwner(row []byte) []byte {
+	if len(row) <= DB_PREFIX_LEN || row[0] == KEY_TYPE_SYSTEM || row[DB_PREFIX_LEN] == KEY_TYPE_SLOT {
+		return nil
+	}
+	var key []byte
+	if isMetaKey(row) {
+		key = row[DB_PREFIX_LEN+1:]
+	} else {
+		var ok bool
+		if key, _, ok = fieldKey(row); !ok {
+			return nil
+		}
+	}
+	ret := make([]byte, 0, DB_PREFIX_LEN+len(key))
+	ret = append(ret, row[:DB_PREFIX_LEN]...)
+	return append(ret, key...)
+}
+
+func (w *watchTable) active() bool {
+	return w != nil && atomic.LoadInt32(&w.count) > 0
+}
+
+//touch marks dirty every Watch on one of the given phys-keys
+func (w *watchTable) touch(keys map[string]bool) {
+	if len(keys) == 0 {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for k := range keys {
+		for watch := range w.watches[k] {
+			atomic.StoreInt32(&watch.dirty, 1)
+		}
+	}
+}
+
+//touchDB marks dirty every Watch on a key of one of the physical databases
+func (w *watchTable) touchDB(physicals ...uint16) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for k, watches := range w.watches {
+		for _, phys := range physicals {
+			if string(encodeDBPrefix(phys)) == k[:DB_PREFIX_LEN] {
+				for watch := range watches {
+					atomic.StoreInt32(&watch.dirty, 1)
+				}
+			}
+		}
+	}
+}
+
+//Watch adds keys of the database of c to w, a nil w starts a new Watch
+func (c *RedisCommand) Watch(w *Watch, keys ...[]byte) *Watch {
+	if w == nil {
+		w = &Watch{keys: make(map[string]bool)}
+	}
+	prefix := encodeDBPrefix(c.physical())
+	for _, key := range keys {
+		k := string(prefix) + string(key)
+		if _, ok := w.keys[k]; ok {
+			continue
+		}
+		db := c.DB(key)
+		alive := false
+		_ = db.Transaction(func(t interface{}) error {
+			alive = c.keyType(db, t, key) != 0
+			return nil
+		})
+		c.watches.lock.Lock()
+		set, ok := c.watches.watches[k]
+		if !ok {
+			set = make(map[*Watch]bool)
+			c.watches.watches[k] = set
+			atomic.AddInt32(&c.watches.count, 1)
+		}
+		set[w] = true
+		c.watches.lock.Unlock()
+		w.keys[k] = alive
+	}
+	return w
+}
+
+//Unwatch forgets every key of w
+func (c *RedisCommand) Unwatch(w *Watch) {
+	if w == nil {
+		return
+	}
+	c.watches.lock.Lock()
+	defer c.watches.lock.Unlock()
+	for k := range w.keys {
+		set := c.watches.watches[k]
+		delete(set, w)
+		if len(set) == 0 {
+			delete(c.watches.watches, k)
+			atomic.AddInt32(&c.watches.count, -1)
+		}
+	}
+	w.keys = make(map[string]bool)
+}
+
+//Changed reports whether a key of w has been written, deleted or has expired since it was watched
+func (c *RedisCommand) Changed(w *Watch) bool {
+	if w == nil {
+		return false
+	}
+	if atomic.LoadInt32(&w.dirty) != 0 {
+		return true
+	}
+	for k, alive := range w.keys {
+		if !alive {
+			continue
+		}
+		view := c.physicalView(binary.BigEndian.Uint16([]byte(k)))
+		key := []byte(k[DB_PREFIX_LEN:])
+		db := view.DB(key)
+		exists := false
+		_ = db.Transaction(func(t interface{}) error {
+			exists = view.keyType(db, t, key) != 0
+			return nil
+		})
+		if !exists {
+			return true
+		}
+	}
+	return false
+}
+
+//Keys returns the keys of w as sorted phys-keys
+func (w *Watch) Keys() [][]byte {
+	if w == nil {
+		return nil
+	}
+	ret := make([][]byte, 0, len(w.keys))
+	for k := range w.keys {
+		ret = append(ret, []byte(k))
+	}
+	sort.Slice(ret, func(i, j int) bool { return string(ret[i]) < string(ret[j]) })
+	return ret
+}
+
+//Digest hashes the content and ttl of the keys given as phys-keys, missing and expired keys
+//included. Field rows are hashed without their generation, which differs between members
+//freeing collections in the background at their own pace
+func (c *RedisCommand) Digest(keys [][]byte) []byte {
+	h := sha1.New()
+	size := make([]byte, 4)
+	write := func(b []byte) {
+		binary.BigEndian.PutUint32(size, uint32(len(b)))
+		h.Write(size)
+		h.Write(b)
+	}
+	for _, k := range keys {
+		if len(k) < DB_PREFIX_LEN {
+			continue
+		}
+		write(k)
+		view := c.physicalView(binary.BigEndian.Uint16(k))
+		key := k[DB_PREFIX_LEN:]
+		db := view.DB(key)
+		_ = db.Transaction(func(t interface{}) error {
+			for _, v := range view.keyRows(db, t, key) {
+				if isMetaKey(v.V0) {
+					write(v.V0[DB_PREFIX_LEN:])
+				} else if _, header, ok := fieldKey(v.V0); ok {
+					write(append([]byte{v.V0[DB_PREFIX_LEN]}, v.V0[header:]...))
+				}
+				write(v.V1)
+			}
+			return nil
+		})
+	}
+	return h.Sum(nil)
+}
@@ -5,21 +5,49 @@ import (
 	"fmt"
 	"github.com/Zealous-w/redcon"
 	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/raft"
 	"github.com/Zealous-w/tacodb/server"
 	"github.com/Zealous-w/tacodb/store"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var (
-	flagHost  = flag.String("h", "127.0.0.1", "host name")
-	flagPort  = flag.String("p", "6380", "port")
-	flagPath  = flag.String("d", "./data/", "directory")
-	flagStore = flag.String("s", "leveldb", "kv store [boltdb, leveldb]")
+	flagHost    = flag.String("h", "127.0.0.1", "host name")
+	flagPort    = flag.String("p", "6380", "port")
+	flagPath    = flag.String("d", "./data/", "directory")
+	flagStore   = flag.String("s", "leveldb", "kv store [boltdb, leveldb]")
+	flagKeys    = flag.Bool("keys", true, "enable the KEYS command")
+	flagDBs     = flag.Int("databases", command.DATABASES_DEFAULT, "number of logical databases")
+	flagShard   = flag.String("shard-hash", "", "function spreading the keys of a new data directory over the shards: bkdr, crc16, xxhash or jump. Keys sharing a {tag} share a shard")
+	flagShards  = flag.Int("shards", 0, "number of shards of a new data directory, 0 for 16")
+	flagHz      = flag.Int("hz", 10, "expire cycles run per second to delete expired keys nobody reads, 0 disables them")
+	flagReshard = flag.Int("reshard", 0, "move the keys of the data directory into this many shards, with the -shard-hash function if given, and exit. The server must be stopped")
+
+	flagPubSubHard   = flag.Int("pubsub-hard-limit", server.Conf.PubSubHardLimit, "bytes a subscriber may fall behind before it is disconnected, 0 disables")
+	flagPubSubSoft   = flag.Int("pubsub-soft-limit", server.Conf.PubSubSoftLimit, "bytes a subscriber may fall behind for pubsub-soft-seconds, 0 disables")
+	flagPubSubPeriod = flag.Int("pubsub-soft-seconds", int(server.Conf.PubSubSoftPeriod/time.Second), "seconds a subscriber may stay over pubsub-soft-limit")
+	flagLuaTimeLimit = flag.Int("lua-time-limit", int(server.Conf.LuaTimeLimit/time.Millisecond), "milliseconds a script runs before other clients get BUSY and SCRIPT KILL may stop it, 0 means forever")
+	flagNotify       = flag.String("notify-keyspace-events", "", "event classes published as keyspace notifications, like \"KEA\"")
+
+	flagCDC           = flag.Bool("cdc", false, "keep a change log of every shard for CDC READ")
+	flagCDCMaxEntries = flag.Int("cdc-max-entries", 1000000, "change log entries kept per shard, 0 keeps any number")
+	flagCDCMaxSeconds = flag.Int("cdc-max-seconds", 86400, "seconds a change log entry is kept, 0 keeps it forever")
+	flagReplicaOf     = flag.String("replicaof", "", "host:port of a primary to replicate from, it needs -cdc")
+
+	flagRaft        = flag.String("raft-addr", "", "host:port to serve raft on, turns raft mode on")
+	flagRaftPeers   = flag.String("raft-peers", "", "members of a new raft group, raftaddr=clientaddr,... empty to wait for RAFT ADDNODE")
+	flagRaftForward = flag.Bool("raft-forward", true, "forward writes on followers to the raft leader instead of answering NOTLEADER")
+
+	flagCluster        = flag.Bool("cluster-enabled", false, "serve a share of the hash slots of a redis compatible cluster, -h must be reachable by the other nodes")
+	flagClusterConfig  = flag.String("cluster-config-file", "nodes.conf", "file the cluster state is kept in, relative to -d")
+	flagClusterTimeout = flag.Int("cluster-node-timeout", 15000, "milliseconds a node may not answer before it is flagged failing")
 )
 
 var (
@@ -29,10 +57,6 @@ var (
 func msgCommandDispatcher(conn redcon.Conn, cmd redcon.Command) {
 	switch strings.ToLower(string(cmd.Args[0])) {
 	default:
-		if len(cmd.Args) < 2 {
-			conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd.Args))
-			return
-		}
 		err := server.MsgCmd.Dispatcher(strings.ToLower(string(cmd.Args[0])), &server.Client{Conn: conn}, cmd.Args...)
 		if err != nil {
 			conn.WriteError("ERR '" + err.Error() + "'")
@@ -44,9 +68,6 @@ func msgCommandDispatcher(conn redcon.Conn, cmd redcon.Command) {
 		conn.WriteString(fmt.Sprintf("pid:%d", os.Getpid()))
 		conn.WriteNull()
 		return
-	case "select":
-		conn.WriteString("OK")
-		return
 	case "detach":
 		hconn := conn.Detach()
 		go func() {
@@ -55,8 +76,6 @@ func msgCommandDispatcher(conn redcon.Conn, cmd redcon.Command) {
 			hconn.Flush()
 		}()
 		return
-	case "ping":
-		conn.WriteString("PONG")
 	case "quit":
 		conn.WriteString("OK")
 		conn.Close()
@@ -81,19 +100,91 @@ func signalHandler(s *redcon.Server) {
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.Parse()
-	db, close := store.NewDBStore(*flagStore, *flagPath)
+	server.Conf.EnableKeys = *flagKeys
+	server.Conf.PubSubHardLimit = *flagPubSubHard
+	server.Conf.PubSubSoftLimit = *flagPubSubSoft
+	server.Conf.PubSubSoftPeriod = time.Duration(*flagPubSubPeriod) * time.Second
+	server.Conf.LuaTimeLimit = time.Duration(*flagLuaTimeLimit) * time.Millisecond
+	if *flagReshard > 0 {
+		err := store.Reshard(*flagStore, *flagPath, *flagReshard, func(from, to []store.IStore) error {
+			return command.Reshard(from, to, *flagDBs, *flagShard)
+		})
+		if err != nil {
+			panic(fmt.Sprintf("reshard failed, err=%+v", err))
+		}
+		log.Printf("tacodb resharded %s into %d shards", *flagPath, *flagReshard)
+		return
+	}
+	db, close := store.NewDBStore(*flagStore, *flagPath, *flagShards)
 	defer close()
+	server.SetShards(len(db))
 	workers.Start()
 
 	log.Printf("tacodb start success, store:%s addr:%s", *flagStore, *flagHost+":"+*flagPort)
-	c := command.NewRedisCommand(db)
+	c := command.NewRedisCommand(db, *flagDBs, *flagShard)
+	notify, err := command.ParseNotifyFlags(*flagNotify)
+	if err != nil {
+		panic(fmt.Sprintf("parse notify-keyspace-events failed, err=%+v", err))
+	}
+	c.SetNotify(notify, server.Hub.Publish)
+	if *flagCDC {
+		c.EnableChangeLog(*flagCDCMaxEntries, time.Duration(*flagCDCMaxSeconds)*time.Second)
+	}
+	if err := server.LoadFunctions(c); err != nil {
+		panic(fmt.Sprintf("load functions failed, err=%+v", err))
+	}
+	if *flagCluster {
+		if *flagReplicaOf != "" || *flagRaft != "" {
+			panic("cluster mode can't be combined with -replicaof or -raft-addr")
+		}
+		err := server.StartCluster(c, *flagHost+":"+*flagPort, filepath.Join(*flagPath, *flagClusterConfig),
+			time.Duration(*flagClusterTimeout)*time.Millisecond)
+		if err != nil {
+			panic(fmt.Sprintf("start cluster failed, err=%+v", err))
+		}
+	} else if err := c.SetSlotIndex(false); err != nil {
+		panic(fmt.Sprintf("drop hash slot index failed, err=%+v", err))
+	}
+	if *flagReplicaOf != "" {
+		server.Repl.ReplicaOf(c, *flagReplicaOf)
+	}
+	server.StartExpireCycle(c, *flagHz)
+	if *flagRaft != "" {
+		peers, err := server.ParseRaftPeers(*flagRaftPeers)
+		if err != nil {
+			panic(fmt.Sprintf("parse raft-peers failed, err=%+v", err))
+		}
+		raftStore := store.NewLevelDB()
+		if *flagStore == "boltdb" {
+			raftStore = store.NewBoltDB()
+		}
+		if err := raftStore.Open(*flagPath + "/raft"); err != nil {
+			panic(fmt.Sprintf("open raft log failed, err=%+v", err))
+		}
+		defer raftStore.Close()
+		err = server.StartRaft(c, raft.Config{
+			ID:      *flagRaft,
+			Addr:    *flagHost + ":" + *flagPort,
+			Store:   raftStore,
+			Peers:   peers,
+			Forward: *flagRaftForward,
+		})
+		if err != nil {
+			panic(fmt.Sprintf("start raft failed, err=%+v", err))
+		}
+		defer server.Raft.Close()
+	}
 	server := redcon.NewServer(*flagHost+":"+*flagPort,
 		msgCommandDispatcher,
 		func(conn redcon.Conn) bool {
-			conn.SetContext(c)
+			conn.SetContext(server.NewSession(conn, c))
 			return true
 		},
-		nil)
+		func(conn redcon.Conn, err error) {
+			if s, ok := conn.Context().(*server.Session); ok {
+				s.Close()
+			}
+		})
 	signalHandler(server)
 	_ = server.ListenAndServe()
 	log.Printf("tacodb exit, bye bye...")
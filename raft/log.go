@@ -0,0 +1,231 @@
+package raft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//rows of the log store:
+//
+//	t                  current term, BE
+//	v                  member voted for in the current term
+//	s                  index and term the log was compacted up to, BE, followed by the members then
+//	e | BE index       an entry: BE term | type | data
+var (
+	termKey     = []byte("t")
+	voteKey     = []byte("v")
+	snapshotKey = []byte("s")
+	entryPrefix = []byte("e")
+)
+
+//raftLog keeps the entries after the last compaction in memory and in the store
+type raftLog struct {
+	db          store.IStore
+	snapIndex   uint64
+	snapTerm    uint64
+	snapMembers []Member
+	entries     []*Entry //entries[0] has index snapIndex+1
+}
+
+func openLog(db store.IStore) (l *raftLog, term uint64, vote string, err error) {
+	l = &raftLog{db: db}
+	_ = db.Transaction(func(t interface{}) error {
+		if v := db.Get(t, termKey); len(v) == 8 {
+			term = binary.BigEndian.Uint64(v)
+		}
+		vote = string(db.Get(t, voteKey))
+		if v := db.Get(t, snapshotKey); len(v) >= 16 {
+			l.snapIndex, l.snapTerm = binary.BigEndian.Uint64(v), binary.BigEndian.Uint64(v[8:])
+			err = json.Unmarshal(v[16:], &l.snapMembers)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, "", err
+	}
+	for _, v := range db.Range(entryPrefix, []byte("f")) {
+		if len(v.V0) != 9 || len(v.V1) < 9 {
+			return nil, 0, "", ErrCorrupt
+		}
+		e := &Entry{
+			Index: binary.BigEndian.Uint64(v.V0[1:]),
+			Term:  binary.BigEndian.Uint64(v.V1),
+			Type:  v.V1[8],
+			Data:  v.V1[9:],
+		}
+		if e.Index <= l.snapIndex {
+			continue
+		}
+		if e.Index != l.lastIndex()+1 {
+			return nil, 0, "", ErrCorrupt
+		}
+		l.entries = append(l.entries, e)
+	}
+	return l, term, vote, nil
+}
+
+func entryKey(index uint64) []byte {
+	ret := make([]byte, 9)
+	ret[0] = entryPrefix[0]
+	binary.BigEndian.PutUint64(ret[1:], index)
+	return ret
+}
+
+func (l *raftLog) saveState(term uint64, vote string) error {
+	return l.db.Transaction(func(t interface{}) error {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, term)
+		if err := l.db.Put(t, termKey, v); err != nil {
+			return err
+		}
+		return l.db.Put(t, voteKey, []byte(vote))
+	})
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+//term returns the term of the entry at index, false when it was compacted or isn't there yet
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	if index == l.snapIndex {
+		return l.snapTerm, true
+	}
+	if e := l.entry(index); e != nil {
+		return e.Term, true
+	}
+	return 0, false
+}
+
+func (l *raftLog) entry(index uint64) *Entry {
+	if index <= l.snapIndex || index > l.lastIndex() {
+		return nil
+	}
+	return l.entries[index-l.snapIndex-1]
+}
+
+//slice returns at most max entries from index on
+func (l *raftLog) slice(index uint64, max int) []*Entry {
+	if index <= l.snapIndex || index > l.lastIndex() {
+		return nil
+	}
+	ret := l.entries[index-l.snapIndex-1:]
+	if len(ret) > max {
+		ret = ret[:max]
+	}
+	return append([]*Entry{}, ret...)
+}
+
+//members returns the last configuration of the log up to index
+func (l *raftLog) members(index uint64) []Member {
+	for i := l.entry(index); i != nil; i = l.entry(i.Index - 1) {
+		if i.Type == ENTRY_CONFIG {
+			var ret []Member
+			if json.Unmarshal(i.Data, &ret) == nil {
+				return ret
+			}
+		}
+	}
+	return l.snapMembers
+}
+
+func (l *raftLog) append(entries ...*Entry) error {
+	err := l.db.Transaction(func(t interface{}) error {
+		for _, e := range entries {
+			v := make([]byte, 9+len(e.Data))
+			binary.BigEndian.PutUint64(v, e.Term)
+			v[8] = e.Type
+			copy(v[9:], e.Data)
+			if err := l.db.Put(t, entryKey(e.Index), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+//truncate removes the entries from index on, they conflict with the leader
+func (l *raftLog) truncate(index uint64) error {
+	last := l.lastIndex()
+	err := l.db.Transaction(func(t interface{}) error {
+		for i := index; i <= last; i++ {
+			if err := l.db.Del(t, entryKey(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	l.entries = l.entries[:index-l.snapIndex-1]
+	return nil
+}
+
+//compact drops the entries up to index, the state machine holds their effect
+func (l *raftLog) compact(index uint64) error {
+	term, _ := l.term(index)
+	members := l.members(index)
+	from := l.snapIndex + 1
+	err := l.db.Transaction(func(t interface{}) error {
+		if err := l.db.Put(t, snapshotKey, encodeSnapshot(index, term, members)); err != nil {
+			return err
+		}
+		for i := from; i <= index; i++ {
+			if err := l.db.Del(t, entryKey(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	l.entries = append([]*Entry{}, l.entries[index-l.snapIndex:]...)
+	l.snapIndex, l.snapTerm, l.snapMembers = index, term, members
+	return nil
+}
+
+//reset replaces the whole log by a snapshot installed from the leader
+func (l *raftLog) reset(index, term uint64, members []Member) error {
+	from, last := l.snapIndex+1, l.lastIndex()
+	err := l.db.Transaction(func(t interface{}) error {
+		if err := l.db.Put(t, snapshotKey, encodeSnapshot(index, term, members)); err != nil {
+			return err
+		}
+		for i := from; i <= last; i++ {
+			if err := l.db.Del(t, entryKey(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	l.entries = nil
+	l.snapIndex, l.snapTerm, l.snapMembers = index, term, members
+	return nil
+}
+
+func encodeSnapshot(index, term uint64, members []Member) []byte {
+	data, _ := json.Marshal(members)
+	ret := make([]byte, 16, 16+len(data))
+	binary.BigEndian.PutUint64(ret, index)
+	binary.BigEndian.PutUint64(ret[8:], term)
+	return append(ret, data...)
+}
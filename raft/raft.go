@@ -0,0 +1,865 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//A Node replicates a log of commands to a group of members with the Raft consensus
+//algorithm. An entry is committed once a majority of the members stored it, every member
+//then applies it to its StateMachine in log order. The state machine keeps the index it
+//applied durably with its data, so it is the snapshot: the log is compacted behind it, and
+//a member missing compacted entries is sent the whole state machine instead.
+//
+//Membership changes one member at a time, a configuration takes effect as soon as it is in
+//the log and the next change waits for it to commit
+
+const (
+	ENTRY_COMMAND = iota //Data is given to StateMachine.Apply
+	ENTRY_CONFIG         //Data is the json of the members from then on
+	ENTRY_NOOP           //appended by a new leader to commit the entries of earlier terms
+)
+
+const (
+	APPEND_BATCH    = 256 //entries per AppendEntries
+	PROPOSE_TIMEOUT = 10 * time.Second
+)
+
+const (
+	STATE_FOLLOWER = iota
+	STATE_CANDIDATE
+	STATE_LEADER
+)
+
+var (
+	ErrNotLeader     = errors.New("not the raft leader")
+	ErrNoLeader      = errors.New("no raft leader")
+	ErrLeaderChanged = errors.New("raft leader changed before the entry committed")
+	ErrTimeout       = errors.New("raft timeout")
+	ErrClosed        = errors.New("raft node closed")
+	ErrChanging      = errors.New("a raft membership change is in progress")
+	ErrMember        = errors.New("unknown raft member")
+	ErrCorrupt       = errors.New("corrupt raft log")
+)
+
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  byte
+	Data  []byte
+}
+
+//Member identifies a member by the address it serves Raft on, clients reach it at Addr
+type Member struct {
+	ID   string
+	Addr string
+}
+
+//StateMachine is what the log is applied to. Apply and the snapshot methods are never
+//called concurrently
+type StateMachine interface {
+	//Apply applies a committed command and returns its result, the index is stored with the
+	//effect in one durable write
+	Apply(index, term uint64, data []byte) []byte
+	//Applied returns the last index and term stored by Apply or Restored
+	Applied() (index, term uint64)
+	//Snapshot writes the whole state in chunks
+	Snapshot(write func(chunk []byte) error) error
+	//Restore receives the chunks of a snapshot of the leader, seq 0 starts from an empty state
+	Restore(seq int, chunk []byte) error
+	//Restored ends a snapshot taken at index and term
+	Restored(index, term uint64) error
+}
+
+type Config struct {
+	ID                string       //address Raft is served on, it identifies the member
+	Addr              string       //address clients reach the member on
+	Store             store.IStore //keeps the log, the term and the vote
+	Machine           StateMachine
+	Peers             []Member //members of a new group, empty for a node waiting to be added
+	Forward           bool     //Apply on a follower forwards to the leader instead of failing
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration //randomized between it and twice it
+	KeepEntries       uint64        //applied entries kept for followers lagging behind
+	//Prepare, if set, is run by the leader on the data of a command entry before appending
+	//it, to fill in what every member must apply the same, like the clock of the leader
+	Prepare func(data []byte) []byte
+}
+
+type waiter struct {
+	term uint64
+	done chan proposal
+}
+
+type proposal struct {
+	result []byte
+	err    error
+}
+
+type Node struct {
+	conf Config
+	t    *transport
+
+	lock      sync.Mutex
+	state     int
+	term      uint64
+	vote      string
+	leader    string
+	contact   time.Time //last time the leader was heard from
+	deadline  time.Time //an election starts when nothing is heard until then
+	log       *raftLog
+	commit    uint64
+	applied   uint64
+	members   []Member
+	next      map[string]uint64 //next entry sent per follower, leader only
+	match     map[string]uint64 //last entry known stored per follower, leader only
+	wake      map[string]chan struct{}
+	waiters   map[uint64]*waiter
+	restoring int //seq of the next snapshot chunk, -1 when none is expected
+	closed    bool
+
+	applyLock sync.Mutex //held while the state machine is applied, snapshot or restored
+	applyWake chan struct{}
+	quit      chan struct{}
+}
+
+//Start opens the log in conf.Store and serves Raft on conf.ID
+func Start(conf Config) (*Node, error) {
+	if conf.HeartbeatInterval <= 0 {
+		conf.HeartbeatInterval = 100 * time.Millisecond
+	}
+	if conf.ElectionTimeout <= 0 {
+		conf.ElectionTimeout = 10 * conf.HeartbeatInterval
+	}
+	if conf.KeepEntries == 0 {
+		conf.KeepEntries = 10000
+	}
+	l, term, vote, err := openLog(conf.Store)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		conf:      conf,
+		term:      term,
+		vote:      vote,
+		log:       l,
+		waiters:   make(map[uint64]*waiter),
+		restoring: -1,
+		applyWake: make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+	}
+	if l.lastIndex() == 0 && len(conf.Peers) > 0 {
+		//every member of a new group starts from the same first entry
+		data, _ := json.Marshal(conf.Peers)
+		if err := l.append(&Entry{Index: 1, Type: ENTRY_CONFIG, Data: data}); err != nil {
+			return nil, err
+		}
+	}
+	index, appliedTerm := conf.Machine.Applied()
+	switch {
+	case index > l.lastIndex():
+		err = l.reset(index, appliedTerm, l.members(l.lastIndex()))
+	case index < l.snapIndex:
+		//a snapshot being restored was cut short, the leader sends it again
+		log.Printf("raft state machine at %d behind the log compacted up to %d, discarding the log", index, l.snapIndex)
+		err = l.reset(0, 0, nil)
+		index = 0
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.commit, n.applied = index, index
+	n.members = l.members(l.lastIndex())
+	n.resetDeadline()
+	if n.t, err = listen(n, conf.ID); err != nil {
+		return nil, err
+	}
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+//Close stops the node, its log store is left to the caller
+func (n *Node) Close() {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.quit)
+	n.lock.Unlock()
+	n.t.close()
+	//wait for the entry being applied
+	n.applyLock.Lock()
+	n.applyLock.Unlock()
+}
+
+//Status describes the node for RAFT INFO
+type Status struct {
+	ID        string
+	State     string
+	Term      uint64
+	Leader    Member
+	Commit    uint64
+	Applied   uint64
+	LastIndex uint64
+	SnapIndex uint64
+	Members   []Member
+}
+
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	leader, _ := n.member(n.leader)
+	return Status{
+		ID:        n.conf.ID,
+		State:     []string{"follower", "candidate", "leader"}[n.state],
+		Term:      n.term,
+		Leader:    leader,
+		Commit:    n.commit,
+		Applied:   n.applied,
+		LastIndex: n.log.lastIndex(),
+		SnapIndex: n.log.snapIndex,
+		Members:   append([]Member{}, n.members...),
+	}
+}
+
+//Leader returns the leader known, an empty ID when there is none
+func (n *Node) Leader() Member {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	m, _ := n.member(n.leader)
+	return m
+}
+
+func (n *Node) member(id string) (Member, bool) {
+	for _, v := range n.members {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return Member{ID: id}, false
+}
+
+func (n *Node) isMember(id string) bool {
+	_, ok := n.member(id)
+	return ok
+}
+
+//Apply proposes a command and returns its result once the leader applied it. A follower
+//forwards it to the leader when conf.Forward is set
+func (n *Node) Apply(data []byte) ([]byte, error) {
+	return n.propose(ENTRY_COMMAND, data, &ProposeArgs{Data: data})
+}
+
+//AddMember adds m to the group, the leader replicates the log to it from then on
+func (n *Node) AddMember(m Member) error {
+	n.lock.Lock()
+	if n.state != STATE_LEADER {
+		n.lock.Unlock()
+		_, err := n.propose(ENTRY_CONFIG, nil, &ProposeArgs{Add: &m})
+		return err
+	}
+	members := make([]Member, 0, len(n.members)+1)
+	for _, v := range n.members {
+		if v.ID != m.ID {
+			members = append(members, v)
+		}
+	}
+	n.lock.Unlock()
+	data, _ := json.Marshal(append(members, m))
+	_, err := n.propose(ENTRY_CONFIG, data, nil)
+	return err
+}
+
+//RemoveMember removes the member id, a leader removing itself steps down once it committed
+func (n *Node) RemoveMember(id string) error {
+	n.lock.Lock()
+	if n.state != STATE_LEADER {
+		n.lock.Unlock()
+		_, err := n.propose(ENTRY_CONFIG, nil, &ProposeArgs{Remove: id})
+		return err
+	}
+	if !n.isMember(id) {
+		n.lock.Unlock()
+		return ErrMember
+	}
+	members := make([]Member, 0, len(n.members))
+	for _, v := range n.members {
+		if v.ID != id {
+			members = append(members, v)
+		}
+	}
+	n.lock.Unlock()
+	data, _ := json.Marshal(members)
+	_, err := n.propose(ENTRY_CONFIG, data, nil)
+	return err
+}
+
+//propose appends an entry when leader, otherwise sends forward to the leader
+func (n *Node) propose(typ byte, data []byte, forward *ProposeArgs) ([]byte, error) {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return nil, ErrClosed
+	}
+	if n.state != STATE_LEADER {
+		leader := n.leader
+		n.lock.Unlock()
+		if leader == "" {
+			return nil, ErrNoLeader
+		}
+		if forward == nil || !n.conf.Forward {
+			return nil, ErrNotLeader
+		}
+		var reply ProposeReply
+		if err := n.t.call(leader, "Propose", forward, &reply, PROPOSE_TIMEOUT); err != nil {
+			return nil, err
+		}
+		if reply.Err != "" {
+			return nil, errors.New(reply.Err)
+		}
+		return reply.Result, nil
+	}
+	if typ == ENTRY_CONFIG && n.configPending() {
+		n.lock.Unlock()
+		return nil, ErrChanging
+	}
+	if typ == ENTRY_COMMAND && n.conf.Prepare != nil {
+		data = n.conf.Prepare(data)
+	}
+	e := &Entry{Index: n.log.lastIndex() + 1, Term: n.term, Type: typ, Data: data}
+	if err := n.appendLocal(e); err != nil {
+		n.lock.Unlock()
+		return nil, err
+	}
+	w := &waiter{term: n.term, done: make(chan proposal, 1)}
+	n.waiters[e.Index] = w
+	n.lock.Unlock()
+
+	timer := time.NewTimer(PROPOSE_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case p := <-w.done:
+		return p.result, p.err
+	case <-timer.C:
+		n.lock.Lock()
+		delete(n.waiters, e.Index)
+		n.lock.Unlock()
+		return nil, ErrTimeout
+	case <-n.quit:
+		return nil, ErrClosed
+	}
+}
+
+//configPending reports whether the last configuration in the log isn't committed yet
+func (n *Node) configPending() bool {
+	for i := n.log.lastIndex(); i > n.commit; i-- {
+		if e := n.log.entry(i); e != nil && e.Type == ENTRY_CONFIG {
+			return true
+		}
+	}
+	return false
+}
+
+//appendLocal appends an entry of the leader and sends it to the followers
+func (n *Node) appendLocal(e *Entry) error {
+	if err := n.log.append(e); err != nil {
+		return err
+	}
+	if e.Type == ENTRY_CONFIG {
+		n.setMembers()
+	}
+	n.match[n.conf.ID] = e.Index
+	n.advanceCommit()
+	for _, ch := range n.wake {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+//setMembers adopts the last configuration of the log, the leader starts replicating to
+//members it didn't know
+func (n *Node) setMembers() {
+	n.members = n.log.members(n.log.lastIndex())
+	if n.state != STATE_LEADER {
+		return
+	}
+	for _, m := range n.members {
+		if m.ID == n.conf.ID || n.wake[m.ID] != nil {
+			continue
+		}
+		n.next[m.ID] = n.log.lastIndex() + 1
+		n.match[m.ID] = 0
+		n.wake[m.ID] = make(chan struct{}, 1)
+		go n.replicate(m.ID, n.term, n.wake[m.ID])
+	}
+}
+
+func (n *Node) resetDeadline() {
+	d := n.conf.ElectionTimeout
+	n.deadline = time.Now().Add(d + time.Duration(rand.Int63n(int64(d))))
+}
+
+//setTerm moves to a newer term as a follower
+func (n *Node) setTerm(term uint64) {
+	if term > n.term {
+		n.term, n.vote = term, ""
+		if err := n.log.saveState(n.term, n.vote); err != nil {
+			log.Printf("raft save term failed, err=%+v", err)
+		}
+	}
+	if n.state != STATE_FOLLOWER {
+		n.state = STATE_FOLLOWER
+		n.next, n.match, n.wake = nil, nil, nil
+	}
+	n.leader = ""
+}
+
+func (n *Node) run() {
+	ticker := time.NewTicker(n.conf.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+		}
+		n.lock.Lock()
+		if n.state == STATE_LEADER {
+			for _, ch := range n.wake {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		} else if time.Now().After(n.deadline) && n.isMember(n.conf.ID) {
+			n.campaign()
+		}
+		n.lock.Unlock()
+	}
+}
+
+//campaign starts an election, with n.lock held
+func (n *Node) campaign() {
+	n.state, n.term, n.vote, n.leader = STATE_CANDIDATE, n.term+1, n.conf.ID, ""
+	if err := n.log.saveState(n.term, n.vote); err != nil {
+		log.Printf("raft save term failed, err=%+v", err)
+	}
+	n.resetDeadline()
+	term := n.term
+	args := &VoteArgs{Term: term, Candidate: n.conf.ID, LastIndex: n.log.lastIndex(), LastTerm: n.log.lastTerm()}
+	votes := 1
+	if votes > len(n.members)/2 {
+		n.becomeLeader()
+		return
+	}
+	for _, m := range n.members {
+		if m.ID == n.conf.ID {
+			continue
+		}
+		go func(peer string) {
+			var reply VoteReply
+			if err := n.t.call(peer, "RequestVote", args, &reply, n.conf.ElectionTimeout); err != nil {
+				return
+			}
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			if reply.Term > n.term {
+				n.setTerm(reply.Term)
+				return
+			}
+			if n.state != STATE_CANDIDATE || n.term != term || !reply.Granted {
+				return
+			}
+			votes++
+			if votes > len(n.members)/2 {
+				n.becomeLeader()
+			}
+		}(m.ID)
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.state, n.leader = STATE_LEADER, n.conf.ID
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.wake = make(map[string]chan struct{})
+	n.setMembers()
+	if err := n.appendLocal(&Entry{Index: n.log.lastIndex() + 1, Term: n.term, Type: ENTRY_NOOP}); err != nil {
+		log.Printf("raft append failed, err=%+v", err)
+	}
+}
+
+//advanceCommit commits the last entry of the current term a majority stored, with n.lock held
+func (n *Node) advanceCommit() {
+	for i := n.log.lastIndex(); i > n.commit; i-- {
+		if term, _ := n.log.term(i); term != n.term {
+			return
+		}
+		count := 0
+		for _, m := range n.members {
+			if n.match[m.ID] >= i {
+				count++
+			}
+		}
+		if count > len(n.members)/2 {
+			n.setCommit(i)
+			return
+		}
+	}
+}
+
+func (n *Node) setCommit(index uint64) {
+	n.commit = index
+	select {
+	case n.applyWake <- struct{}{}:
+	default:
+	}
+}
+
+//replicate sends the log to peer while the node leads in term
+func (n *Node) replicate(peer string, term uint64, wake chan struct{}) {
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-wake:
+		}
+		for {
+			n.lock.Lock()
+			if n.state != STATE_LEADER || n.term != term || n.wake[peer] != wake {
+				n.lock.Unlock()
+				return
+			}
+			if !n.isMember(peer) {
+				delete(n.wake, peer)
+				n.lock.Unlock()
+				return
+			}
+			next := n.next[peer]
+			if next <= n.log.snapIndex {
+				n.lock.Unlock()
+				if !n.sendSnapshot(peer, term) {
+					break
+				}
+				continue
+			}
+			prevTerm, _ := n.log.term(next - 1)
+			args := &AppendArgs{
+				Term:      term,
+				Leader:    n.conf.ID,
+				PrevIndex: next - 1,
+				PrevTerm:  prevTerm,
+				Entries:   n.log.slice(next, APPEND_BATCH),
+				Commit:    n.commit,
+			}
+			n.lock.Unlock()
+
+			var reply AppendReply
+			if err := n.t.call(peer, "AppendEntries", args, &reply, n.conf.ElectionTimeout); err != nil {
+				break
+			}
+			n.lock.Lock()
+			if reply.Term > n.term {
+				n.setTerm(reply.Term)
+				n.lock.Unlock()
+				return
+			}
+			if n.state != STATE_LEADER || n.term != term {
+				n.lock.Unlock()
+				return
+			}
+			if !reply.Success {
+				n.next[peer] = reply.Next
+				if reply.Next >= next || reply.Next == 0 {
+					n.next[peer] = next - 1
+				}
+				n.lock.Unlock()
+				continue
+			}
+			match := args.PrevIndex + uint64(len(args.Entries))
+			if match > n.match[peer] {
+				n.match[peer] = match
+			}
+			n.next[peer] = match + 1
+			n.advanceCommit()
+			more := n.next[peer] <= n.log.lastIndex()
+			n.lock.Unlock()
+			if !more {
+				break
+			}
+		}
+	}
+}
+
+//sendSnapshot sends the state machine to peer. Applying waits meanwhile, so the state
+//doesn't move away from the index it is sent for. A first empty chunk makes sure the peer is
+//there before applying is held up
+func (n *Node) sendSnapshot(peer string, term uint64) bool {
+	seq := 0
+	send := func(args *SnapshotArgs) error {
+		args.Term, args.Leader, args.Seq = term, n.conf.ID, seq
+		var reply SnapshotReply
+		if err := n.t.call(peer, "InstallSnapshot", args, &reply, n.conf.ElectionTimeout); err != nil {
+			return err
+		}
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		if reply.Term > n.term {
+			n.setTerm(reply.Term)
+		}
+		if n.state != STATE_LEADER || n.term != term || !reply.OK {
+			return ErrLeaderChanged
+		}
+		seq++
+		return nil
+	}
+	if send(&SnapshotArgs{}) != nil {
+		return false
+	}
+
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	n.lock.Lock()
+	index := n.applied
+	lastTerm, _ := n.log.term(index)
+	members := n.log.members(index)
+	n.lock.Unlock()
+	err := n.conf.Machine.Snapshot(func(chunk []byte) error {
+		return send(&SnapshotArgs{Data: chunk})
+	})
+	if err == nil {
+		err = send(&SnapshotArgs{Done: true, Index: index, LastTerm: lastTerm, Members: members})
+	}
+	if err != nil {
+		log.Printf("raft snapshot to %s failed, err=%+v", peer, err)
+		return false
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.state == STATE_LEADER && n.term == term {
+		n.next[peer], n.match[peer] = index+1, index
+	}
+	return true
+}
+
+//heard handles a message of a leader of term, with n.lock held. It returns false when the
+//leader is stale
+func (n *Node) heard(term uint64, leader string) bool {
+	if term < n.term {
+		return false
+	}
+	if term > n.term || n.state != STATE_FOLLOWER {
+		n.setTerm(term)
+	}
+	n.leader, n.contact = leader, time.Now()
+	n.resetDeadline()
+	return true
+}
+
+func (n *Node) requestVote(args *VoteArgs) VoteReply {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	//a member which heard from the leader lately ignores candidates, so members removed
+	//without knowing it can't disrupt the group
+	if n.closed || n.leader != "" && time.Since(n.contact) < n.conf.ElectionTimeout || args.Term < n.term {
+		return VoteReply{Term: n.term}
+	}
+	if args.Term > n.term {
+		n.setTerm(args.Term)
+	}
+	upToDate := args.LastTerm > n.log.lastTerm() ||
+		args.LastTerm == n.log.lastTerm() && args.LastIndex >= n.log.lastIndex()
+	if (n.vote != "" && n.vote != args.Candidate) || !upToDate {
+		return VoteReply{Term: n.term}
+	}
+	n.vote = args.Candidate
+	if err := n.log.saveState(n.term, n.vote); err != nil {
+		return VoteReply{Term: n.term}
+	}
+	n.resetDeadline()
+	return VoteReply{Term: n.term, Granted: true}
+}
+
+func (n *Node) appendEntries(args *AppendArgs) AppendReply {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed || !n.heard(args.Term, args.Leader) {
+		return AppendReply{Term: n.term}
+	}
+	fail := AppendReply{Term: n.term}
+	switch prevTerm, ok := n.log.term(args.PrevIndex); {
+	case args.PrevIndex < n.log.snapIndex:
+		fail.Next = n.log.snapIndex + 1
+		return fail
+	case !ok:
+		fail.Next = n.log.lastIndex() + 1
+		return fail
+	case prevTerm != args.PrevTerm:
+		//skip the whole conflicting term at once
+		i := args.PrevIndex
+		for i > n.log.snapIndex+1 {
+			if t, _ := n.log.term(i - 1); t != prevTerm {
+				break
+			}
+			i--
+		}
+		fail.Next = i
+		return fail
+	}
+
+	changed := false //the configuration may have changed
+	for i, e := range args.Entries {
+		if term, ok := n.log.term(e.Index); ok {
+			if term == e.Term {
+				continue
+			}
+			if err := n.truncate(e.Index); err != nil {
+				return fail
+			}
+			changed = true
+		}
+		if err := n.log.append(args.Entries[i:]...); err != nil {
+			return fail
+		}
+		for _, v := range args.Entries[i:] {
+			changed = changed || v.Type == ENTRY_CONFIG
+		}
+		break
+	}
+	if changed {
+		n.setMembers()
+	}
+	if last := args.PrevIndex + uint64(len(args.Entries)); args.Commit > n.commit && last > n.commit {
+		if args.Commit < last {
+			last = args.Commit
+		}
+		n.setCommit(last)
+	}
+	return AppendReply{Term: n.term, Success: true}
+}
+
+//truncate drops the entries from index on, the proposals waiting for them failed
+func (n *Node) truncate(index uint64) error {
+	if err := n.log.truncate(index); err != nil {
+		return err
+	}
+	for i, w := range n.waiters {
+		if i >= index {
+			w.done <- proposal{err: ErrLeaderChanged}
+			delete(n.waiters, i)
+		}
+	}
+	return nil
+}
+
+func (n *Node) installSnapshot(args *SnapshotArgs) SnapshotReply {
+	n.lock.Lock()
+	if n.closed || !n.heard(args.Term, args.Leader) {
+		defer n.lock.Unlock()
+		return SnapshotReply{Term: n.term}
+	}
+	if args.Seq != 0 && args.Seq != n.restoring {
+		defer n.lock.Unlock()
+		return SnapshotReply{Term: n.term}
+	}
+	n.restoring = args.Seq + 1
+	n.lock.Unlock()
+
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	var err error
+	if args.Seq == 0 || args.Data != nil {
+		err = n.conf.Machine.Restore(args.Seq, args.Data)
+	}
+	if err == nil && args.Done {
+		err = n.conf.Machine.Restored(args.Index, args.LastTerm)
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if err != nil {
+		log.Printf("raft restore snapshot failed, err=%+v", err)
+		n.restoring = -1
+		return SnapshotReply{Term: n.term}
+	}
+	if args.Done {
+		n.restoring = -1
+		if err := n.log.reset(args.Index, args.LastTerm, args.Members); err != nil {
+			log.Printf("raft reset log failed, err=%+v", err)
+			return SnapshotReply{Term: n.term}
+		}
+		for i, w := range n.waiters {
+			w.done <- proposal{err: ErrLeaderChanged}
+			delete(n.waiters, i)
+		}
+		n.members = args.Members
+		n.commit, n.applied = args.Index, args.Index
+	}
+	return SnapshotReply{Term: n.term, OK: true}
+}
+
+//applyLoop applies the committed entries in order
+func (n *Node) applyLoop() {
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-n.applyWake:
+		}
+		for n.applyNext() {
+		}
+	}
+}
+
+//applyNext applies the next committed entry, false when there is none
+func (n *Node) applyNext() bool {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	n.lock.Lock()
+	if n.closed || n.applied >= n.commit {
+		n.lock.Unlock()
+		return false
+	}
+	e := n.log.entry(n.applied + 1)
+	n.lock.Unlock()
+	if e == nil {
+		return false
+	}
+
+	var result []byte
+	if e.Type == ENTRY_COMMAND {
+		result = n.conf.Machine.Apply(e.Index, e.Term, e.Data)
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.applied = e.Index
+	if w := n.waiters[e.Index]; w != nil {
+		if w.term == e.Term {
+			w.done <- proposal{result: result}
+		} else {
+			w.done <- proposal{err: ErrLeaderChanged}
+		}
+		delete(n.waiters, e.Index)
+	}
+	if e.Type == ENTRY_CONFIG && n.state == STATE_LEADER && !n.isMember(n.conf.ID) && !n.configPending() {
+		//removed from the group, leave it to the others
+		n.setTerm(n.term)
+	}
+	if n.applied-n.log.snapIndex >= 2*n.conf.KeepEntries {
+		if err := n.log.compact(n.applied - n.conf.KeepEntries); err != nil {
+			log.Printf("raft compact log failed, err=%+v", err)
+		}
+	}
+	return true
+}
@@ -0,0 +1,393 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//testMachine keeps the applied commands in memory, its snapshot is one chunk per command
+type testMachine struct {
+	lock     sync.Mutex
+	cmds     []string
+	index    uint64
+	term     uint64
+	restored int //snapshots installed
+}
+
+func (m *testMachine) Apply(index, term uint64, data []byte) []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cmds = append(m.cmds, string(data))
+	m.index, m.term = index, term
+	return []byte(fmt.Sprintf("%d:%s", len(m.cmds), data))
+}
+
+func (m *testMachine) Applied() (index, term uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.index, m.term
+}
+
+func (m *testMachine) Snapshot(write func(chunk []byte) error) error {
+	for _, v := range m.commands() {
+		if err := write([]byte(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *testMachine) Restore(seq int, chunk []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if seq == 0 {
+		m.cmds, m.index, m.term = nil, 0, 0
+	}
+	if chunk != nil {
+		m.cmds = append(m.cmds, string(chunk))
+	}
+	return nil
+}
+
+func (m *testMachine) Restored(index, term uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.index, m.term = index, term
+	m.restored++
+	return nil
+}
+
+func (m *testMachine) snapshots() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.restored
+}
+
+func (m *testMachine) commands() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string{}, m.cmds...)
+}
+
+//testMember is a member of a testGroup, its log and state machine outlive restarts
+type testMember struct {
+	conf Config
+	node *Node
+}
+
+//testGroup runs the members of a raft group in process on loopback ports
+type testGroup struct {
+	t       *testing.T
+	members []*testMember
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+//newTestGroup starts a new group of size members, conf is the base of their Config
+func newTestGroup(t *testing.T, size int, conf Config) *testGroup {
+	g := &testGroup{t: t}
+	var peers []Member
+	for i := 0; i < size; i++ {
+		addr := freeAddr(t)
+		peers = append(peers, Member{ID: addr, Addr: fmt.Sprintf("client-%d", i)})
+	}
+	for _, p := range peers {
+		g.add(p, peers, conf)
+	}
+	return g
+}
+
+//add starts a member with peers, none for a member waiting to be added
+func (g *testGroup) add(m Member, peers []Member, conf Config) *testMember {
+	db := store.NewLevelDB()
+	if err := db.Open(g.t.TempDir()); err != nil {
+		g.t.Fatal(err)
+	}
+	g.t.Cleanup(db.Close)
+	conf.ID, conf.Addr, conf.Store, conf.Machine, conf.Peers = m.ID, m.Addr, db, &testMachine{}, peers
+	if conf.HeartbeatInterval == 0 {
+		conf.HeartbeatInterval = 10 * time.Millisecond
+	}
+	ret := &testMember{conf: conf}
+	g.members = append(g.members, ret)
+	g.start(ret)
+	return ret
+}
+
+func (g *testGroup) start(m *testMember) {
+	node, err := Start(m.conf)
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	m.node = node
+	g.t.Cleanup(node.Close)
+}
+
+func (g *testGroup) stop(m *testMember) {
+	m.node.Close()
+	m.node = nil
+}
+
+func (m *testMember) machine() *testMachine {
+	return m.conf.Machine.(*testMachine)
+}
+
+//statusMember reports whether id is in the configuration of s
+func statusMember(s Status, id string) bool {
+	for _, v := range s.Members {
+		if v.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+//leader waits for the running members to agree on one leader
+func (g *testGroup) leader() *testMember {
+	g.t.Helper()
+	var ret *testMember
+	g.wait("a leader", func() bool {
+		ret = nil
+		var ids []string
+		for _, m := range g.members {
+			if m.node == nil {
+				continue
+			}
+			//Status copies the members under the lock of the node, it runs concurrently
+			s := m.node.Status()
+			if !statusMember(s, m.conf.ID) {
+				continue
+			}
+			if s.State == "leader" {
+				ret = m
+			}
+			ids = append(ids, s.Leader.ID)
+		}
+		for _, v := range ids {
+			if ret == nil || v != ret.conf.ID {
+				return false
+			}
+		}
+		return true
+	})
+	return ret
+}
+
+func (g *testGroup) followers() (ret []*testMember) {
+	leader := g.leader()
+	for _, m := range g.members {
+		if m != leader && m.node != nil {
+			ret = append(ret, m)
+		}
+	}
+	return
+}
+
+func (g *testGroup) wait(what string, f func() bool) {
+	g.t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !f(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			g.t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+//applied waits until m applied the commands of want
+func (g *testGroup) applied(m *testMember, want []string) {
+	g.t.Helper()
+	g.wait(m.conf.ID+" to apply", func() bool {
+		return reflect.DeepEqual(m.machine().commands(), want)
+	})
+}
+
+func TestElection(t *testing.T) {
+	g := newTestGroup(t, 3, Config{})
+	first := g.leader()
+	term := first.node.Status().Term
+	for _, m := range g.members {
+		if got := m.node.Leader(); got != (Member{ID: first.conf.ID, Addr: first.conf.Addr}) {
+			t.Fatalf("%s: Leader() = %v, want %v", m.conf.ID, got, first.conf.ID)
+		}
+	}
+
+	//the two members left elect one of them
+	g.stop(first)
+	second := g.leader()
+	if second == first {
+		t.Fatal("the stopped leader is still the leader")
+	}
+	if got := second.node.Status().Term; got <= term {
+		t.Fatalf("term %d of the new leader, want more than %d", got, term)
+	}
+	if _, err := second.node.Apply([]byte("a")); err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+
+	//the old leader comes back as a follower and catches up
+	g.start(first)
+	if g.leader() != second {
+		t.Fatal("the restarted member took over")
+	}
+	g.applied(first, []string{"a"})
+}
+
+func TestMajorityAck(t *testing.T) {
+	g := newTestGroup(t, 3, Config{})
+	leader := g.leader()
+	followers := g.followers()
+
+	//one follower down, the other makes a majority
+	g.stop(followers[0])
+	ret, err := leader.node.Apply([]byte("a"))
+	if err != nil || string(ret) != "1:a" {
+		t.Fatalf("Apply() = %q, %v", ret, err)
+	}
+	if s := followers[1].node.Status(); s.LastIndex < leader.node.Status().Commit {
+		t.Fatalf("acked at %d, the follower stored up to %d", leader.node.Status().Commit, s.LastIndex)
+	}
+
+	//both down, the entry waits for one of them
+	g.stop(followers[1])
+	done := make(chan error, 1)
+	go func() {
+		_, err := leader.node.Apply([]byte("b"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Apply() = %v without a majority", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if got := leader.machine().commands(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("the leader applied %q without a majority", got)
+	}
+	g.start(followers[0])
+	if err := <-done; err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+	g.applied(leader, []string{"a", "b"})
+	g.applied(followers[0], []string{"a", "b"})
+}
+
+func TestNotLeader(t *testing.T) {
+	tests := []struct {
+		forward bool
+		ret     string
+		err     error
+	}{
+		{false, "", ErrNotLeader},
+		{true, "1:a", nil},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("forward=%v", tt.forward), func(t *testing.T) {
+			g := newTestGroup(t, 3, Config{Forward: tt.forward})
+			leader := g.leader()
+			follower := g.followers()[0]
+			ret, err := follower.node.Apply([]byte("a"))
+			if string(ret) != tt.ret || err != tt.err {
+				t.Fatalf("Apply() = %q, %v, want %q, %v", ret, err, tt.ret, tt.err)
+			}
+			//the client is sent to the leader
+			if got := follower.node.Leader().Addr; got != leader.conf.Addr {
+				t.Fatalf("Leader().Addr = %q, want %q", got, leader.conf.Addr)
+			}
+		})
+	}
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	g := newTestGroup(t, 3, Config{KeepEntries: 2})
+	leader := g.leader()
+	lagging := g.followers()[0]
+	g.stop(lagging)
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		cmd := fmt.Sprintf("cmd%d", i)
+		if _, err := leader.node.Apply([]byte(cmd)); err != nil {
+			t.Fatalf("Apply(%s) = %v", cmd, err)
+		}
+		want = append(want, cmd)
+	}
+	snap := leader.node.Status().SnapIndex
+	if snap == 0 {
+		t.Fatal("the leader didn't compact its log")
+	}
+
+	//the entries the follower misses are gone, it is sent the state machine
+	g.start(lagging)
+	g.wait("a snapshot installed", func() bool { return lagging.machine().snapshots() > 0 })
+	g.applied(lagging, want)
+	if s := lagging.node.Status(); s.SnapIndex < snap || !reflect.DeepEqual(s.Members, leader.node.Status().Members) {
+		t.Fatalf("follower status %+v", s)
+	}
+
+	//and follows the log from the snapshot on
+	if _, err := leader.node.Apply([]byte("last")); err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+	g.applied(lagging, append(want, "last"))
+}
+
+func TestMembership(t *testing.T) {
+	g := newTestGroup(t, 3, Config{})
+	leader := g.leader()
+	if _, err := leader.node.Apply([]byte("a")); err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+
+	//a new member is sent the log once added
+	added := g.add(Member{ID: freeAddr(t), Addr: "client-3"}, nil, Config{})
+	if err := leader.node.AddMember(Member{ID: added.conf.ID, Addr: added.conf.Addr}); err != nil {
+		t.Fatalf("AddMember() = %v", err)
+	}
+	g.applied(added, []string{"a"})
+	if got := len(leader.node.Status().Members); got != 4 {
+		t.Fatalf("%d members, want 4", got)
+	}
+
+	//a majority of four is three, the group commits with one member down
+	g.stop(g.followers()[0])
+	if _, err := leader.node.Apply([]byte("b")); err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+	if err := leader.node.RemoveMember("unknown"); err != ErrMember {
+		t.Fatalf("RemoveMember(unknown) = %v", err)
+	}
+
+	//the leader removing itself steps down, the others go on without it
+	members := leader.node.Status().Members
+	if err := leader.node.RemoveMember(leader.conf.ID); err != nil {
+		t.Fatalf("RemoveMember() = %v", err)
+	}
+	next := g.leader()
+	if next == leader {
+		t.Fatal("the removed leader still leads")
+	}
+	if got := next.node.Status().Members; len(got) != len(members)-1 {
+		t.Fatalf("members %v after removing %s from %v", got, leader.conf.ID, members)
+	}
+	for _, m := range next.node.Status().Members {
+		if m.ID == leader.conf.ID {
+			t.Fatalf("%s is still a member", m.ID)
+		}
+	}
+	if _, err := next.node.Apply([]byte("c")); err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+	g.applied(added, []string{"a", "b", "c"})
+}
@@ -0,0 +1,213 @@
+package raft
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+//the messages members exchange over net/rpc, see the Raft paper for the first three
+type VoteArgs struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type VoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendArgs struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []*Entry
+	Commit    uint64
+}
+
+type AppendReply struct {
+	Term    uint64
+	Success bool
+	Next    uint64 //index the leader should send from when Success is false
+}
+
+//SnapshotArgs carries one chunk of the state machine, Seq counts the chunks from 0
+type SnapshotArgs struct {
+	Term     uint64
+	Leader   string
+	Seq      int
+	Data     []byte
+	Done     bool //last chunk, Index, LastTerm and Members describe the snapshot
+	Index    uint64
+	LastTerm uint64
+	Members  []Member
+}
+
+type SnapshotReply struct {
+	Term uint64
+	OK   bool //false asks the leader to start over
+}
+
+//ProposeArgs is a proposal forwarded to the leader, a command unless Add or Remove is set
+type ProposeArgs struct {
+	Data   []byte
+	Add    *Member
+	Remove string
+}
+
+type ProposeReply struct {
+	Result []byte
+	Err    string
+}
+
+//service exposes a Node to net/rpc
+type service struct {
+	n *Node
+}
+
+func (s *service) RequestVote(args *VoteArgs, reply *VoteReply) error {
+	*reply = s.n.requestVote(args)
+	return nil
+}
+
+func (s *service) AppendEntries(args *AppendArgs, reply *AppendReply) error {
+	*reply = s.n.appendEntries(args)
+	return nil
+}
+
+func (s *service) InstallSnapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+	*reply = s.n.installSnapshot(args)
+	return nil
+}
+
+func (s *service) Propose(args *ProposeArgs, reply *ProposeReply) error {
+	var err error
+	switch {
+	case args.Add != nil:
+		err = s.n.AddMember(*args.Add)
+	case args.Remove != "":
+		err = s.n.RemoveMember(args.Remove)
+	default:
+		reply.Result, err = s.n.Apply(args.Data)
+	}
+	if err != nil {
+		reply.Err = err.Error()
+	}
+	return nil
+}
+
+//transport serves the rpc of a node and keeps one connection per peer
+type transport struct {
+	ln      net.Listener
+	lock    sync.Mutex
+	clients map[string]*rpc.Client
+	conns   map[net.Conn]bool //accepted
+	closed  bool
+}
+
+func listen(n *Node, addr string) (*transport, error) {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Raft", &service{n: n}); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t := &transport{ln: ln, clients: make(map[string]*rpc.Client), conns: make(map[net.Conn]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.lock.Lock()
+			if t.closed {
+				t.lock.Unlock()
+				_ = conn.Close()
+				return
+			}
+			t.conns[conn] = true
+			t.lock.Unlock()
+			go func() {
+				srv.ServeConn(conn)
+				t.lock.Lock()
+				delete(t.conns, conn)
+				t.lock.Unlock()
+			}()
+		}
+	}()
+	return t, nil
+}
+
+var errTransportClosed = errors.New("raft transport closed")
+
+//call runs method on peer, a connection failing or timing out is dropped and dialed again next time
+func (t *transport) call(peer, method string, args, reply interface{}, timeout time.Duration) error {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return errTransportClosed
+	}
+	c := t.clients[peer]
+	t.lock.Unlock()
+	if c == nil {
+		conn, err := net.DialTimeout("tcp", peer, timeout)
+		if err != nil {
+			return err
+		}
+		c = rpc.NewClient(conn)
+		t.lock.Lock()
+		if old := t.clients[peer]; old != nil || t.closed {
+			_ = c.Close()
+			c = old
+		} else {
+			t.clients[peer] = c
+		}
+		t.lock.Unlock()
+		if c == nil {
+			return errTransportClosed
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case call := <-c.Go("Raft."+method, args, reply, make(chan *rpc.Call, 1)).Done:
+		if _, ok := call.Error.(rpc.ServerError); call.Error != nil && !ok {
+			t.drop(peer, c)
+		}
+		return call.Error
+	case <-timer.C:
+		t.drop(peer, c)
+		return ErrTimeout
+	}
+}
+
+func (t *transport) drop(peer string, c *rpc.Client) {
+	t.lock.Lock()
+	if t.clients[peer] == c {
+		delete(t.clients, peer)
+	}
+	t.lock.Unlock()
+	_ = c.Close()
+}
+
+func (t *transport) close() {
+	t.lock.Lock()
+	t.closed = true
+	clients, conns := t.clients, t.conns
+	t.clients, t.conns = nil, nil
+	t.lock.Unlock()
+	_ = t.ln.Close()
+	for _, c := range clients {
+		_ = c.Close()
+	}
+	for conn := range conns {
+		_ = conn.Close()
+	}
+}
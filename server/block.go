@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTimeoutInvalid  = errors.New("timeout is not a float or out of range")
+	ErrTimeoutNegative = errors.New("timeout is negative")
+)
+
+//BlockingKeys wakes up clients blocked on keys (BZPOPMIN etc.) when a key receives new data,
+//the same key name in different logical databases is watched separately
+type BlockingKeys struct {
+	lock    sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+	keys    map[chan struct{}][]string //keys each waiter is registered under
+}
+
+var Blocking = NewBlockingKeys()
+
+func NewBlockingKeys() *BlockingKeys {
+	return &BlockingKeys{
+		waiters: make(map[string]map[chan struct{}]struct{}),
+		keys:    make(map[chan struct{}][]string),
+	}
+}
+
+//blockingKey is the key of the waiters of key in logical database db
+func blockingKey(db int, key []byte) string {
+	return strconv.Itoa(db) + ":" + string(key)
+}
+
+//Watch registers a waiter on keys of database db, the returned channel is closed on the first Signal of any of them
+func (b *BlockingKeys) Watch(db int, keys ...[]byte) (chan struct{}, func()) {
+	ch := make(chan struct{})
+	names := make([]string, len(keys))
+	b.lock.Lock()
+	for i, k := range keys {
+		names[i] = blockingKey(db, k)
+		set, ok := b.waiters[names[i]]
+		if !ok {
+			set = make(map[chan struct{}]struct{})
+			b.waiters[names[i]] = set
+		}
+		set[ch] = struct{}{}
+	}
+	b.keys[ch] = names
+	b.lock.Unlock()
+
+	cancel := func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.remove(ch)
+	}
+	return ch, cancel
+}
+
+//Signal wakes the waiters of key in database db. A waiter is removed from all its keys as it is woken, so
+//a Signal of another of them never closes its channel again
+func (b *BlockingKeys) Signal(db int, key []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.waiters[blockingKey(db, key)] {
+		close(ch)
+		b.remove(ch)
+	}
+}
+
+//pendingSignals holds back the Signals of the commands run by EXEC or a script, whose writes
+//are only seen by the woken clients once they commit
+type pendingSignals struct {
+	dbs  []int
+	keys [][]byte
+}
+
+//signal wakes the clients blocked on key of database db, or holds the Signal back in c.signals
+func (c *Client) signal(db int, key []byte) {
+	if c.signals != nil {
+		c.signals.dbs = append(c.signals.dbs, db)
+		c.signals.keys = append(c.signals.keys, key)
+		return
+	}
+	Blocking.Signal(db, key)
+}
+
+//flush sends the held back Signals once the writes committed, or moves them to to, the
+//Signals of an EXEC running the script that commits later
+func (p *pendingSignals) flush(to *pendingSignals) {
+	if to != nil {
+		to.dbs = append(to.dbs, p.dbs...)
+		to.keys = append(to.keys, p.keys...)
+		return
+	}
+	for i, k := range p.keys {
+		Blocking.Signal(p.dbs[i], k)
+	}
+}
+
+//remove unregisters the waiter ch from all its keys, the caller holds the lock
+func (b *BlockingKeys) remove(ch chan struct{}) {
+	for _, k := range b.keys[ch] {
+		set := b.waiters[k]
+		delete(set, ch)
+		if len(set) == 0 {
+			delete(b.waiters, k)
+		}
+	}
+	delete(b.keys, ch)
+}
+
+//Block calls try until it succeeds or timeout elapses, woken by Signals of keys in database db,
+//a zero timeout blocks forever
+func (b *BlockingKeys) Block(db int, keys [][]byte, timeout time.Duration, try func() bool) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		ch, cancel := b.Watch(db, keys...)
+		if try() {
+			cancel()
+			return true
+		}
+		select {
+		case <-ch:
+			cancel()
+		case <-deadline:
+			cancel()
+			return false
+		}
+	}
+}
+
+//parseTimeout parses a blocking timeout given in seconds
+func parseTimeout(arg []byte) (time.Duration, error) {
+	sec, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(sec) || math.IsInf(sec, 0) {
+		return 0, ErrTimeoutInvalid
+	}
+	if sec < 0 {
+		return 0, ErrTimeoutNegative
+	}
+	return time.Duration(sec * float64(time.Second)), nil
+}
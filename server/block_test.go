@@ -0,0 +1,186 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlockingKeysSignal(t *testing.T) {
+	tests := []struct {
+		name    string
+		watch   []string
+		db      int //database of the signals, the keys are watched in database 0
+		signals []string
+		woken   bool
+	}{
+		{"no signal", []string{"a"}, 0, nil, false},
+		{"other key", []string{"a"}, 0, []string{"b"}, false},
+		{"other database", []string{"a"}, 1, []string{"a"}, false},
+		{"one key", []string{"a"}, 0, []string{"a"}, true},
+		{"every key", []string{"a", "b", "c"}, 0, []string{"a", "b", "c"}, true},
+		{"same key twice", []string{"a", "b"}, 0, []string{"b", "b", "a"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBlockingKeys()
+			keys := make([][]byte, 0, len(tt.watch))
+			for _, v := range tt.watch {
+				keys = append(keys, []byte(v))
+			}
+			ch, cancel := b.Watch(0, keys...)
+			defer cancel()
+			for _, v := range tt.signals {
+				b.Signal(tt.db, []byte(v))
+			}
+			select {
+			case <-ch:
+				if !tt.woken {
+					t.Fatal("woken without a signal of its keys")
+				}
+			default:
+				if tt.woken {
+					t.Fatal("not woken")
+				}
+			}
+			if tt.woken && (len(b.waiters) != 0 || len(b.keys) != 0) {
+				t.Fatalf("woken waiter still registered: %v", b.waiters)
+			}
+		})
+	}
+}
+
+func TestBlockingKeysCancel(t *testing.T) {
+	b := NewBlockingKeys()
+	_, cancel := b.Watch(0, []byte("a"), []byte("b"))
+	cancel()
+	cancel()
+	b.Signal(0, []byte("a"))
+	if len(b.waiters) != 0 || len(b.keys) != 0 {
+		t.Fatalf("cancelled waiter still registered: %v", b.waiters)
+	}
+}
+
+//TestPendingSignals holds back the Signal of a command run by a script, inside EXEC or not,
+//until the writes commit
+func TestPendingSignals(t *testing.T) {
+	tests := []struct {
+		name string
+		exec bool //the script runs inside EXEC, which commits after it
+	}{
+		{"script", false},
+		{"script in exec", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, cancel := Blocking.Watch(0, []byte("k"))
+			defer cancel()
+			woken := func() bool {
+				select {
+				case <-ch:
+					return true
+				default:
+					return false
+				}
+			}
+			c := &Client{signals: &pendingSignals{}}
+			c.signal(0, []byte("k"))
+			if woken() {
+				t.Fatal("woken before the commit")
+			}
+			if tt.exec {
+				exec := &pendingSignals{}
+				c.signals.flush(exec)
+				if woken() {
+					t.Fatal("woken before the commit of EXEC")
+				}
+				exec.flush(nil)
+			} else {
+				c.signals.flush(nil)
+			}
+			if !woken() {
+				t.Fatal("not woken after the commit")
+			}
+		})
+	}
+}
+
+//TestBlockSeveralKeys has two clients block on the same keys, then signals the keys one
+//after the other like ZADD a, ZADD b would
+func TestBlockSeveralKeys(t *testing.T) {
+	b := NewBlockingKeys()
+	keys := [][]byte{[]byte("a"), []byte("b")}
+	var lock sync.Mutex
+	ready := map[string]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok := b.Block(0, keys, 5*time.Second, func() bool {
+				lock.Lock()
+				defer lock.Unlock()
+				for _, k := range []string{"a", "b"} {
+					if ready[k] > 0 {
+						ready[k]--
+						return true
+					}
+				}
+				return false
+			})
+			if !ok {
+				t.Error("Block timed out")
+			}
+		}()
+	}
+	for _, k := range []string{"a", "b"} {
+		//wait for both clients to be registered before the first signal
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			b.lock.Lock()
+			n := len(b.keys)
+			b.lock.Unlock()
+			if n == 2 || time.Now().After(deadline) {
+				break
+			}
+		}
+		lock.Lock()
+		ready[k]++
+		lock.Unlock()
+		b.Signal(0, []byte(k))
+	}
+	wg.Wait()
+}
+
+func TestBlockTimeout(t *testing.T) {
+	b := NewBlockingKeys()
+	start := time.Now()
+	if b.Block(0, [][]byte{[]byte("a")}, 20*time.Millisecond, func() bool { return false }) {
+		t.Fatal("Block succeeded without data")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("Block returned before its timeout")
+	}
+	if len(b.waiters) != 0 {
+		t.Fatalf("timed out waiter still registered: %v", b.waiters)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want time.Duration
+		err  error
+	}{
+		{"0", 0, nil},
+		{"1.5", 1500 * time.Millisecond, nil},
+		{"-1", 0, ErrTimeoutNegative},
+		{"x", 0, ErrTimeoutInvalid},
+		{"inf", 0, ErrTimeoutInvalid},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeout([]byte(tt.arg))
+		if got != tt.want || err != tt.err {
+			t.Errorf("parseTimeout(%q) = %v, %v, want %v, %v", tt.arg, got, err, tt.want, tt.err)
+		}
+	}
+}
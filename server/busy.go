@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//scriptRun is a script or function being run by runLua
+type scriptRun struct {
+	kind   string //the command killing it, SCRIPT or FUNCTION
+	start  time.Time
+	cancel context.CancelFunc
+	lock   sync.Mutex
+	wrote  bool //a write command was called, the run can't be killed anymore
+	killed bool
+}
+
+//write reports whether the run may call a write command, false once it was killed
+func (r *scriptRun) write() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.killed {
+		return false
+	}
+	r.wrote = true
+	return true
+}
+
+//kill stops the run unless it wrote already
+func (r *scriptRun) kill() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.wrote {
+		return false
+	}
+	r.killed = true
+	r.cancel()
+	return true
+}
+
+func (r *scriptRun) isKilled() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.killed
+}
+
+//runningScripts tracks the runs of scripts and functions. Once one ran for longer than
+//Conf.LuaTimeLimit the other clients get BUSY until it ends or SCRIPT KILL or FUNCTION KILL
+//stops it
+type runningScripts struct {
+	lock  sync.Mutex
+	runs  map[*scriptRun]bool
+	count int32 //len(runs), busy skips the lock while it is zero
+}
+
+var Running = &runningScripts{runs: make(map[*scriptRun]bool)}
+
+func (s *runningScripts) add(kind string, cancel context.CancelFunc) *scriptRun {
+	r := &scriptRun{kind: kind, start: time.Now(), cancel: cancel}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.runs[r] = true
+	atomic.StoreInt32(&s.count, int32(len(s.runs)))
+	return r
+}
+
+func (s *runningScripts) remove(r *scriptRun) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.runs, r)
+	atomic.StoreInt32(&s.count, int32(len(s.runs)))
+	r.cancel()
+}
+
+//busy returns the BUSY reply while a run is over the time limit, "" otherwise
+func (s *runningScripts) busy() string {
+	if atomic.LoadInt32(&s.count) == 0 {
+		return ""
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if Conf.LuaTimeLimit <= 0 {
+		return ""
+	}
+	for r := range s.runs {
+		if time.Since(r.start) > Conf.LuaTimeLimit {
+			return "BUSY Redis is busy running a script. You can only call " + r.kind + " KILL or SHUTDOWN NOSCRIPT."
+		}
+	}
+	return ""
+}
+
+//kill stops the runs of kind and returns the error to reply, "" when one was stopped
+func (s *runningScripts) kill(kind string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	found, killed := false, false
+	for r := range s.runs {
+		if r.kind == kind {
+			found = true
+			killed = r.kill() || killed
+		}
+	}
+	switch {
+	case !found:
+		return "NOTBUSY No scripts in execution right now."
+	case !killed:
+		return "UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."
+	}
+	return ""
+}
+
+//scriptKill reports whether the command is SCRIPT KILL or FUNCTION KILL, which are served
+//while a script runs and without waiting for shardLock
+func scriptKill(cmd string, args [][]byte) bool {
+	return (cmd == "script" || cmd == "function") && len(args) == 2 && strings.EqualFold(string(args[1]), "kill")
+}
+
+func killScripts(c *Client, kind string) {
+	if e := Running.kill(kind); e != "" {
+		c.Conn.WriteError(e)
+		return
+	}
+	c.Conn.WriteString("OK")
+}
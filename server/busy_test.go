@@ -0,0 +1,115 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+//waitBusy waits for a script to go over the time limit, then returns the reply of conn. A
+//command sent before would wait for the shards the script holds
+func waitBusy(t *testing.T, conn *testConn) string {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); Running.busy() == ""; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("never busy")
+		}
+	}
+	return conn.do("get", "x")
+}
+
+func TestScriptKill(t *testing.T) {
+	defer func(limit time.Duration) { Conf.LuaTimeLimit = limit }(Conf.LuaTimeLimit)
+	Conf.LuaTimeLimit = 50 * time.Millisecond
+	db := newTestDB(t)
+	setup := newTestConn(db)
+	setup.do("function", "load", "#!lua name=lib\nredis.register_function('spin', function(keys, args) while true do end end)")
+
+	tests := []struct {
+		name  string
+		run   []string
+		kill  []string
+		busy  string
+		reply string //of the killed run
+	}{
+		{"eval", []string{"eval", "while true do end", "0"}, []string{"script", "kill"},
+			"-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSCRIPT.",
+			"-ERR Script killed by user with SCRIPT KILL..."},
+		{"eval with keys", []string{"eval", "redis.call('get', KEYS[1]) while true do end", "1", "k"}, []string{"script", "kill"},
+			"-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSCRIPT.",
+			"-ERR Script killed by user with SCRIPT KILL..."},
+		{"fcall", []string{"fcall", "spin", "0"}, []string{"function", "kill"},
+			"-BUSY Redis is busy running a script. You can only call FUNCTION KILL or SHUTDOWN NOSCRIPT.",
+			"-ERR Script killed by user with FUNCTION KILL..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner, other := newTestConn(db), newTestConn(db)
+			done := make(chan string)
+			go func() { done <- runner.do(tt.run...) }()
+			if busy := waitBusy(t, other); busy != tt.busy {
+				t.Fatalf("busy reply %q, want %q", busy, tt.busy)
+			}
+			if ret := other.do(tt.kill...); ret != "+OK" {
+				t.Fatalf("%v = %q", tt.kill, ret)
+			}
+			if ret := <-done; ret != tt.reply {
+				t.Fatalf("killed run replied %q, want %q", ret, tt.reply)
+			}
+			if ret := other.do("set", "x", "1"); ret != "+OK" {
+				t.Fatalf("SET after the kill = %q", ret)
+			}
+		})
+	}
+}
+
+func TestScriptUnkillable(t *testing.T) {
+	defer func(limit time.Duration) { Conf.LuaTimeLimit = limit }(Conf.LuaTimeLimit)
+	Conf.LuaTimeLimit = 50 * time.Millisecond
+	db := newTestDB(t)
+	runner, other := newTestConn(db), newTestConn(db)
+	if ret := other.do("script", "kill"); ret != "-NOTBUSY No scripts in execution right now." {
+		t.Fatalf("SCRIPT KILL without a script = %q", ret)
+	}
+
+	//the script writes, then spins until the test writes stop behind the server's back
+	done := make(chan string)
+	go func() {
+		done <- runner.do("eval", "redis.call('set', 'w', '1') while not redis.call('get', 'stop') do end return 'ended'", "0")
+	}()
+	waitBusy(t, other)
+	if ret := other.do("script", "kill"); !strings.HasPrefix(ret, "-UNKILLABLE") {
+		t.Fatalf("SCRIPT KILL of a script that wrote = %q", ret)
+	}
+	if ret := other.do("function", "kill"); ret != "-NOTBUSY No scripts in execution right now." {
+		t.Fatalf("FUNCTION KILL of a script = %q", ret)
+	}
+	db.Set([]byte("stop"), []byte("1"), 0)
+	if ret := <-done; ret != "$5 ended" {
+		t.Fatalf("script replied %q", ret)
+	}
+	if ret := other.do("get", "w"); ret != "+1" {
+		t.Fatalf("write of the script = %q", ret)
+	}
+}
+
+func TestLuaTimeLimitConfig(t *testing.T) {
+	defer func(limit time.Duration) { Conf.LuaTimeLimit = limit }(Conf.LuaTimeLimit)
+	conn := newTestConn(newTestDB(t))
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"config", "set", "lua-time-limit", "250"}, "+OK"},
+		{[]string{"config", "get", "lua-time-limit"}, "*2 $14 lua-time-limit $3 250"},
+		{[]string{"config", "set", "lua-time-limit", "-1"}, "-ERR Invalid argument '-1' for CONFIG SET 'lua-time-limit' - argument must be a non negative number of milliseconds"},
+	}
+	for _, tt := range tests {
+		if got := conn.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if Conf.LuaTimeLimit != 250*time.Millisecond {
+		t.Errorf("Conf.LuaTimeLimit = %v", Conf.LuaTimeLimit)
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zealous-w/tacodb/command"
+)
+
+const (
+	CDC_READ_COUNT = 100 //entries returned by CDC READ without COUNT
+)
+
+//cmdCDC serves the change log to consumers mirroring the data elsewhere:
+//
+//	CDC INFO                                      -> [shard first next] per shard
+//	CDC READ shard seq [COUNT n] [BLOCK ms]       -> [seq time command [[db key row value] ...]] ...
+//
+//An entry lists the rows one transaction wrote, value is null for a deleted row and db
+//is -1 when the physical database is no longer selectable. A consumer reads from the seq
+//after the last entry it applied, BLOCK waits for new entries like XREAD does
+func cmdCDC(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	switch strings.ToUpper(string(args[1])) {
+	case "INFO":
+		if len(args) != 2 {
+			break
+		}
+		c.Conn.WriteArray(db.Shards())
+		for i := 0; i < db.Shards(); i++ {
+			first, next, err := db.ChangeLogRange(i)
+			if err != nil {
+				c.Conn.WriteError("ERR " + err.Error())
+				return nil
+			}
+			c.Conn.WriteArray(3)
+			c.Conn.WriteInt(i)
+			c.Conn.WriteInt(int(first))
+			c.Conn.WriteInt(int(next))
+		}
+		return nil
+	case "READ":
+		if len(args) < 4 {
+			break
+		}
+		return cdcRead(c, db, args[2:]...)
+	}
+	c.Conn.WriteError("ERR unknown subcommand or wrong number of arguments for '" + string(args[1]) + "'. Try CDC HELP.")
+	return nil
+}
+
+func cdcRead(c *Client, db *command.RedisCommand, args ...[]byte) error {
+	shard, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		c.Conn.WriteError("ERR value is not an integer or out of range")
+		return nil
+	}
+	seq, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		c.Conn.WriteError("ERR value is not an integer or out of range")
+		return nil
+	}
+	count, block, timeout := CDC_READ_COUNT, false, time.Duration(0)
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.Conn.WriteError("ERR syntax error")
+			return nil
+		}
+		n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil || n < 0 {
+			c.Conn.WriteError("ERR value is not an integer or out of range")
+			return nil
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "COUNT":
+			if n > 0 {
+				count = int(n)
+			}
+		case "BLOCK":
+			block, timeout = true, time.Duration(n)*time.Millisecond
+		default:
+			c.Conn.WriteError("ERR syntax error")
+			return nil
+		}
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		entries, wait, err := db.ReadChanges(shard, seq, count)
+		if err != nil {
+			c.Conn.WriteError("ERR " + err.Error())
+			return nil
+		}
+		if len(entries) > 0 || !block || c.exec {
+			writeChanges(c, db, entries)
+			return nil
+		}
+		shardLock.RUnlock()
+		select {
+		case <-wait:
+		case <-deadline:
+			wait = nil
+		}
+		shardLock.RLock()
+		if wait == nil {
+			c.Conn.WriteNull()
+			return nil
+		}
+	}
+}
+
+func writeChanges(c *Client, db *command.RedisCommand, entries []*command.ChangeEntry) {
+	c.Conn.WriteArray(len(entries))
+	for _, e := range entries {
+		c.Conn.WriteArray(4)
+		c.Conn.WriteInt(int(e.Seq))
+		c.Conn.WriteInt(int(e.Time))
+		c.Conn.WriteBulk([]byte(e.Command))
+		c.Conn.WriteArray(len(e.Changes))
+		for _, v := range e.Changes {
+			c.Conn.WriteArray(4)
+			c.Conn.WriteInt(db.IndexOf(v.Phys))
+			c.Conn.WriteBulk(v.Key)
+			c.Conn.WriteBulk(v.Row)
+			if v.Value == nil {
+				c.Conn.WriteNull()
+			} else {
+				c.Conn.WriteBulk(v.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/store"
+)
+
+func TestCDC(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string //prefix of the reply, entries carry their commit time
+	}{
+		{[]string{"cdc", "info"}, "*2 *3 :0 :0 :1 *3 :1 :0 :0"},
+		{[]string{"cdc", "read", "0", "0"}, "*1 *4 :0 :"},
+		{[]string{"cdc", "read", "1", "0"}, "*0"},
+		{[]string{"cdc", "read", "0", "1", "BLOCK", "10"}, "$-1"},
+		{[]string{"cdc", "read", "0", "0", "COUNT"}, "-ERR syntax error"},
+		{[]string{"cdc", "read", "0", "0", "COUNT", "-1"}, "-ERR value is not an integer or out of range"},
+		{[]string{"cdc", "read", "0", "0", "FOO", "1"}, "-ERR syntax error"},
+		{[]string{"cdc", "read", "x", "0"}, "-ERR value is not an integer or out of range"},
+		{[]string{"cdc", "read", "9", "0"}, "-ERR change log is not enabled"},
+		{[]string{"cdc", "nosuch"}, "-ERR unknown subcommand or wrong number of arguments for 'nosuch'. Try CDC HELP."},
+	}
+	stores, closeDB := store.NewDBStore("leveldb", t.TempDir(), 2)
+	t.Cleanup(closeDB)
+	db := command.NewRedisCommand(stores, command.DATABASES_DEFAULT, "")
+	db.EnableChangeLog(0, 0)
+	c := newTestConn(db)
+	//one write to the shard of k
+	key := "k"
+	for db.Shard([]byte(key)) != 0 {
+		key += "k"
+	}
+	c.do("set", key, "v")
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%v = %q, want %q...", tt.cmd, got, tt.want)
+		}
+	}
+	if got := c.do("cdc", "read", "0", "0"); !strings.Contains(got, " $3 set *1 *4 :0 $"+strconv.Itoa(len(key))+" "+key+" ") {
+		t.Errorf("CDC READ = %q", got)
+	}
+
+	//BLOCK returns the entry written while waiting
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		newTestConn(db).do("set", key, "w")
+	}()
+	if got := c.do("cdc", "read", "0", "1", "BLOCK", "5000"); !strings.HasPrefix(got, "*1 *4 :1 :") {
+		t.Errorf("CDC READ BLOCK = %q", got)
+	}
+}
@@ -0,0 +1,1061 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zealous-w/redcon"
+	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//Cluster mode splits the keyspace in util.HASH_SLOTS hash slots like redis cluster. Every node
+//serves the slots it owns and answers MOVED with the owner for the others, a slot being
+//migrated answers ASK for the keys already moved, see clusterCheck. Only database 0 exists.
+//
+//Nodes talk over the client port: every CLUSTER_GOSSIP_PERIOD a node sends each node it
+//knows "CLUSTER GOSSIP currentEpoch nodes", nodes in the format of CLUSTER NODES, and gets the
+//same back. The line flagged myself is taken as the truth about its sender, the other lines
+//only introduce nodes. A slot claimed by a node goes to it when no node owns it or its config
+//epoch is greater than the one of the owner, which is how CLUSTER SETSLOT NODE on the node
+//importing a slot spreads. Like in redis slots are never freed by gossip, DELSLOTS only changes
+//the node it is sent to. The view of a node is saved to its config file at every change.
+//
+//There is no failover, a node unreachable for the node timeout is only flagged fail?
+const (
+	CLUSTER_GOSSIP_PERIOD = time.Second
+	CLUSTER_FORGET_TTL    = 60 * time.Second //a forgotten node isn't added back by gossip for this long
+)
+
+var (
+	ErrClusterConfig = errors.New("invalid cluster config file")
+	ErrClusterAddr   = errors.New("invalid node address")
+)
+
+//Cluster is the cluster state of the node, nil unless cluster mode is on
+var Cluster *cluster
+
+type clusterNode struct {
+	id        string
+	ip        string
+	port      int
+	epoch     uint64 //config epoch
+	handshake bool   //met with MEET, id is a placeholder until it answers
+	pingSent  time.Time
+	pongRecv  time.Time
+	connected bool
+	busy      bool //a gossip exchange with the node is running
+	conn      net.Conn
+	rd        *bufio.Reader
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.port))
+}
+
+type cluster struct {
+	lock      sync.RWMutex
+	db        *command.RedisCommand
+	path      string
+	timeout   time.Duration
+	epoch     uint64 //current epoch
+	myself    *clusterNode
+	nodes     map[string]*clusterNode
+	slots     [util.HASH_SLOTS]*clusterNode
+	migrating map[int]*clusterNode //slot -> node it is migrated to
+	importing map[int]*clusterNode //slot -> node it is imported from
+	banned    map[string]time.Time
+}
+
+//StartCluster turns cluster mode on, addr is the address other nodes reach this one on and
+//path its config file, created when missing
+func StartCluster(db *command.RedisCommand, addr, path string, timeout time.Duration) error {
+	host, port, err := splitNodeAddr(addr)
+	if err != nil {
+		return err
+	}
+	if err := db.SetSlotIndex(true); err != nil {
+		return err
+	}
+	c := &cluster{
+		db:        db,
+		path:      path,
+		timeout:   timeout,
+		nodes:     make(map[string]*clusterNode),
+		migrating: make(map[int]*clusterNode),
+		importing: make(map[int]*clusterNode),
+		banned:    make(map[string]time.Time),
+	}
+	if err := c.load(); err != nil {
+		return err
+	}
+	if c.myself == nil {
+		c.myself = &clusterNode{id: newNodeID()}
+		c.nodes[c.myself.id] = c.myself
+	}
+	c.myself.ip, c.myself.port, c.myself.connected = host, port, true
+	if err := c.save(); err != nil {
+		return err
+	}
+	Cluster = c
+	go c.gossipLoop()
+	return nil
+}
+
+func newNodeID() string {
+	id := make([]byte, 20)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func splitNodeAddr(addr string) (string, int, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, ErrClusterAddr
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 || host == "" {
+		return "", 0, ErrClusterAddr
+	}
+	return host, port, nil
+}
+
+//nodeLine formats n like a line of CLUSTER NODES
+func (c *cluster) nodeLine(n *clusterNode) string {
+	flags := "master"
+	switch {
+	case n == c.myself:
+		flags = "myself,master"
+	case n.handshake:
+		flags = "handshake"
+	case time.Since(n.pongRecv) > c.timeout:
+		flags = "master,fail?"
+	}
+	link := "disconnected"
+	if n.connected {
+		link = "connected"
+	}
+	fields := []string{
+		n.id,
+		n.addr() + "@" + strconv.Itoa(n.port),
+		flags,
+		"-",
+		strconv.FormatInt(unixMilli(n.pingSent), 10),
+		strconv.FormatInt(unixMilli(n.pongRecv), 10),
+		strconv.FormatUint(n.epoch, 10),
+		link,
+	}
+	for _, r := range c.slotRanges(n) {
+		if r[0] == r[1] {
+			fields = append(fields, strconv.Itoa(r[0]))
+		} else {
+			fields = append(fields, strconv.Itoa(r[0])+"-"+strconv.Itoa(r[1]))
+		}
+	}
+	if n == c.myself {
+		for _, slot := range sortedSlots(c.migrating) {
+			fields = append(fields, "["+strconv.Itoa(slot)+"->-"+c.migrating[slot].id+"]")
+		}
+		for _, slot := range sortedSlots(c.importing) {
+			fields = append(fields, "["+strconv.Itoa(slot)+"-<-"+c.importing[slot].id+"]")
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func sortedSlots(m map[int]*clusterNode) []int {
+	ret := make([]int, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+//slotRanges returns the ranges of slots owned by n, nil n returns those nobody owns
+func (c *cluster) slotRanges(n *clusterNode) (ret [][2]int) {
+	for i := 0; i < util.HASH_SLOTS; i++ {
+		if c.slots[i] != n {
+			continue
+		}
+		if len(ret) > 0 && ret[len(ret)-1][1] == i-1 {
+			ret[len(ret)-1][1] = i
+		} else {
+			ret = append(ret, [2]int{i, i})
+		}
+	}
+	return
+}
+
+//sortedNodes returns the nodes ordered by id
+func (c *cluster) sortedNodes() []*clusterNode {
+	ret := make([]*clusterNode, 0, len(c.nodes))
+	for _, v := range c.nodes {
+		ret = append(ret, v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].id < ret[j].id })
+	return ret
+}
+
+func (c *cluster) nodesText() string {
+	var b strings.Builder
+	for _, n := range c.sortedNodes() {
+		b.WriteString(c.nodeLine(n))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+//save writes the config file, nodes met but not answering yet aren't kept
+func (c *cluster) save() error {
+	var b strings.Builder
+	for _, n := range c.sortedNodes() {
+		if !n.handshake {
+			b.WriteString(c.nodeLine(n))
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString("vars currentEpoch " + strconv.FormatUint(c.epoch, 10) + " lastVoteEpoch 0\n")
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+//saveLogged saves the config file, a failure is only logged as the change is made already
+func (c *cluster) saveLogged() {
+	if err := c.save(); err != nil {
+		log.Printf("save cluster config failed, path=%s, err=%+v", c.path, err)
+	}
+}
+
+//nodeInfo is a line of CLUSTER NODES
+type nodeInfo struct {
+	id        string
+	ip        string
+	port      int
+	myself    bool
+	handshake bool
+	epoch     uint64
+	slots     []int
+	migrating map[int]string
+	importing map[int]string
+}
+
+func parseNodeLine(line string) (*nodeInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 8 {
+		return nil, ErrClusterConfig
+	}
+	addr := fields[1]
+	if i := strings.IndexByte(addr, '@'); i >= 0 {
+		addr = addr[:i]
+	}
+	info := &nodeInfo{id: fields[0], migrating: make(map[int]string), importing: make(map[int]string)}
+	var err error
+	if info.ip, info.port, err = splitNodeAddr(addr); err != nil {
+		return nil, err
+	}
+	for _, v := range strings.Split(fields[2], ",") {
+		info.myself = info.myself || v == "myself"
+		info.handshake = info.handshake || v == "handshake"
+	}
+	if info.epoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+		return nil, ErrClusterConfig
+	}
+	for _, v := range fields[8:] {
+		if strings.HasPrefix(v, "[") && strings.HasSuffix(v, "]") {
+			v = v[1 : len(v)-1]
+			if i := strings.Index(v, "->-"); i > 0 {
+				if slot, err := parseSlot(v[:i]); err == nil {
+					info.migrating[slot] = v[i+3:]
+				}
+			} else if i := strings.Index(v, "-<-"); i > 0 {
+				if slot, err := parseSlot(v[:i]); err == nil {
+					info.importing[slot] = v[i+3:]
+				}
+			}
+			continue
+		}
+		from, to := v, v
+		if i := strings.IndexByte(v, '-'); i > 0 {
+			from, to = v[:i], v[i+1:]
+		}
+		start, err1 := parseSlot(from)
+		end, err2 := parseSlot(to)
+		if err1 != nil || err2 != nil || start > end {
+			return nil, ErrClusterConfig
+		}
+		for i := start; i <= end; i++ {
+			info.slots = append(info.slots, i)
+		}
+	}
+	return info, nil
+}
+
+func parseSlot(s string) (int, error) {
+	slot, err := strconv.Atoi(s)
+	if err != nil || slot < 0 || slot >= util.HASH_SLOTS {
+		return 0, errors.New("Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+func (c *cluster) load() error {
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var infos []*nodeInfo
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					c.epoch, _ = strconv.ParseUint(fields[i+1], 10, 64)
+				}
+			}
+			continue
+		}
+		info, err := parseNodeLine(line)
+		if err != nil {
+			return err
+		}
+		n := &clusterNode{id: info.id, ip: info.ip, port: info.port, epoch: info.epoch, pongRecv: time.Now()}
+		if info.myself {
+			c.myself = n
+		}
+		c.nodes[n.id] = n
+		for _, slot := range info.slots {
+			c.slots[slot] = n
+		}
+		infos = append(infos, info)
+	}
+	for _, info := range infos {
+		if !info.myself {
+			continue
+		}
+		for slot, id := range info.migrating {
+			if n := c.nodes[id]; n != nil {
+				c.migrating[slot] = n
+			}
+		}
+		for slot, id := range info.importing {
+			if n := c.nodes[id]; n != nil {
+				c.importing[slot] = n
+			}
+		}
+	}
+	return nil
+}
+
+//gossipLoop starts an exchange with every node not in one already each period
+func (c *cluster) gossipLoop() {
+	ticker := time.NewTicker(CLUSTER_GOSSIP_PERIOD)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.lock.Lock()
+		for id, until := range c.banned {
+			if time.Now().After(until) {
+				delete(c.banned, id)
+			}
+		}
+		for _, n := range c.nodes {
+			if n != c.myself && !n.busy {
+				n.busy = true
+				go c.gossip(n)
+			}
+		}
+		c.lock.Unlock()
+	}
+}
+
+//gossip sends the view of this node to n and merges the one n answers with. The connection
+//of n is only used by the exchange holding busy
+func (c *cluster) gossip(n *clusterNode) {
+	c.lock.Lock()
+	addr, epoch, text := n.addr(), c.epoch, c.nodesText()
+	n.pingSent = time.Now()
+	c.lock.Unlock()
+
+	reply, err := n.exchange(addr, c.timeout, "CLUSTER", "GOSSIP", strconv.FormatUint(epoch, 10), text)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n.busy = false
+	n.connected = err == nil
+	if c.nodes[n.id] != n {
+		//forgotten meanwhile
+		n.close()
+		return
+	}
+	if err == nil && len(reply) != 2 {
+		err = ErrReplProtocol
+	}
+	if err != nil {
+		n.close()
+		if n.handshake && time.Since(n.pongRecv) > c.timeout {
+			delete(c.nodes, n.id)
+		}
+		return
+	}
+	if e, err := strconv.ParseUint(string(reply[0]), 10, 64); err == nil {
+		c.merge(n, e, string(reply[1]))
+	}
+}
+
+//exchange sends a command to n and reads its reply, dialing addr first when not connected
+func (n *clusterNode) exchange(addr string, timeout time.Duration, args ...string) ([][]byte, error) {
+	if n.conn == nil {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		n.conn, n.rd = conn, bufio.NewReader(conn)
+	}
+	buf := redcon.AppendArray(nil, len(args))
+	for _, v := range args {
+		buf = redcon.AppendBulk(buf, []byte(v))
+	}
+	_ = n.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := n.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return readFrame(n.rd)
+}
+
+func (n *clusterNode) close() {
+	if n.conn != nil {
+		_ = n.conn.Close()
+		n.conn, n.rd = nil, nil
+	}
+}
+
+//merge takes in the view of the sender of a gossip message, from is the node the message was
+//exchanged with when this node sent it
+func (c *cluster) merge(from *clusterNode, epoch uint64, text string) {
+	var sender *nodeInfo
+	var others []*nodeInfo
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		info, err := parseNodeLine(line)
+		if err != nil {
+			continue
+		}
+		if info.myself {
+			sender = info
+		} else {
+			others = append(others, info)
+		}
+	}
+	if sender == nil || sender.id == c.myself.id {
+		return
+	}
+	if _, ok := c.banned[sender.id]; ok {
+		return
+	}
+	changed := false
+	n := c.nodes[sender.id]
+	if from != nil && from.handshake {
+		//the node met answered, it is known by its id from now on
+		delete(c.nodes, from.id)
+		if n == nil {
+			n = from
+			n.id, n.handshake = sender.id, false
+			c.nodes[n.id] = n
+		} else {
+			from.close()
+		}
+		changed = true
+	}
+	if n == nil {
+		n = &clusterNode{id: sender.id}
+		c.nodes[n.id] = n
+		changed = true
+	}
+	if n.ip != sender.ip || n.port != sender.port || n.epoch != sender.epoch {
+		n.ip, n.port, n.epoch = sender.ip, sender.port, sender.epoch
+		changed = true
+	}
+	n.pongRecv = time.Now()
+	if epoch > c.epoch {
+		c.epoch = epoch
+		changed = true
+	}
+	if n.epoch == c.myself.epoch && n.id > c.myself.id {
+		//two nodes with the same config epoch, the one with the smaller id takes a new one
+		c.epoch++
+		c.myself.epoch = c.epoch
+		changed = true
+	}
+
+	for _, slot := range sender.slots {
+		owner := c.slots[slot]
+		if owner == n || (owner != nil && owner.epoch >= n.epoch) {
+			continue
+		}
+		c.slots[slot] = n
+		if owner == c.myself {
+			delete(c.migrating, slot)
+		}
+		changed = true
+	}
+
+	for _, v := range others {
+		if v.handshake || v.id == c.myself.id || c.nodes[v.id] != nil {
+			continue
+		}
+		if _, ok := c.banned[v.id]; ok {
+			continue
+		}
+		c.nodes[v.id] = &clusterNode{id: v.id, ip: v.ip, port: v.port, epoch: v.epoch, pongRecv: time.Now()}
+		changed = true
+	}
+	if changed {
+		c.saveLogged()
+	}
+}
+
+//bumpEpoch gives this node a config epoch greater than any other unless it has one already
+func (c *cluster) bumpEpoch() bool {
+	max := c.epoch
+	for _, n := range c.nodes {
+		if n.epoch > max {
+			max = n.epoch
+		}
+	}
+	if c.myself.epoch != 0 && c.myself.epoch == max {
+		return false
+	}
+	c.epoch = max + 1
+	c.myself.epoch = c.epoch
+	return true
+}
+
+//route returns the error redirecting a command on keys of db, empty when this node serves it.
+//MIGRATE runs whatever keys of a migrating slot are still there
+func (c *cluster) route(db *command.RedisCommand, keys [][]byte, asking, migrate bool) string {
+	slot := util.HashSlot(keys[0])
+	for _, v := range keys[1:] {
+		if util.HashSlot(v) != slot {
+			return "CROSSSLOT Keys in request don't hash to the same slot"
+		}
+	}
+	c.lock.RLock()
+	owner, migrating, importing := c.slots[slot], c.migrating[slot], c.importing[slot]
+	var addr, target string
+	if owner != nil {
+		addr = owner.addr()
+	}
+	if migrating != nil {
+		target = migrating.addr()
+	}
+	myself := owner == c.myself
+	c.lock.RUnlock()
+
+	switch {
+	case owner == nil:
+		return "CLUSTERDOWN Hash slot not served"
+	case !myself && (importing == nil || !asking):
+		return "MOVED " + strconv.Itoa(slot) + " " + addr
+	case !myself:
+		if len(keys) > 1 && db.Exists(keys...) < len(keys) {
+			return "TRYAGAIN Multiple keys request during rehashing of slot"
+		}
+	case migrating != nil && !migrate:
+		switch n := db.Exists(keys...); {
+		case n == 0:
+			return "ASK " + strconv.Itoa(slot) + " " + target
+		case n < len(keys):
+			return "TRYAGAIN Multiple keys request during rehashing of slot"
+		}
+	}
+	return ""
+}
+
+//clusterCheck answers a command the node doesn't serve with a redirection and reports whether
+//it may run. Inside MULTI the keys of the queued commands must share a slot, EXEC checks
+//them all again and discards the transaction when the slot moved meanwhile
+func clusterCheck(client *Client, cmd string, args [][]byte) bool {
+	s := client.Session()
+	asking := s.asking
+	if cmd != "asking" {
+		s.asking = false
+	}
+	m := s.multi
+	var keys [][]byte
+	switch {
+	case cmd == "exec" && m != nil:
+		if m.dirty {
+			return true
+		}
+		for _, v := range m.queue {
+			keys = append(keys, commandKeys(strings.ToLower(string(v[0])), v)...)
+		}
+	case m != nil && multiImmediate[cmd]:
+		return true
+	default:
+		keys = commandKeys(cmd, args)
+		if m != nil && m.key != nil && len(keys) > 0 {
+			keys = append([][]byte{m.key}, keys...)
+		}
+	}
+	if len(keys) == 0 {
+		return true
+	}
+	msg := Cluster.route(s.DB, keys, asking, cmd == "migrate")
+	if msg == "" {
+		if m != nil && m.key == nil && cmd != "exec" {
+			m.key = append([]byte{}, keys[0]...)
+		}
+		return true
+	}
+	if cmd == "exec" {
+		s.multi = nil
+		s.unwatch()
+	} else if m != nil {
+		m.dirty = true
+	}
+	client.Conn.WriteError(msg)
+	return false
+}
+
+func cmdAsking(c *Client, args ...[]byte) error {
+	if len(args) != 1 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	if Cluster == nil {
+		c.Conn.WriteError("ERR This instance has cluster support disabled")
+		return nil
+	}
+	c.Session().asking = true
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+//cmdReadOnly and cmdReadWrite are accepted for cluster clients, there are no replicas to read from
+func cmdReadOnly(c *Client, args ...[]byte) error {
+	return clusterOK(c, args)
+}
+
+func cmdReadWrite(c *Client, args ...[]byte) error {
+	return clusterOK(c, args)
+}
+
+func clusterOK(c *Client, args [][]byte) error {
+	switch {
+	case len(args) != 1:
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+	case Cluster == nil:
+		c.Conn.WriteError("ERR This instance has cluster support disabled")
+	default:
+		c.Conn.WriteString("OK")
+	}
+	return nil
+}
+
+//cmdCluster inspects and changes the cluster:
+//
+//	CLUSTER INFO | MYID | NODES | SLOTS | SHARDS
+//	CLUSTER KEYSLOT key | COUNTKEYSINSLOT slot | GETKEYSINSLOT slot count
+//	CLUSTER ADDSLOTS slot... | ADDSLOTSRANGE start end... | DELSLOTS slot... | DELSLOTSRANGE start end... | FLUSHSLOTS
+//	CLUSTER MEET ip port | FORGET id
+//	CLUSTER SETSLOT slot IMPORTING id | MIGRATING id | STABLE | NODE id
+//	CLUSTER SET-CONFIG-EPOCH epoch | BUMPEPOCH | SAVECONFIG
+//	CLUSTER GOSSIP currentEpoch nodes     -> exchanged between nodes
+func cmdCluster(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	cl := Cluster
+	if cl == nil {
+		c.Conn.WriteError("ERR This instance has cluster support disabled")
+		return nil
+	}
+	sub := strings.ToUpper(string(args[1]))
+	switch {
+	case sub == "KEYSLOT" && len(args) == 3:
+		c.Conn.WriteInt(util.HashSlot(args[2]))
+		return nil
+	case sub == "COUNTKEYSINSLOT" && len(args) == 3:
+		slot, err := parseSlot(string(args[2]))
+		if err != nil {
+			c.Conn.WriteError("ERR " + err.Error())
+			return nil
+		}
+		c.Conn.WriteInt(int(cl.db.CountKeysInSlot(slot)))
+		return nil
+	case sub == "GETKEYSINSLOT" && len(args) == 4:
+		slot, err := parseSlot(string(args[2]))
+		if err != nil {
+			c.Conn.WriteError("ERR " + err.Error())
+			return nil
+		}
+		count, err := strconv.Atoi(string(args[3]))
+		if err != nil || count < 0 {
+			c.Conn.WriteError("ERR Invalid number of keys")
+			return nil
+		}
+		keys := cl.db.GetKeysInSlot(slot, count)
+		c.Conn.WriteArray(len(keys))
+		for _, v := range keys {
+			c.Conn.WriteBulk(v)
+		}
+		return nil
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	var err error
+	switch {
+	case sub == "INFO" && len(args) == 2:
+		c.Conn.WriteBulk([]byte(cl.info()))
+		return nil
+	case sub == "MYID" && len(args) == 2:
+		c.Conn.WriteBulk([]byte(cl.myself.id))
+		return nil
+	case sub == "NODES" && len(args) == 2:
+		c.Conn.WriteBulk([]byte(cl.nodesText()))
+		return nil
+	case sub == "SLOTS" && len(args) == 2:
+		cl.writeSlots(c.Conn)
+		return nil
+	case sub == "SHARDS" && len(args) == 2:
+		cl.writeShards(c.Conn)
+		return nil
+	case sub == "GOSSIP" && len(args) == 4:
+		epoch, perr := strconv.ParseUint(string(args[2]), 10, 64)
+		if perr != nil {
+			c.Conn.WriteError("ERR " + command.ErrNotInteger.Error())
+			return nil
+		}
+		cl.merge(nil, epoch, string(args[3]))
+		c.Conn.WriteArray(2)
+		c.Conn.WriteBulk([]byte(strconv.FormatUint(cl.epoch, 10)))
+		c.Conn.WriteBulk([]byte(cl.nodesText()))
+		return nil
+	case (sub == "ADDSLOTS" || sub == "DELSLOTS") && len(args) > 2:
+		err = cl.setSlots(args[2:], false, sub == "ADDSLOTS")
+	case (sub == "ADDSLOTSRANGE" || sub == "DELSLOTSRANGE") && len(args) > 2 && len(args)%2 == 0:
+		err = cl.setSlots(args[2:], true, sub == "ADDSLOTSRANGE")
+	case sub == "FLUSHSLOTS" && len(args) == 2:
+		if cl.db.DBSize() > 0 {
+			err = errors.New("DB must be empty to perform CLUSTER FLUSHSLOTS.")
+			break
+		}
+		for i, v := range cl.slots {
+			if v == cl.myself {
+				cl.slots[i] = nil
+			}
+		}
+	case sub == "MEET" && (len(args) == 4 || len(args) == 5):
+		err = cl.meet(string(args[2]), string(args[3]))
+	case sub == "FORGET" && len(args) == 3:
+		err = cl.forget(string(args[2]))
+	case sub == "SETSLOT" && len(args) >= 4:
+		err = cl.setSlot(args[2:])
+	case sub == "SET-CONFIG-EPOCH" && len(args) == 3:
+		epoch, perr := strconv.ParseUint(string(args[2]), 10, 64)
+		switch {
+		case perr != nil:
+			err = errors.New("Invalid config epoch specified: " + string(args[2]))
+		case len(cl.nodes) > 1:
+			err = errors.New("The user can assign a config epoch only when the node does not know any other node.")
+		case cl.myself.epoch != 0:
+			err = errors.New("Node config epoch is already non-zero")
+		default:
+			cl.myself.epoch = epoch
+			if epoch > cl.epoch {
+				cl.epoch = epoch
+			}
+		}
+	case sub == "BUMPEPOCH" && len(args) == 2:
+		status := "STILL"
+		if cl.bumpEpoch() {
+			status = "BUMPED"
+			cl.saveLogged()
+		}
+		c.Conn.WriteString(status + " " + strconv.FormatUint(cl.myself.epoch, 10))
+		return nil
+	case sub == "SAVECONFIG" && len(args) == 2:
+	default:
+		c.Conn.WriteError("ERR unknown subcommand or wrong number of arguments for '" + string(args[1]) + "'. Try CLUSTER HELP.")
+		return nil
+	}
+	if err == nil {
+		err = cl.save()
+	}
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+func (c *cluster) info() string {
+	assigned, failing := 0, 0
+	size := make(map[*clusterNode]bool)
+	for _, n := range c.slots {
+		if n == nil {
+			continue
+		}
+		assigned++
+		size[n] = true
+		if n != c.myself && time.Since(n.pongRecv) > c.timeout {
+			failing++
+		}
+	}
+	state := "ok"
+	if assigned < util.HASH_SLOTS {
+		state = "fail"
+	}
+	var b strings.Builder
+	b.WriteString("cluster_enabled:1\r\n")
+	b.WriteString("cluster_state:" + state + "\r\n")
+	b.WriteString("cluster_slots_assigned:" + strconv.Itoa(assigned) + "\r\n")
+	b.WriteString("cluster_slots_ok:" + strconv.Itoa(assigned-failing) + "\r\n")
+	b.WriteString("cluster_slots_pfail:" + strconv.Itoa(failing) + "\r\n")
+	b.WriteString("cluster_slots_fail:0\r\n")
+	b.WriteString("cluster_known_nodes:" + strconv.Itoa(len(c.nodes)) + "\r\n")
+	b.WriteString("cluster_size:" + strconv.Itoa(len(size)) + "\r\n")
+	b.WriteString("cluster_current_epoch:" + strconv.FormatUint(c.epoch, 10) + "\r\n")
+	b.WriteString("cluster_my_epoch:" + strconv.FormatUint(c.myself.epoch, 10) + "\r\n")
+	return b.String()
+}
+
+//writeSlots replies to CLUSTER SLOTS: [start end [ip port id]] per range of slots
+func (c *cluster) writeSlots(conn redcon.Conn) {
+	type entry struct {
+		r [2]int
+		n *clusterNode
+	}
+	var entries []entry
+	for _, n := range c.sortedNodes() {
+		for _, r := range c.slotRanges(n) {
+			entries = append(entries, entry{r, n})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].r[0] < entries[j].r[0] })
+	conn.WriteArray(len(entries))
+	for _, v := range entries {
+		conn.WriteArray(3)
+		conn.WriteInt(v.r[0])
+		conn.WriteInt(v.r[1])
+		conn.WriteArray(3)
+		conn.WriteBulk([]byte(v.n.ip))
+		conn.WriteInt(v.n.port)
+		conn.WriteBulk([]byte(v.n.id))
+	}
+}
+
+//writeShards replies to CLUSTER SHARDS, every node owning slots is a shard without replicas
+func (c *cluster) writeShards(conn redcon.Conn) {
+	var shards []*clusterNode
+	for _, n := range c.sortedNodes() {
+		if !n.handshake {
+			shards = append(shards, n)
+		}
+	}
+	conn.WriteArray(len(shards))
+	for _, n := range shards {
+		ranges := c.slotRanges(n)
+		conn.WriteArray(4)
+		conn.WriteBulk([]byte("slots"))
+		conn.WriteArray(2 * len(ranges))
+		for _, r := range ranges {
+			conn.WriteInt(r[0])
+			conn.WriteInt(r[1])
+		}
+		conn.WriteBulk([]byte("nodes"))
+		conn.WriteArray(1)
+		health := "online"
+		if n != c.myself && time.Since(n.pongRecv) > c.timeout {
+			health = "fail"
+		}
+		conn.WriteArray(14)
+		conn.WriteBulk([]byte("id"))
+		conn.WriteBulk([]byte(n.id))
+		conn.WriteBulk([]byte("port"))
+		conn.WriteInt(n.port)
+		conn.WriteBulk([]byte("ip"))
+		conn.WriteBulk([]byte(n.ip))
+		conn.WriteBulk([]byte("endpoint"))
+		conn.WriteBulk([]byte(n.ip))
+		conn.WriteBulk([]byte("role"))
+		conn.WriteBulk([]byte("master"))
+		conn.WriteBulk([]byte("replication-offset"))
+		conn.WriteInt(0)
+		conn.WriteBulk([]byte("health"))
+		conn.WriteBulk([]byte(health))
+	}
+}
+
+//setSlots assigns slots to this node or frees them, given one by one or as ranges
+func (c *cluster) setSlots(args [][]byte, ranges, add bool) error {
+	var slots []int
+	for i := 0; i < len(args); i++ {
+		start, err := parseSlot(string(args[i]))
+		if err != nil {
+			return err
+		}
+		end := start
+		if ranges {
+			i++
+			if end, err = parseSlot(string(args[i])); err != nil {
+				return err
+			}
+			if start > end {
+				return errors.New("start slot number " + strconv.Itoa(start) + " is greater than end slot number " + strconv.Itoa(end))
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+	for _, slot := range slots {
+		if add && c.slots[slot] != nil {
+			return errors.New("Slot " + strconv.Itoa(slot) + " is already busy")
+		}
+		if !add && c.slots[slot] == nil {
+			return errors.New("Slot " + strconv.Itoa(slot) + " is already unassigned")
+		}
+	}
+	for _, slot := range slots {
+		if add {
+			c.slots[slot] = c.myself
+			delete(c.importing, slot)
+		} else {
+			c.slots[slot] = nil
+		}
+	}
+	return nil
+}
+
+func (c *cluster) meet(ip, port string) error {
+	host, p, err := splitNodeAddr(net.JoinHostPort(ip, port))
+	if err != nil {
+		return errors.New("Invalid node address specified: " + ip + ":" + port)
+	}
+	for _, n := range c.nodes {
+		if n.ip == host && n.port == p {
+			return nil
+		}
+	}
+	n := &clusterNode{id: newNodeID(), ip: host, port: p, handshake: true, pongRecv: time.Now()}
+	c.nodes[n.id] = n
+	return nil
+}
+
+func (c *cluster) forget(id string) error {
+	n := c.nodes[id]
+	switch {
+	case n == c.myself:
+		return errors.New("I tried hard but I can't forget myself...")
+	case n == nil:
+		return errors.New("Unknown node " + id)
+	}
+	delete(c.nodes, id)
+	c.banned[id] = time.Now().Add(CLUSTER_FORGET_TTL)
+	for slot, v := range c.slots {
+		if v == n {
+			c.slots[slot] = nil
+		}
+	}
+	for slot, v := range c.migrating {
+		if v == n {
+			delete(c.migrating, slot)
+		}
+	}
+	for slot, v := range c.importing {
+		if v == n {
+			delete(c.importing, slot)
+		}
+	}
+	return nil
+}
+
+//setSlot runs CLUSTER SETSLOT slot IMPORTING|MIGRATING|STABLE|NODE [id]
+func (c *cluster) setSlot(args [][]byte) error {
+	slot, err := parseSlot(string(args[0]))
+	if err != nil {
+		return err
+	}
+	action := strings.ToUpper(string(args[1]))
+	if action == "STABLE" {
+		if len(args) != 2 {
+			return command.ErrSyntax
+		}
+		delete(c.migrating, slot)
+		delete(c.importing, slot)
+		return nil
+	}
+	if len(args) != 3 {
+		return command.ErrSyntax
+	}
+	n := c.nodes[string(args[2])]
+	if n == nil || n.handshake {
+		return errors.New("I don't know about node " + string(args[2]))
+	}
+	switch action {
+	case "MIGRATING":
+		if c.slots[slot] != c.myself {
+			return errors.New("I'm not the owner of hash slot " + strconv.Itoa(slot))
+		}
+		if n == c.myself {
+			return errors.New("I can't migrate a slot to myself")
+		}
+		c.migrating[slot] = n
+	case "IMPORTING":
+		if c.slots[slot] == c.myself {
+			return errors.New("I'm already the owner of hash slot " + strconv.Itoa(slot))
+		}
+		if n == c.myself {
+			return errors.New("I can't import a slot from myself")
+		}
+		c.importing[slot] = n
+	case "NODE":
+		if c.slots[slot] == c.myself && n != c.myself && c.db.CountKeysInSlot(slot) > 0 {
+			return errors.New("Can't assign hashslot " + strconv.Itoa(slot) + " to a different node while I still hold keys for this hash slot.")
+		}
+		if n != c.myself {
+			delete(c.migrating, slot)
+		}
+		if n == c.myself && c.importing[slot] != nil {
+			//the new owner takes an epoch above every other so the others accept the change
+			delete(c.importing, slot)
+			c.bumpEpoch()
+		}
+		c.slots[slot] = n
+	default:
+		return command.ErrSyntax
+	}
+	return nil
+}
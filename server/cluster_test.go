@@ -0,0 +1,141 @@
+package server
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//newTestCluster is StartCluster without gossip: the node 127.0.0.1:7000 knows a node other
+//at 127.0.0.1:7001, no slot is assigned
+func newTestCluster(t *testing.T, db *command.RedisCommand) (c *cluster, other *clusterNode) {
+	t.Helper()
+	if err := db.SetSlotIndex(true); err != nil {
+		t.Fatal(err)
+	}
+	c = &cluster{
+		db:        db,
+		path:      filepath.Join(t.TempDir(), "nodes.conf"),
+		nodes:     make(map[string]*clusterNode),
+		migrating: make(map[int]*clusterNode),
+		importing: make(map[int]*clusterNode),
+		banned:    make(map[string]time.Time),
+	}
+	c.myself = &clusterNode{id: newNodeID(), ip: "127.0.0.1", port: 7000, connected: true}
+	other = &clusterNode{id: newNodeID(), ip: "127.0.0.1", port: 7001, connected: true}
+	c.nodes[c.myself.id], c.nodes[other.id] = c.myself, other
+	return c, other
+}
+
+func TestClusterRoute(t *testing.T) {
+	slot := util.HashSlot([]byte("x"))
+	moved := "MOVED " + strconv.Itoa(slot) + " 127.0.0.1:7001"
+	ask := "ASK " + strconv.Itoa(slot) + " 127.0.0.1:7001"
+	tryAgain := "TRYAGAIN Multiple keys request during rehashing of slot"
+	tests := []struct {
+		name      string
+		owner     string //myself, other or none
+		migrating bool   //to other
+		importing bool   //from other
+		keys      []string
+		asking    bool
+		migrate   bool
+		want      string
+	}{
+		{"not served", "none", false, false, []string{"{x}a"}, false, false, "CLUSTERDOWN Hash slot not served"},
+		{"cross slot", "myself", false, false, []string{"{x}a", "{y}a"}, false, false, "CROSSSLOT Keys in request don't hash to the same slot"},
+		{"served", "myself", false, false, []string{"{x}a", "{x}b"}, false, false, ""},
+		{"moved", "other", false, false, []string{"{x}a"}, false, false, moved},
+		{"moved asking", "other", false, false, []string{"{x}a"}, true, false, moved},
+		{"migrating key still here", "myself", true, false, []string{"{x}a"}, false, false, ""},
+		{"migrating key gone", "myself", true, false, []string{"{x}gone"}, false, false, ask},
+		{"migrating some keys gone", "myself", true, false, []string{"{x}a", "{x}gone"}, false, false, tryAgain},
+		{"migrating every key here", "myself", true, false, []string{"{x}a", "{x}b"}, false, false, ""},
+		{"migrate key gone", "myself", true, false, []string{"{x}gone"}, false, true, ""},
+		{"importing without asking", "other", false, true, []string{"{x}a"}, false, false, moved},
+		{"importing asking", "other", false, true, []string{"{x}gone"}, true, false, ""},
+		{"importing asking some keys missing", "other", false, true, []string{"{x}a", "{x}gone"}, true, false, tryAgain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			c, other := newTestCluster(t, db)
+			db.Set([]byte("{x}a"), []byte("v"), 0)
+			db.Set([]byte("{x}b"), []byte("v"), 0)
+			switch tt.owner {
+			case "myself":
+				c.slots[slot] = c.myself
+			case "other":
+				c.slots[slot] = other
+			}
+			c.slots[util.HashSlot([]byte("y"))] = c.myself
+			if tt.migrating {
+				c.migrating[slot] = other
+			}
+			if tt.importing {
+				c.importing[slot] = other
+			}
+			keys := make([][]byte, 0, len(tt.keys))
+			for _, v := range tt.keys {
+				keys = append(keys, []byte(v))
+			}
+			if got := c.route(db, keys, tt.asking, tt.migrate); got != tt.want {
+				t.Fatalf("route() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+//TestClusterCommands runs commands of one connection on a node owning slot x
+func TestClusterCommands(t *testing.T) {
+	slot := strconv.Itoa(util.HashSlot([]byte("x")))
+	other := strconv.Itoa(util.HashSlot([]byte("y")))
+	tests := []struct {
+		name string
+		cmds [][]string
+		want string //reply of the last command
+	}{
+		{"keyslot", [][]string{{"cluster", "keyslot", "{x}a"}}, ":" + slot},
+		{"served", [][]string{{"set", "{x}a", "v"}}, "+OK"},
+		{"moved", [][]string{{"get", "{y}a"}}, "-MOVED " + other + " 127.0.0.1:7001"},
+		{"asking lasts one command", [][]string{{"cluster", "setslot", other, "importing", "$other"}, {"asking"}, {"get", "{y}a"}, {"get", "{y}a"}}, "-MOVED " + other + " 127.0.0.1:7001"},
+		{"asking importing", [][]string{{"cluster", "setslot", other, "importing", "$other"}, {"asking"}, {"get", "{y}a"}}, "$-1"},
+		{"ask", [][]string{{"cluster", "setslot", slot, "migrating", "$other"}, {"get", "{x}gone"}}, "-ASK " + slot + " 127.0.0.1:7001"},
+		{"multi moved", [][]string{{"multi"}, {"set", "{y}a", "v"}, {"exec"}}, "-EXECABORT Transaction discarded because of previous errors."},
+		{"multi cross slot", [][]string{{"multi"}, {"set", "{x}a", "v"}, {"set", "{y}a", "v"}}, "-CROSSSLOT Keys in request don't hash to the same slot"},
+		{"multi one slot", [][]string{{"multi"}, {"set", "{x}a", "v"}, {"get", "{x}a"}, {"exec"}}, "*2 +OK +v"},
+		{"migrate a slot not owned", [][]string{{"cluster", "setslot", other, "migrating", "$other"}}, "-ERR I'm not the owner of hash slot " + other},
+		{"import an owned slot", [][]string{{"cluster", "setslot", slot, "importing", "$other"}}, "-ERR I'm already the owner of hash slot " + slot},
+		{"give away a slot with keys", [][]string{{"set", "{x}a", "v"}, {"cluster", "setslot", slot, "node", "$other"}}, "-ERR Can't assign hashslot " + slot + " to a different node while I still hold keys for this hash slot."},
+		{"give away an empty slot", [][]string{{"cluster", "setslot", slot, "node", "$other"}, {"get", "{x}a"}}, "-MOVED " + slot + " 127.0.0.1:7001"},
+		{"countkeysinslot", [][]string{{"set", "{x}a", "v"}, {"set", "{x}b", "v"}, {"cluster", "countkeysinslot", slot}}, ":2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			c, node := newTestCluster(t, db)
+			c.slots[util.HashSlot([]byte("x"))] = c.myself
+			c.slots[util.HashSlot([]byte("y"))] = node
+			Cluster = c
+			defer func() { Cluster = nil }()
+			conn := newTestConn(db)
+			var ret string
+			for _, v := range tt.cmds {
+				args := append([]string{}, v...)
+				for i := range args {
+					if args[i] == "$other" {
+						args[i] = node.id
+					}
+				}
+				ret = conn.do(args...)
+			}
+			if ret != tt.want {
+				t.Fatalf("%v = %q, want %q", tt.cmds, ret, tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/store"
 	"reflect"
 	"runtime"
 	"strconv"
@@ -71,13 +72,149 @@ func (c *Command) init() {
 	register(cmdZRevRange)
 	register(cmdZRank)
 	register(cmdZCard)
+	register(cmdZRemRangeByScore)
+	register(cmdZRemRangeByRank)
+	register(cmdZRemRangeByLex)
+	register(cmdZPopMin)
+	register(cmdZPopMax)
+	register(cmdBZPopMin)
+	register(cmdBZPopMax)
+	register(cmdZUnionStore)
+	register(cmdZInterStore)
+	register(cmdZDiffStore)
+	register(cmdZUnion)
+	register(cmdZInter)
+	register(cmdZDiff)
+	register(cmdZScore)
+	register(cmdZMScore)
+	register(cmdZRandMember)
+	register(cmdGeoAdd)
+	register(cmdGeoPos)
+	register(cmdGeoDist)
+	register(cmdGeoSearch)
+	register(cmdGeoSearchStore)
+	register(cmdXAdd)
+	register(cmdXRange)
+	register(cmdXRevRange)
+	register(cmdXLen)
+	register(cmdXTrim)
+	register(cmdXDel)
+	register(cmdXRead)
+	register(cmdXGroup)
+	register(cmdXReadGroup)
+	register(cmdXAck)
+	register(cmdXPending)
+	register(cmdXClaim)
+	register(cmdXAutoClaim)
+	register(cmdXInfo)
+	register(cmdScan)
+	register(cmdHScan)
+	register(cmdSScan)
+	register(cmdZScan)
+	register(cmdExists)
+	register(cmdTouch)
+	register(cmdType)
+	register(cmdKeys)
+	register(cmdRandomKey)
+	register(cmdDBSize)
+	register(cmdRename)
+	register(cmdRenameNX)
+	register(cmdCopy)
+	register(cmdMove)
+	register(cmdSelect)
+	register(cmdSwapDB)
+	register(cmdFlushDB)
+	register(cmdFlushAll)
+	register(cmdUnlink)
+	register(cmdDump)
+	register(cmdRestore)
+	register(cmdPing)
+	register(cmdMulti)
+	register(cmdExec)
+	register(cmdDiscard)
+	register(cmdWatch)
+	register(cmdUnwatch)
+	register(cmdEval)
+	register(cmdEvalSha)
+	register(cmdScript)
+	register(cmdFunction)
+	register(cmdFCall)
+	register(cmdFCall_RO)
+	register(cmdPublish)
+	register(cmdSubscribe)
+	register(cmdPSubscribe)
+	register(cmdUnsubscribe)
+	register(cmdPUnsubscribe)
+	register(cmdPubSub)
+	register(cmdConfig)
+	register(cmdCDC)
+	register(cmdReplicaOf)
+	register(cmdPSync)
+	register(cmdRole)
+	register(cmdRaft)
+	register(cmdCluster)
+	register(cmdAsking)
+	register(cmdReadOnly)
+	register(cmdReadWrite)
+	register(cmdMigrate)
 }
 
 func (c *Command) Dispatcher(cmd string, client *Client, args ...[]byte) error {
-	if _, ok := c.cmds[cmd]; !ok {
+	f, ok := c.cmds[cmd]
+	if ok && Cluster != nil && !clusterCheck(client, cmd, args) {
+		return nil
+	}
+	if writeCommands[cmd] && Repl.IsReplica() {
+		if s := client.Session(); s.multi != nil {
+			s.multi.dirty = true
+		}
+		client.Conn.WriteError(errReadOnlyReplica)
+		return nil
+	}
+	if s := client.Session(); s.multi != nil && !multiImmediate[cmd] {
+		if !ok {
+			s.multi.dirty = true
+			return fmt.Errorf("not found cmds %s", cmd)
+		}
+		if !arityValid(cmd, len(args)) {
+			s.multi.dirty = true
+			client.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+			return nil
+		}
+		s.multi.add(args)
+		client.Conn.WriteString("QUEUED")
+		return nil
+	}
+	if !ok {
 		return fmt.Errorf("not found cmds %s", cmd)
 	}
-	return c.cmds[cmd](client, args...)
+	kill := scriptKill(cmd, args)
+	if busy := Running.busy(); busy != "" && !kill {
+		client.Conn.WriteError(busy)
+		return nil
+	}
+	if Raft != nil && raftProposed(cmd, args) {
+		client.cmd = cmd
+		return raftPropose(client, &raftEntry{cmds: [][][]byte{args}})
+	}
+	if !selfLocking[cmd] && !kill {
+		shardLock.RLock()
+		defer shardLock.RUnlock()
+	}
+	client.cmd = cmd
+	return f(client, args...)
+}
+
+func cmdPing(c *Client, args ...[]byte) error {
+	switch len(args) {
+	case 1:
+		c.Conn.WriteString("PONG")
+	case 2:
+		c.Conn.WriteBulk(args[1])
+	default:
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+	}
+	return nil
 }
 
 /////////
@@ -86,7 +223,7 @@ func cmdSet(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	err := db.Set(args[1], args[2], 0)
 	if err != nil {
 		return err
@@ -100,7 +237,7 @@ func cmdGet(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret := db.Get(args[1])
 	if ret == nil {
 		c.Conn.WriteNull()
@@ -115,7 +252,7 @@ func cmdDel(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret := db.Del(args[1])
 	c.Conn.WriteInt(ret)
 	return nil
@@ -126,7 +263,7 @@ func cmdHSet(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	err := db.HSet(args[1], args[2:]...)
 	if err != nil {
 		c.Conn.WriteNull()
@@ -141,7 +278,7 @@ func cmdHGet(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret, err := db.HGet(args[1], args[2:]...)
 	if err != nil {
 		c.Conn.WriteNull()
@@ -160,7 +297,7 @@ func cmdHDel(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret, err := db.HDel(args[1], args[2:]...)
 	if err != nil {
 		c.Conn.WriteNull()
@@ -175,7 +312,7 @@ func cmdHGetAll(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret, err := db.HGetAll(args[1])
 	if err != nil {
 		c.Conn.WriteNull()
@@ -198,7 +335,7 @@ func cmdHKeys(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret := db.HKeys(args[1])
 	if ret == nil {
 		c.Conn.WriteNull()
@@ -220,7 +357,7 @@ func cmdSAdd(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret := db.SAdd(args[1], args[2:]...)
 	if ret != nil {
 		c.Conn.WriteNull()
@@ -235,7 +372,7 @@ func cmdSRem(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret := db.SRem(args[1], args[2:]...)
 	if ret != nil {
 		c.Conn.WriteString("ERR " + ret.Error())
@@ -250,7 +387,7 @@ func cmdSMembers(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret, err := db.SMembers(args[1], args[2:]...)
 	if err != nil {
 		c.Conn.WriteString("ERR " + err.Error())
@@ -273,7 +410,7 @@ func cmdSCard(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret, err := db.SCard(args[1])
 	if err != nil {
 		c.Conn.WriteString("ERR " + err.Error())
@@ -289,7 +426,7 @@ func cmdLPush(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	err := db.LPush(args[1], args[2:]...)
 	if err != nil {
 		c.Conn.WriteString("ERR " + err.Error())
@@ -305,7 +442,7 @@ func cmdLPop(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret := db.LPop(args[1])
 	if ret == nil {
 		c.Conn.WriteString("ERR Not Found item")
@@ -321,7 +458,7 @@ func cmdRPush(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	err := db.RPush(args[1], args[2:]...)
 	if err != nil {
 		c.Conn.WriteString("ERR " + err.Error())
@@ -337,7 +474,7 @@ func cmdRPop(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret := db.RPop(args[1])
 	if ret == nil {
 		c.Conn.WriteString("ERR Not Found item")
@@ -353,7 +490,7 @@ func cmdLRange(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	start, err := strconv.Atoi(string(args[2]))
 	if err != nil {
 		c.Conn.WriteError("ERR value is not an integer or out of range")
@@ -382,7 +519,7 @@ func cmdLTrim(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	start, err := strconv.Atoi(string(args[2]))
 	if err != nil {
 		c.Conn.WriteError("ERR value is not an integer or out of range")
@@ -408,7 +545,7 @@ func cmdLLen(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret := db.LLen(args[1])
 	c.Conn.WriteInt(int(ret))
 	return nil
@@ -419,7 +556,7 @@ func cmdZAdd(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	score, err := strconv.ParseUint(string(args[2]), 10, 64)
 	if err != nil {
 		c.Conn.WriteError("ERR value is not an integer or out of range")
@@ -430,22 +567,23 @@ func cmdZAdd(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR " + err.Error())
 		return nil
 	}
+	c.signal(c.DB().Index(), args[1])
 	c.Conn.WriteInt(int(1))
 	return nil
 }
 
 func cmdZRem(c *Client, args ...[]byte) error {
-	if len(args) != 3 {
+	if len(args) < 3 {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
-	err := db.ZRem(args[1], args[2:]...)
-	if err != nil {
+	db := c.DB()
+	ret, err := db.ZRem(args[1], args[2:]...)
+	if err != nil && err != command.ErrKeyNotFound {
 		c.Conn.WriteError("ERR " + err.Error() + ":" + string(args[1]))
 		return nil
 	}
-	c.Conn.WriteInt(int(1))
+	c.Conn.WriteInt(ret)
 	return nil
 }
 
@@ -454,7 +592,7 @@ func cmdZRange(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret := db.ZRange(args[1], args[2:]...)
 	if ret == nil {
 		c.Conn.WriteError("ERR not found key" + ":" + string(args[1]))
@@ -472,7 +610,7 @@ func cmdZIncrby(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret, err := db.ZIncrby(args[1], args[2:]...)
 	if err != nil {
 		c.Conn.WriteError("ERR " + err.Error())
@@ -487,7 +625,7 @@ func cmdZCount(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret, err := db.ZCount(args[1], args[2:]...)
 	if err != nil {
 		c.Conn.WriteError("ERR " + err.Error())
@@ -502,7 +640,7 @@ func cmdZRevRange(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret := db.ZRevRange(args[1], args[2:]...)
 	if ret == nil {
 		c.Conn.WriteError("ERR not found key" + ":" + string(args[1]))
@@ -520,7 +658,7 @@ func cmdZRank(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret, err := db.ZRank(args[1], args[2])
 	if err != nil {
 		c.Conn.WriteNull()
@@ -535,7 +673,7 @@ func cmdZCard(c *Client, args ...[]byte) error {
 		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
 		return nil
 	}
-	db := c.Conn.Context().(*command.RedisCommand)
+	db := c.DB()
 	ret, err := db.ZCard(args[1])
 	if err != nil {
 		c.Conn.WriteNull()
@@ -544,3 +682,311 @@ func cmdZCard(c *Client, args ...[]byte) error {
 	c.Conn.WriteInt(ret)
 	return nil
 }
+
+func cmdZRemRangeByScore(c *Client, args ...[]byte) error {
+	if len(args) != 4 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	ret, err := db.ZRemRangeByScore(args[1], args[2], args[3])
+	if err != nil && err != command.ErrKeyNotFound {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteInt(ret)
+	return nil
+}
+
+func cmdZRemRangeByRank(c *Client, args ...[]byte) error {
+	if len(args) != 4 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	start, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		c.Conn.WriteError("ERR value is not an integer or out of range")
+		return nil
+	}
+	stop, err := strconv.Atoi(string(args[3]))
+	if err != nil {
+		c.Conn.WriteError("ERR value is not an integer or out of range")
+		return nil
+	}
+	ret, err := db.ZRemRangeByRank(args[1], start, stop)
+	if err != nil && err != command.ErrKeyNotFound {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteInt(ret)
+	return nil
+}
+
+func cmdZRemRangeByLex(c *Client, args ...[]byte) error {
+	if len(args) != 4 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	ret, err := db.ZRemRangeByLex(args[1], args[2], args[3])
+	if err != nil && err != command.ErrKeyNotFound {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteInt(ret)
+	return nil
+}
+
+func cmdZPopMin(c *Client, args ...[]byte) error {
+	return zsetPop(c, false, args...)
+}
+
+func cmdZPopMax(c *Client, args ...[]byte) error {
+	return zsetPop(c, true, args...)
+}
+
+func zsetPop(c *Client, max bool, args ...[]byte) error {
+	if len(args) != 2 && len(args) != 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	count := 1
+	if len(args) == 3 {
+		n, err := strconv.Atoi(string(args[2]))
+		if err != nil || n < 0 {
+			c.Conn.WriteError("ERR value is out of range, must be positive")
+			return nil
+		}
+		count = n
+	}
+	pop := db.ZPopMin
+	if max {
+		pop = db.ZPopMax
+	}
+	ret, err := pop(args[1], count)
+	if err != nil && err != command.ErrKeyNotFound {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteArray(len(ret) * 2)
+	for _, v := range ret {
+		c.Conn.WriteBulk(v.V0)
+		c.Conn.WriteBulk(v.V1)
+	}
+	return nil
+}
+
+func cmdBZPopMin(c *Client, args ...[]byte) error {
+	return zsetBlockingPop(c, false, args...)
+}
+
+func cmdBZPopMax(c *Client, args ...[]byte) error {
+	return zsetBlockingPop(c, true, args...)
+}
+
+func zsetBlockingPop(c *Client, max bool, args ...[]byte) error {
+	if len(args) < 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	timeout, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	pop := db.ZPopMin
+	if max {
+		pop = db.ZPopMax
+	}
+	keys := args[1 : len(args)-1]
+	var key []byte
+	var ret []*store.Pair
+	ok := c.block(keys, timeout, func() bool {
+		for _, k := range keys {
+			ret, err = pop(k, 1)
+			if err == nil && len(ret) > 0 {
+				key = k
+				return true
+			}
+		}
+		return false
+	})
+	if !ok {
+		c.Conn.WriteNull()
+		return nil
+	}
+	c.Conn.WriteArray(3)
+	c.Conn.WriteBulk(key)
+	c.Conn.WriteBulk(ret[0].V0)
+	c.Conn.WriteBulk(ret[0].V1)
+	return nil
+}
+
+type zsetAggregateFunc func(*command.RedisCommand, *command.ZSetAggregateOption) ([]*command.ZSetMember, error)
+
+func cmdZUnionStore(c *Client, args ...[]byte) error {
+	return zsetAggregateStore(c, (*command.RedisCommand).ZUnion, true, args...)
+}
+
+func cmdZInterStore(c *Client, args ...[]byte) error {
+	return zsetAggregateStore(c, (*command.RedisCommand).ZInter, true, args...)
+}
+
+func cmdZDiffStore(c *Client, args ...[]byte) error {
+	return zsetAggregateStore(c, (*command.RedisCommand).ZDiff, false, args...)
+}
+
+func cmdZUnion(c *Client, args ...[]byte) error {
+	return zsetAggregate(c, (*command.RedisCommand).ZUnion, true, args...)
+}
+
+func cmdZInter(c *Client, args ...[]byte) error {
+	return zsetAggregate(c, (*command.RedisCommand).ZInter, true, args...)
+}
+
+func cmdZDiff(c *Client, args ...[]byte) error {
+	return zsetAggregate(c, (*command.RedisCommand).ZDiff, false, args...)
+}
+
+func zsetAggregateStore(c *Client, f zsetAggregateFunc, aggregate bool, args ...[]byte) error {
+	if len(args) < 4 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	opt, err := command.ZSetParseAggregateOption(args[2:], aggregate, false)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	ret, err := f(db, opt)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	err = db.ZStore(args[1], ret, strings.ToLower(string(args[0])))
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if len(ret) > 0 {
+		c.signal(c.DB().Index(), args[1])
+	}
+	c.Conn.WriteInt(len(ret))
+	return nil
+}
+
+func zsetAggregate(c *Client, f zsetAggregateFunc, aggregate bool, args ...[]byte) error {
+	if len(args) < 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	opt, err := command.ZSetParseAggregateOption(args[1:], aggregate, true)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	ret, err := f(db, opt)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	writeZSetMembers(c, ret, opt.WithScores)
+	return nil
+}
+
+func writeZSetMembers(c *Client, members []*command.ZSetMember, withScores bool) {
+	if withScores {
+		c.Conn.WriteArray(len(members) * 2)
+	} else {
+		c.Conn.WriteArray(len(members))
+	}
+	for _, v := range members {
+		c.Conn.WriteBulk(v.Member)
+		if withScores {
+			c.Conn.WriteBulk([]byte(strconv.FormatUint(v.Score, 10)))
+		}
+	}
+}
+
+func cmdZScore(c *Client, args ...[]byte) error {
+	if len(args) != 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	ret := db.ZScore(args[1], args[2])
+	if ret == nil {
+		c.Conn.WriteNull()
+		return nil
+	}
+	c.Conn.WriteBulk(ret)
+	return nil
+}
+
+func cmdZMScore(c *Client, args ...[]byte) error {
+	if len(args) < 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	ret, err := db.ZMScore(args[1], args[2:]...)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteArray(len(ret))
+	for _, v := range ret {
+		if v == nil {
+			c.Conn.WriteNull()
+			continue
+		}
+		c.Conn.WriteBulk(v)
+	}
+	return nil
+}
+
+func cmdZRandMember(c *Client, args ...[]byte) error {
+	if len(args) < 2 || len(args) > 4 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	if len(args) == 2 {
+		ret, err := db.ZRandMember(args[1], 1)
+		if err != nil {
+			c.Conn.WriteError("ERR " + err.Error())
+			return nil
+		}
+		if len(ret) == 0 {
+			c.Conn.WriteNull()
+			return nil
+		}
+		c.Conn.WriteBulk(ret[0].Member)
+		return nil
+	}
+	count, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		c.Conn.WriteError("ERR value is not an integer or out of range")
+		return nil
+	}
+	withScores := false
+	if len(args) == 4 {
+		if strings.ToUpper(string(args[3])) != "WITHSCORES" {
+			c.Conn.WriteError("ERR syntax error")
+			return nil
+		}
+		withScores = true
+	}
+	ret, err := db.ZRandMember(args[1], count)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	writeZSetMembers(c, ret, withScores)
+	return nil
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Zealous-w/tacodb/command"
+)
+
+func cmdExists(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	c.Conn.WriteInt(db.Exists(args[1:]...))
+	return nil
+}
+
+//cmdTouch only reports existing keys, access times are not tracked
+func cmdTouch(c *Client, args ...[]byte) error {
+	return cmdExists(c, args...)
+}
+
+func cmdType(c *Client, args ...[]byte) error {
+	if len(args) != 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	c.Conn.WriteString(command.KeyTypeName(db.Type(args[1])))
+	return nil
+}
+
+func cmdKeys(c *Client, args ...[]byte) error {
+	if len(args) != 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	if !Conf.EnableKeys {
+		c.Conn.WriteError("ERR KEYS is disabled, use SCAN instead")
+		return nil
+	}
+	db := c.DB()
+	match := args[1]
+	if string(match) == "*" {
+		match = nil
+	}
+	ret := db.Keys(match)
+	c.Conn.WriteArray(len(ret))
+	for _, v := range ret {
+		c.Conn.WriteBulk(v)
+	}
+	return nil
+}
+
+func cmdRandomKey(c *Client, args ...[]byte) error {
+	if len(args) != 1 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	ret := db.RandomKey()
+	if ret == nil {
+		c.Conn.WriteNull()
+		return nil
+	}
+	c.Conn.WriteBulk(ret)
+	return nil
+}
+
+func cmdDBSize(c *Client, args ...[]byte) error {
+	if len(args) != 1 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	c.Conn.WriteInt(int(db.DBSize()))
+	return nil
+}
+
+func rename(c *Client, nx bool, args ...[]byte) error {
+	if len(args) != 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	done, err := db.Rename(args[1], args[2], nx)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if done {
+		c.signal(db.Index(), args[2])
+	}
+	if !nx {
+		c.Conn.WriteString("OK")
+	} else if done {
+		c.Conn.WriteInt(1)
+	} else {
+		c.Conn.WriteInt(0)
+	}
+	return nil
+}
+
+func cmdRename(c *Client, args ...[]byte) error {
+	return rename(c, false, args...)
+}
+
+func cmdRenameNX(c *Client, args ...[]byte) error {
+	return rename(c, true, args...)
+}
+
+//selectDB returns the view of the database named by arg
+func selectDB(db *command.RedisCommand, arg []byte) (*command.RedisCommand, error) {
+	index, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return nil, command.ErrNotInteger
+	}
+	return db.Select(index)
+}
+
+func cmdCopy(c *Client, args ...[]byte) error {
+	if len(args) < 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	to := db
+	replace := false
+	var err error
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(args) {
+				c.Conn.WriteError("ERR syntax error")
+				return nil
+			}
+			if to, err = selectDB(db, args[i+1]); err != nil {
+				c.Conn.WriteError("ERR " + err.Error())
+				return nil
+			}
+			i++
+		default:
+			c.Conn.WriteError("ERR syntax error")
+			return nil
+		}
+	}
+	done, err := db.Copy(args[1], to, args[2], replace)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if done {
+		c.signal(to.Index(), args[2])
+		c.Conn.WriteInt(1)
+	} else {
+		c.Conn.WriteInt(0)
+	}
+	return nil
+}
+
+func cmdMove(c *Client, args ...[]byte) error {
+	if len(args) != 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	if Cluster != nil {
+		c.Conn.WriteError("ERR MOVE is not allowed in cluster mode")
+		return nil
+	}
+	db := c.DB()
+	to, err := selectDB(db, args[2])
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	done, err := db.Move(args[1], to)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if done {
+		c.signal(to.Index(), args[1])
+		c.Conn.WriteInt(1)
+	} else {
+		c.Conn.WriteInt(0)
+	}
+	return nil
+}
+
+func cmdSelect(c *Client, args ...[]byte) error {
+	if len(args) != 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	if Cluster != nil && string(args[1]) != "0" {
+		c.Conn.WriteError("ERR SELECT is not allowed in cluster mode")
+		return nil
+	}
+	db, err := selectDB(c.DB(), args[1])
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Session().DB = db
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+func cmdSwapDB(c *Client, args ...[]byte) error {
+	if len(args) != 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	if Cluster != nil {
+		c.Conn.WriteError("ERR SWAPDB is not allowed in cluster mode")
+		return nil
+	}
+	a, err1 := strconv.Atoi(string(args[1]))
+	b, err2 := strconv.Atoi(string(args[2]))
+	if err1 != nil || err2 != nil {
+		c.Conn.WriteError("ERR invalid DB index")
+		return nil
+	}
+	if err := c.DB().SwapDB(a, b); err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+//parseFlushMode reads the optional ASYNC|SYNC argument of FLUSHDB and FLUSHALL
+func parseFlushMode(args [][]byte) (async bool, err error) {
+	if len(args) > 2 {
+		return false, command.ErrSyntax
+	}
+	if len(args) == 2 {
+		switch strings.ToUpper(string(args[1])) {
+		case "ASYNC":
+			async = true
+		case "SYNC":
+		default:
+			return false, command.ErrSyntax
+		}
+	}
+	return
+}
+
+func cmdFlushDB(c *Client, args ...[]byte) error {
+	async, err := parseFlushMode(args)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if async {
+		err = c.DB().FlushDBAsync()
+	} else {
+		err = c.DB().FlushDB()
+	}
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+func cmdFlushAll(c *Client, args ...[]byte) error {
+	async, err := parseFlushMode(args)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if err = c.DB().FlushAll(async); err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+func cmdUnlink(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	c.Conn.WriteInt(c.DB().Unlink(args[1:]...))
+	return nil
+}
+
+func cmdDump(c *Client, args ...[]byte) error {
+	if len(args) != 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	ret, err := c.DB().Dump(args[1])
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if ret == nil {
+		c.Conn.WriteNull()
+		return nil
+	}
+	c.Conn.WriteBulk(ret)
+	return nil
+}
+
+//cmdRestore accepts IDLETIME and FREQ for compatibility, access statistics are not tracked
+func cmdRestore(c *Client, args ...[]byte) error {
+	if len(args) < 4 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	ttl, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		c.Conn.WriteError("ERR " + command.ErrNotInteger.Error())
+		return nil
+	}
+	if ttl < 0 {
+		c.Conn.WriteError("ERR Invalid TTL value, must be >= 0")
+		return nil
+	}
+	replace, absTTL := false, false
+	idle, freq := false, false
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME", "FREQ":
+			if i+1 >= len(args) || idle || freq {
+				c.Conn.WriteError("ERR syntax error")
+				return nil
+			}
+			name := strings.ToUpper(string(args[i]))
+			v, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				c.Conn.WriteError("ERR " + command.ErrNotInteger.Error())
+				return nil
+			}
+			if name == "IDLETIME" && v < 0 {
+				c.Conn.WriteError("ERR Invalid IDLETIME value, must be >= 0")
+				return nil
+			}
+			if name == "FREQ" && (v < 0 || v > 255) {
+				c.Conn.WriteError("ERR Invalid FREQ value, must be >= 0 and <= 255")
+				return nil
+			}
+			idle, freq = idle || name == "IDLETIME", freq || name == "FREQ"
+			i++
+		default:
+			c.Conn.WriteError("ERR syntax error")
+			return nil
+		}
+	}
+	err = c.DB().Restore(args[1], ttl, args[3], replace, absTTL)
+	switch err {
+	case nil:
+	case command.ErrBusyKey:
+		c.Conn.WriteError("BUSYKEY " + err.Error())
+		return nil
+	default:
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.signal(c.DB().Index(), args[1])
+	c.Conn.WriteString("OK")
+	return nil
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//fillTypes writes a key of every type to the database of c
+func fillTypes(c *testConn) {
+	c.do("set", "string", "v")
+	c.do("hset", "hash", "f", "v")
+	c.do("sadd", "set", "m")
+	c.do("zadd", "zset", "1", "m")
+	c.do("rpush", "list", "a")
+	c.do("xadd", "stream", "1-1", "f", "v")
+}
+
+//sortBulks sorts the bulk strings of an array reply rendered by do
+func sortBulks(r string) string {
+	fields := strings.Fields(r)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "*") {
+		return r
+	}
+	var items []string
+	for i := 2; i < len(fields); i += 2 {
+		items = append(items, fields[i])
+	}
+	sort.Strings(items)
+	return reply(items...)
+}
+
+func TestKeyspace(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"exists", "string", "hash", "missing"}, ":2"},
+		{[]string{"exists", "string", "string"}, ":2"},
+		{[]string{"exists", "missing"}, ":0"},
+		{[]string{"touch", "list", "missing"}, ":1"},
+		{[]string{"type", "string"}, "+string"},
+		{[]string{"type", "hash"}, "+hash"},
+		{[]string{"type", "set"}, "+set"},
+		{[]string{"type", "zset"}, "+zset"},
+		{[]string{"type", "list"}, "+list"},
+		{[]string{"type", "stream"}, "+stream"},
+		{[]string{"type", "missing"}, "+none"},
+		{[]string{"dbsize"}, ":6"},
+		{[]string{"keys", "s*"}, reply("set", "stream", "string")},
+		{[]string{"keys", "?set"}, reply("zset")},
+		{[]string{"keys", "nosuch*"}, "*0"},
+		{[]string{"exists"}, "-ERR wrong number of arguments for 'exists' command"},
+		{[]string{"randomkey", "x"}, "-ERR wrong number of arguments for 'randomkey' command"},
+		//a deleted key is gone from every listing
+		{[]string{"del", "hash"}, ":1"},
+		{[]string{"exists", "hash"}, ":0"},
+		{[]string{"type", "hash"}, "+none"},
+		{[]string{"dbsize"}, ":5"},
+		{[]string{"select", "1"}, "+OK"},
+		{[]string{"randomkey"}, "$-1"},
+		{[]string{"dbsize"}, ":0"},
+		{[]string{"exists", "string"}, ":0"},
+	}
+	c := newTestConn(newTestDB(t))
+	fillTypes(c)
+	for _, tt := range tests {
+		got := c.do(tt.cmd...)
+		if tt.cmd[0] == "keys" {
+			//KEYS replies in shard order
+			got = sortBulks(got)
+		}
+		if got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestRandomKey(t *testing.T) {
+	c := newTestConn(newTestDB(t))
+	fillTypes(c)
+	seen := make(map[string]bool)
+	for i := 0; i < 200 && len(seen) < 6; i++ {
+		got := strings.Fields(c.do("randomkey"))
+		if len(got) != 2 || c.do("exists", got[1]) != ":1" {
+			t.Fatalf("RANDOMKEY = %v", got)
+		}
+		seen[got[1]] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("RANDOMKEY only returned %v", seen)
+	}
+}
+
+func TestKeysDisabled(t *testing.T) {
+	Conf.EnableKeys = false
+	defer func() { Conf.EnableKeys = true }()
+	if got := newTestConn(newTestDB(t)).do("keys", "*"); got != "-ERR KEYS is disabled, use SCAN instead" {
+		t.Fatalf("KEYS = %q", got)
+	}
+}
+
+//TestRenameTypes moves or copies a key of every type and compares its DUMP payloads
+func TestRenameTypes(t *testing.T) {
+	tests := []struct {
+		cmd    []string //the key is appended after the command name
+		want   string
+		dst    string //the key holding the value afterwards
+		dstDB  string
+		source bool //the source key is left
+	}{
+		{[]string{"rename", "$key", "dst"}, "+OK", "dst", "0", false},
+		{[]string{"rename", "$key", "string"}, "+OK", "string", "0", false},
+		{[]string{"renamenx", "$key", "dst"}, ":1", "dst", "0", false},
+		{[]string{"copy", "$key", "dst"}, ":1", "dst", "0", true},
+		{[]string{"copy", "$key", "string", "REPLACE"}, ":1", "string", "0", true},
+		{[]string{"copy", "$key", "dst", "DB", "2"}, ":1", "dst", "2", true},
+		{[]string{"move", "$key", "3"}, ":1", "$key", "3", false},
+	}
+	for _, key := range []string{"hash", "set", "zset", "list", "stream"} {
+		for _, tt := range tests {
+			args := strings.Fields(strings.ReplaceAll(strings.Join(tt.cmd, " "), "$key", key))
+			t.Run(strings.Join(args, " "), func(t *testing.T) {
+				c := newTestConn(newTestDB(t))
+				fillTypes(c)
+				c.do("rpush", "list", "b", "c")
+				c.do("hset", "hash", "g", "w")
+				payload := c.do("dump", key)
+				if got := c.do(args...); got != tt.want {
+					t.Fatalf("%v = %q, want %q", args, got, tt.want)
+				}
+				if got := c.do("exists", key); got != map[bool]string{true: ":1", false: ":0"}[tt.source] {
+					t.Fatalf("EXISTS %s = %s after %v", key, got, args)
+				}
+				dst := strings.ReplaceAll(tt.dst, "$key", key)
+				c.do("select", tt.dstDB)
+				if got := c.do("dump", dst); got != payload {
+					t.Fatalf("DUMP %s = %q, want %q", dst, got, payload)
+				}
+				if got := c.do("type", dst); got != "+"+key {
+					t.Fatalf("TYPE %s = %s", dst, got)
+				}
+			})
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"rename", "missing", "x"}, "-ERR no such key"},
+		{[]string{"renamenx", "missing", "x"}, "-ERR no such key"},
+		{[]string{"rename", "string", "string"}, "+OK"},
+		{[]string{"get", "string"}, "+v"},
+		{[]string{"renamenx", "string", "hash"}, ":0"},
+		{[]string{"copy", "string", "hash"}, ":0"},
+		{[]string{"copy", "missing", "x"}, ":0"},
+		{[]string{"copy", "string", "x", "DB"}, "-ERR syntax error"},
+		{[]string{"copy", "string", "x", "DB", "100"}, "-ERR DB index is out of range"},
+		{[]string{"copy", "string", "x", "FOO"}, "-ERR syntax error"},
+		{[]string{"move", "string", "0"}, "-ERR source and destination objects are the same"},
+		{[]string{"move", "missing", "1"}, ":0"},
+		{[]string{"move", "string", "x"}, "-ERR value is not an integer or out of range"},
+		{[]string{"copy", "string", "string", "DB", "1"}, ":1"},
+		{[]string{"move", "string", "1"}, ":0"},
+		{[]string{"exists", "string"}, ":1"},
+		{[]string{"rename", "hash", "string"}, "+OK"},
+		{[]string{"type", "string"}, "+hash"},
+		{[]string{"dbsize"}, ":5"},
+	}
+	c := newTestConn(newTestDB(t))
+	fillTypes(c)
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+//TestDatabases runs the commands of two connections, conn 1 starts in database 1
+func TestDatabases(t *testing.T) {
+	tests := []struct {
+		conn int
+		cmd  []string
+		want string
+	}{
+		{0, []string{"set", "k", "zero"}, "+OK"},
+		{1, []string{"set", "k", "one"}, "+OK"},
+		{1, []string{"hset", "h", "f", "one"}, "+OK"},
+		{0, []string{"get", "k"}, "+zero"},
+		{1, []string{"get", "k"}, "+one"},
+		{0, []string{"exists", "h"}, ":0"},
+		{0, []string{"dbsize"}, ":1"},
+		{1, []string{"dbsize"}, ":2"},
+		{0, []string{"select", "16"}, "-ERR DB index is out of range"},
+		{0, []string{"select", "-1"}, "-ERR DB index is out of range"},
+		{0, []string{"select", "x"}, "-ERR value is not an integer or out of range"},
+		{0, []string{"get", "k"}, "+zero"},
+		//both connections see the contents of the other database after SWAPDB
+		{0, []string{"swapdb", "0", "1"}, "+OK"},
+		{0, []string{"get", "k"}, "+one"},
+		{0, []string{"hget", "h", "f"}, "+one"},
+		{1, []string{"get", "k"}, "+zero"},
+		{1, []string{"dbsize"}, ":1"},
+		{0, []string{"swapdb", "1", "1"}, "+OK"},
+		{0, []string{"swapdb", "0", "16"}, "-ERR DB index is out of range"},
+		{0, []string{"swapdb", "0", "x"}, "-ERR invalid DB index"},
+		{0, []string{"swapdb", "1", "0"}, "+OK"},
+		{0, []string{"get", "k"}, "+zero"},
+		{1, []string{"flushdb"}, "+OK"},
+		{1, []string{"dbsize"}, ":0"},
+		{0, []string{"get", "k"}, "+zero"},
+		{0, []string{"select", "15"}, "+OK"},
+		{0, []string{"get", "k"}, "$-1"},
+	}
+	db := newTestDB(t)
+	conns := []*testConn{newTestConn(db), newTestConn(db)}
+	conns[1].do("select", "1")
+	for _, tt := range tests {
+		if got := conns[tt.conn].do(tt.cmd...); got != tt.want {
+			t.Errorf("%d: %v = %q, want %q", tt.conn, tt.cmd, got, tt.want)
+		}
+	}
+}
+
+//TestDatabasesCluster refuses other databases than 0 in cluster mode
+func TestDatabasesCluster(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"select", "0"}, "+OK"},
+		{[]string{"select", "1"}, "-ERR SELECT is not allowed in cluster mode"},
+		{[]string{"swapdb", "0", "1"}, "-ERR SWAPDB is not allowed in cluster mode"},
+		{[]string{"move", "k", "1"}, "-ERR MOVE is not allowed in cluster mode"},
+	}
+	db := newTestDB(t)
+	Cluster, _ = newTestCluster(t, db)
+	Cluster.slots[util.HashSlot([]byte("k"))] = Cluster.myself
+	defer func() { Cluster = nil }()
+	c := newTestConn(db)
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestFlushMode(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"flushdb", "foo"}, "-ERR syntax error"},
+		{[]string{"flushall", "async", "sync"}, "-ERR syntax error"},
+		{[]string{"dbsize"}, ":6"},
+		{[]string{"flushdb", "sync"}, "+OK"},
+		{[]string{"dbsize"}, ":0"},
+		{[]string{"select", "1"}, "+OK"},
+		{[]string{"dbsize"}, ":6"},
+		{[]string{"flushall", "ASYNC"}, "+OK"},
+		{[]string{"dbsize"}, ":0"},
+		{[]string{"select", "0"}, "+OK"},
+		{[]string{"dbsize"}, ":0"},
+	}
+	db := newTestDB(t)
+	c := newTestConn(db)
+	fillTypes(c)
+	c.do("select", "1")
+	fillTypes(c)
+	c.do("select", "0")
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Zealous-w/tacodb/command"
+)
+
+func cmdGeoAdd(c *Client, args ...[]byte) error {
+	if len(args) < 5 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	nx, xx, ch := false, false, false
+	i := 2
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+			continue
+		case "XX":
+			xx = true
+			continue
+		case "CH":
+			ch = true
+			continue
+		}
+		break
+	}
+	if nx && xx {
+		c.Conn.WriteError("ERR XX and NX options at the same time are not compatible")
+		return nil
+	}
+	ret, err := db.GeoAdd(args[1], nx, xx, ch, args[i:]...)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.signal(c.DB().Index(), args[1])
+	c.Conn.WriteInt(ret)
+	return nil
+}
+
+func cmdGeoPos(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	ret, err := db.GeoPos(args[1], args[2:]...)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteArray(len(ret))
+	for _, v := range ret {
+		if v == nil {
+			c.Conn.WriteNull()
+			continue
+		}
+		writeGeoCoord(c, v)
+	}
+	return nil
+}
+
+func cmdGeoDist(c *Client, args ...[]byte) error {
+	if len(args) != 4 && len(args) != 5 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	unit := 1.0
+	if len(args) == 5 {
+		var err error
+		unit, err = command.GeoParseUnit(args[4])
+		if err != nil {
+			c.Conn.WriteError("ERR " + err.Error())
+			return nil
+		}
+	}
+	dist, ok, err := db.GeoDist(args[1], args[2], args[3])
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if !ok {
+		c.Conn.WriteNull()
+		return nil
+	}
+	c.Conn.WriteBulk([]byte(strconv.FormatFloat(dist/unit, 'f', 4, 64)))
+	return nil
+}
+
+func cmdGeoSearch(c *Client, args ...[]byte) error {
+	if len(args) < 6 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	opt, err := command.GeoParseSearchOption(args[2:], false)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	ret, err := db.GeoSearch(args[1], opt)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteArray(len(ret))
+	for _, v := range ret {
+		if !opt.WithCoord && !opt.WithDist && !opt.WithHash {
+			c.Conn.WriteBulk(v.Member)
+			continue
+		}
+		n := 1
+		for _, with := range []bool{opt.WithDist, opt.WithHash, opt.WithCoord} {
+			if with {
+				n++
+			}
+		}
+		c.Conn.WriteArray(n)
+		c.Conn.WriteBulk(v.Member)
+		if opt.WithDist {
+			c.Conn.WriteBulk([]byte(strconv.FormatFloat(v.Dist, 'f', 4, 64)))
+		}
+		if opt.WithHash {
+			c.Conn.WriteInt(int(v.Hash))
+		}
+		if opt.WithCoord {
+			writeGeoCoord(c, v)
+		}
+	}
+	return nil
+}
+
+func cmdGeoSearchStore(c *Client, args ...[]byte) error {
+	if len(args) < 7 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	opt, err := command.GeoParseSearchOption(args[3:], true)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	ret, err := db.GeoSearchStore(args[1], args[2], opt)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if ret > 0 {
+		c.signal(c.DB().Index(), args[1])
+	}
+	c.Conn.WriteInt(ret)
+	return nil
+}
+
+func writeGeoCoord(c *Client, p *command.GeoPoint) {
+	c.Conn.WriteArray(2)
+	c.Conn.WriteBulk([]byte(strconv.FormatFloat(p.Long, 'f', -1, 64)))
+	c.Conn.WriteBulk([]byte(strconv.FormatFloat(p.Lat, 'f', -1, 64)))
+}
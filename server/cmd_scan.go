@@ -0,0 +1,221 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/store"
+)
+
+const (
+	SCAN_CURSOR_MAX    = 1 << 16 //cursors kept before the oldest are forgotten
+	SCAN_COUNT_DEFAULT = 10
+	SCAN_SHARD_BITS    = 8
+)
+
+//scanCursorTable hands out the numeric cursors clients expect and remembers the
+//encoded key each one stands for. The shard index lives in the low bits of the cursor
+//itself, so a forgotten cursor only restarts its own shard
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+type scanCursorTable struct {
+	mu      sync.Mutex
+	id      uint64
+	cursors map[uint64][]byte
+	order   []uint64
+}
+
+var scanCursors = &scanCursorTable{cursors: make(map[uint64][]byte)}
+
+func (s *scanCursorTable) Put(shard int, last []byte) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.id++
+	cursor := s.id<<SCAN_SHARD_BITS | uint64(shard)
+	s.cursors[cursor] = last
+	s.order = append(s.order, cursor)
+	if len(s.order) > SCAN_CURSOR_MAX {
+		delete(s.cursors, s.order[0])
+		s.order = s.order[1:]
+	}
+	return cursor
+}
+
+func (s *scanCursorTable) Get(cursor uint64) (int, []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(cursor & (1<<SCAN_SHARD_BITS - 1)), s.cursors[cursor]
+}
+
+type scanOption struct {
+	cursor uint64
+	match  []byte
+	count  int
+	tp     byte
+}
+
+//parseScanOption parses "cursor [MATCH pattern] [COUNT count] [TYPE type]"
+func parseScanOption(args [][]byte, withType bool) (*scanOption, error) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	opt := &scanOption{cursor: cursor, count: SCAN_COUNT_DEFAULT}
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, command.ErrSyntax
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			opt.match = args[i+1]
+			if string(opt.match) == "*" {
+				opt.match = nil
+			}
+		case "COUNT":
+			opt.count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return nil, command.ErrNotInteger
+			}
+			if opt.count < 1 {
+				return nil, command.ErrSyntax
+			}
+		case "TYPE":
+			if !withType {
+				return nil, command.ErrSyntax
+			}
+			opt.tp = command.ParseKeyType(strings.ToLower(string(args[i+1])))
+			if opt.tp == 0 {
+				//unknown types match nothing, like redis
+				opt.tp = 0xFF
+			}
+		default:
+			return nil, command.ErrSyntax
+		}
+	}
+	return opt, nil
+}
+
+func writeScanReply(c *Client, cursor uint64, n int) {
+	c.Conn.WriteArray(2)
+	c.Conn.WriteBulk([]byte(strconv.FormatUint(cursor, 10)))
+	c.Conn.WriteArray(n)
+}
+
+func cmdScan(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	opt, err := parseScanOption(args[1:], true)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	var keys [][]byte
+	if opt.tp != 0xFF {
+		cursor := command.ScanCursor{}
+		if opt.cursor != 0 {
+			cursor.Shard, cursor.Last = scanCursors.Get(opt.cursor)
+		}
+		next, ret, done := db.Scan(cursor, opt.match, opt.count, opt.tp)
+		keys = ret
+		opt.cursor = 0
+		if !done {
+			opt.cursor = scanCursors.Put(next.Shard, next.Last)
+		}
+	} else {
+		opt.cursor = 0
+	}
+	writeScanReply(c, opt.cursor, len(keys))
+	for _, v := range keys {
+		c.Conn.WriteBulk(v)
+	}
+	return nil
+}
+
+//collectionScan runs one page of H/S/ZSCAN and swaps the encoded position for a cursor
+func collectionScan(c *Client, args [][]byte, f func(db *command.RedisCommand, last []byte, opt *scanOption) ([]byte, error)) (bool, uint64) {
+	if len(args) < 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return false, 0
+	}
+	db := c.DB()
+	opt, err := parseScanOption(args[2:], false)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return false, 0
+	}
+	var last []byte
+	if opt.cursor != 0 {
+		_, last = scanCursors.Get(opt.cursor)
+	}
+	next, err := f(db, last, opt)
+	if err == command.ErrKeyTypeError {
+		c.Conn.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return false, 0
+	}
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return false, 0
+	}
+	if next == nil {
+		return true, 0
+	}
+	return true, scanCursors.Put(0, next)
+}
+
+func cmdHScan(c *Client, args ...[]byte) error {
+	var ret []*store.Pair
+	ok, cursor := collectionScan(c, args, func(db *command.RedisCommand, last []byte, opt *scanOption) (next []byte, err error) {
+		next, ret, err = db.HScan(args[1], last, opt.match, opt.count)
+		return
+	})
+	if !ok {
+		return nil
+	}
+	writeScanReply(c, cursor, len(ret)*2)
+	for _, v := range ret {
+		c.Conn.WriteBulk(v.V0)
+		c.Conn.WriteBulk(v.V1)
+	}
+	return nil
+}
+
+func cmdSScan(c *Client, args ...[]byte) error {
+	var ret [][]byte
+	ok, cursor := collectionScan(c, args, func(db *command.RedisCommand, last []byte, opt *scanOption) (next []byte, err error) {
+		next, ret, err = db.SScan(args[1], last, opt.match, opt.count)
+		return
+	})
+	if !ok {
+		return nil
+	}
+	writeScanReply(c, cursor, len(ret))
+	for _, v := range ret {
+		c.Conn.WriteBulk(v)
+	}
+	return nil
+}
+
+func cmdZScan(c *Client, args ...[]byte) error {
+	var ret []*command.ZSetMember
+	ok, cursor := collectionScan(c, args, func(db *command.RedisCommand, last []byte, opt *scanOption) (next []byte, err error) {
+		next, ret, err = db.ZScan(args[1], last, opt.match, opt.count)
+		return
+	})
+	if !ok {
+		return nil
+	}
+	writeScanReply(c, cursor, len(ret)*2)
+	for _, v := range ret {
+		c.Conn.WriteBulk(v.Member)
+		c.Conn.WriteBulk([]byte(strconv.FormatUint(v.Score, 10)))
+	}
+	return nil
+}
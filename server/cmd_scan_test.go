@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+//scanAll follows the cursors of a SCAN family command until it returns 0 and collects
+//the items of every page
+func scanAll(t *testing.T, c *testConn, cmd []string, opts []string) []string {
+	t.Helper()
+	var items []string
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > 1000 {
+			t.Fatalf("%v doesn't finish", cmd)
+		}
+		args := append(append(append([]string{}, cmd...), cursor), opts...)
+		fields := strings.Fields(c.do(args...))
+		if len(fields) < 4 || fields[0] != "*2" {
+			t.Fatalf("%v = %v", args, fields)
+		}
+		cursor = fields[2]
+		for i := 5; i < len(fields); i += 2 {
+			items = append(items, fields[i])
+		}
+		if cursor == "0" {
+			return items
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	var keys, matched []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprint("k", i))
+		if i == 1 || i/10 == 1 {
+			matched = append(matched, fmt.Sprint("k", i))
+		}
+	}
+	tests := []struct {
+		opts []string
+		want []string
+	}{
+		{nil, append(append([]string{}, keys...), "h", "s", "x", "z")},
+		{[]string{"COUNT", "1"}, append(append([]string{}, keys...), "h", "s", "x", "z")},
+		{[]string{"MATCH", "k1*", "COUNT", "3"}, matched},
+		{[]string{"TYPE", "string", "COUNT", "7"}, keys},
+		{[]string{"TYPE", "hash"}, []string{"h"}},
+		{[]string{"TYPE", "zset", "MATCH", "z"}, []string{"z"}},
+		{[]string{"TYPE", "stream"}, []string{"x"}},
+		{[]string{"TYPE", "nosuchtype"}, nil},
+		{[]string{"MATCH", "nosuchkey*"}, nil},
+	}
+	c := newTestConn(newTestDB(t))
+	for _, k := range keys {
+		c.do("set", k, "v")
+	}
+	c.do("hset", "h", "f", "v")
+	c.do("sadd", "s", "m")
+	c.do("zadd", "z", "1", "m")
+	c.do("xadd", "x", "*", "f", "v")
+	for _, tt := range tests {
+		got := scanAll(t, c, []string{"scan"}, tt.opts)
+		sort.Strings(got)
+		want := append([]string{}, tt.want...)
+		sort.Strings(want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("SCAN %v = %v, want %v", tt.opts, got, want)
+		}
+	}
+}
+
+func TestCollectionScan(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		opts []string
+		want string //sorted items
+	}{
+		{[]string{"hscan", "h"}, []string{"MATCH", "f1?", "COUNT", "2"}, "f10 f11 f12 f13 f14 v10 v11 v12 v13 v14"},
+		{[]string{"hscan", "h"}, []string{"MATCH", "f4", "COUNT", "1"}, "f4 v4"},
+		{[]string{"sscan", "s"}, []string{"MATCH", "m1?", "COUNT", "3"}, "m10 m11 m12 m13 m14"},
+		{[]string{"zscan", "z"}, []string{"MATCH", "m1?"}, "10 11 12 13 14 m10 m11 m12 m13 m14"},
+		{[]string{"zscan", "z"}, []string{"MATCH", "m2", "COUNT", "1"}, "2 m2"},
+		{[]string{"sscan", "missing"}, nil, ""},
+	}
+	c := newTestConn(newTestDB(t))
+	for i := 0; i < 15; i++ {
+		c.do("hset", "h", fmt.Sprint("f", i), fmt.Sprint("v", i))
+		c.do("sadd", "s", fmt.Sprint("m", i))
+		c.do("zadd", "z", fmt.Sprint(i), fmt.Sprint("m", i))
+	}
+	for _, tt := range tests {
+		got := scanAll(t, c, tt.cmd, tt.opts)
+		sort.Strings(got)
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%v %v = %v, want %s", tt.cmd, tt.opts, got, tt.want)
+		}
+	}
+	//every member once with the smallest pages
+	for _, cmd := range [][]string{{"hscan", "h"}, {"sscan", "s"}, {"zscan", "z"}} {
+		want := 15
+		if cmd[0] != "sscan" {
+			want = 30
+		}
+		if got := scanAll(t, c, cmd, []string{"COUNT", "1"}); len(got) != want {
+			t.Errorf("%v COUNT 1 = %d items, want %d", cmd, len(got), want)
+		}
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"scan", "x"}, "-ERR invalid cursor"},
+		{[]string{"scan", "0", "COUNT", "0"}, "-ERR syntax error"},
+		{[]string{"scan", "0", "COUNT", "x"}, "-ERR value is not an integer or out of range"},
+		{[]string{"scan", "0", "MATCH"}, "-ERR syntax error"},
+		{[]string{"hscan", "h", "0", "TYPE", "hash"}, "-ERR syntax error"},
+		{[]string{"sscan", "h", "0"}, "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{[]string{"hscan", "h"}, "-ERR wrong number of arguments for 'hscan' command"},
+	}
+	c := newTestConn(newTestDB(t))
+	c.do("hset", "h", "f", "v")
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
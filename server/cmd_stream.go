@@ -0,0 +1,857 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zealous-w/tacodb/command"
+)
+
+func writeStreamEntries(c *Client, entries []*command.StreamEntry) {
+	c.Conn.WriteArray(len(entries))
+	for _, v := range entries {
+		c.Conn.WriteArray(2)
+		c.Conn.WriteBulk([]byte(v.ID.String()))
+		c.Conn.WriteArray(len(v.Fields))
+		for _, f := range v.Fields {
+			c.Conn.WriteBulk(f)
+		}
+	}
+}
+
+func cmdXAdd(c *Client, args ...[]byte) error {
+	if len(args) < 5 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	opt := &command.StreamAddOption{}
+	i := 2
+	for ; i < len(args) && opt.ID == nil; i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NOMKSTREAM":
+			opt.NoMkStream = true
+		case "MAXLEN", "MINID":
+			trim, n, err := command.ParseStreamTrimOption(args[i:])
+			if err != nil {
+				c.Conn.WriteError("ERR " + err.Error())
+				return nil
+			}
+			opt.Trim = trim
+			i += n - 1
+		default:
+			opt.ID = args[i]
+		}
+	}
+	fields := args[i:]
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	id, err := db.XAdd(args[1], opt, fields)
+	if err == command.ErrKeyNotFound {
+		c.Conn.WriteNull()
+		return nil
+	}
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.signal(c.DB().Index(), args[1])
+	c.Conn.WriteBulk([]byte(id.String()))
+	return nil
+}
+
+func cmdXRange(c *Client, args ...[]byte) error {
+	return streamRange(c, false, args...)
+}
+
+func cmdXRevRange(c *Client, args ...[]byte) error {
+	return streamRange(c, true, args...)
+}
+
+func streamRange(c *Client, rev bool, args ...[]byte) error {
+	if len(args) != 4 && len(args) != 6 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	startArg, endArg := args[2], args[3]
+	if rev {
+		startArg, endArg = args[3], args[2]
+	}
+	start, ok1, err := command.ParseStreamRangeID(startArg, true)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	end, ok2, err := command.ParseStreamRangeID(endArg, false)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	count := 0
+	if len(args) == 6 {
+		if strings.ToUpper(string(args[4])) != "COUNT" {
+			c.Conn.WriteError("ERR syntax error")
+			return nil
+		}
+		count, err = strconv.Atoi(string(args[5]))
+		if err != nil {
+			c.Conn.WriteError("ERR value is not an integer or out of range")
+			return nil
+		}
+		if count <= 0 {
+			c.Conn.WriteArray(0)
+			return nil
+		}
+	}
+	if !ok1 || !ok2 {
+		c.Conn.WriteArray(0)
+		return nil
+	}
+	ret, err := db.XRange(args[1], start, end, count, rev)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	writeStreamEntries(c, ret)
+	return nil
+}
+
+func cmdXLen(c *Client, args ...[]byte) error {
+	if len(args) != 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	ret, err := db.XLen(args[1])
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteInt(int(ret))
+	return nil
+}
+
+func cmdXTrim(c *Client, args ...[]byte) error {
+	if len(args) < 4 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	opt, n, err := command.ParseStreamTrimOption(args[2:])
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if 2+n != len(args) {
+		c.Conn.WriteError("ERR syntax error")
+		return nil
+	}
+	ret, err := db.XTrim(args[1], opt)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteInt(ret)
+	return nil
+}
+
+func cmdXDel(c *Client, args ...[]byte) error {
+	if len(args) < 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	ids := make([]command.StreamID, 0, len(args)-2)
+	for _, v := range args[2:] {
+		id, err := command.ParseStreamID(v, 0)
+		if err != nil {
+			c.Conn.WriteError("ERR " + err.Error())
+			return nil
+		}
+		ids = append(ids, id)
+	}
+	ret, err := db.XDel(args[1], ids...)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	c.Conn.WriteInt(ret)
+	return nil
+}
+
+//streamReadOption holds "[COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]"
+type streamReadOption struct {
+	count   int
+	block   bool
+	timeout time.Duration
+	noAck   bool
+	keys    [][]byte
+	ids     [][]byte
+}
+
+//parseStreamReadOption parses XREAD options, group enables the XREADGROUP only NOACK flag
+func parseStreamReadOption(args [][]byte, group bool) (*streamReadOption, error) {
+	opt := &streamReadOption{}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return nil, command.ErrSyntax
+			}
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return nil, command.ErrNotInteger
+			}
+			if n > 0 {
+				opt.count = n
+			}
+			i++
+		case "BLOCK":
+			if i+1 >= len(args) {
+				return nil, command.ErrSyntax
+			}
+			ms, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, ErrTimeoutInvalid
+			}
+			if ms < 0 {
+				return nil, ErrTimeoutNegative
+			}
+			opt.block = true
+			opt.timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case "NOACK":
+			if !group {
+				return nil, command.ErrSyntax
+			}
+			opt.noAck = true
+		case "STREAMS":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				name := "xread"
+				if group {
+					name = "xreadgroup"
+				}
+				return nil, errors.New("Unbalanced '" + name + "' list of streams: for each stream key an ID or '$' must be specified.")
+			}
+			opt.keys, opt.ids = rest[:len(rest)/2], rest[len(rest)/2:]
+			return opt, nil
+		default:
+			return nil, command.ErrSyntax
+		}
+	}
+	return nil, command.ErrSyntax
+}
+
+func cmdXRead(c *Client, args ...[]byte) error {
+	if len(args) < 4 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	opt, err := parseStreamReadOption(args[1:], false)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	ids := make([]command.StreamID, len(opt.keys))
+	for k, v := range opt.ids {
+		if string(v) == "$" {
+			ids[k], err = db.XLastID(opt.keys[k])
+		} else {
+			ids[k], err = command.ParseStreamID(v, 0)
+		}
+		if err != nil {
+			c.Conn.WriteError("ERR " + err.Error())
+			return nil
+		}
+	}
+
+	var ret [][]*command.StreamEntry
+	try := func() bool {
+		ret, err = db.XRead(opt.keys, ids, opt.count)
+		if err != nil {
+			return true
+		}
+		for _, v := range ret {
+			if len(v) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	ok := try()
+	if !ok && opt.block {
+		ok = c.block(opt.keys, opt.timeout, try)
+	}
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if !ok {
+		c.Conn.WriteNull()
+		return nil
+	}
+	writeStreamRead(c, opt.keys, ret)
+	return nil
+}
+
+func writeStreamRead(c *Client, keys [][]byte, ret [][]*command.StreamEntry) {
+	n := 0
+	for _, v := range ret {
+		if len(v) > 0 {
+			n++
+		}
+	}
+	c.Conn.WriteArray(n)
+	for k, v := range ret {
+		if len(v) == 0 {
+			continue
+		}
+		c.Conn.WriteArray(2)
+		c.Conn.WriteBulk(keys[k])
+		writeStreamEntries(c, v)
+	}
+}
+
+func writeStreamError(c *Client, err error) {
+	if err == command.ErrStreamNoGroup || err == command.ErrStreamBusyGroup {
+		c.Conn.WriteError(err.Error())
+		return
+	}
+	c.Conn.WriteError("ERR " + err.Error())
+}
+
+func cmdXGroup(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	sub := strings.ToUpper(string(args[1]))
+	arity := map[string]int{"CREATE": 5, "SETID": 5, "DESTROY": 4, "CREATECONSUMER": 5, "DELCONSUMER": 5}
+	n, ok := arity[sub]
+	if !ok {
+		c.Conn.WriteError("ERR unknown subcommand '" + string(args[1]) + "'. Try XGROUP HELP.")
+		return nil
+	}
+	if len(args) < n || (sub != "CREATE" && sub != "SETID" && len(args) != n) {
+		c.Conn.WriteError("ERR wrong number of arguments for 'xgroup|" + strings.ToLower(sub) + "' command")
+		return nil
+	}
+	key, group := args[2], args[3]
+	var err error
+	ret := 0
+	switch sub {
+	case "CREATE", "SETID":
+		mkStream, entriesRead := false, int64(-1)
+		for i := 5; i < len(args); i++ {
+			switch strings.ToUpper(string(args[i])) {
+			case "MKSTREAM":
+				if sub != "CREATE" {
+					c.Conn.WriteError("ERR syntax error")
+					return nil
+				}
+				mkStream = true
+			case "ENTRIESREAD":
+				if i+1 >= len(args) {
+					c.Conn.WriteError("ERR syntax error")
+					return nil
+				}
+				entriesRead, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+				if err != nil || entriesRead < 0 {
+					c.Conn.WriteError("ERR value for ENTRIESREAD must be positive or -1")
+					return nil
+				}
+				i++
+			default:
+				c.Conn.WriteError("ERR syntax error")
+				return nil
+			}
+		}
+		if sub == "CREATE" {
+			err = db.XGroupCreate(key, group, args[4], mkStream, entriesRead)
+		} else {
+			err = db.XGroupSetID(key, group, args[4], entriesRead)
+		}
+		if err != nil {
+			writeStreamError(c, err)
+			return nil
+		}
+		c.Conn.WriteString("OK")
+		return nil
+	case "DESTROY":
+		ret, err = db.XGroupDestroy(key, group)
+	case "CREATECONSUMER":
+		ret, err = db.XGroupCreateConsumer(key, group, args[4])
+	case "DELCONSUMER":
+		ret, err = db.XGroupDelConsumer(key, group, args[4])
+	}
+	if err != nil {
+		writeStreamError(c, err)
+		return nil
+	}
+	c.Conn.WriteInt(ret)
+	return nil
+}
+
+func cmdXReadGroup(c *Client, args ...[]byte) error {
+	if len(args) < 7 || strings.ToUpper(string(args[1])) != "GROUP" {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	group, consumer := args[2], args[3]
+	opt, err := parseStreamReadOption(args[4:], true)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	history := false
+	for _, v := range opt.ids {
+		if string(v) != ">" {
+			history = true
+		}
+	}
+
+	var ret [][]*command.StreamEntry
+	try := func() bool {
+		ret = make([][]*command.StreamEntry, len(opt.keys))
+		for k, key := range opt.keys {
+			ret[k], err = db.XReadGroup(key, group, consumer, opt.ids[k], opt.count, opt.noAck)
+			if err != nil {
+				return true
+			}
+		}
+		if history {
+			return true
+		}
+		for _, v := range ret {
+			if len(v) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	ok := try()
+	if !ok && opt.block {
+		ok = c.block(opt.keys, opt.timeout, try)
+	}
+	if err == command.ErrStreamNoGroup {
+		c.Conn.WriteError("NOGROUP No such key '" + string(opt.keys[0]) + "' or consumer group '" + string(group) + "' in XREADGROUP with GROUP option")
+		return nil
+	}
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	if !ok {
+		c.Conn.WriteNull()
+		return nil
+	}
+	if !history {
+		writeStreamRead(c, opt.keys, ret)
+		return nil
+	}
+	c.Conn.WriteArray(len(ret))
+	for k, v := range ret {
+		c.Conn.WriteArray(2)
+		c.Conn.WriteBulk(opt.keys[k])
+		c.Conn.WriteArray(len(v))
+		for _, e := range v {
+			c.Conn.WriteArray(2)
+			c.Conn.WriteBulk([]byte(e.ID.String()))
+			if e.Fields == nil {
+				c.Conn.WriteNull()
+				continue
+			}
+			c.Conn.WriteArray(len(e.Fields))
+			for _, f := range e.Fields {
+				c.Conn.WriteBulk(f)
+			}
+		}
+	}
+	return nil
+}
+
+func parseStreamIDs(args [][]byte) ([]command.StreamID, error) {
+	ids := make([]command.StreamID, 0, len(args))
+	for _, v := range args {
+		id, err := command.ParseStreamID(v, 0)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func cmdXAck(c *Client, args ...[]byte) error {
+	if len(args) < 4 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	ids, err := parseStreamIDs(args[3:])
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	ret, err := db.XAck(args[1], args[2], ids...)
+	if err != nil {
+		writeStreamError(c, err)
+		return nil
+	}
+	c.Conn.WriteInt(ret)
+	return nil
+}
+
+func cmdXPending(c *Client, args ...[]byte) error {
+	if len(args) != 3 && (len(args) < 6 || len(args) > 9) {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	key, group := args[1], args[2]
+	if len(args) == 3 {
+		count, min, max, consumers, err := db.XPendingSummary(key, group)
+		if err != nil {
+			writeStreamError(c, err)
+			return nil
+		}
+		c.Conn.WriteArray(4)
+		c.Conn.WriteInt(count)
+		if count == 0 {
+			c.Conn.WriteNull()
+			c.Conn.WriteNull()
+			c.Conn.WriteNull()
+			return nil
+		}
+		c.Conn.WriteBulk([]byte(min.String()))
+		c.Conn.WriteBulk([]byte(max.String()))
+		c.Conn.WriteArray(len(consumers))
+		for _, v := range consumers {
+			c.Conn.WriteArray(2)
+			c.Conn.WriteBulk(v.Name)
+			c.Conn.WriteBulk([]byte(strconv.Itoa(v.Pending)))
+		}
+		return nil
+	}
+
+	i := 3
+	minIdle := uint64(0)
+	if strings.ToUpper(string(args[i])) == "IDLE" {
+		idle, err := strconv.ParseUint(string(args[i+1]), 10, 64)
+		if err != nil {
+			c.Conn.WriteError("ERR value is not an integer or out of range")
+			return nil
+		}
+		minIdle = idle
+		i += 2
+	}
+	if len(args)-i != 3 && len(args)-i != 4 {
+		c.Conn.WriteError("ERR syntax error")
+		return nil
+	}
+	start, ok1, err := command.ParseStreamRangeID(args[i], true)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	end, ok2, err := command.ParseStreamRangeID(args[i+1], false)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	count, err := strconv.Atoi(string(args[i+2]))
+	if err != nil {
+		c.Conn.WriteError("ERR value is not an integer or out of range")
+		return nil
+	}
+	var consumer []byte
+	if len(args)-i == 4 {
+		consumer = args[i+3]
+	}
+	var ret []*command.StreamPendingEntry
+	if ok1 && ok2 {
+		ret, err = db.XPending(key, group, start, end, count, consumer, minIdle)
+		if err != nil {
+			writeStreamError(c, err)
+			return nil
+		}
+	}
+	now := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	c.Conn.WriteArray(len(ret))
+	for _, v := range ret {
+		idle := uint64(0)
+		if now > v.DeliveryTime {
+			idle = now - v.DeliveryTime
+		}
+		c.Conn.WriteArray(4)
+		c.Conn.WriteBulk([]byte(v.ID.String()))
+		c.Conn.WriteBulk(v.Consumer)
+		c.Conn.WriteInt(int(idle))
+		c.Conn.WriteInt(int(v.DeliveryCount))
+	}
+	return nil
+}
+
+func writeStreamClaimed(c *Client, entries []*command.StreamEntry, justID bool) {
+	if !justID {
+		writeStreamEntries(c, entries)
+		return
+	}
+	c.Conn.WriteArray(len(entries))
+	for _, v := range entries {
+		c.Conn.WriteBulk([]byte(v.ID.String()))
+	}
+}
+
+func cmdXClaim(c *Client, args ...[]byte) error {
+	if len(args) < 6 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	minIdle, err := strconv.ParseUint(string(args[4]), 10, 64)
+	if err != nil {
+		c.Conn.WriteError("ERR Invalid min-idle-time argument for XCLAIM")
+		return nil
+	}
+	i := 5
+	var ids []command.StreamID
+	for ; i < len(args); i++ {
+		id, err := command.ParseStreamID(args[i], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	opt := &command.StreamClaimOption{Idle: -1, Time: -1, RetryCount: -1}
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch option {
+		case "FORCE":
+			opt.Force = true
+		case "JUSTID":
+			opt.JustID = true
+		case "IDLE", "TIME", "RETRYCOUNT":
+			if i+1 >= len(args) {
+				c.Conn.WriteError("ERR syntax error")
+				return nil
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n < 0 {
+				c.Conn.WriteError("ERR Invalid " + option + " option argument for XCLAIM")
+				return nil
+			}
+			switch option {
+			case "IDLE":
+				opt.Idle = n
+			case "TIME":
+				opt.Time = n
+			default:
+				opt.RetryCount = n
+			}
+			i++
+		case "LASTID":
+			if i+1 >= len(args) {
+				c.Conn.WriteError("ERR syntax error")
+				return nil
+			}
+			id, err := command.ParseStreamID(args[i+1], 0)
+			if err != nil {
+				c.Conn.WriteError("ERR " + err.Error())
+				return nil
+			}
+			opt.LastID = &id
+			i++
+		default:
+			c.Conn.WriteError("ERR Unrecognized XCLAIM option '" + string(args[i]) + "'")
+			return nil
+		}
+	}
+	ret, err := db.XClaim(args[1], args[2], args[3], minIdle, ids, opt)
+	if err != nil {
+		writeStreamError(c, err)
+		return nil
+	}
+	writeStreamClaimed(c, ret, opt.JustID)
+	return nil
+}
+
+func cmdXAutoClaim(c *Client, args ...[]byte) error {
+	if len(args) < 6 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	minIdle, err := strconv.ParseUint(string(args[4]), 10, 64)
+	if err != nil {
+		c.Conn.WriteError("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+		return nil
+	}
+	start, ok, err := command.ParseStreamRangeID(args[5], true)
+	if err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	count, justID := 100, false
+	for i := 6; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				c.Conn.WriteError("ERR syntax error")
+				return nil
+			}
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				c.Conn.WriteError("ERR COUNT must be > 0")
+				return nil
+			}
+			i++
+		case "JUSTID":
+			justID = true
+		default:
+			c.Conn.WriteError("ERR syntax error")
+			return nil
+		}
+	}
+	next := command.STREAM_ID_MIN
+	var ret []*command.StreamEntry
+	var deleted []command.StreamID
+	if ok {
+		next, ret, deleted, err = db.XAutoClaim(args[1], args[2], args[3], minIdle, start, count, justID)
+		if err != nil {
+			writeStreamError(c, err)
+			return nil
+		}
+	}
+	c.Conn.WriteArray(3)
+	c.Conn.WriteBulk([]byte(next.String()))
+	writeStreamClaimed(c, ret, justID)
+	c.Conn.WriteArray(len(deleted))
+	for _, v := range deleted {
+		c.Conn.WriteBulk([]byte(v.String()))
+	}
+	return nil
+}
+
+func writeStreamEntry(c *Client, e *command.StreamEntry) {
+	if e == nil {
+		c.Conn.WriteNull()
+		return
+	}
+	writeStreamEntries(c, []*command.StreamEntry{e})
+}
+
+func cmdXInfo(c *Client, args ...[]byte) error {
+	if len(args) < 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	now := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	switch strings.ToUpper(string(args[1])) {
+	case "STREAM":
+		info, err := db.XInfoStream(args[2])
+		if err == command.ErrKeyNotFound {
+			c.Conn.WriteError("ERR no such key")
+			return nil
+		}
+		if err != nil {
+			c.Conn.WriteError("ERR " + err.Error())
+			return nil
+		}
+		c.Conn.WriteArray(14)
+		c.Conn.WriteBulk([]byte("length"))
+		c.Conn.WriteInt(int(info.Length))
+		c.Conn.WriteBulk([]byte("last-generated-id"))
+		c.Conn.WriteBulk([]byte(info.LastID.String()))
+		c.Conn.WriteBulk([]byte("max-deleted-entry-id"))
+		c.Conn.WriteBulk([]byte(info.MaxDeletedID.String()))
+		c.Conn.WriteBulk([]byte("entries-added"))
+		c.Conn.WriteInt(int(info.EntriesAdded))
+		c.Conn.WriteBulk([]byte("groups"))
+		c.Conn.WriteInt(info.Groups)
+		c.Conn.WriteBulk([]byte("first-entry"))
+		writeStreamEntry(c, info.First)
+		c.Conn.WriteBulk([]byte("last-entry"))
+		writeStreamEntry(c, info.Last)
+	case "GROUPS":
+		ret, err := db.XInfoGroups(args[2])
+		if err == command.ErrKeyNotFound {
+			c.Conn.WriteError("ERR no such key")
+			return nil
+		}
+		if err != nil {
+			c.Conn.WriteError("ERR " + err.Error())
+			return nil
+		}
+		c.Conn.WriteArray(len(ret))
+		for _, v := range ret {
+			c.Conn.WriteArray(12)
+			c.Conn.WriteBulk([]byte("name"))
+			c.Conn.WriteBulk(v.Name)
+			c.Conn.WriteBulk([]byte("consumers"))
+			c.Conn.WriteInt(v.Consumers)
+			c.Conn.WriteBulk([]byte("pending"))
+			c.Conn.WriteInt(v.Pending)
+			c.Conn.WriteBulk([]byte("last-delivered-id"))
+			c.Conn.WriteBulk([]byte(v.LastID.String()))
+			c.Conn.WriteBulk([]byte("entries-read"))
+			if v.EntriesRead == command.STREAM_ENTRIES_READ_UNKNOWN {
+				c.Conn.WriteNull()
+			} else {
+				c.Conn.WriteInt(int(v.EntriesRead))
+			}
+			c.Conn.WriteBulk([]byte("lag"))
+			if v.Lag < 0 {
+				c.Conn.WriteNull()
+			} else {
+				c.Conn.WriteInt(int(v.Lag))
+			}
+		}
+	case "CONSUMERS":
+		if len(args) != 4 {
+			c.Conn.WriteError("ERR wrong number of arguments for 'xinfo|consumers' command")
+			return nil
+		}
+		ret, err := db.XInfoConsumers(args[2], args[3])
+		if err != nil {
+			writeStreamError(c, err)
+			return nil
+		}
+		c.Conn.WriteArray(len(ret))
+		for _, v := range ret {
+			c.Conn.WriteArray(8)
+			c.Conn.WriteBulk([]byte("name"))
+			c.Conn.WriteBulk(v.Name)
+			c.Conn.WriteBulk([]byte("pending"))
+			c.Conn.WriteInt(v.Pending)
+			c.Conn.WriteBulk([]byte("idle"))
+			c.Conn.WriteInt(int(sinceMs(now, v.SeenTime)))
+			c.Conn.WriteBulk([]byte("inactive"))
+			if v.ActiveTime == 0 {
+				c.Conn.WriteInt(-1)
+			} else {
+				c.Conn.WriteInt(int(sinceMs(now, v.ActiveTime)))
+			}
+		}
+	default:
+		c.Conn.WriteError("ERR unknown subcommand '" + string(args[1]) + "'. Try XINFO HELP.")
+	}
+	return nil
+}
+
+func sinceMs(now, t uint64) uint64 {
+	if now < t {
+		return 0
+	}
+	return now - t
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//reply renders the expected reply of an array of bulk strings like do
+func reply(items ...string) string {
+	ret := []string{"*" + strconv.Itoa(len(items))}
+	for _, v := range items {
+		ret = append(ret, "$"+strconv.Itoa(len(v)), v)
+	}
+	return strings.Join(ret, " ")
+}
+
+func TestZSetAggregate(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"zunion", "2", "z1", "z2", "WITHSCORES"}, reply("a", "1", "b", "12", "c", "23", "d", "30")},
+		{[]string{"zunion", "2", "z1", "z2"}, reply("a", "b", "c", "d")},
+		{[]string{"zunion", "2", "z1", "z2", "WEIGHTS", "2", "1", "WITHSCORES"}, reply("a", "2", "b", "14", "c", "26", "d", "30")},
+		{[]string{"zunion", "2", "z1", "z2", "AGGREGATE", "MIN", "WITHSCORES"}, reply("a", "1", "b", "2", "c", "3", "d", "30")},
+		{[]string{"zunion", "2", "z1", "z2", "AGGREGATE", "MAX", "WITHSCORES"}, reply("a", "1", "b", "10", "c", "20", "d", "30")},
+		{[]string{"zunion", "2", "z1", "missing", "WITHSCORES"}, reply("a", "1", "b", "2", "c", "3")},
+		{[]string{"zinter", "2", "z1", "z2", "WITHSCORES"}, reply("b", "12", "c", "23")},
+		{[]string{"zinter", "2", "z1", "missing"}, "*0"},
+		{[]string{"zdiff", "2", "z1", "z2", "WITHSCORES"}, reply("a", "1")},
+		{[]string{"zdiff", "1", "z1"}, reply("a", "b", "c")},
+		{[]string{"zdiff", "2", "z1", "z2", "WEIGHTS", "1", "1"}, "-ERR syntax error"},
+		{[]string{"zunion", "2", "z1"}, "-ERR syntax error"},
+		{[]string{"zunion", "2", "z1", "z2", "WEIGHTS", "1"}, "-ERR syntax error"},
+		{[]string{"zunion", "2", "z1", "z2", "AGGREGATE", "AVG"}, "-ERR syntax error"},
+		{[]string{"zunion", "2", "z1", "s"}, "-ERR key type is invalid"},
+		{[]string{"zunionstore", "dst", "2", "z1", "z2"}, ":4"},
+		{[]string{"zrange", "dst", "0", "-1", "WITHSCORES"}, reply("a", "1", "b", "12", "c", "23", "d", "30")},
+		{[]string{"zunionstore", "dst", "2", "z1", "z2", "WITHSCORES"}, "-ERR syntax error"},
+		{[]string{"zinterstore", "dst", "2", "z1", "z2", "WEIGHTS", "1", "0"}, ":2"},
+		{[]string{"zrange", "dst", "0", "-1", "WITHSCORES"}, reply("b", "2", "c", "3")},
+		{[]string{"zdiffstore", "dst", "2", "z2", "z1"}, ":1"},
+		{[]string{"zrange", "dst", "0", "-1", "WITHSCORES"}, reply("d", "30")},
+		//an empty result deletes the destination
+		{[]string{"zinterstore", "dst", "2", "z1", "missing"}, ":0"},
+		{[]string{"exists", "dst"}, ":0"},
+		{[]string{"zunionstore", "s", "1", "z1"}, ":3"},
+		{[]string{"type", "s"}, "+zset"},
+	}
+	c := newTestConn(newTestDB(t))
+	for _, v := range [][]string{{"z1", "1", "a"}, {"z1", "2", "b"}, {"z1", "3", "c"}, {"z2", "10", "b"}, {"z2", "20", "c"}, {"z2", "30", "d"}} {
+		c.do(append([]string{"zadd"}, v...)...)
+	}
+	c.do("set", "s", "v")
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestZScore(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"zscore", "z", "b"}, "$1 2"},
+		{[]string{"zscore", "z", "x"}, "$-1"},
+		{[]string{"zscore", "missing", "a"}, "$-1"},
+		{[]string{"zscore", "z"}, "-ERR wrong number of arguments for 'zscore' command"},
+		{[]string{"zmscore", "z", "a", "x", "c"}, "*3 $1 1 $-1 $1 3"},
+		{[]string{"zmscore", "missing", "a", "b"}, "*2 $-1 $-1"},
+		//like the other zset reads a key of another type holds no members
+		{[]string{"zmscore", "s", "a"}, "*1 $-1"},
+		{[]string{"zrandmember", "missing"}, "$-1"},
+		{[]string{"zrandmember", "missing", "3"}, "*0"},
+		{[]string{"zrandmember", "z", "0"}, "*0"},
+		{[]string{"zrandmember", "z", "x"}, "-ERR value is not an integer or out of range"},
+		{[]string{"zrandmember", "z", "1", "FOO"}, "-ERR syntax error"},
+	}
+	c := newTestConn(newTestDB(t))
+	for _, v := range [][]string{{"z", "1", "a"}, {"z", "2", "b"}, {"z", "3", "c"}} {
+		c.do(append([]string{"zadd"}, v...)...)
+	}
+	c.do("set", "s", "v")
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestZRandMember(t *testing.T) {
+	scores := map[string]string{"a": "1", "b": "2", "c": "3"}
+	tests := []struct {
+		args     []string //after ZRANDMEMBER z
+		count    int      //members replied
+		distinct bool
+	}{
+		{nil, 1, true},
+		{[]string{"2"}, 2, true},
+		{[]string{"5"}, 3, true},
+		{[]string{"-5"}, 5, false},
+		{[]string{"2", "WITHSCORES"}, 2, true},
+		{[]string{"-4", "WITHSCORES"}, 4, false},
+	}
+	db := newTestDB(t)
+	c := newTestConn(db)
+	for m, s := range scores {
+		c.do("zadd", "z", s, m)
+	}
+	for _, tt := range tests {
+		withScores := len(tt.args) == 2
+		items := strings.Fields(c.do(append([]string{"zrandmember", "z"}, tt.args...)...))
+		if tt.args != nil {
+			//drop the array header, the items are the lengths and values of bulk strings
+			items = items[1:]
+		}
+		var members []string
+		for i := 1; i < len(items); i += 2 {
+			v := items[i]
+			if withScores && i%4 == 3 {
+				if want := scores[members[len(members)-1]]; v != want {
+					t.Errorf("%v: score %s, want %s", tt.args, v, want)
+				}
+				continue
+			}
+			if _, ok := scores[v]; !ok {
+				t.Errorf("%v: member %q of no zset", tt.args, v)
+			}
+			members = append(members, v)
+		}
+		if len(members) != tt.count {
+			t.Errorf("%v: %d members, want %d", tt.args, len(members), tt.count)
+		}
+		seen := make(map[string]bool)
+		for _, v := range members {
+			seen[v] = true
+		}
+		if tt.distinct && len(seen) != len(members) {
+			t.Errorf("%v: repeated members %v", tt.args, members)
+		}
+	}
+}
+
+//TestZSetRemove runs each command on z holding a..e with the scores 1..5, and l holding
+//a..e with the score 0, then checks the members left
+func TestZSetRemove(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+		rest string //members of the key left, empty when it is removed
+	}{
+		{[]string{"zremrangebyscore", "z", "2", "4"}, ":3", reply("a", "e")},
+		{[]string{"zremrangebyscore", "z", "(2", "(4"}, ":1", reply("a", "b", "d", "e")},
+		{[]string{"zremrangebyscore", "z", "(1", "+inf"}, ":4", reply("a")},
+		{[]string{"zremrangebyscore", "z", "-inf", "+inf"}, ":5", ""},
+		{[]string{"zremrangebyscore", "z", "4", "2"}, ":0", reply("a", "b", "c", "d", "e")},
+		{[]string{"zremrangebyscore", "z", "x", "2"}, "-ERR min or max is not an unsigned integer", reply("a", "b", "c", "d", "e")},
+		{[]string{"zremrangebyscore", "missing", "1", "2"}, ":0", ""},
+		{[]string{"zremrangebyrank", "z", "0", "1"}, ":2", reply("c", "d", "e")},
+		{[]string{"zremrangebyrank", "z", "-2", "-1"}, ":2", reply("a", "b", "c")},
+		{[]string{"zremrangebyrank", "z", "1", "-2"}, ":3", reply("a", "e")},
+		{[]string{"zremrangebyrank", "z", "0", "-1"}, ":5", ""},
+		{[]string{"zremrangebyrank", "z", "3", "1"}, ":0", reply("a", "b", "c", "d", "e")},
+		{[]string{"zremrangebyrank", "z", "5", "10"}, ":0", reply("a", "b", "c", "d", "e")},
+		{[]string{"zremrangebyrank", "z", "x", "1"}, "-ERR value is not an integer or out of range", reply("a", "b", "c", "d", "e")},
+		{[]string{"zremrangebylex", "l", "[b", "[d"}, ":3", reply("a", "e")},
+		{[]string{"zremrangebylex", "l", "(b", "(d"}, ":1", reply("a", "b", "d", "e")},
+		{[]string{"zremrangebylex", "l", "-", "(c"}, ":2", reply("c", "d", "e")},
+		{[]string{"zremrangebylex", "l", "[d", "+"}, ":2", reply("a", "b", "c")},
+		{[]string{"zremrangebylex", "l", "-", "+"}, ":5", ""},
+		{[]string{"zremrangebylex", "l", "b", "[d"}, "-ERR min or max not valid string range item", reply("a", "b", "c", "d", "e")},
+		{[]string{"zpopmin", "z"}, reply("a", "1"), reply("b", "c", "d", "e")},
+		{[]string{"zpopmax", "z"}, reply("e", "5"), reply("a", "b", "c", "d")},
+		{[]string{"zpopmin", "z", "2"}, reply("a", "1", "b", "2"), reply("c", "d", "e")},
+		{[]string{"zpopmax", "z", "2"}, reply("e", "5", "d", "4"), reply("a", "b", "c")},
+		{[]string{"zpopmin", "z", "0"}, "*0", reply("a", "b", "c", "d", "e")},
+		{[]string{"zpopmax", "z", "10"}, reply("e", "5", "d", "4", "c", "3", "b", "2", "a", "1"), ""},
+		{[]string{"zpopmin", "z", "-1"}, "-ERR value is out of range, must be positive", reply("a", "b", "c", "d", "e")},
+		{[]string{"zpopmin", "missing"}, "*0", ""},
+	}
+	for _, tt := range tests {
+		c := newTestConn(newTestDB(t))
+		for i, m := range []string{"a", "b", "c", "d", "e"} {
+			c.do("zadd", "z", strconv.Itoa(i+1), m)
+			c.do("zadd", "l", "0", m)
+		}
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+		key := tt.cmd[1]
+		if tt.rest == "" {
+			if got := c.do("exists", key); got != ":0" {
+				t.Errorf("%v: emptied key exists: %s", tt.cmd, got)
+			}
+		} else if got := c.do("zrange", key, "0", "-1"); got != tt.rest {
+			t.Errorf("%v left %q, want %q", tt.cmd, got, tt.rest)
+		}
+	}
+}
+
+//waitBlocked waits until n clients are blocked on keys
+func waitBlocked(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		Blocking.lock.Lock()
+		blocked := len(Blocking.keys)
+		Blocking.lock.Unlock()
+		if blocked == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients blocked, want %d", blocked, n)
+		}
+	}
+}
+
+func TestZSetBlockingPop(t *testing.T) {
+	tests := []struct {
+		name  string
+		fill  [][]string //ZADD arguments run before the command
+		cmd   []string
+		write []string //ZADD arguments run by another client once the command blocks
+		db    string   //database of the write
+		want  string
+	}{
+		{"ready", [][]string{{"z", "1", "a"}, {"z", "2", "b"}}, []string{"bzpopmin", "z", "1"}, nil, "", reply("z", "a", "1")},
+		{"max", [][]string{{"z", "1", "a"}, {"z", "2", "b"}}, []string{"bzpopmax", "z", "1"}, nil, "", reply("z", "b", "2")},
+		{"first ready key", [][]string{{"z2", "1", "a"}}, []string{"bzpopmin", "z1", "z2", "1"}, nil, "", reply("z2", "a", "1")},
+		{"timeout", nil, []string{"bzpopmin", "z", "0.05"}, nil, "", "$-1"},
+		{"wakeup", nil, []string{"bzpopmax", "z1", "z2", "5"}, []string{"z2", "3", "c"}, "0", reply("z2", "c", "3")},
+		{"other key", nil, []string{"bzpopmin", "z", "0.2"}, []string{"y", "3", "c"}, "0", "$-1"},
+		{"other database", nil, []string{"bzpopmin", "z", "0.2"}, []string{"z", "3", "c"}, "1", "$-1"},
+		{"negative timeout", nil, []string{"bzpopmin", "z", "-1"}, nil, "", "-ERR timeout is negative"},
+		{"invalid timeout", nil, []string{"bzpopmin", "z", "x"}, nil, "", "-ERR timeout is not a float or out of range"},
+		{"no key", nil, []string{"bzpopmin", "1"}, nil, "", "-ERR wrong number of arguments for 'bzpopmin' command"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			c := newTestConn(db)
+			for _, v := range tt.fill {
+				c.do(append([]string{"zadd"}, v...)...)
+			}
+			done := make(chan string)
+			go func() { done <- c.do(tt.cmd...) }()
+			if tt.write != nil {
+				waitBlocked(t, 1)
+				w := newTestConn(db)
+				w.do("select", tt.db)
+				w.do(append([]string{"zadd"}, tt.write...)...)
+			}
+			if got := <-done; got != tt.want {
+				t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+			}
+			//a popped key is removed once empty
+			if tt.want != "$-1" && tt.write != nil {
+				if got := c.do("exists", tt.write[0]); got != ":0" {
+					t.Errorf("emptied key exists: %s", got)
+				}
+			}
+		})
+	}
+}
+
+//TestGeo runs the examples of the redis documentation of the geo commands
+func TestGeo(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"geoadd", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"}, ":2"},
+		{[]string{"geoadd", "Sicily", "13.361389", "38.115556", "Palermo"}, ":0"},
+		{[]string{"zrange", "Sicily", "0", "-1", "WITHSCORES"}, reply("Palermo", "3479099956230698", "Catania", "3479447370796909")},
+		{[]string{"geodist", "Sicily", "Palermo", "Catania"}, "$11 166274.1516"},
+		{[]string{"geodist", "Sicily", "Palermo", "Catania", "km"}, "$8 166.2742"},
+		{[]string{"geodist", "Sicily", "Palermo", "Catania", "mi"}, "$8 103.3182"},
+		{[]string{"geodist", "Sicily", "Palermo", "Agrigento"}, "$-1"},
+		{[]string{"geodist", "Sicily", "Palermo", "Catania", "parsec"}, "-ERR unsupported unit provided. please use M, KM, FT, MI"},
+		{[]string{"geopos", "Sicily", "Palermo", "Agrigento"}, "*2 *2 $18 13.361389338970184 $16 38.1155563954963 $-1"},
+		{[]string{"geoadd", "Sicily", "200", "38", "Nowhere"}, "-ERR invalid longitude,latitude pair 200.000000,38.000000"},
+		{[]string{"geoadd", "Sicily", "XX", "NX", "13", "38", "Palermo"}, "-ERR XX and NX options at the same time are not compatible"},
+		{[]string{"geosearch", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC"}, reply("Catania", "Palermo")},
+		{[]string{"geosearch", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "100", "km"}, reply("Catania")},
+		{[]string{"geosearch", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "DESC", "COUNT", "1"}, reply("Palermo")},
+		{[]string{"geosearch", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC", "WITHDIST"}, "*2 *2 $7 Catania $7 56.4413 *2 $7 Palermo $8 190.4424"},
+		{[]string{"geosearch", "Sicily", "FROMMEMBER", "Palermo", "BYBOX", "400", "400", "km", "ASC"}, reply("Palermo", "Catania")},
+		{[]string{"geosearch", "Sicily", "FROMMEMBER", "Agrigento", "BYRADIUS", "1", "km"}, "-ERR could not decode requested zset member"},
+		{[]string{"geosearch", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "-1", "km"}, "-ERR radius cannot be negative"},
+		{[]string{"geosearch", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "1", "km", "ANY"}, "-ERR the ANY argument requires COUNT argument"},
+		{[]string{"geosearch", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ANY", "COUNT", "2"}, reply("Palermo", "Catania")},
+		{[]string{"geosearch", "Sicily", "BYRADIUS", "1", "km", "ASC"}, "-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified"},
+		{[]string{"geosearch", "missing", "FROMLONLAT", "15", "37", "BYRADIUS", "1", "km"}, "*0"},
+		{[]string{"geosearchstore", "near", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "STOREDIST"}, ":2"},
+		{[]string{"zrange", "near", "0", "-1"}, reply("Catania", "Palermo")},
+		{[]string{"geosearchstore", "near", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "WITHDIST"}, "-ERR STORE option in GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options"},
+		{[]string{"geosearchstore", "near", "Sicily", "FROMLONLAT", "0", "0", "BYRADIUS", "1", "km"}, ":0"},
+		{[]string{"exists", "near"}, ":0"},
+	}
+	c := newTestConn(newTestDB(t))
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	entry := func(id string) string { return "*2 $" + strconv.Itoa(len(id)) + " " + id + " *2 $1 f $1 v" }
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"xadd", "s", "1-1", "f", "v"}, "$3 1-1"},
+		{[]string{"xadd", "s", "1-1", "f", "v"}, "-ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{[]string{"xadd", "s", "0-0", "f", "v"}, "-ERR The ID specified in XADD must be greater than 0-0"},
+		{[]string{"xadd", "s", "2-*", "f", "v"}, "$3 2-0"},
+		{[]string{"xadd", "s", "2-*", "f", "v"}, "$3 2-1"},
+		{[]string{"xadd", "s", "3", "f", "v"}, "$3 3-0"},
+		{[]string{"xadd", "s", "bad", "f", "v"}, "-ERR Invalid stream ID specified as stream command argument"},
+		{[]string{"xadd", "s", "4-0", "f"}, "-ERR wrong number of arguments for 'xadd' command"},
+		{[]string{"xadd", "new", "NOMKSTREAM", "*", "f", "v"}, "$-1"},
+		{[]string{"exists", "new"}, ":0"},
+		{[]string{"xlen", "s"}, ":4"},
+		{[]string{"xlen", "missing"}, ":0"},
+		{[]string{"xrange", "s", "-", "+", "COUNT", "2"}, "*2 " + entry("1-1") + " " + entry("2-0")},
+		{[]string{"xrange", "s", "2", "2"}, "*2 " + entry("2-0") + " " + entry("2-1")},
+		{[]string{"xrange", "s", "(1-1", "(3-0"}, "*2 " + entry("2-0") + " " + entry("2-1")},
+		{[]string{"xrange", "s", "3", "1"}, "*0"},
+		{[]string{"xrevrange", "s", "+", "-", "COUNT", "1"}, "*1 " + entry("3-0")},
+		{[]string{"xrange", "s", "-", "+", "LIMIT", "1"}, "-ERR syntax error"},
+		{[]string{"xdel", "s", "2-0", "9-9"}, ":1"},
+		{[]string{"xlen", "s"}, ":3"},
+		{[]string{"xtrim", "s", "MAXLEN", "2"}, ":1"},
+		{[]string{"xrange", "s", "-", "+"}, "*2 " + entry("2-1") + " " + entry("3-0")},
+		{[]string{"xtrim", "s", "MINID", "3"}, ":1"},
+		{[]string{"xtrim", "s", "MAXLEN", "-1"}, "-ERR The MAXLEN argument must be >= 0."},
+		{[]string{"xtrim", "s", "MAXLEN", "1", "LIMIT", "10"}, "-ERR syntax error, LIMIT cannot be used without the special ~ option"},
+		//an ID below one deleted is still refused
+		{[]string{"xadd", "s", "2-5", "f", "v"}, "-ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{[]string{"xadd", "s", "MAXLEN", "1", "5-0", "f", "v"}, "$3 5-0"},
+		{[]string{"xlen", "s"}, ":1"},
+		{[]string{"xread", "COUNT", "1", "STREAMS", "s", "0"}, "*1 *2 $1 s *1 " + entry("5-0")},
+		{[]string{"xread", "STREAMS", "s", "5-0"}, "$-1"},
+		{[]string{"xread", "STREAMS", "s", "$"}, "$-1"},
+		{[]string{"xread", "STREAMS", "s", "missing", "0"}, "-ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."},
+	}
+	c := newTestConn(newTestDB(t))
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestStreamGroup(t *testing.T) {
+	entry := func(id string) string { return "*2 $3 " + id + " *2 $1 f $1 v" }
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"xgroup", "create", "s", "g", "0"}, "+OK"},
+		{[]string{"xgroup", "create", "s", "g", "0"}, "-BUSYGROUP Consumer Group name already exists"},
+		{[]string{"xgroup", "create", "missing", "g", "$"}, "-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."},
+		{[]string{"xgroup", "create", "empty", "g", "$", "MKSTREAM"}, "+OK"},
+		{[]string{"xlen", "empty"}, ":0"},
+		{[]string{"xgroup", "nosuch", "s"}, "-ERR unknown subcommand 'nosuch'. Try XGROUP HELP."},
+		{[]string{"xreadgroup", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">"}, "*1 *2 $1 s *2 " + entry("1-0") + " " + entry("2-0")},
+		{[]string{"xreadgroup", "GROUP", "g", "bob", "STREAMS", "s", ">"}, "*1 *2 $1 s *1 " + entry("3-0")},
+		{[]string{"xreadgroup", "GROUP", "g", "bob", "STREAMS", "s", ">"}, "$-1"},
+		//the history of a consumer is its pending entries
+		{[]string{"xreadgroup", "GROUP", "g", "alice", "STREAMS", "s", "0"}, "*1 *2 $1 s *2 " + entry("1-0") + " " + entry("2-0")},
+		{[]string{"xreadgroup", "GROUP", "nogroup", "alice", "STREAMS", "s", ">"}, "-NOGROUP No such key 's' or consumer group 'nogroup' in XREADGROUP with GROUP option"},
+		{[]string{"xpending", "s", "g"}, "*4 :3 $3 1-0 $3 3-0 *2 *2 $5 alice $1 2 *2 $3 bob $1 1"},
+		{[]string{"xack", "s", "g", "1-0", "9-0"}, ":1"},
+		{[]string{"xack", "s", "nogroup", "2-0"}, ":0"},
+		{[]string{"xreadgroup", "GROUP", "g", "alice", "STREAMS", "s", "0"}, "*1 *2 $1 s *1 " + entry("2-0")},
+		{[]string{"xclaim", "s", "g", "bob", "0", "2-0", "JUSTID"}, "*1 $3 2-0"},
+		{[]string{"xclaim", "s", "g", "bob", "x", "2-0"}, "-ERR Invalid min-idle-time argument for XCLAIM"},
+		{[]string{"xpending", "s", "g"}, "*4 :2 $3 2-0 $3 3-0 *1 *2 $3 bob $1 2"},
+		{[]string{"xautoclaim", "s", "g", "alice", "0", "0", "COUNT", "10", "JUSTID"}, "*3 $3 0-0 *2 $3 2-0 $3 3-0 *0"},
+		{[]string{"xautoclaim", "s", "g", "alice", "0", "0", "COUNT", "0"}, "-ERR COUNT must be > 0"},
+		{[]string{"xgroup", "createconsumer", "s", "g", "carol"}, ":1"},
+		{[]string{"xgroup", "createconsumer", "s", "g", "carol"}, ":0"},
+		{[]string{"xgroup", "delconsumer", "s", "g", "alice"}, ":2"},
+		{[]string{"xpending", "s", "g"}, "*4 :0 $-1 $-1 $-1"},
+		{[]string{"xgroup", "setid", "s", "g", "0"}, "+OK"},
+		{[]string{"xreadgroup", "GROUP", "g", "carol", "COUNT", "1", "STREAMS", "s", ">"}, "*1 *2 $1 s *1 " + entry("1-0")},
+		{[]string{"xgroup", "destroy", "s", "g"}, ":1"},
+		{[]string{"xgroup", "destroy", "s", "g"}, ":0"},
+	}
+	c := newTestConn(newTestDB(t))
+	for _, id := range []string{"1-0", "2-0", "3-0"} {
+		c.do("xadd", "s", id, "f", "v")
+	}
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
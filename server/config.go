@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//Config holds the server settings that commands consult at runtime
+type Config struct {
+	EnableKeys       bool          //KEYS walks the whole keyspace, production setups should turn it off
+	PubSubHardLimit  int           //bytes of output a subscriber may fall behind by, 0 means no limit
+	PubSubSoftLimit  int           //bytes of output a subscriber may fall behind by for PubSubSoftPeriod
+	PubSubSoftPeriod time.Duration //how long a subscriber may stay over PubSubSoftLimit
+	LuaTimeLimit     time.Duration //how long a script runs before other clients get BUSY, 0 means forever
+}
+
+var Conf = &Config{
+	EnableKeys:       true,
+	PubSubHardLimit:  32 << 20,
+	PubSubSoftLimit:  8 << 20,
+	PubSubSoftPeriod: 60 * time.Second,
+	LuaTimeLimit:     5 * time.Second,
+}
+
+//configParam is a parameter CONFIG GET and CONFIG SET work on, set is nil for read only ones
+type configParam struct {
+	get func(c *Client) string
+	set func(c *Client, value string) error
+}
+
+var configParams = map[string]*configParam{
+	"shard-hash": {
+		get: func(c *Client) string {
+			return c.DB().Sharding()
+		},
+	},
+	"shards": {
+		get: func(c *Client) string {
+			return strconv.Itoa(c.DB().Shards())
+		},
+	},
+	"lua-time-limit": {
+		get: func(c *Client) string {
+			return strconv.FormatInt(int64(Conf.LuaTimeLimit/time.Millisecond), 10)
+		},
+		set: func(c *Client, value string) error {
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || ms < 0 {
+				return errors.New("argument must be a non negative number of milliseconds")
+			}
+			Conf.LuaTimeLimit = time.Duration(ms) * time.Millisecond
+			return nil
+		},
+	},
+	"notify-keyspace-events": {
+		get: func(c *Client) string {
+			return command.NotifyFlagsString(c.DB().NotifyFlags())
+		},
+		set: func(c *Client, value string) error {
+			flags, err := command.ParseNotifyFlags(value)
+			if err != nil {
+				return err
+			}
+			c.DB().SetNotify(flags, nil)
+			return nil
+		},
+	},
+}
+
+func cmdConfig(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	sub := strings.ToUpper(string(args[1]))
+	switch {
+	case sub == "GET" && len(args) >= 3:
+		ret := make(map[string]string)
+		for _, pattern := range args[2:] {
+			for name, p := range configParams {
+				if util.GlobMatch(bytes.ToLower(pattern), []byte(name)) {
+					ret[name] = p.get(c)
+				}
+			}
+		}
+		names := make([]string, 0, len(ret))
+		for k := range ret {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		c.Conn.WriteArray(2 * len(names))
+		for _, v := range names {
+			c.Conn.WriteBulk([]byte(v))
+			c.Conn.WriteBulk([]byte(ret[v]))
+		}
+	case sub == "SET" && len(args) >= 4 && len(args)%2 == 0:
+		for i := 2; i < len(args); i += 2 {
+			p := configParams[strings.ToLower(string(args[i]))]
+			if p == nil || p.set == nil {
+				c.Conn.WriteError("ERR Unknown option or number of arguments for CONFIG SET - '" + string(args[i]) + "'")
+				return nil
+			}
+		}
+		for i := 2; i < len(args); i += 2 {
+			if err := configParams[strings.ToLower(string(args[i]))].set(c, string(args[i+1])); err != nil {
+				c.Conn.WriteError("ERR Invalid argument '" + string(args[i+1]) + "' for CONFIG SET '" + string(args[i]) + "' - " + err.Error())
+				return nil
+			}
+		}
+		c.Conn.WriteString("OK")
+	default:
+		c.Conn.WriteError("ERR unknown subcommand or wrong number of arguments for '" + string(args[1]) + "'. Try CONFIG HELP.")
+	}
+	return nil
+}
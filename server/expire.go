@@ -0,0 +1,27 @@
+package server
+
+import (
+	"time"
+
+	"github.com/Zealous-w/tacodb/command"
+)
+
+//StartExpireCycle runs the expire cycle of db hz times a second, see command.ExpireCycle.
+//A replica leaves the expiry of its keys to the primary, whose deletes it replicates
+func StartExpireCycle(db *command.RedisCommand, hz int) {
+	if hz <= 0 {
+		return
+	}
+	period := time.Second / time.Duration(hz)
+	e := db.NewExpireCycle()
+	go func() {
+		for range time.Tick(period) {
+			if Repl.IsReplica() {
+				continue
+			}
+			shardLock.RLock()
+			e.Run(time.Now().Add(period * command.EXPIRE_CYCLE_TIME / 100))
+			shardLock.RUnlock()
+		}
+	}()
+}
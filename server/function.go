@@ -0,0 +1,495 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/store"
+	"github.com/Zealous-w/tacodb/util"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var (
+	ErrFunctionNotFound = errors.New("ERR Function not found")
+	ErrLibraryNotFound  = errors.New("ERR Library not found")
+	ErrNoFunctions      = errors.New("ERR No functions registered")
+	ErrLibraryMetadata  = errors.New("ERR Missing library metadata")
+	ErrLibraryNoName    = errors.New("ERR Library name was not given")
+	ErrLibraryName      = errors.New("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+)
+
+//functionFlags lists the flags redis.register_function accepts
+var functionFlags = map[string]bool{
+	"no-writes":             true,
+	"allow-oom":             true,
+	"allow-stale":           true,
+	"no-cluster":            true,
+	"allow-cross-slot-keys": true,
+}
+
+//luaFunction is a function registered by a library
+type luaFunction struct {
+	name        string
+	description string
+	flags       []string
+	readOnly    bool //flagged no-writes, FCALL_RO may call it
+}
+
+//luaLibrary is a library of FUNCTION LOAD. Lua functions belong to the state that created them,
+//so every FCALL runs the compiled library in its fresh state to register them again
+type luaLibrary struct {
+	name      string
+	code      []byte
+	proto     *lua.FunctionProto
+	functions map[string]*luaFunction
+}
+
+//functionRegistry holds the loaded libraries, a copy of their code is persisted with
+//command.SaveLibraries and loaded again by LoadFunctions on start
+type functionRegistry struct {
+	lock      sync.RWMutex
+	libraries map[string]*luaLibrary
+	functions map[string]*luaLibrary //function name -> library
+}
+
+var Functions = &functionRegistry{
+	libraries: make(map[string]*luaLibrary),
+	functions: make(map[string]*luaLibrary),
+}
+
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, v := range name {
+		if !(v >= 'a' && v <= 'z' || v >= 'A' && v <= 'Z' || v >= '0' && v <= '9' || v == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+//parseShebang reads the name of a library from its first line, #!lua name=<name>. The returned
+//body keeps the line break so line numbers of errors still match
+func parseShebang(code []byte) (string, []byte, error) {
+	if !bytes.HasPrefix(code, []byte("#!")) {
+		return "", nil, ErrLibraryMetadata
+	}
+	line, body := code, []byte{}
+	if i := bytes.IndexByte(code, '\n'); i >= 0 {
+		line, body = code[:i], code[i:]
+	}
+	parts := strings.Fields(string(line[2:]))
+	if len(parts) == 0 {
+		return "", nil, ErrLibraryMetadata
+	}
+	if strings.ToLower(parts[0]) != "lua" {
+		return "", nil, fmt.Errorf("ERR Engine '%s' not found", parts[0])
+	}
+	name := ""
+	for _, v := range parts[1:] {
+		if !strings.HasPrefix(v, "name=") {
+			return "", nil, fmt.Errorf("ERR Invalid metadata value given: %s", v)
+		}
+		name = v[len("name="):]
+	}
+	if name == "" {
+		return "", nil, ErrLibraryNoName
+	}
+	if !validFunctionName(name) {
+		return "", nil, ErrLibraryName
+	}
+	return name, body, nil
+}
+
+//compileLibrary compiles code and runs it once to learn the functions it registers
+func compileLibrary(code []byte) (*luaLibrary, error) {
+	name, body, err := parseShebang(code)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(bytes.NewReader(body), "user_function")
+	if err != nil {
+		return nil, errors.New("ERR Error compiling function: " + strings.TrimSpace(err.Error()))
+	}
+	proto, err := lua.Compile(chunk, "user_function")
+	if err != nil {
+		return nil, errors.New("ERR Error compiling function: " + strings.TrimSpace(err.Error()))
+	}
+	lib := &luaLibrary{name: name, code: code, proto: proto}
+
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	openScriptLibs(L)
+	functions, _, err := lib.register(L)
+	if err != nil {
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			err = errors.New(apiErr.Object.String())
+		}
+		return nil, errors.New("ERR Error registering functions: " + err.Error())
+	}
+	if len(functions) == 0 {
+		return nil, ErrNoFunctions
+	}
+	lib.functions = functions
+	return lib, nil
+}
+
+//register runs the library in L, returning the functions it registers and their callbacks
+func (lib *luaLibrary) register(L *lua.LState) (map[string]*luaFunction, map[string]*lua.LFunction, error) {
+	functions := make(map[string]*luaFunction)
+	callbacks := make(map[string]*lua.LFunction)
+	redis := L.GetGlobal("redis").(*lua.LTable)
+	L.SetField(redis, "register_function", L.NewFunction(func(L *lua.LState) int {
+		fn := &luaFunction{}
+		var callback lua.LValue
+		if t, ok := L.Get(1).(*lua.LTable); ok && L.GetTop() == 1 {
+			t.ForEach(func(k, v lua.LValue) {
+				switch k.String() {
+				case "function_name":
+					fn.name = lua.LVAsString(v)
+				case "callback":
+					callback = v
+				case "description":
+					fn.description = lua.LVAsString(v)
+				case "flags":
+					flags, ok := v.(*lua.LTable)
+					if !ok {
+						L.RaiseError("flags argument to redis.register_function must be a table representing function flags")
+					}
+					flags.ForEach(func(_, flag lua.LValue) {
+						fn.flags = append(fn.flags, lua.LVAsString(flag))
+					})
+				default:
+					L.RaiseError("unknown argument given to redis.register_function")
+				}
+			})
+		} else {
+			fn.name = L.CheckString(1)
+			callback = L.Get(2)
+		}
+		cb, ok := callback.(*lua.LFunction)
+		if !ok {
+			L.RaiseError("callback argument given to redis.register_function must be a function")
+		}
+		if !validFunctionName(fn.name) {
+			L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+		}
+		if _, ok := functions[fn.name]; ok {
+			L.RaiseError("Function already exists in the library")
+		}
+		for _, flag := range fn.flags {
+			if !functionFlags[flag] {
+				L.RaiseError("unknown flag given")
+			}
+			if flag == "no-writes" {
+				fn.readOnly = true
+			}
+		}
+		functions[fn.name] = fn
+		callbacks[fn.name] = cb
+		return 0
+	}))
+	L.Push(L.NewFunctionFromProto(lib.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		return nil, nil, err
+	}
+	return functions, callbacks, nil
+}
+
+//LoadFunctions loads the libraries persisted by FUNCTION LOAD and RESTORE
+func LoadFunctions(db *command.RedisCommand) error {
+	var libs []*luaLibrary
+	for _, v := range db.Libraries() {
+		lib, err := compileLibrary(v.V1)
+		if err != nil {
+			return fmt.Errorf("library %s: %v", v.V0, err)
+		}
+		libs = append(libs, lib)
+	}
+	return Functions.apply(nil, libs, true, false)
+}
+
+func (r *functionRegistry) lookup(name string) (*luaLibrary, *luaFunction) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	lib := r.functions[name]
+	if lib == nil {
+		return nil, nil
+	}
+	return lib, lib.functions[name]
+}
+
+//apply adds libs after removing every library with flush, replacing libraries of the same name
+//with replace. The result is checked for clashing function names and persisted through db first,
+//a nil db only loads
+func (r *functionRegistry) apply(db *command.RedisCommand, libs []*luaLibrary, flush, replace bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	next := make(map[string]*luaLibrary)
+	if !flush {
+		for k, v := range r.libraries {
+			next[k] = v
+		}
+	}
+	added := make(map[string]bool)
+	for _, lib := range libs {
+		if _, ok := next[lib.name]; ok && (!replace || added[lib.name]) {
+			return fmt.Errorf("ERR Library '%s' already exists", lib.name)
+		}
+		next[lib.name] = lib
+		added[lib.name] = true
+	}
+	functions := make(map[string]*luaLibrary)
+	for _, lib := range next {
+		for name := range lib.functions {
+			if _, ok := functions[name]; ok {
+				return fmt.Errorf("ERR Function %s already exists", name)
+			}
+			functions[name] = lib
+		}
+	}
+	if db != nil {
+		put := make([]*store.Pair, 0, len(libs))
+		for _, lib := range libs {
+			put = append(put, &store.Pair{V0: []byte(lib.name), V1: lib.code})
+		}
+		if err := db.SaveLibraries(flush, nil, put); err != nil {
+			return errors.New("ERR " + err.Error())
+		}
+	}
+	r.libraries, r.functions = next, functions
+	return nil
+}
+
+func (r *functionRegistry) remove(db *command.RedisCommand, name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	lib, ok := r.libraries[name]
+	if !ok {
+		return ErrLibraryNotFound
+	}
+	if err := db.SaveLibraries(false, [][]byte{[]byte(name)}, nil); err != nil {
+		return errors.New("ERR " + err.Error())
+	}
+	delete(r.libraries, name)
+	for fn := range lib.functions {
+		delete(r.functions, fn)
+	}
+	return nil
+}
+
+//sorted returns the libraries ordered by name
+func (r *functionRegistry) sorted() []*luaLibrary {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make([]*luaLibrary, 0, len(r.libraries))
+	for _, v := range r.libraries {
+		ret = append(ret, v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+func cmdFCall(c *Client, args ...[]byte) error {
+	return fcall(c, false, args...)
+}
+
+func cmdFCall_RO(c *Client, args ...[]byte) error {
+	return fcall(c, true, args...)
+}
+
+//fcall runs a function like runScript runs a script. Functions flagged no-writes run read only,
+//they are the ones FCALL_RO accepts
+func fcall(c *Client, ro bool, args ...[]byte) error {
+	if len(args) < 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	lib, fn := Functions.lookup(string(args[1]))
+	if fn == nil {
+		c.Conn.WriteError(ErrFunctionNotFound.Error())
+		return nil
+	}
+	if ro && !fn.readOnly {
+		c.Conn.WriteError("ERR Can not execute a script with write flag using *_ro command.")
+		return nil
+	}
+	runLua(c, fn.name, "FUNCTION", fn.readOnly, args[2:], func(L *lua.LState, keys, argv *lua.LTable) error {
+		_, callbacks, err := lib.register(L)
+		if err != nil {
+			return err
+		}
+		L.Push(callbacks[fn.name])
+		L.Push(keys)
+		L.Push(argv)
+		return L.PCall(2, 1, nil)
+	})
+	return nil
+}
+
+func cmdFunction(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	db := c.DB()
+	sub := strings.ToUpper(string(args[1]))
+	if functionWrites[sub] && Repl.IsReplica() {
+		c.Conn.WriteError(errReadOnlyReplica)
+		return nil
+	}
+	var err error
+	switch {
+	case sub == "LOAD" && len(args) >= 3:
+		replace := len(args) == 4 && strings.ToUpper(string(args[2])) == "REPLACE"
+		if len(args) > 4 || len(args) == 4 && !replace {
+			c.Conn.WriteError("ERR Unknown option given: " + string(args[2]))
+			return nil
+		}
+		var lib *luaLibrary
+		if lib, err = compileLibrary(args[len(args)-1]); err == nil {
+			if err = Functions.apply(db, []*luaLibrary{lib}, false, replace); err == nil {
+				c.Conn.WriteBulk([]byte(lib.name))
+			}
+		}
+	case sub == "DELETE" && len(args) == 3:
+		if err = Functions.remove(db, string(args[2])); err == nil {
+			c.Conn.WriteString("OK")
+		}
+	case sub == "FLUSH" && len(args) <= 3:
+		if len(args) == 3 {
+			mode := strings.ToUpper(string(args[2]))
+			if mode != "ASYNC" && mode != "SYNC" {
+				c.Conn.WriteError("ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+				return nil
+			}
+		}
+		if err = Functions.apply(db, nil, true, false); err == nil {
+			c.Conn.WriteString("OK")
+		}
+	case sub == "KILL" && len(args) == 2:
+		killScripts(c, "FUNCTION")
+	case sub == "LIST":
+		functionList(c, args[2:]...)
+	case sub == "DUMP" && len(args) == 2:
+		libs := Functions.sorted()
+		codes := make([][]byte, 0, len(libs))
+		for _, v := range libs {
+			codes = append(codes, v.code)
+		}
+		c.Conn.WriteBulk(command.EncodeFunctionDump(codes))
+	case sub == "RESTORE" && (len(args) == 3 || len(args) == 4):
+		flush, replace := false, false
+		if len(args) == 4 {
+			switch strings.ToUpper(string(args[3])) {
+			case "FLUSH":
+				flush = true
+			case "REPLACE":
+				replace = true
+			case "APPEND":
+			default:
+				c.Conn.WriteError("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+				return nil
+			}
+		}
+		codes, derr := command.DecodeFunctionDump(args[2])
+		if derr != nil {
+			c.Conn.WriteError("ERR payload version or checksum are wrong")
+			return nil
+		}
+		libs := make([]*luaLibrary, 0, len(codes))
+		for _, v := range codes {
+			var lib *luaLibrary
+			if lib, err = compileLibrary(v); err != nil {
+				break
+			}
+			libs = append(libs, lib)
+		}
+		if err == nil {
+			if err = Functions.apply(db, libs, flush, replace); err == nil {
+				c.Conn.WriteString("OK")
+			}
+		}
+	default:
+		c.Conn.WriteError("ERR unknown subcommand or wrong number of arguments for '" + string(args[1]) + "'. Try FUNCTION HELP.")
+	}
+	if err != nil {
+		c.Conn.WriteError(err.Error())
+	}
+	return nil
+}
+
+//functionList replies FUNCTION LIST [WITHCODE] [LIBRARYNAME pattern]
+func functionList(c *Client, args ...[]byte) {
+	withCode := false
+	var pattern []byte
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "WITHCODE":
+			withCode = true
+		case "LIBRARYNAME":
+			if i+1 >= len(args) || pattern != nil {
+				c.Conn.WriteError("ERR library name argument was not given")
+				return
+			}
+			i++
+			pattern = args[i]
+		default:
+			c.Conn.WriteError("ERR Unknown argument " + string(args[i]))
+			return
+		}
+	}
+	var libs []*luaLibrary
+	for _, v := range Functions.sorted() {
+		if pattern == nil || util.GlobMatch(pattern, []byte(v.name)) {
+			libs = append(libs, v)
+		}
+	}
+	c.Conn.WriteArray(len(libs))
+	for _, lib := range libs {
+		if withCode {
+			c.Conn.WriteArray(8)
+		} else {
+			c.Conn.WriteArray(6)
+		}
+		c.Conn.WriteBulk([]byte("library_name"))
+		c.Conn.WriteBulk([]byte(lib.name))
+		c.Conn.WriteBulk([]byte("engine"))
+		c.Conn.WriteBulk([]byte("LUA"))
+		c.Conn.WriteBulk([]byte("functions"))
+		names := make([]string, 0, len(lib.functions))
+		for name := range lib.functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.Conn.WriteArray(len(names))
+		for _, name := range names {
+			fn := lib.functions[name]
+			c.Conn.WriteArray(6)
+			c.Conn.WriteBulk([]byte("name"))
+			c.Conn.WriteBulk([]byte(fn.name))
+			c.Conn.WriteBulk([]byte("description"))
+			if fn.description == "" {
+				c.Conn.WriteNull()
+			} else {
+				c.Conn.WriteBulk([]byte(fn.description))
+			}
+			c.Conn.WriteBulk([]byte("flags"))
+			c.Conn.WriteArray(len(fn.flags))
+			for _, flag := range fn.flags {
+				c.Conn.WriteBulk([]byte(flag))
+			}
+		}
+		if withCode {
+			c.Conn.WriteBulk([]byte("library_code"))
+			c.Conn.WriteBulk(lib.code)
+		}
+	}
+}
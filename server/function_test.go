@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const (
+	testLibrary = "#!lua name=mylib\nredis.register_function('knockknock', function() return 'Who\\'s there?' end)\n" +
+		"redis.register_function('setit', function(keys, args) return redis.call('SET', keys[1], args[1]) end)\n" +
+		"redis.register_function{function_name='getit', callback=function(keys) return redis.call('GET', keys[1]) end, flags={'no-writes'}}"
+	otherLibrary = "#!lua name=otherlib\nredis.register_function('other', function() return 1 end)"
+)
+
+//resetFunctions forgets the libraries loaded by a test
+func resetFunctions(t *testing.T) {
+	t.Cleanup(func() { _ = Functions.apply(nil, nil, true, false) })
+}
+
+func TestFunction(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"function", "load", testLibrary}, "$5 mylib"},
+		{[]string{"function", "load", testLibrary}, "-ERR Library 'mylib' already exists"},
+		{[]string{"function", "load", "REPLACE", testLibrary}, "$5 mylib"},
+		{[]string{"function", "load", "FOO", testLibrary}, "-ERR Unknown option given: FOO"},
+		{[]string{"fcall", "knockknock", "0"}, "$12 Who's there?"},
+		{[]string{"fcall", "nosuch", "0"}, "-ERR Function not found"},
+		{[]string{"fcall", "setit", "1", "k", "v"}, "+OK"},
+		{[]string{"get", "k"}, "+v"},
+		{[]string{"fcall_ro", "setit", "1", "k", "w"}, "-ERR Can not execute a script with write flag using *_ro command."},
+		{[]string{"fcall_ro", "getit", "1", "k"}, "+v"},
+		{[]string{"fcall", "knockknock"}, "-ERR wrong number of arguments for 'fcall' command"},
+		{[]string{"function", "load", "return 1"}, "-ERR Missing library metadata"},
+		{[]string{"function", "load", "#!lua\nreturn 1"}, "-ERR Library name was not given"},
+		{[]string{"function", "load", "#!python name=x\nreturn 1"}, "-ERR Engine 'python' not found"},
+		{[]string{"function", "load", "#!lua name=a-b\nreturn 1"}, "-ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long"},
+		{[]string{"function", "load", "#!lua name=empty\nlocal a = 1"}, "-ERR No functions registered"},
+		{[]string{"function", "load", "#!lua name=clash\nredis.register_function('knockknock', function() return 1 end)"}, "-ERR Function knockknock already exists"},
+		{[]string{"function", "load", otherLibrary}, "$8 otherlib"},
+		{[]string{"fcall", "other", "0"}, ":1"},
+		{[]string{"function", "delete", "otherlib"}, "+OK"},
+		{[]string{"function", "delete", "otherlib"}, "-ERR Library not found"},
+		{[]string{"fcall", "other", "0"}, "-ERR Function not found"},
+		{[]string{"function", "flush", "LAZY"}, "-ERR FUNCTION FLUSH only supports SYNC|ASYNC option"},
+		{[]string{"function", "restore", "garbage"}, "-ERR payload version or checksum are wrong"},
+		{[]string{"function", "nosuch"}, "-ERR unknown subcommand or wrong number of arguments for 'nosuch'. Try FUNCTION HELP."},
+	}
+	resetFunctions(t)
+	c := newTestConn(newTestDB(t))
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+	if got := c.do("function", "load", "#!lua name=bad\nfoo("); !strings.HasPrefix(got, "-ERR Error compiling function: ") {
+		t.Errorf("FUNCTION LOAD of a syntax error = %q", got)
+	}
+}
+
+//TestFunctionRestore restores a FUNCTION DUMP payload with every policy
+func TestFunctionRestore(t *testing.T) {
+	tests := []struct {
+		policy []string
+		want   string
+		other  bool //otherlib is loaded afterwards
+	}{
+		{nil, "-ERR Library 'mylib' already exists", true},
+		{[]string{"APPEND"}, "-ERR Library 'mylib' already exists", true},
+		{[]string{"REPLACE"}, "+OK", true},
+		{[]string{"FLUSH"}, "+OK", false},
+		{[]string{"KEEP"}, "-ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.", true},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(append([]string{"restore"}, tt.policy...), " "), func(t *testing.T) {
+			resetFunctions(t)
+			c := newTestConn(newTestDB(t))
+			c.do("function", "load", testLibrary)
+			if got := c.do("function", "dump"); !strings.HasPrefix(got, "$") {
+				t.Fatalf("FUNCTION DUMP = %q", got)
+			}
+			dump := c.buf[bytes.IndexByte(c.buf, '\n')+1 : len(c.buf)-2]
+			c.do("function", "load", otherLibrary)
+			if got := c.do(append([]string{"function", "restore", string(dump)}, tt.policy...)...); got != tt.want {
+				t.Fatalf("FUNCTION RESTORE = %q, want %q", got, tt.want)
+			}
+			if got := c.do("fcall", "knockknock", "0"); got != "$12 Who's there?" {
+				t.Fatalf("FCALL knockknock = %q", got)
+			}
+			want := "-ERR Function not found"
+			if tt.other {
+				want = ":1"
+			}
+			if got := c.do("fcall", "other", "0"); got != want {
+				t.Fatalf("FCALL other = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+//TestFunctionPersisted loads the libraries saved by FUNCTION LOAD like a restarted server
+func TestFunctionPersisted(t *testing.T) {
+	resetFunctions(t)
+	db := newTestDB(t)
+	c := newTestConn(db)
+	c.do("function", "load", testLibrary)
+	c.do("function", "load", otherLibrary)
+	c.do("function", "delete", "otherlib")
+	if err := Functions.apply(nil, nil, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.do("fcall", "knockknock", "0"); got != "-ERR Function not found" {
+		t.Fatalf("FCALL knockknock = %q after forgetting the libraries", got)
+	}
+	if err := LoadFunctions(db); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.do("fcall", "knockknock", "0"); got != "$12 Who's there?" {
+		t.Fatalf("FCALL knockknock = %q after loading the libraries", got)
+	}
+	if got := c.do("fcall", "other", "0"); got != "-ERR Function not found" {
+		t.Fatalf("FCALL other = %q, the library was deleted", got)
+	}
+	//FUNCTION FLUSH deletes the saved libraries too
+	c.do("function", "flush")
+	if err := LoadFunctions(db); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.do("fcall", "knockknock", "0"); got != "-ERR Function not found" {
+		t.Fatalf("FCALL knockknock = %q after FUNCTION FLUSH", got)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+//keySpec tells where the keys of a command are: from first on, every step-th, up to last,
+//a negative last counts from the end of the arguments
+type keySpec struct {
+	first, last, step int
+}
+
+var keySpecs = map[string]keySpec{
+	"del":            {1, -1, 1},
+	"exists":         {1, -1, 1},
+	"touch":          {1, -1, 1},
+	"unlink":         {1, -1, 1},
+	"watch":          {1, -1, 1},
+	"rename":         {1, 2, 1},
+	"renamenx":       {1, 2, 1},
+	"copy":           {1, 2, 1},
+	"geosearchstore": {1, 2, 1},
+	"bzpopmin":       {1, -2, 1},
+	"bzpopmax":       {1, -2, 1},
+}
+
+//firstKeyCommands lists the commands whose only key is their first argument
+var firstKeyCommands = []string{
+	"set", "get", "hset", "hget", "hdel", "hgetall", "hkeys", "hscan",
+	"sadd", "srem", "smembers", "scard", "sscan",
+	"lpush", "lpop", "rpush", "rpop", "lrange", "ltrim", "llen",
+	"zadd", "zrem", "zrange", "zincrby", "zcount", "zrevrange", "zrank", "zcard", "zscore", "zmscore",
+	"zremrangebyscore", "zremrangebyrank", "zremrangebylex", "zpopmin", "zpopmax", "zrandmember", "zscan",
+	"geoadd", "geopos", "geodist", "geosearch",
+	"xadd", "xrange", "xrevrange", "xlen", "xtrim", "xdel", "xack", "xpending", "xclaim", "xautoclaim",
+	"type", "dump", "restore", "move",
+}
+
+func init() {
+	for _, v := range firstKeyCommands {
+		keySpecs[v] = keySpec{1, 1, 1}
+	}
+}
+
+//commandKeys returns the keys args of cmd refer to
+func commandKeys(cmd string, args [][]byte) [][]byte {
+	switch cmd {
+	case "zunionstore", "zinterstore", "zdiffstore":
+		if len(args) < 3 {
+			return nil
+		}
+		return append([][]byte{args[1]}, numKeys(args, 2)...)
+	case "zunion", "zinter", "zdiff":
+		return numKeys(args, 1)
+	case "eval", "evalsha", "fcall", "fcall_ro":
+		return numKeys(args, 2)
+	case "xread", "xreadgroup":
+		for i := 1; i < len(args); i++ {
+			if strings.ToUpper(string(args[i])) == "STREAMS" {
+				n := (len(args) - i - 1) / 2
+				return args[i+1 : i+1+n]
+			}
+		}
+		return nil
+	case "xgroup", "xinfo":
+		if len(args) > 2 {
+			return args[2:3]
+		}
+		return nil
+	case "migrate":
+		if len(args) > 3 && len(args[3]) > 0 {
+			return args[3:4]
+		}
+		for i := 6; i < len(args); i++ {
+			if strings.ToUpper(string(args[i])) == "KEYS" {
+				return args[i+1:]
+			}
+		}
+		return nil
+	}
+	spec, ok := keySpecs[cmd]
+	if !ok || spec.first >= len(args) {
+		return nil
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	var ret [][]byte
+	for i := spec.first; i <= last; i += spec.step {
+		ret = append(ret, args[i])
+	}
+	return ret
+}
+
+//numKeys returns the keys counted by the argument at index, nil when the count is invalid
+func numKeys(args [][]byte, index int) [][]byte {
+	if index >= len(args) {
+		return nil
+	}
+	n, err := strconv.Atoi(string(args[index]))
+	if err != nil || n < 0 || index+1+n > len(args) {
+		return nil
+	}
+	return args[index+1 : index+1+n]
+}
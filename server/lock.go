@@ -0,0 +1,80 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//shardLocks keeps the commands that must run alone from interleaving with others. Every command
+//holds all of them shared while it runs, EXEC holds all of them exclusively and a script only the
+//ones of the shards of its KEYS, so scripts on different shards run side by side.
+//Locks are always taken in ascending order, which keeps two holders from waiting on each other
+type shardLocks []sync.RWMutex
+
+var shardLock = make(shardLocks, 1<<store.CONST_STORE_NUM)
+
+//SetShards sizes shardLock to one lock per shard of the data directory, it must be called
+//before the server accepts connections
+func SetShards(n int) {
+	if n < 1 {
+		n = 1
+	}
+	shardLock = make(shardLocks, n)
+}
+
+//selfLocking lists the commands taking shardLock themselves instead of in Dispatcher
+var selfLocking = map[string]bool{
+	"exec":     true,
+	"eval":     true,
+	"evalsha":  true,
+	"fcall":    true,
+	"fcall_ro": true,
+	"migrate":  true,
+}
+
+func (l shardLocks) RLock() {
+	for i := range l {
+		l[i].RLock()
+	}
+}
+
+func (l shardLocks) RUnlock() {
+	for i := len(l) - 1; i >= 0; i-- {
+		l[i].RUnlock()
+	}
+}
+
+func (l shardLocks) Lock() {
+	for i := range l {
+		l[i].Lock()
+	}
+}
+
+func (l shardLocks) Unlock() {
+	for i := len(l) - 1; i >= 0; i-- {
+		l[i].Unlock()
+	}
+}
+
+//LockShards locks the given shards exclusively and returns the function unlocking them
+func (l shardLocks) LockShards(shards ...int) func() {
+	set := make(map[int]bool)
+	for _, v := range shards {
+		set[v%len(l)] = true
+	}
+	locked := make([]int, 0, len(set))
+	for v := range set {
+		locked = append(locked, v)
+	}
+	sort.Ints(locked)
+	for _, v := range locked {
+		l[v].Lock()
+	}
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			l[locked[i]].Unlock()
+		}
+	}
+}
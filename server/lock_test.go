@@ -0,0 +1,49 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+//TestSetShards locks one shard and checks which shards another holder can still lock, a
+//data directory with more shards than the default must not share locks between shards
+func TestSetShards(t *testing.T) {
+	defer SetShards(len(shardLock))
+	tests := []struct {
+		shards  int
+		held    int
+		other   int
+		blocked bool
+	}{
+		{16, 4, 4, true},
+		{16, 4, 5, false},
+		{16, 4, 20, true},
+		{32, 4, 20, false},
+		{32, 4, 36, true},
+		{1, 0, 7, true},
+	}
+	for _, tt := range tests {
+		SetShards(tt.shards)
+		if len(shardLock) != tt.shards {
+			t.Fatalf("SetShards(%d) made %d locks", tt.shards, len(shardLock))
+		}
+		unlock := shardLock.LockShards(tt.held)
+		done := make(chan struct{})
+		go func() {
+			shardLock.LockShards(tt.other)()
+			close(done)
+		}()
+		select {
+		case <-done:
+			if tt.blocked {
+				t.Errorf("%d shards: shard %d locked while %d is held", tt.shards, tt.other, tt.held)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if !tt.blocked {
+				t.Errorf("%d shards: shard %d waits for %d", tt.shards, tt.other, tt.held)
+			}
+		}
+		unlock()
+		<-done
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zealous-w/redcon"
+)
+
+//cmdMigrate moves keys to another server with DUMP and RESTORE:
+//
+//	MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key...]
+//
+//Every RESTORE is preceded by ASKING, so a cluster node importing the slot of the keys takes
+//them. The shards of the keys stay locked until the target answered, no write can slip in
+//between the dump and the delete. AUTH is accepted and ignored, the server has no passwords
+func cmdMigrate(c *Client, args ...[]byte) error {
+	if len(args) < 6 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	port, err1 := strconv.Atoi(string(args[2]))
+	index, err2 := strconv.Atoi(string(args[4]))
+	timeout, err3 := strconv.ParseInt(string(args[5]), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		c.Conn.WriteError("ERR value is not an integer or out of range")
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	keep, replace := false, false
+	var keys [][]byte
+	if len(args[3]) > 0 {
+		keys = args[3:4]
+	}
+	for i := 6; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "COPY":
+			keep = true
+		case "REPLACE":
+			replace = true
+		case "AUTH", "AUTH2":
+			if strings.ToUpper(string(args[i])) == "AUTH2" {
+				i++
+			}
+			if i++; i >= len(args) {
+				c.Conn.WriteError("ERR syntax error")
+				return nil
+			}
+		case "KEYS":
+			if len(args[3]) > 0 {
+				c.Conn.WriteError("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+				return nil
+			}
+			keys, i = args[i+1:], len(args)
+		default:
+			c.Conn.WriteError("ERR syntax error")
+			return nil
+		}
+	}
+	switch {
+	case Raft != nil:
+		c.Conn.WriteError("ERR MIGRATE is not supported in raft mode")
+		return nil
+	case !keep && Repl.IsReplica():
+		c.Conn.WriteError(errReadOnlyReplica)
+		return nil
+	}
+
+	db := c.DB()
+	shards := make([]int, 0, len(keys))
+	for _, v := range keys {
+		shards = append(shards, db.Shard(v))
+	}
+	unlock := shardLock.LockShards(shards...)
+	defer unlock()
+
+	var moved [][]byte
+	var req []byte
+	if index != 0 {
+		req = appendCommand(req, []byte("SELECT"), []byte(strconv.Itoa(index)))
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, v := range keys {
+		payload, err := db.Dump(v)
+		if err != nil {
+			c.Conn.WriteError("ERR " + err.Error())
+			return nil
+		}
+		if payload == nil {
+			continue
+		}
+		ttl := int64(0)
+		if at := db.ExpireAt(v); at != 0 {
+			//the expire is kept in seconds, a key still there has at least a millisecond left
+			if ttl = at*1000 - now; ttl <= 0 {
+				ttl = 1
+			}
+		}
+		restore := [][]byte{[]byte("RESTORE"), v, []byte(strconv.FormatInt(ttl, 10)), payload}
+		if replace {
+			restore = append(restore, []byte("REPLACE"))
+		}
+		req = appendCommand(req, []byte("ASKING"))
+		req = appendCommand(req, restore...)
+		moved = append(moved, v)
+	}
+	if len(moved) == 0 {
+		c.Conn.WriteString("NOKEY")
+		return nil
+	}
+
+	deadline := time.Duration(timeout) * time.Millisecond
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(string(args[1]), strconv.Itoa(port)), deadline)
+	if err != nil {
+		c.Conn.WriteError("IOERR error or timeout connecting to the client")
+		return nil
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(deadline))
+	if _, err := conn.Write(req); err != nil {
+		c.Conn.WriteError("IOERR error or timeout writing to target instance")
+		return nil
+	}
+	rd := bufio.NewReader(conn)
+	if index != 0 {
+		if _, err := readFrame(rd); err != nil {
+			c.Conn.WriteError("ERR Target instance replied with error: " + err.Error())
+			return nil
+		}
+	}
+	var failed error
+	for _, v := range moved {
+		//ASKING fails on a server outside cluster mode, which takes the keys all the same
+		var err error
+		for i := 0; i < 2 && !isIOError(err); i++ {
+			_, err = readFrame(rd)
+		}
+		if isIOError(err) {
+			c.Conn.WriteError("IOERR error or timeout reading to target instance")
+			return nil
+		}
+		if err != nil {
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		if !keep {
+			db.Del(v)
+		}
+	}
+	if failed != nil {
+		c.Conn.WriteError("ERR Target instance replied with error: " + failed.Error())
+		return nil
+	}
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+func appendCommand(buf []byte, args ...[]byte) []byte {
+	buf = redcon.AppendArray(buf, len(args))
+	for _, v := range args {
+		buf = redcon.AppendBulk(buf, v)
+	}
+	return buf
+}
+
+//isIOError reports whether err is a failure of the connection rather than an error reply
+func isIOError(err error) bool {
+	_, reply := err.(replyError)
+	return err != nil && !reply
+}
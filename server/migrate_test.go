@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//serveTestDB serves the commands of db on a loopback port and returns its port. Like a
+//server of its own it runs them without Dispatcher, whose locks and cluster state belong to
+//the server under test
+func serveTestDB(t *testing.T, db *command.RedisCommand) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := newTestConn(db)
+				rd := bufio.NewReader(conn)
+				for {
+					args, err := readFrame(rd)
+					if err != nil {
+						return
+					}
+					c.buf = nil
+					if f, ok := MsgCmd.cmds[strings.ToLower(string(args[0]))]; !ok {
+						c.WriteError("ERR unknown command '" + string(args[0]) + "'")
+					} else if err := f(&Client{Conn: c}, args...); err != nil {
+						c.WriteError("ERR '" + err.Error() + "'")
+					}
+					if _, err := conn.Write(c.buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string //after MIGRATE 127.0.0.1 port
+		target [][]string
+		want   string
+		source map[string]string //values left, "" for none
+		dest   map[string]string
+		destDB int
+	}{
+		{"one key", []string{"a", "0", "1000"}, nil, "+OK",
+			map[string]string{"a": ""}, map[string]string{"a": "1"}, 0},
+		{"keys", []string{"", "0", "1000", "KEYS", "a", "b", "missing"}, nil, "+OK",
+			map[string]string{"a": "", "b": ""}, map[string]string{"a": "1", "b": "2", "missing": ""}, 0},
+		{"copy", []string{"a", "0", "1000", "COPY"}, nil, "+OK",
+			map[string]string{"a": "1"}, map[string]string{"a": "1"}, 0},
+		{"nokey", []string{"missing", "0", "1000"}, nil, "+NOKEY",
+			nil, map[string]string{"missing": ""}, 0},
+		{"busy key", []string{"a", "0", "1000"}, [][]string{{"set", "a", "old"}}, "-ERR Target instance replied with error: BUSYKEY Target key name already exists.",
+			map[string]string{"a": "1"}, map[string]string{"a": "old"}, 0},
+		{"replace", []string{"a", "0", "1000", "REPLACE"}, [][]string{{"set", "a", "old"}}, "+OK",
+			map[string]string{"a": ""}, map[string]string{"a": "1"}, 0},
+		{"destination db", []string{"a", "3", "1000", "AUTH", "password"}, nil, "+OK",
+			map[string]string{"a": ""}, map[string]string{"a": "1"}, 3},
+		{"syntax", []string{"a", "0", "1000", "AUTH"}, nil, "-ERR syntax error",
+			map[string]string{"a": "1"}, map[string]string{"a": ""}, 0},
+		{"keys without empty key", []string{"a", "0", "1000", "KEYS", "b"}, nil, "-ERR When using MIGRATE KEYS option, the key argument must be set to the empty string",
+			map[string]string{"a": "1"}, map[string]string{"a": ""}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := newTestDB(t), newTestDB(t)
+			src.Set([]byte("a"), []byte("1"), 0)
+			src.Set([]byte("b"), []byte("2"), 0)
+			target := newTestConn(dst)
+			for _, v := range tt.target {
+				target.do(v...)
+			}
+			port := serveTestDB(t, dst)
+			if ret := newTestConn(src).do(append([]string{"migrate", "127.0.0.1", port}, tt.args...)...); ret != tt.want {
+				t.Fatalf("MIGRATE = %q, want %q", ret, tt.want)
+			}
+			for k, v := range tt.source {
+				if got := string(src.Get([]byte(k))); got != v {
+					t.Errorf("source %s = %q, want %q", k, got, v)
+				}
+			}
+			view, err := dst.Select(tt.destDB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.dest {
+				if got := string(view.Get([]byte(k))); got != v {
+					t.Errorf("target %s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateTTL(t *testing.T) {
+	src, dst := newTestDB(t), newTestDB(t)
+	src.Set([]byte("a"), []byte("v"), 0)
+	payload, _ := src.Dump([]byte("a"))
+	c := newTestConn(src)
+	c.do("restore", "t", "100000", string(payload))
+	at := src.ExpireAt([]byte("t"))
+	if ret := c.do("migrate", "127.0.0.1", serveTestDB(t, dst), "t", "0", "1000"); ret != "+OK" {
+		t.Fatalf("MIGRATE = %q", ret)
+	}
+	//the ttl sent is rounded up to the second again by RESTORE
+	if got := dst.ExpireAt([]byte("t")); got != at && got != at+1 {
+		t.Fatalf("ExpireAt() = %d on the target, %d on the source", got, at)
+	}
+}
+
+func TestMigrateIOError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+	src := newTestDB(t)
+	src.Set([]byte("a"), []byte("1"), 0)
+	if ret := newTestConn(src).do("migrate", "127.0.0.1", port, "a", "0", "100"); ret != "-IOERR error or timeout connecting to the client" {
+		t.Fatalf("MIGRATE = %q", ret)
+	}
+	if got := string(src.Get([]byte("a"))); got != "1" {
+		t.Fatalf("a = %q after a failed MIGRATE", got)
+	}
+}
+
+//TestMigrateSlot moves a key of a slot being migrated like redis-cli --cluster reshard, the
+//source answers ASK for it from then on
+func TestMigrateSlot(t *testing.T) {
+	src, dst := newTestDB(t), newTestDB(t)
+	c, other := newTestCluster(t, src)
+	slot := util.HashSlot([]byte("x"))
+	c.slots[slot] = c.myself
+	Cluster = c
+	defer func() { Cluster = nil }()
+
+	conn := newTestConn(src)
+	conn.do("set", "{x}a", "1")
+	conn.do("set", "{x}b", "2")
+	conn.do("cluster", "setslot", strconv.Itoa(slot), "migrating", other.id)
+	if ret := conn.do("migrate", "127.0.0.1", serveTestDB(t, dst), "", "0", "1000", "KEYS", "{x}a"); ret != "+OK" {
+		t.Fatalf("MIGRATE = %q", ret)
+	}
+	if got := string(dst.Get([]byte("{x}a"))); got != "1" {
+		t.Fatalf("target {x}a = %q", got)
+	}
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"get", "{x}a"}, "-ASK " + strconv.Itoa(slot) + " 127.0.0.1:7001"},
+		{[]string{"get", "{x}b"}, "+2"},
+		{[]string{"del", "{x}a", "{x}b"}, "-TRYAGAIN Multiple keys request during rehashing of slot"},
+		{[]string{"cluster", "countkeysinslot", strconv.Itoa(slot)}, ":1"},
+		{[]string{"migrate", "127.0.0.1", "1", "{x}a", "0", "1000"}, "+NOKEY"},
+	}
+	for _, tt := range tests {
+		if got := conn.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
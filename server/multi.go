@@ -0,0 +1,268 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Zealous-w/redcon"
+)
+
+//multiState holds the commands queued by a connection after MULTI
+type multiState struct {
+	queue [][][]byte
+	dirty bool   //a command failed to queue, EXEC discards the transaction
+	key   []byte //first key queued, in cluster mode every other one must hash to its slot
+}
+
+//multiImmediate lists the commands that run at once inside MULTI instead of being queued
+var multiImmediate = map[string]bool{
+	"multi":   true,
+	"exec":    true,
+	"discard": true,
+	"watch":   true,
+}
+
+//commandArity is the number of arguments of each command, its name included, like redis
+//a negative -n means at least n. MULTI checks it when queueing a command, the commands
+//check their arguments completely when they run
+var commandArity = map[string]int{
+	"set": 3, "get": 2, "del": 2, "unlink": -2, "exists": -2, "touch": 2, "type": 2,
+	"keys": 2, "randomkey": 1, "dbsize": 1, "rename": 3, "renamenx": 3, "copy": -3,
+	"move": 3, "select": 2, "swapdb": 3, "flushdb": -1, "flushall": -1, "dump": 2,
+	"restore": -4, "scan": -2, "hscan": -3, "sscan": -3, "zscan": -3,
+	"hset": -4, "hget": 3, "hdel": 3, "hgetall": 2, "hkeys": 2,
+	"sadd": -3, "srem": -3, "smembers": 2, "scard": 2,
+	"lpush": -3, "lpop": 2, "rpush": -3, "rpop": 2, "lrange": 4, "ltrim": 4, "llen": 2,
+	"zadd": 4, "zrem": -3, "zrange": -4, "zincrby": 4, "zcount": 4, "zrevrange": -4,
+	"zrank": 3, "zcard": 2, "zremrangebyscore": 4, "zremrangebyrank": 4, "zremrangebylex": 4,
+	"zpopmin": -2, "zpopmax": -2, "bzpopmin": -3, "bzpopmax": -3,
+	"zunionstore": -4, "zinterstore": -4, "zdiffstore": -4, "zunion": -4, "zinter": -4, "zdiff": -4,
+	"zscore": 3, "zmscore": -3, "zrandmember": -2,
+	"geoadd": -5, "geopos": -2, "geodist": -4, "geosearch": -6, "geosearchstore": -7,
+	"xadd": -5, "xrange": -4, "xrevrange": -4, "xlen": 2, "xtrim": -4, "xdel": -3,
+	"xread": -4, "xgroup": -2, "xreadgroup": -7, "xack": -4, "xpending": -3,
+	"xclaim": -6, "xautoclaim": -6, "xinfo": -3,
+	"ping": -1, "multi": 1, "exec": 1, "discard": 1, "watch": -2, "unwatch": 1,
+	"eval": -3, "evalsha": -3, "script": -2, "function": -2, "fcall": -3, "fcall_ro": -3,
+	"publish": 3, "subscribe": -2, "psubscribe": -2, "unsubscribe": -1, "punsubscribe": -1,
+	"pubsub": -2, "config": -2, "cdc": -2, "replicaof": 3, "psync": -3, "role": 1,
+	"raft": -2, "cluster": -2, "asking": 1, "readonly": 1, "readwrite": 1, "migrate": -6,
+}
+
+//arityValid reports whether n arguments, the name included, suit the arity of cmd
+func arityValid(cmd string, n int) bool {
+	arity, ok := commandArity[cmd]
+	switch {
+	case !ok:
+		return true
+	case arity < 0:
+		return n >= -arity
+	}
+	return n == arity
+}
+
+//replyConn collects the replies of the commands run by EXEC, they are only sent once the
+//transaction has committed
+type replyConn struct {
+	redcon.Conn
+	buf []byte
+}
+
+func (r *replyConn) WriteError(msg string) {
+	r.buf = redcon.AppendError(r.buf, msg)
+}
+
+func (r *replyConn) WriteString(str string) {
+	r.buf = redcon.AppendString(r.buf, str)
+}
+
+func (r *replyConn) WriteBulk(bulk []byte) {
+	r.buf = redcon.AppendBulk(r.buf, bulk)
+}
+
+func (r *replyConn) WriteInt(num int) {
+	r.buf = redcon.AppendInt(r.buf, int64(num))
+}
+
+func (r *replyConn) WriteArray(count int) {
+	r.buf = redcon.AppendArray(r.buf, count)
+}
+
+func (r *replyConn) WriteNull() {
+	r.buf = redcon.AppendNull(r.buf)
+}
+
+func (r *replyConn) WriteRaw(data []byte) {
+	r.buf = append(r.buf, data...)
+}
+
+//add appends a command to the transaction of the connection
+func (m *multiState) add(args [][]byte) {
+	//the arguments point into the read buffer of the connection, which is reused
+	cmd := make([][]byte, 0, len(args))
+	for _, v := range args {
+		cmd = append(cmd, append([]byte{}, v...))
+	}
+	m.queue = append(m.queue, cmd)
+}
+
+//raftQueued reports whether a transaction writes, so it goes through the raft log
+func raftQueued(queue [][][]byte) bool {
+	for _, v := range queue {
+		if raftProposed(strings.ToLower(string(v[0])), v) {
+			return true
+		}
+	}
+	return false
+}
+
+//block waits like Blocking.Block without holding off EXEC of other connections,
+//inside EXEC it tries once and never waits, like redis
+func (c *Client) block(keys [][]byte, timeout time.Duration, try func() bool) bool {
+	if c.exec {
+		return try()
+	}
+	shardLock.RUnlock()
+	defer shardLock.RLock()
+	return Blocking.Block(c.DB().Index(), keys, timeout, func() bool {
+		shardLock.RLock()
+		defer shardLock.RUnlock()
+		return try()
+	})
+}
+
+func cmdMulti(c *Client, args ...[]byte) error {
+	if len(args) != 1 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	s := c.Session()
+	if s.multi != nil {
+		c.Conn.WriteError("ERR MULTI calls can not be nested")
+		return nil
+	}
+	s.multi = &multiState{}
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+func cmdDiscard(c *Client, args ...[]byte) error {
+	if len(args) != 1 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	s := c.Session()
+	if s.multi == nil {
+		c.Conn.WriteError("ERR DISCARD without MULTI")
+		return nil
+	}
+	s.multi = nil
+	s.unwatch()
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+func cmdWatch(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	s := c.Session()
+	if s.multi != nil {
+		c.Conn.WriteError("ERR WATCH inside MULTI is not allowed")
+		return nil
+	}
+	s.watch = s.DB.Watch(s.watch, args[1:]...)
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+func cmdUnwatch(c *Client, args ...[]byte) error {
+	if len(args) != 1 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	c.Session().unwatch()
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+//unwatch forgets the keys watched by the connection
+func (s *Session) unwatch() {
+	if s.watch != nil {
+		s.DB.Unwatch(s.watch)
+		s.watch = nil
+	}
+}
+
+//cmdExec runs the queued commands against write buffers while holding shardLock and
+//commits the buffers before any reply is sent, see command.Multi for the commit protocol
+func cmdExec(c *Client, args ...[]byte) error {
+	if len(args) != 1 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	s := c.Session()
+	m := s.multi
+	if m == nil {
+		c.Conn.WriteError("ERR EXEC without MULTI")
+		return nil
+	}
+	s.multi = nil
+	if m.dirty {
+		s.unwatch()
+		c.Conn.WriteError("EXECABORT Transaction discarded because of previous errors.")
+		return nil
+	}
+	if Raft != nil && raftQueued(m.queue) {
+		e := &raftEntry{exec: true, cmds: m.queue}
+		shardLock.Lock()
+		changed := s.DB.Changed(s.watch)
+		if !changed {
+			//the members recheck the keys when they apply the entry
+			e.watch = s.watch.Keys()
+			e.digest = s.DB.Digest(e.watch)
+		}
+		shardLock.Unlock()
+		s.unwatch()
+		if changed {
+			c.Conn.WriteNull()
+			return nil
+		}
+		return raftPropose(c, e)
+	}
+
+	shardLock.Lock()
+	defer shardLock.Unlock()
+	changed := s.DB.Changed(s.watch)
+	s.unwatch()
+	if changed {
+		c.Conn.WriteNull()
+		return nil
+	}
+	selected := s.DB
+	s.DB = c.DB().Multi()
+	reply := &replyConn{Conn: c.Conn}
+	client := &Client{Conn: reply, exec: true, signals: &pendingSignals{}}
+	for _, v := range m.queue {
+		cmd := strings.ToLower(string(v[0]))
+		if err := MsgCmd.cmds[cmd](client, v...); err != nil {
+			reply.WriteError("ERR '" + err.Error() + "'")
+		}
+	}
+	//keep a database chosen by SELECT inside the transaction, minus the write buffers
+	tx := s.DB
+	if db, err := selected.Select(tx.Index()); err == nil {
+		s.DB = db
+	} else {
+		s.DB = selected
+	}
+	if err := tx.Commit(); err != nil {
+		c.Conn.WriteError("ERR " + err.Error())
+		return nil
+	}
+	client.signals.flush(c.signals)
+	c.Conn.WriteArray(len(m.queue))
+	c.Conn.WriteRaw(reply.buf)
+	return nil
+}
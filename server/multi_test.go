@@ -0,0 +1,142 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		watch []string
+		other [][]string //run by another connection after WATCH
+		own   [][]string //run by the watching connection after WATCH, before MULTI
+		exec  string     //reply of EXEC queuing SET n 1
+	}{
+		{"untouched", []string{"w"}, nil, nil, "*1 +OK"},
+		{"other key", []string{"w"}, [][]string{{"set", "x", "1"}}, nil, "*1 +OK"},
+		{"set", []string{"w"}, [][]string{{"set", "w", "2"}}, nil, "$-1"},
+		{"same value", []string{"w"}, [][]string{{"set", "w", "v"}}, nil, "$-1"},
+		{"del", []string{"w"}, [][]string{{"del", "w"}}, nil, "$-1"},
+		{"unlink", []string{"w"}, [][]string{{"unlink", "w"}}, nil, "$-1"},
+		{"hset", []string{"h"}, [][]string{{"hset", "h", "f2", "v"}}, nil, "$-1"},
+		{"missing key created", []string{"missing"}, [][]string{{"set", "missing", "v"}}, nil, "$-1"},
+		{"missing key untouched", []string{"missing"}, [][]string{{"del", "missing"}}, nil, "*1 +OK"},
+		{"one of several", []string{"a", "w", "b"}, [][]string{{"set", "b", "1"}}, nil, "$-1"},
+		{"rename onto", []string{"w"}, [][]string{{"rename", "x2", "w"}}, nil, "$-1"},
+		{"rename away", []string{"w"}, [][]string{{"rename", "w", "x3"}}, nil, "$-1"},
+		{"flushdb", []string{"w"}, [][]string{{"flushdb"}}, nil, "$-1"},
+		{"flushall", []string{"w"}, [][]string{{"flushall"}}, nil, "$-1"},
+		{"other database", []string{"w"}, [][]string{{"select", "1"}, {"set", "w", "2"}}, nil, "*1 +OK"},
+		{"own write", []string{"w"}, nil, [][]string{{"set", "w", "2"}}, "$-1"},
+		{"unwatch", []string{"w"}, [][]string{{"set", "w", "2"}}, [][]string{{"unwatch"}}, "*1 +OK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			c, other := newTestConn(db), newTestConn(db)
+			for _, v := range [][]string{{"set", "w", "v"}, {"set", "x2", "v"}, {"hset", "h", "f", "v"}, {"set", "a", "v"}} {
+				other.do(v...)
+			}
+			if ret := c.do(append([]string{"watch"}, tt.watch...)...); ret != "+OK" {
+				t.Fatalf("WATCH = %q", ret)
+			}
+			for _, v := range tt.other {
+				other.do(v...)
+			}
+			for _, v := range tt.own {
+				c.do(v...)
+			}
+			c.do("multi")
+			c.do("set", "n", "1")
+			if ret := c.do("exec"); ret != tt.exec {
+				t.Fatalf("EXEC = %q, want %q", ret, tt.exec)
+			}
+			//the next transaction watches nothing
+			c.do("multi")
+			c.do("set", "n", "2")
+			if ret := c.do("exec"); ret != "*1 +OK" {
+				t.Fatalf("second EXEC = %q", ret)
+			}
+		})
+	}
+}
+
+//TestWatchExpire watches a key with a ttl, EXEC fails once it has expired
+func TestWatchExpire(t *testing.T) {
+	db := newTestDB(t)
+	db.Set([]byte("w"), []byte("v"), 0)
+	payload, _ := db.Dump([]byte("w"))
+	c := newTestConn(db)
+	if ret := c.do("restore", "t", "50", string(payload)); ret != "+OK" {
+		t.Fatalf("RESTORE = %q", ret)
+	}
+	c.do("watch", "t")
+	//a key expires once the second of its ttl is over
+	time.Sleep(time.Until(time.Unix(db.ExpireAt([]byte("t"))+1, 0)) + 10*time.Millisecond)
+	c.do("multi")
+	c.do("set", "n", "1")
+	if ret := c.do("exec"); ret != "$-1" {
+		t.Fatalf("EXEC = %q after the watched key expired", ret)
+	}
+}
+
+func TestMultiErrors(t *testing.T) {
+	tests := []struct {
+		cmds [][]string
+		want string //reply of the last command
+	}{
+		{[][]string{{"exec"}}, "-ERR EXEC without MULTI"},
+		{[][]string{{"discard"}}, "-ERR DISCARD without MULTI"},
+		{[][]string{{"multi"}, {"multi"}}, "-ERR MULTI calls can not be nested"},
+		{[][]string{{"multi"}, {"watch", "w"}}, "-ERR WATCH inside MULTI is not allowed"},
+		{[][]string{{"multi"}, {"nosuchcommand"}, {"exec"}}, "-EXECABORT Transaction discarded because of previous errors."},
+		{[][]string{{"multi"}, {"set", "w", "v"}, {"discard"}, {"get", "w"}}, "$-1"},
+		{[][]string{{"multi"}, {"set", "w", "v"}, {"get", "w"}, {"exec"}}, "*2 +OK +v"},
+		{[][]string{{"multi"}, {"set", "a", "1"}, {"lpush"}}, "-ERR wrong number of arguments for 'lpush' command"},
+		{[][]string{{"multi"}, {"set", "a", "1"}, {"lpush"}, {"exec"}}, "-EXECABORT Transaction discarded because of previous errors."},
+		{[][]string{{"multi"}, {"set", "a", "1"}, {"lpush"}, {"exec"}, {"get", "a"}}, "$-1"},
+		{[][]string{{"multi"}, {"GET", "a", "b"}}, "-ERR wrong number of arguments for 'GET' command"},
+		//a minimum arity only rejects too few arguments, the command checks the rest when it runs
+		{[][]string{{"multi"}, {"zpopmin", "z", "1", "2"}, {"exec"}}, "*1 -ERR wrong number of arguments for 'zpopmin' command"},
+		{[][]string{{"multi"}, {"lpush", "l", "a", "b"}, {"lrange", "l", "0", "-1"}, {"exec"}}, "*2 +OK *2 $1 b $1 a"},
+	}
+	for _, tt := range tests {
+		c := newTestConn(newTestDB(t))
+		var ret string
+		for _, v := range tt.cmds {
+			ret = c.do(v...)
+		}
+		if ret != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmds, ret, tt.want)
+		}
+	}
+}
+
+//TestCommandArity checks every command has an arity, and that MULTI queues commands with
+//as many arguments as they take
+func TestCommandArity(t *testing.T) {
+	for cmd := range MsgCmd.cmds {
+		if _, ok := commandArity[cmd]; !ok {
+			t.Errorf("no arity for %s", cmd)
+		}
+	}
+	tests := []struct {
+		cmd  string
+		n    int
+		want bool
+	}{
+		{"get", 2, true},
+		{"get", 1, false},
+		{"get", 3, false},
+		{"lpush", 2, false},
+		{"lpush", 3, true},
+		{"lpush", 10, true},
+		{"nosuchcommand", 1, true},
+	}
+	for _, tt := range tests {
+		if got := arityValid(tt.cmd, tt.n); got != tt.want {
+			t.Errorf("arityValid(%s, %d) = %v, want %v", tt.cmd, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package server
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zealous-w/redcon"
+	"github.com/Zealous-w/tacodb/util"
+)
+
+//PubSub routes published messages to the subscribers of a channel or of a pattern matching it
+type PubSub struct {
+	lock     sync.RWMutex
+	channels map[string]map[*subscriber]bool
+	patterns map[string]map[*subscriber]bool
+}
+
+var Hub = NewPubSub()
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*subscriber]bool),
+		patterns: make(map[string]map[*subscriber]bool),
+	}
+}
+
+//subscriberAllowed lists the commands a connection in subscriber mode may run
+var subscriberAllowed = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+}
+
+//subscriber is a connection detached from redcon by its first SUBSCRIBE or PSUBSCRIBE. Its own
+//goroutine reads its commands from then on, and every reply or message is queued for a writer
+//goroutine, so a publisher never waits on a slow subscriber. One falling behind by more than
+//the limits of Conf is disconnected instead
+type subscriber struct {
+	redcon.DetachedConn
+	channels map[string]bool
+	patterns map[string]bool
+
+	lock      sync.Mutex
+	out       []byte    //queued output not handed to the connection yet
+	softSince time.Time //when out grew beyond the soft limit, zero below it
+	closed    bool
+	quit      bool //close once out is written
+	wake      chan struct{}
+}
+
+func newSubscriber(conn redcon.DetachedConn) *subscriber {
+	s := &subscriber{
+		DetachedConn: conn,
+		channels:     make(map[string]bool),
+		patterns:     make(map[string]bool),
+		wake:         make(chan struct{}, 1),
+	}
+	go s.writeLoop()
+	return s
+}
+
+//subscriberOf returns the subscriber c runs as, detaching the connection of c when it is
+//not one yet. detached reports that the caller has to start serve once it has replied
+func subscriberOf(c *Client) (s *subscriber, detached bool) {
+	if s, ok := c.Conn.(*subscriber); ok {
+		return s, false
+	}
+	return newSubscriber(c.Conn.Detach()), true
+}
+
+//queue appends output for the writer goroutine, disconnecting the subscriber if it
+//falls behind more than the output buffer limits allow
+func (s *subscriber) queue(data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	size := len(s.out) + len(data)
+	if Conf.PubSubHardLimit > 0 && size > Conf.PubSubHardLimit {
+		s.closeLocked("hard")
+		return
+	}
+	if Conf.PubSubSoftLimit > 0 && size > Conf.PubSubSoftLimit {
+		if s.softSince.IsZero() {
+			s.softSince = time.Now()
+		} else if time.Since(s.softSince) > Conf.PubSubSoftPeriod {
+			s.closeLocked("soft")
+			return
+		}
+	} else {
+		s.softSince = time.Time{}
+	}
+	s.out = append(s.out, data...)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+//closeLocked disconnects the subscriber, the blocked read of serve then fails and cleans up,
+//limit names the output buffer limit it went over if any
+func (s *subscriber) closeLocked(limit string) {
+	if limit != "" {
+		log.Printf("subscriber %s disconnected, output buffer over the %s limit, size=%d", s.RemoteAddr(), limit, len(s.out))
+	}
+	s.closed = true
+	s.out = nil
+	_ = s.DetachedConn.Close()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.closeLocked("")
+	}
+	return nil
+}
+
+//finish closes the connection once the queued output is written
+func (s *subscriber) finish() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.quit = true
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) writeLoop() {
+	for range s.wake {
+		s.lock.Lock()
+		out, closed := s.out, s.closed
+		s.out = nil
+		s.lock.Unlock()
+		if closed {
+			return
+		}
+		if len(out) > 0 {
+			s.DetachedConn.WriteRaw(out)
+			if err := s.DetachedConn.Flush(); err != nil {
+				_ = s.Close()
+				return
+			}
+		}
+		s.lock.Lock()
+		if s.quit && len(s.out) == 0 {
+			s.closeLocked("")
+			s.lock.Unlock()
+			return
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (s *subscriber) WriteError(msg string) {
+	s.queue(redcon.AppendError(nil, msg))
+}
+
+func (s *subscriber) WriteString(str string) {
+	s.queue(redcon.AppendString(nil, str))
+}
+
+func (s *subscriber) WriteBulk(bulk []byte) {
+	s.queue(redcon.AppendBulk(nil, bulk))
+}
+
+func (s *subscriber) WriteInt(num int) {
+	s.queue(redcon.AppendInt(nil, int64(num)))
+}
+
+func (s *subscriber) WriteArray(count int) {
+	s.queue(redcon.AppendArray(nil, count))
+}
+
+func (s *subscriber) WriteNull() {
+	s.queue(redcon.AppendNull(nil))
+}
+
+func (s *subscriber) WriteRaw(data []byte) {
+	s.queue(append([]byte{}, data...))
+}
+
+func (s *subscriber) count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+//serve runs the commands of the connection until it is gone. While subscribed only the
+//commands of subscriberAllowed run, once every subscription is dropped any command does
+func (s *subscriber) serve() {
+	defer func() {
+		Hub.drop(s)
+		s.finish()
+		if session, ok := s.Context().(*Session); ok {
+			session.Close()
+		}
+	}()
+	for {
+		cmd, err := s.ReadCommand()
+		if err != nil {
+			return
+		}
+		name := strings.ToLower(string(cmd.Args[0]))
+		if s.count() > 0 && !subscriberAllowed[name] {
+			s.WriteError("ERR Can't execute '" + name + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+			continue
+		}
+		switch name {
+		case "quit":
+			s.WriteString("OK")
+			return
+		case "ping":
+			if s.count() > 0 && len(cmd.Args) <= 2 {
+				s.WriteArray(2)
+				s.WriteBulk([]byte("pong"))
+				if len(cmd.Args) == 2 {
+					s.WriteBulk(cmd.Args[1])
+				} else {
+					s.WriteBulk([]byte{})
+				}
+				continue
+			}
+		}
+		if err := MsgCmd.Dispatcher(name, &Client{Conn: s}, cmd.Args...); err != nil {
+			s.WriteError("ERR '" + err.Error() + "'")
+		}
+	}
+}
+
+//message builds a message or pmessage push
+func message(pattern, channel, payload []byte) []byte {
+	if pattern == nil {
+		ret := redcon.AppendArray(nil, 3)
+		ret = redcon.AppendBulk(ret, []byte("message"))
+		ret = redcon.AppendBulk(ret, channel)
+		return redcon.AppendBulk(ret, payload)
+	}
+	ret := redcon.AppendArray(nil, 4)
+	ret = redcon.AppendBulk(ret, []byte("pmessage"))
+	ret = redcon.AppendBulk(ret, pattern)
+	ret = redcon.AppendBulk(ret, channel)
+	return redcon.AppendBulk(ret, payload)
+}
+
+//Publish sends payload to the subscribers of channel and returns how many received it
+func (p *PubSub) Publish(channel, payload []byte) int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	ret := 0
+	if subs := p.channels[string(channel)]; len(subs) > 0 {
+		msg := message(nil, channel, payload)
+		for s := range subs {
+			s.queue(msg)
+			ret++
+		}
+	}
+	for pattern, subs := range p.patterns {
+		if !util.GlobMatch([]byte(pattern), channel) {
+			continue
+		}
+		msg := message([]byte(pattern), channel, payload)
+		for s := range subs {
+			s.queue(msg)
+			ret++
+		}
+	}
+	return ret
+}
+
+//subscribe adds s to a channel, or a pattern with pattern set, and replies the confirmation
+func (p *PubSub) subscribe(s *subscriber, name []byte, pattern bool) {
+	own, table, kind := s.channels, p.channels, "subscribe"
+	if pattern {
+		own, table, kind = s.patterns, p.patterns, "psubscribe"
+	}
+	p.lock.Lock()
+	if !own[string(name)] {
+		own[string(name)] = true
+		set, ok := table[string(name)]
+		if !ok {
+			set = make(map[*subscriber]bool)
+			table[string(name)] = set
+		}
+		set[s] = true
+	}
+	count := s.count()
+	p.lock.Unlock()
+	s.WriteArray(3)
+	s.WriteBulk([]byte(kind))
+	s.WriteBulk(name)
+	s.WriteInt(count)
+}
+
+//unsubscribe removes s from the given channels or patterns, all of them when none is given,
+//and replies a confirmation for each
+func (p *PubSub) unsubscribe(s *subscriber, names [][]byte, pattern bool) {
+	own, table, kind := s.channels, p.channels, "unsubscribe"
+	if pattern {
+		own, table, kind = s.patterns, p.patterns, "punsubscribe"
+	}
+	p.lock.Lock()
+	if len(names) == 0 {
+		for k := range own {
+			names = append(names, []byte(k))
+		}
+		sort.Slice(names, func(i, j int) bool { return string(names[i]) < string(names[j]) })
+	}
+	counts := make([]int, 0, len(names))
+	for _, name := range names {
+		if own[string(name)] {
+			delete(own, string(name))
+			delete(table[string(name)], s)
+			if len(table[string(name)]) == 0 {
+				delete(table, string(name))
+			}
+		}
+		counts = append(counts, s.count())
+	}
+	p.lock.Unlock()
+	if len(names) == 0 {
+		s.WriteArray(3)
+		s.WriteBulk([]byte(kind))
+		s.WriteNull()
+		s.WriteInt(s.count())
+		return
+	}
+	for i, name := range names {
+		s.WriteArray(3)
+		s.WriteBulk([]byte(kind))
+		s.WriteBulk(name)
+		s.WriteInt(counts[i])
+	}
+}
+
+//drop removes every subscription of s
+func (p *PubSub) drop(s *subscriber) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for k := range s.channels {
+		delete(p.channels[k], s)
+		if len(p.channels[k]) == 0 {
+			delete(p.channels, k)
+		}
+	}
+	for k := range s.patterns {
+		delete(p.patterns[k], s)
+		if len(p.patterns[k]) == 0 {
+			delete(p.patterns, k)
+		}
+	}
+	s.channels, s.patterns = make(map[string]bool), make(map[string]bool)
+}
+
+func cmdPublish(c *Client, args ...[]byte) error {
+	if len(args) != 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	c.Conn.WriteInt(Hub.Publish(args[1], args[2]))
+	return nil
+}
+
+func cmdSubscribe(c *Client, args ...[]byte) error {
+	return subscribe(c, false, args...)
+}
+
+func cmdPSubscribe(c *Client, args ...[]byte) error {
+	return subscribe(c, true, args...)
+}
+
+func subscribe(c *Client, pattern bool, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	if c.exec {
+		c.Conn.WriteError("ERR " + strings.ToUpper(string(args[0])) + " isn't allowed inside a transaction or script")
+		return nil
+	}
+	s, detached := subscriberOf(c)
+	for _, v := range args[1:] {
+		Hub.subscribe(s, v, pattern)
+	}
+	if detached {
+		go s.serve()
+	}
+	return nil
+}
+
+func cmdUnsubscribe(c *Client, args ...[]byte) error {
+	return unsubscribe(c, false, args...)
+}
+
+func cmdPUnsubscribe(c *Client, args ...[]byte) error {
+	return unsubscribe(c, true, args...)
+}
+
+func unsubscribe(c *Client, pattern bool, args ...[]byte) error {
+	s, ok := c.Conn.(*subscriber)
+	if !ok {
+		//a connection that never subscribed has nothing to drop
+		kind := strings.ToLower(string(args[0]))
+		names := args[1:]
+		if len(names) == 0 {
+			c.Conn.WriteArray(3)
+			c.Conn.WriteBulk([]byte(kind))
+			c.Conn.WriteNull()
+			c.Conn.WriteInt(0)
+			return nil
+		}
+		for _, v := range names {
+			c.Conn.WriteArray(3)
+			c.Conn.WriteBulk([]byte(kind))
+			c.Conn.WriteBulk(v)
+			c.Conn.WriteInt(0)
+		}
+		return nil
+	}
+	Hub.unsubscribe(s, args[1:], pattern)
+	return nil
+}
+
+//cmdPubSub answers PUBSUB CHANNELS [pattern], PUBSUB NUMSUB [channel ...] and PUBSUB NUMPAT
+func cmdPubSub(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	Hub.lock.RLock()
+	defer Hub.lock.RUnlock()
+	sub := strings.ToUpper(string(args[1]))
+	switch {
+	case sub == "CHANNELS" && len(args) <= 3:
+		var ret []string
+		for k := range Hub.channels {
+			if len(args) == 2 || util.GlobMatch(args[2], []byte(k)) {
+				ret = append(ret, k)
+			}
+		}
+		sort.Strings(ret)
+		c.Conn.WriteArray(len(ret))
+		for _, v := range ret {
+			c.Conn.WriteBulk([]byte(v))
+		}
+	case sub == "NUMSUB":
+		c.Conn.WriteArray(2 * (len(args) - 2))
+		for _, v := range args[2:] {
+			c.Conn.WriteBulk(v)
+			c.Conn.WriteInt(len(Hub.channels[string(v)]))
+		}
+	case sub == "NUMPAT" && len(args) == 2:
+		c.Conn.WriteInt(len(Hub.patterns))
+	default:
+		c.Conn.WriteError("ERR unknown subcommand or wrong number of arguments for '" + string(args[1]) + "'. Try PUBSUB HELP.")
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Zealous-w/redcon"
+	"github.com/Zealous-w/tacodb/command"
+)
+
+//pipeConn is the server end of a connection detached by SUBSCRIBE
+type pipeConn struct {
+	redcon.DetachedConn
+	conn net.Conn
+	rd   *bufio.Reader
+	buf  []byte
+	ctx  interface{}
+}
+
+func (p *pipeConn) RemoteAddr() string       { return "test" }
+func (p *pipeConn) Context() interface{}     { return p.ctx }
+func (p *pipeConn) SetContext(v interface{}) { p.ctx = v }
+func (p *pipeConn) WriteRaw(data []byte)     { p.buf = append(p.buf, data...) }
+func (p *pipeConn) Close() error             { return p.conn.Close() }
+
+func (p *pipeConn) Flush() error {
+	_, err := p.conn.Write(p.buf)
+	p.buf = nil
+	return err
+}
+
+func (p *pipeConn) ReadCommand() (redcon.Command, error) {
+	args, err := readFrame(p.rd)
+	return redcon.Command{Args: args}, err
+}
+
+//subConn is a test connection that may turn into a subscriber, its commands are sent over
+//a pipe from then on
+type subConn struct {
+	testConn
+	detached *pipeConn
+	client   net.Conn
+	rd       *bufio.Reader
+	sub      bool
+}
+
+func newSubConn(t *testing.T, db *command.RedisCommand) *subConn {
+	server, client := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	c := &subConn{detached: &pipeConn{conn: server, rd: bufio.NewReader(server)}, client: client, rd: bufio.NewReader(client)}
+	c.ctx = NewSession(c, db)
+	c.detached.ctx = c.ctx
+	return c
+}
+
+func (c *subConn) Detach() redcon.DetachedConn {
+	c.sub = true
+	return c.detached
+}
+
+//send runs a command and returns its first reply
+func (c *subConn) send(t *testing.T, args ...string) string {
+	t.Helper()
+	if !c.sub {
+		c.buf = nil
+		argv := make([][]byte, 0, len(args))
+		for _, v := range args {
+			argv = append(argv, []byte(v))
+		}
+		if err := MsgCmd.Dispatcher(strings.ToLower(args[0]), &Client{Conn: c}, argv...); err != nil {
+			c.WriteError("ERR '" + err.Error() + "'")
+		}
+		if !c.sub {
+			return strings.TrimSpace(strings.ReplaceAll(string(c.buf), "\r\n", " "))
+		}
+		return c.read(t)
+	}
+	buf := redcon.AppendArray(nil, len(args))
+	for _, v := range args {
+		buf = redcon.AppendBulk(buf, []byte(v))
+	}
+	_ = c.client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.client.Write(buf); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return c.read(t)
+}
+
+//read returns the next reply pushed to a subscriber, CRLF replaced by spaces like do
+func (c *subConn) read(t *testing.T) string {
+	t.Helper()
+	_ = c.client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var raw []byte
+	if err := readRaw(c.rd, &raw); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(raw), "\r\n", " "))
+}
+
+//readRaw appends one complete RESP reply read from rd to raw
+func readRaw(rd *bufio.Reader, raw *[]byte) error {
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	*raw = append(*raw, line...)
+	n, _ := strconv.Atoi(strings.TrimSpace(string(line[1:])))
+	switch line[0] {
+	case '$':
+		if n >= 0 {
+			bulk := make([]byte, n+2)
+			if _, err := io.ReadFull(rd, bulk); err != nil {
+				return err
+			}
+			*raw = append(*raw, bulk...)
+		}
+	case '*':
+		for i := 0; i < n; i++ {
+			if err := readRaw(rd, raw); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//TestPubSub runs the steps of a publishing connection 0 and the subscribers 1 and 2
+func TestPubSub(t *testing.T) {
+	tests := []struct {
+		conn int
+		cmd  []string //nil only reads
+		want []string
+	}{
+		{1, []string{"subscribe", "news", "sport"}, []string{"*3 $9 subscribe $4 news :1", "*3 $9 subscribe $5 sport :2"}},
+		{2, []string{"psubscribe", "n*"}, []string{"*3 $10 psubscribe $2 n* :1"}},
+		{0, []string{"publish", "news", "hi"}, []string{":2"}},
+		{1, nil, []string{"*3 $7 message $4 news $2 hi"}},
+		{2, nil, []string{"*4 $8 pmessage $2 n* $4 news $2 hi"}},
+		{0, []string{"publish", "other", "x"}, []string{":0"}},
+		{0, []string{"pubsub", "channels"}, []string{reply("news", "sport")}},
+		{0, []string{"pubsub", "channels", "s*"}, []string{reply("sport")}},
+		{0, []string{"pubsub", "numsub", "news", "nosuch"}, []string{"*4 $4 news :1 $6 nosuch :0"}},
+		{0, []string{"pubsub", "numpat"}, []string{":1"}},
+		{0, []string{"pubsub", "nosuch"}, []string{"-ERR unknown subcommand or wrong number of arguments for 'nosuch'. Try PUBSUB HELP."}},
+		{1, []string{"get", "k"}, []string{"-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context"}},
+		{1, []string{"ping"}, []string{"*2 $4 pong $0"}},
+		{1, []string{"subscribe", "news"}, []string{"*3 $9 subscribe $4 news :2"}},
+		{1, []string{"unsubscribe"}, []string{"*3 $11 unsubscribe $4 news :1", "*3 $11 unsubscribe $5 sport :0"}},
+		//with no subscription left any command runs again
+		{1, []string{"get", "k"}, []string{"$-1"}},
+		{1, []string{"unsubscribe"}, []string{"*3 $11 unsubscribe $-1 :0"}},
+		{0, []string{"publish", "news", "x"}, []string{":1"}},
+		{2, nil, []string{"*4 $8 pmessage $2 n* $4 news $1 x"}},
+		{2, []string{"punsubscribe", "n*", "m*"}, []string{"*3 $12 punsubscribe $2 n* :0", "*3 $12 punsubscribe $2 m* :0"}},
+		{0, []string{"unsubscribe", "news"}, []string{"*3 $11 unsubscribe $4 news :0"}},
+		{0, []string{"pubsub", "numpat"}, []string{":0"}},
+		{0, []string{"pubsub", "channels"}, []string{"*0"}},
+		{0, []string{"publish", "news"}, []string{"-ERR wrong number of arguments for 'publish' command"}},
+	}
+	db := newTestDB(t)
+	conns := []*subConn{newSubConn(t, db), newSubConn(t, db), newSubConn(t, db)}
+	for _, tt := range tests {
+		c := conns[tt.conn]
+		for i, want := range tt.want {
+			var got string
+			if i == 0 && tt.cmd != nil {
+				got = c.send(t, tt.cmd...)
+			} else {
+				got = c.read(t)
+			}
+			if got != want {
+				t.Fatalf("%d: %v = %q, want %q", tt.conn, tt.cmd, got, want)
+			}
+		}
+	}
+}
+
+//TestPubSubHardLimit disconnects a subscriber that doesn't read its messages
+func TestPubSubHardLimit(t *testing.T) {
+	limit := Conf.PubSubHardLimit
+	Conf.PubSubHardLimit = 4096
+	defer func() { Conf.PubSubHardLimit = limit }()
+	db := newTestDB(t)
+	c, publisher := newSubConn(t, db), newTestConn(db)
+	c.send(t, "subscribe", "slow")
+	payload := strings.Repeat("x", 1024)
+	for i := 0; i < 16; i++ {
+		publisher.do("publish", "slow", payload)
+	}
+	for deadline := time.Now().Add(5 * time.Second); publisher.do("pubsub", "numsub", "slow") != "*2 $4 slow :0"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the subscriber over the hard limit is still subscribed")
+		}
+	}
+}
+
+//keyspace formats the pmessages of __key* for event of key in database db, keyspace first
+func keyspace(db, event, key string) []string {
+	pmessage := func(ch, msg string) string {
+		return "*4 $8 pmessage $6 __key* $" + strconv.Itoa(len(ch)) + " " + ch + " $" + strconv.Itoa(len(msg)) + " " + msg
+	}
+	return []string{pmessage("__keyspace@"+db+"__:"+key, event), pmessage("__keyevent@"+db+"__:"+event, key)}
+}
+
+//TestKeyspaceEvents runs commands with notify-keyspace-events set by CONFIG SET and reads
+//the events a __key* subscriber receives for each
+func TestKeyspaceEvents(t *testing.T) {
+	join := func(events ...[]string) (ret []string) {
+		for _, v := range events {
+			ret = append(ret, v...)
+		}
+		return
+	}
+	tests := []struct {
+		cmd    []string
+		reply  string
+		events []string
+	}{
+		{[]string{"config", "get", "notify-keyspace-events"}, "*2 $22 notify-keyspace-events $0", nil},
+		{[]string{"set", "k", "v"}, "+OK", nil},
+		{[]string{"config", "set", "notify-keyspace-events", "KEA"}, "+OK", nil},
+		{[]string{"config", "get", "notify-keyspace-events"}, "*2 $22 notify-keyspace-events $3 AKE", nil},
+		{[]string{"set", "k", "v"}, "+OK", keyspace("0", "set", "k")},
+		{[]string{"hset", "h", "f", "v"}, "+OK", keyspace("0", "hset", "h")},
+		{[]string{"zadd", "z", "1", "a"}, ":1", keyspace("0", "zadd", "z")},
+		{[]string{"zadd", "z", "2", "b"}, ":1", keyspace("0", "zadd", "z")},
+		{[]string{"zpopmin", "z"}, reply("a", "1"), keyspace("0", "zpopmin", "z")},
+		//popping the last member deletes the key
+		{[]string{"zpopmin", "z"}, reply("b", "2"), join(keyspace("0", "zpopmin", "z"), keyspace("0", "del", "z"))},
+		{[]string{"zpopmin", "z"}, "*0", nil},
+		{[]string{"lpush", "l", "a"}, "+OK", keyspace("0", "lpush", "l")},
+		{[]string{"lpop", "l"}, "$1 a", join(keyspace("0", "lpop", "l"), keyspace("0", "del", "l"))},
+		{[]string{"exists", "l"}, ":0", nil},
+		{[]string{"rename", "k", "k2"}, "+OK", join(keyspace("0", "rename_from", "k"), keyspace("0", "rename_to", "k2"))},
+		{[]string{"del", "k2"}, ":1", keyspace("0", "del", "k2")},
+		{[]string{"del", "k2"}, ":0", nil},
+		{[]string{"select", "1"}, "+OK", nil},
+		{[]string{"set", "k", "v"}, "+OK", keyspace("1", "set", "k")},
+		{[]string{"del", "k"}, ":1", keyspace("1", "del", "k")},
+		//only the key events of sorted sets
+		{[]string{"config", "set", "notify-keyspace-events", "zE"}, "+OK", nil},
+		{[]string{"config", "get", "notify-keyspace-events"}, "*2 $22 notify-keyspace-events $2 zE", nil},
+		{[]string{"set", "k", "v"}, "+OK", nil},
+		{[]string{"zadd", "z", "1", "a"}, ":1", keyspace("1", "zadd", "z")[1:]},
+		{[]string{"config", "set", "notify-keyspace-events", "Kq"}, "-ERR Invalid argument 'Kq' for CONFIG SET 'notify-keyspace-events' - Invalid event class character. Use 'Ag$lshzxeKEtmdn'.", nil},
+		{[]string{"config", "get", "notify-keyspace-events"}, "*2 $22 notify-keyspace-events $2 zE", nil},
+		{[]string{"config", "set", "notify-keyspace-events", ""}, "+OK", nil},
+		{[]string{"zadd", "z", "2", "b"}, ":1", nil},
+	}
+	db := newTestDB(t)
+	db.SetNotify(0, Hub.Publish)
+	sub, c := newSubConn(t, db), newTestConn(db)
+	if got := sub.send(t, "psubscribe", "__key*"); got != "*3 $10 psubscribe $6 __key* :1" {
+		t.Fatalf("psubscribe = %q", got)
+	}
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.reply {
+			t.Fatalf("%v = %q, want %q", tt.cmd, got, tt.reply)
+		}
+		for _, want := range tt.events {
+			if got := sub.read(t); got != want {
+				t.Fatalf("%v: event %q, want %q", tt.cmd, got, want)
+			}
+		}
+	}
+	//nothing else was published before the end mark
+	c.do("publish", "__key_end", "x")
+	if got := sub.read(t); got != "*4 $8 pmessage $6 __key* $9 __key_end $1 x" {
+		t.Fatalf("unexpected event %q", got)
+	}
+}
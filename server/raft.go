@@ -0,0 +1,435 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zealous-w/redcon"
+	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/raft"
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//In raft mode the commands writing data aren't run by the connection. Dispatcher proposes
+//them to the raft log instead, and every member runs the committed entries in log order
+//like EXEC runs a transaction, see raftMachine. The client is answered with the reply of
+//the leader once a majority of the members stored the entry. A follower forwards the
+//proposals to the leader, or answers NOTLEADER with the address of the leader when
+//-raft-forward is off. Reads are served by each member from its own data.
+//
+//Blocking commands never wait in the log, like inside MULTI. WATCH is checked when EXEC is
+//proposed, and the entry carries a digest of the watched keys then, which every member
+//compares with the keys when it applies the entry: EXEC fails if they changed in between,
+//whichever member the other writes came through. Unlike a lone server, a write leaving the
+//keys as they were goes unnoticed. The leader stamps every entry with its clock,
+//the commands of the entry read the time from it, so IDs made by XADD *, relative ttls and
+//expiry come out the same on every member, scripts included
+
+//Raft is the member of the raft group, nil unless raft mode is on
+var Raft *raft.Node
+
+var ErrRaftEntry = errors.New("invalid raft entry")
+
+//StartRaft joins db to the raft group of conf
+func StartRaft(db *command.RedisCommand, conf raft.Config) error {
+	conf.Machine = &raftMachine{db: db}
+	conf.Prepare = stampRaftEntry
+	n, err := raft.Start(conf)
+	if err != nil {
+		return err
+	}
+	Raft = n
+	return nil
+}
+
+//ParseRaftPeers parses the members of -raft-peers: id=addr,... with the raft address as id
+//and the address clients connect to
+func ParseRaftPeers(s string) ([]raft.Member, error) {
+	var ret []raft.Member
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		i := strings.IndexByte(v, '=')
+		if i <= 0 || i == len(v)-1 {
+			return nil, errors.New("raft peer " + v + " isn't id=addr")
+		}
+		ret = append(ret, raft.Member{ID: v[:i], Addr: v[i+1:]})
+	}
+	return ret, nil
+}
+
+//raftProposed reports whether the command goes through the raft log
+func raftProposed(cmd string, args [][]byte) bool {
+	switch cmd {
+	case "eval", "evalsha", "fcall":
+		return true
+	case "function":
+		return len(args) > 1 && functionWrites[strings.ToUpper(string(args[1]))]
+	}
+	return writeCommands[cmd]
+}
+
+//raftPropose runs an entry through the raft log and writes the reply of the leader
+func raftPropose(c *Client, e *raftEntry) error {
+	e.db = c.Session().DB.Index()
+	reply, err := Raft.Apply(e.encode())
+	switch {
+	case err == raft.ErrNotLeader:
+		c.Conn.WriteError("NOTLEADER " + Raft.Leader().Addr)
+	case err != nil:
+		c.Conn.WriteError("TRYAGAIN " + err.Error())
+	default:
+		c.Conn.WriteRaw(reply)
+	}
+	return nil
+}
+
+//raftEntry is the data of a command entry
+type raftEntry struct {
+	clock  int64 //unix ms of the leader, see stampRaftEntry
+	db     int
+	exec   bool
+	cmds   [][][]byte
+	watch  [][]byte //phys-keys WATCHed by the connection proposing EXEC
+	digest []byte   //of the watched keys when EXEC was proposed
+}
+
+//encode builds the entry, its clock is left to stampRaftEntry:
+//
+//	BE unix ms clock | uvarint db | flag | uvarint count | [uvarint argc | [uvarint size | arg]...]...
+//	[uvarint keys | [uvarint size | phys-key]... | uvarint size | digest]
+//
+//flag is 0 for a command, 1 for EXEC and 2 for EXEC followed by the keys it watched
+func (e *raftEntry) encode() []byte {
+	ret := binary.AppendUvarint(make([]byte, 8), uint64(e.db))
+	switch {
+	case e.exec && len(e.watch) > 0:
+		ret = append(ret, 2)
+	case e.exec:
+		ret = append(ret, 1)
+	default:
+		ret = append(ret, 0)
+	}
+	appendBytes := func(v []byte) {
+		ret = binary.AppendUvarint(ret, uint64(len(v)))
+		ret = append(ret, v...)
+	}
+	ret = binary.AppendUvarint(ret, uint64(len(e.cmds)))
+	for _, args := range e.cmds {
+		ret = binary.AppendUvarint(ret, uint64(len(args)))
+		for _, v := range args {
+			appendBytes(v)
+		}
+	}
+	if e.exec && len(e.watch) > 0 {
+		ret = binary.AppendUvarint(ret, uint64(len(e.watch)))
+		for _, v := range e.watch {
+			appendBytes(v)
+		}
+		appendBytes(e.digest)
+	}
+	return ret
+}
+
+//stampRaftEntry sets the clock of an entry to the clock of the leader appending it
+func stampRaftEntry(data []byte) []byte {
+	if len(data) < 8 {
+		return data
+	}
+	ret := append([]byte{}, data...)
+	binary.BigEndian.PutUint64(ret, uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	return ret
+}
+
+func decodeRaftEntry(data []byte) (*raftEntry, error) {
+	if len(data) < 8 {
+		return nil, ErrRaftEntry
+	}
+	e := &raftEntry{clock: int64(binary.BigEndian.Uint64(data))}
+	data = data[8:]
+	var err error
+	next := func() uint64 {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			err = ErrRaftEntry
+			return 0
+		}
+		data = data[n:]
+		return v
+	}
+	nextBytes := func() (ret []byte) {
+		size := next()
+		if err == nil && size > uint64(len(data)) {
+			err = ErrRaftEntry
+		}
+		if err == nil {
+			ret, data = data[:size], data[size:]
+		}
+		return
+	}
+	e.db = int(next())
+	if err != nil || len(data) == 0 || data[0] > 2 {
+		return nil, ErrRaftEntry
+	}
+	flag := data[0]
+	e.exec, data = flag != 0, data[1:]
+	count := next()
+	for i := uint64(0); i < count && err == nil; i++ {
+		argc := next()
+		args := make([][]byte, 0, argc)
+		for j := uint64(0); j < argc && err == nil; j++ {
+			if v := nextBytes(); err == nil {
+				args = append(args, v)
+			}
+		}
+		if len(args) == 0 {
+			err = ErrRaftEntry
+		}
+		e.cmds = append(e.cmds, args)
+	}
+	if flag == 2 {
+		count = next()
+		for i := uint64(0); i < count && err == nil; i++ {
+			if v := nextBytes(); err == nil {
+				e.watch = append(e.watch, v)
+			}
+		}
+		e.digest = nextBytes()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+//raftConn gives the commands of an entry the session they run in
+type raftConn struct {
+	redcon.Conn
+	s *Session
+}
+
+func (r *raftConn) Context() interface{} {
+	return r.s
+}
+
+//raftMachine applies the raft log to the shards, which are its snapshot as well
+type raftMachine struct {
+	db *command.RedisCommand
+}
+
+//Apply runs the commands of an entry against write buffers like EXEC and commits the
+//buffers with the index of the entry
+func (m *raftMachine) Apply(index, term uint64, data []byte) []byte {
+	shardLock.Lock()
+	defer shardLock.Unlock()
+	e, err := decodeRaftEntry(data)
+	var db *command.RedisCommand
+	if err == nil {
+		db, err = m.db.Select(e.db)
+	}
+	if err != nil {
+		//skip the entry, its index is recorded all the same
+		if err := m.db.SetRaftApplied(index, term); err != nil {
+			log.Printf("raft apply failed, index=%d, err=%+v", index, err)
+		}
+		return redcon.AppendError(nil, "ERR "+err.Error())
+	}
+	db = db.WithClock(e.clock)
+	//an entry between the proposal and this one wrote a watched key, EXEC fails
+	if len(e.watch) > 0 && !bytes.Equal(db.Digest(e.watch), e.digest) {
+		if err := m.db.SetRaftApplied(index, term); err != nil {
+			log.Printf("raft apply failed, index=%d, err=%+v", index, err)
+		}
+		return redcon.AppendNull(nil)
+	}
+
+	s := &Session{DB: db.Multi()}
+	reply := &replyConn{Conn: &raftConn{s: s}}
+	client := &Client{Conn: reply, exec: true, cmd: "exec", signals: &pendingSignals{}}
+	for _, v := range e.cmds {
+		cmd := strings.ToLower(string(v[0]))
+		if !e.exec {
+			client.cmd = cmd
+		}
+		f, ok := MsgCmd.cmds[cmd]
+		if !ok {
+			reply.WriteError("ERR unknown command '" + string(v[0]) + "'")
+			continue
+		}
+		if err := f(client, v...); err != nil {
+			reply.WriteError("ERR '" + err.Error() + "'")
+		}
+	}
+	tx := s.DB
+	err = tx.SetRaftApplied(index, term)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("raft apply failed, index=%d, err=%+v", index, err)
+		return redcon.AppendError(nil, "ERR "+err.Error())
+	}
+	client.signals.flush(nil)
+	if e.exec {
+		return append(redcon.AppendArray(nil, len(e.cmds)), reply.buf...)
+	}
+	return reply.buf
+}
+
+func (m *raftMachine) Applied() (index, term uint64) {
+	return m.db.RaftApplied()
+}
+
+//Snapshot sends the rows of every shard, a chunk per batch: uvarint shard | [uvarint size | key | uvarint size | value]...
+func (m *raftMachine) Snapshot(write func(chunk []byte) error) error {
+	for shard := 0; shard < m.db.Shards(); shard++ {
+		var after []byte
+		for {
+			rows := m.db.SnapshotRows(shard, after, command.REPL_SNAPSHOT_BATCH)
+			if len(rows) > 0 {
+				chunk := binary.AppendUvarint(nil, uint64(shard))
+				for _, v := range rows {
+					chunk = binary.AppendUvarint(chunk, uint64(len(v.V0)))
+					chunk = append(chunk, v.V0...)
+					chunk = binary.AppendUvarint(chunk, uint64(len(v.V1)))
+					chunk = append(chunk, v.V1...)
+				}
+				if err := write(chunk); err != nil {
+					return err
+				}
+				after = rows[len(rows)-1].V0
+			}
+			if len(rows) < command.REPL_SNAPSHOT_BATCH {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (m *raftMachine) Restore(seq int, chunk []byte) error {
+	if seq == 0 {
+		shardLock.Lock()
+		err := m.db.ResetReplica()
+		shardLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if chunk == nil {
+		return nil
+	}
+	shard, n := binary.Uvarint(chunk)
+	if n <= 0 || shard >= uint64(m.db.Shards()) {
+		return ErrRaftEntry
+	}
+	chunk = chunk[n:]
+	var rows []*store.Pair
+	for len(chunk) > 0 {
+		var pair [2][]byte
+		for i := range pair {
+			size, n := binary.Uvarint(chunk)
+			if n <= 0 || uint64(len(chunk)-n) < size {
+				return ErrRaftEntry
+			}
+			pair[i], chunk = chunk[n:n+int(size)], chunk[n+int(size):]
+		}
+		rows = append(rows, &store.Pair{V0: pair[0], V1: pair[1]})
+	}
+	unlock := shardLock.LockShards(int(shard))
+	defer unlock()
+	return m.db.ApplySnapshot(int(shard), rows)
+}
+
+func (m *raftMachine) Restored(index, term uint64) error {
+	shardLock.Lock()
+	err := m.db.FinishRaftSnapshot(index, term)
+	shardLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return LoadFunctions(m.db)
+}
+
+//cmdRaft inspects and changes the raft group:
+//
+//	RAFT INFO                  -> state of this member
+//	RAFT NODES                 -> [id addr role] per member
+//	RAFT LEADER                -> [id addr], null when no leader is known
+//	RAFT ADDNODE id addr       -> adds the member serving raft on id and clients on addr
+//	RAFT REMOVENODE id
+func cmdRaft(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	if Raft == nil {
+		c.Conn.WriteError("ERR raft mode is off, start the server with -raft-addr")
+		return nil
+	}
+	var err error
+	switch sub := strings.ToUpper(string(args[1])); {
+	case sub == "INFO" && len(args) == 2:
+		st := Raft.Status()
+		var b strings.Builder
+		b.WriteString("# Raft\r\n")
+		b.WriteString("id:" + st.ID + "\r\n")
+		b.WriteString("state:" + st.State + "\r\n")
+		b.WriteString("term:" + strconv.FormatUint(st.Term, 10) + "\r\n")
+		b.WriteString("leader:" + st.Leader.ID + "\r\n")
+		b.WriteString("leader_addr:" + st.Leader.Addr + "\r\n")
+		b.WriteString("commit_index:" + strconv.FormatUint(st.Commit, 10) + "\r\n")
+		b.WriteString("applied_index:" + strconv.FormatUint(st.Applied, 10) + "\r\n")
+		b.WriteString("last_index:" + strconv.FormatUint(st.LastIndex, 10) + "\r\n")
+		b.WriteString("snapshot_index:" + strconv.FormatUint(st.SnapIndex, 10) + "\r\n")
+		b.WriteString("members:" + strconv.Itoa(len(st.Members)) + "\r\n")
+		c.Conn.WriteBulk([]byte(b.String()))
+		return nil
+	case sub == "NODES" && len(args) == 2:
+		st := Raft.Status()
+		c.Conn.WriteArray(len(st.Members))
+		for _, m := range st.Members {
+			role := "follower"
+			if m.ID == st.Leader.ID {
+				role = "leader"
+			}
+			c.Conn.WriteArray(3)
+			c.Conn.WriteBulk([]byte(m.ID))
+			c.Conn.WriteBulk([]byte(m.Addr))
+			c.Conn.WriteBulk([]byte(role))
+		}
+		return nil
+	case sub == "LEADER" && len(args) == 2:
+		leader := Raft.Leader()
+		if leader.ID == "" {
+			c.Conn.WriteNull()
+			return nil
+		}
+		c.Conn.WriteArray(2)
+		c.Conn.WriteBulk([]byte(leader.ID))
+		c.Conn.WriteBulk([]byte(leader.Addr))
+		return nil
+	case sub == "ADDNODE" && len(args) == 4:
+		err = Raft.AddMember(raft.Member{ID: string(args[2]), Addr: string(args[3])})
+	case sub == "REMOVENODE" && len(args) == 3:
+		err = Raft.RemoveMember(string(args[2]))
+	default:
+		c.Conn.WriteError("ERR unknown subcommand or wrong number of arguments for '" + string(args[1]) + "'. Try RAFT HELP.")
+		return nil
+	}
+	switch {
+	case err == raft.ErrNotLeader:
+		c.Conn.WriteError("NOTLEADER " + Raft.Leader().Addr)
+	case err != nil:
+		c.Conn.WriteError("ERR " + err.Error())
+	default:
+		c.Conn.WriteString("OK")
+	}
+	return nil
+}
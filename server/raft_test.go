@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRaftEntry(t *testing.T) {
+	tests := []*raftEntry{
+		{db: 0, cmds: [][][]byte{{[]byte("set"), []byte("k"), []byte("v")}}},
+		{db: 3, exec: true, cmds: [][][]byte{{[]byte("incr"), []byte("n")}, {[]byte("del"), []byte("")}}},
+		{db: 1, exec: true, cmds: [][][]byte{{[]byte("incr"), []byte("n")}}, watch: [][]byte{[]byte("\x00\x01n"), []byte("\x00\x01w")}, digest: []byte("digest")},
+	}
+	for _, tt := range tests {
+		before := time.Now().UnixNano() / int64(time.Millisecond)
+		e, err := decodeRaftEntry(stampRaftEntry(tt.encode()))
+		if err != nil {
+			t.Fatalf("decodeRaftEntry() = %v", err)
+		}
+		if e.clock < before || e.clock > time.Now().UnixNano()/int64(time.Millisecond) {
+			t.Errorf("clock %d isn't the time of stampRaftEntry", e.clock)
+		}
+		e.clock = 0
+		if !reflect.DeepEqual(e, tt) {
+			t.Errorf("decodeRaftEntry() = %+v, want %+v", e, tt)
+		}
+	}
+	for _, bad := range []string{"", "\x00\x00\x00", "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x01",
+		"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x03\x00", "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x01\x05"} {
+		if _, err := decodeRaftEntry([]byte(bad)); err != ErrRaftEntry {
+			t.Errorf("decodeRaftEntry(%q) = %v", bad, err)
+		}
+	}
+}
+
+//TestRaftApplyWatch writes a watched key between the proposal of EXEC and its entry, every
+//member must fail the EXEC
+func TestRaftApplyWatch(t *testing.T) {
+	src := newTestDB(t)
+	src.Set([]byte("w"), []byte("v"), 0)
+	payload, _ := src.Dump([]byte("w"))
+
+	tests := []struct {
+		name  string
+		write []string //applied after EXEC was proposed
+		reply string
+		v     string
+	}{
+		{"untouched", nil, "*1 +OK", "2"},
+		{"other key", []string{"set", "other", "v"}, "*1 +OK", "2"},
+		{"written", []string{"set", "w", "changed"}, "$-1", "1"},
+		{"deleted", []string{"del", "w"}, "$-1", "1"},
+		{"expired", []string{"restore", "w", "1", string(payload), "replace"}, "$-1", "1"},
+		//the content is compared, a write leaving the key as it was goes unnoticed
+		{"same value", []string{"set", "w", "v"}, "*1 +OK", "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &raftMachine{db: newTestDB(t)}
+			m.db.Set([]byte("w"), []byte("v"), 0)
+			m.db.Set([]byte("n"), []byte("1"), 0)
+
+			c := newTestConn(m.db)
+			c.do("watch", "w")
+			s := c.ctx.(*Session)
+			e := &raftEntry{exec: true, cmds: [][][]byte{{[]byte("set"), []byte("n"), []byte("2")}}}
+			e.watch = s.watch.Keys()
+			e.digest = s.DB.Digest(e.watch)
+			index := uint64(1)
+			if tt.write != nil {
+				args := make([][]byte, 0, len(tt.write))
+				for _, v := range tt.write {
+					args = append(args, []byte(v))
+				}
+				m.Apply(index, 1, stampRaftEntry((&raftEntry{cmds: [][][]byte{args}}).encode()))
+				index++
+				time.Sleep(5 * time.Millisecond)
+			}
+			reply := m.Apply(index, 1, stampRaftEntry(e.encode()))
+			if got := strings.TrimSpace(strings.ReplaceAll(string(reply), "\r\n", " ")); got != tt.reply {
+				t.Fatalf("Apply() = %q, want %q", got, tt.reply)
+			}
+			if got := m.db.Get([]byte("n")); string(got) != tt.v {
+				t.Fatalf("n = %q, want %q", got, tt.v)
+			}
+			if applied, _ := m.Applied(); applied != index {
+				t.Fatalf("Applied() = %d, want %d", applied, index)
+			}
+		})
+	}
+}
+
+//TestRaftApplyClock applies the same entries to two members at different times, the commands
+//reading the time must leave the same rows on both
+func TestRaftApplyClock(t *testing.T) {
+	src := newTestDB(t)
+	src.Set([]byte("d"), []byte("dumped"), 0)
+	payload, _ := src.Dump([]byte("d"))
+
+	const clock = 1700000000123
+	entries := []struct {
+		cmd   []string
+		reply string //of both members
+	}{
+		{[]string{"xadd", "s", "*", "f", "v"}, "$15 1700000000123-0"},
+		{[]string{"xadd", "s", "1700000000123-*", "f", "v"}, "$15 1700000000123-1"},
+		{[]string{"restore", "r", "60000", string(payload)}, "+OK"},
+		{[]string{"eval", "return redis.call('xadd', KEYS[1], '*', 'f', 'v')", "1", "s"}, "$15 1700000000123-2"},
+		{[]string{"eval", "return redis.call('restore', KEYS[1], 1000, ARGV[1])", "1", "r2", string(payload)}, "+OK"},
+	}
+	members := []*raftMachine{{db: newTestDB(t)}, {db: newTestDB(t)}}
+	for i, e := range entries {
+		args := make([][]byte, 0, len(e.cmd))
+		for _, v := range e.cmd {
+			args = append(args, []byte(v))
+		}
+		data := (&raftEntry{cmds: [][][]byte{args}}).encode()
+		binary.BigEndian.PutUint64(data, clock)
+		for j, m := range members {
+			if j > 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+			got := strings.TrimSpace(strings.ReplaceAll(string(m.Apply(uint64(i+1), 1, data)), "\r\n", " "))
+			if got != e.reply {
+				t.Fatalf("member %d: %v = %q, want %q", j, e.cmd, got, e.reply)
+			}
+		}
+	}
+	for shard := 0; shard < members[0].db.Shards(); shard++ {
+		a := members[0].db.SnapshotRows(shard, nil, 1<<20)
+		b := members[1].db.SnapshotRows(shard, nil, 1<<20)
+		if len(a) != len(b) {
+			t.Fatalf("shard %d: %d rows and %d rows", shard, len(a), len(b))
+		}
+		for i := range a {
+			if !bytes.Equal(a[i].V0, b[i].V0) || !bytes.Equal(a[i].V1, b[i].V1) {
+				t.Fatalf("shard %d: row %q = %q and %q = %q", shard, a[i].V0, a[i].V1, b[i].V0, b[i].V1)
+			}
+		}
+	}
+	//the ttl of RESTORE counts from the clock of the entry, rounded down to the second
+	if got := members[0].db.WithClock(clock).ExpireAt([]byte("r")); got != (clock+60000)/1000 {
+		t.Fatalf("ExpireAt() = %d, want %d", got, (clock+60000)/1000)
+	}
+}
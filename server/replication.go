@@ -0,0 +1,592 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zealous-w/redcon"
+	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//Replication streams the change logs of a primary to its replicas, see command/replication.go.
+//A replica sends "PSYNC replid offsets sharding" with the next entry it needs per shard, or "?"
+//and "-1" without data, and its sharding function and shard count, which must be the ones of
+//the primary. The primary answers "+CONTINUE replid" when its logs still hold every entry asked
+//for, otherwise "+FULLRESYNC replid offsets" followed by the rows of all shards. Then the
+//connection carries frames of bulk strings:
+//
+//	ROWS shard key value [key value ...]   rows of a full sync
+//	SNAPSHOT-END                           the full sync is complete
+//	ENTRY shard seq entry                  an entry of the change log of shard
+//	PING                                   sent every REPL_PING_PERIOD
+const (
+	REPL_PING_PERIOD = time.Second
+	REPL_TIMEOUT     = 60 * time.Second //a link without any frame for this long is dropped
+	REPL_READ_COUNT  = 128              //entries read from a change log at once
+)
+
+var ErrReplProtocol = errors.New("unexpected replication frame")
+
+//replication is the role of the server, a primary unless primary is set
+type replication struct {
+	lock     sync.Mutex
+	id       string //replication id PSYNC is served with, new at every start
+	primary  string //host:port replicated from
+	state    string //connect, sync or connected
+	offsets  []uint64
+	stop     chan struct{} //closed to end the link to primary
+	replicas map[*replicaLink]bool
+}
+
+var Repl = newReplication()
+
+func newReplication() *replication {
+	id := make([]byte, 20)
+	_, _ = rand.Read(id)
+	return &replication{id: hex.EncodeToString(id), replicas: make(map[*replicaLink]bool)}
+}
+
+//IsReplica reports whether the server follows a primary and refuses writes
+func (r *replication) IsReplica() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.primary != ""
+}
+
+//ReplicaOf starts following the primary at addr, an empty addr makes the server a primary again
+func (r *replication) ReplicaOf(db *command.RedisCommand, addr string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	r.primary, r.state, r.offsets = addr, "connect", nil
+	if addr == "" {
+		return
+	}
+	r.stop = make(chan struct{})
+	go r.link(db, addr, r.stop)
+}
+
+func (r *replication) setState(stop chan struct{}, state string, offsets []uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stop == stop {
+		r.state, r.offsets = state, offsets
+	}
+}
+
+func (r *replication) link(db *command.RedisCommand, addr string, stop chan struct{}) {
+	for {
+		err := r.sync(db, addr, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Printf("replication from %s failed, err=%+v", addr, err)
+		r.setState(stop, "connect", nil)
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+//sync runs one connection to the primary until it fails or stop is closed
+func (r *replication) sync(db *command.RedisCommand, addr string, stop chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", addr, REPL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		_ = conn.Close()
+	}()
+
+	replid, offsets := db.ReplicationOffsets()
+	req := [][]byte{[]byte("PSYNC"), []byte("?"), []byte("-1"), []byte(shardingSpec(db))}
+	if replid != "" {
+		req[1], req[2] = []byte(replid), []byte(formatOffsets(offsets))
+	}
+	buf := redcon.AppendArray(nil, len(req))
+	for _, v := range req {
+		buf = redcon.AppendBulk(buf, v)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	rd := bufio.NewReader(conn)
+	frame, err := readReplFrame(conn, rd)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(frame[0]))
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		replid = fields[1]
+		if offsets, err = parseOffsets(fields[2], db.Shards()); err != nil {
+			return err
+		}
+		r.setState(stop, "sync", nil)
+		if err := r.fullSync(db, conn, rd, replid, offsets); err != nil {
+			return err
+		}
+	case len(fields) == 2 && fields[0] == "CONTINUE" && fields[1] == replid:
+	default:
+		return fmt.Errorf("primary refused PSYNC: %s", frame[0])
+	}
+	r.setState(stop, "connected", append([]uint64{}, offsets...))
+
+	for {
+		frame, err := readReplFrame(conn, rd)
+		if err != nil {
+			return err
+		}
+		switch {
+		case string(frame[0]) == "PING" && len(frame) == 1:
+		case string(frame[0]) == "ENTRY" && len(frame) == 4:
+			shard, err := strconv.Atoi(string(frame[1]))
+			if err != nil || shard < 0 || shard >= len(offsets) {
+				return ErrReplProtocol
+			}
+			seq, err := strconv.ParseUint(string(frame[2]), 10, 64)
+			if err != nil {
+				return ErrReplProtocol
+			}
+			unlock := shardLock.LockShards(shard)
+			keys, functions, err := db.ApplyChangeEntry(replid, shard, seq, frame[3])
+			unlock()
+			if err != nil {
+				return err
+			}
+			for index, v := range keys {
+				for _, k := range v {
+					Blocking.Signal(index, k)
+				}
+			}
+			if functions {
+				if err := LoadFunctions(db); err != nil {
+					log.Printf("reload replicated functions failed, err=%+v", err)
+				}
+			}
+			r.lock.Lock()
+			if r.stop == stop && shard < len(r.offsets) {
+				r.offsets[shard] = seq + 1
+			}
+			r.lock.Unlock()
+		default:
+			return ErrReplProtocol
+		}
+	}
+}
+
+func (r *replication) fullSync(db *command.RedisCommand, conn net.Conn, rd *bufio.Reader, replid string, offsets []uint64) error {
+	shardLock.Lock()
+	err := db.ResetReplica()
+	shardLock.Unlock()
+	if err != nil {
+		return err
+	}
+	for {
+		frame, err := readReplFrame(conn, rd)
+		if err != nil {
+			return err
+		}
+		switch {
+		case string(frame[0]) == "PING" && len(frame) == 1:
+		case string(frame[0]) == "ROWS" && len(frame)%2 == 0:
+			shard, err := strconv.Atoi(string(frame[1]))
+			if err != nil || shard < 0 || shard >= db.Shards() {
+				return ErrReplProtocol
+			}
+			rows := make([]*store.Pair, 0, len(frame)/2-1)
+			for i := 2; i < len(frame); i += 2 {
+				rows = append(rows, &store.Pair{V0: frame[i], V1: frame[i+1]})
+			}
+			unlock := shardLock.LockShards(shard)
+			err = db.ApplySnapshot(shard, rows)
+			unlock()
+			if err != nil {
+				return err
+			}
+		case string(frame[0]) == "SNAPSHOT-END" && len(frame) == 1:
+			shardLock.Lock()
+			err := db.FinishSnapshot(replid, offsets)
+			shardLock.Unlock()
+			if err != nil {
+				return err
+			}
+			return LoadFunctions(db)
+		default:
+			return ErrReplProtocol
+		}
+	}
+}
+
+//readReplFrame reads a status line or an array of bulk strings, an error reply fails
+func readReplFrame(conn net.Conn, rd *bufio.Reader) ([][]byte, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(REPL_TIMEOUT))
+	return readFrame(rd)
+}
+
+//replyError is an error reply read by readFrame
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+//readFrame reads a reply like readReplFrame without a deadline
+func readFrame(rd *bufio.Reader) ([][]byte, error) {
+	line, err := readReplLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return [][]byte{line[1:]}, nil
+	case '-':
+		return nil, replyError(line[1:])
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 1 {
+			return nil, ErrReplProtocol
+		}
+		ret := make([][]byte, 0, n)
+		for i := 0; i < n; i++ {
+			line, err := readReplLine(rd)
+			if err != nil {
+				return nil, err
+			}
+			size, err := strconv.Atoi(string(line[1:]))
+			if line[0] != '$' || err != nil || size < 0 {
+				return nil, ErrReplProtocol
+			}
+			bulk := make([]byte, size+2)
+			if _, err := io.ReadFull(rd, bulk); err != nil {
+				return nil, err
+			}
+			ret = append(ret, bulk[:size])
+		}
+		return ret, nil
+	}
+	return nil, ErrReplProtocol
+}
+
+func readReplLine(rd *bufio.Reader) ([]byte, error) {
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrReplProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+func formatOffsets(offsets []uint64) string {
+	ret := make([]string, 0, len(offsets))
+	for _, v := range offsets {
+		ret = append(ret, strconv.FormatUint(v, 10))
+	}
+	return strings.Join(ret, ",")
+}
+
+func parseOffsets(s string, shards int) ([]uint64, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != shards {
+		return nil, ErrReplProtocol
+	}
+	ret := make([]uint64, 0, shards)
+	for _, v := range fields {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, ErrReplProtocol
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+//replicaLink is the connection of a replica on the primary. Every shard is streamed by a
+//goroutine of its own, frames are written whole under the lock
+type replicaLink struct {
+	conn redcon.DetachedConn
+	addr string
+	lock sync.Mutex
+	sent []uint64 //next entry sent per shard
+	quit chan struct{}
+	once sync.Once
+}
+
+func (l *replicaLink) write(args ...[]byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.conn.WriteArray(len(args))
+	for _, v := range args {
+		l.conn.WriteBulk(v)
+	}
+	return l.conn.Flush()
+}
+
+func (l *replicaLink) close() {
+	l.once.Do(func() {
+		close(l.quit)
+		_ = l.conn.Close()
+		Repl.lock.Lock()
+		delete(Repl.replicas, l)
+		Repl.lock.Unlock()
+	})
+}
+
+func (l *replicaLink) serve(db *command.RedisCommand, full bool, offsets []uint64) {
+	go func() {
+		//replicas send nothing, reading only notices the connection going away
+		for {
+			if _, err := l.conn.ReadCommand(); err != nil {
+				l.close()
+				return
+			}
+		}
+	}()
+	l.lock.Lock()
+	if full {
+		l.conn.WriteString("FULLRESYNC " + Repl.id + " " + formatOffsets(offsets))
+	} else {
+		l.conn.WriteString("CONTINUE " + Repl.id)
+	}
+	err := l.conn.Flush()
+	l.lock.Unlock()
+	if err == nil && full {
+		err = l.snapshot(db)
+	}
+	if err != nil {
+		log.Printf("replica %s failed, err=%+v", l.addr, err)
+		l.close()
+		return
+	}
+	l.sent = append([]uint64{}, offsets...)
+	for i := range offsets {
+		go l.tail(db, i, offsets[i])
+	}
+	ticker := time.NewTicker(REPL_PING_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.quit:
+			return
+		case <-ticker.C:
+			if err := l.write([]byte("PING")); err != nil {
+				l.close()
+				return
+			}
+		}
+	}
+}
+
+func (l *replicaLink) snapshot(db *command.RedisCommand) error {
+	for shard := 0; shard < db.Shards(); shard++ {
+		var after []byte
+		for {
+			rows := db.SnapshotRows(shard, after, command.REPL_SNAPSHOT_BATCH)
+			if len(rows) > 0 {
+				frame := make([][]byte, 0, 2+2*len(rows))
+				frame = append(frame, []byte("ROWS"), []byte(strconv.Itoa(shard)))
+				for _, v := range rows {
+					frame = append(frame, v.V0, v.V1)
+				}
+				if err := l.write(frame...); err != nil {
+					return err
+				}
+				after = rows[len(rows)-1].V0
+			}
+			if len(rows) < command.REPL_SNAPSHOT_BATCH {
+				break
+			}
+		}
+	}
+	return l.write([]byte("SNAPSHOT-END"))
+}
+
+func (l *replicaLink) tail(db *command.RedisCommand, shard int, seq uint64) {
+	for {
+		entries, wait, err := db.ReadChangeLog(shard, seq, REPL_READ_COUNT)
+		if err != nil {
+			log.Printf("replica %s failed, shard=%d, err=%+v", l.addr, shard, err)
+			l.close()
+			return
+		}
+		for _, v := range entries {
+			if err := l.write([]byte("ENTRY"), []byte(strconv.Itoa(shard)), []byte(strconv.FormatUint(seq, 10)), v); err != nil {
+				l.close()
+				return
+			}
+			seq++
+		}
+		l.lock.Lock()
+		l.sent[shard] = seq
+		l.lock.Unlock()
+		if len(entries) == 0 {
+			select {
+			case <-wait:
+			case <-l.quit:
+				return
+			}
+		}
+	}
+}
+
+func cmdPSync(c *Client, args ...[]byte) error {
+	if len(args) != 3 && len(args) != 4 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	if _, ok := c.Conn.(*subscriber); ok || c.exec {
+		c.Conn.WriteError("ERR PSYNC is not allowed in this context")
+		return nil
+	}
+	db := c.DB()
+	if len(args) == 4 && string(args[3]) != shardingSpec(db) {
+		//shards are copied as they are, both sides must put a key in the same one
+		c.Conn.WriteError("ERR the replica shards keys with " + string(args[3]) + ", the primary with " + shardingSpec(db))
+		return nil
+	}
+	full := string(args[1]) != Repl.id
+	offsets, err := parseOffsets(string(args[2]), db.Shards())
+	if err != nil {
+		full = true
+	}
+	next := make([]uint64, db.Shards())
+	for i := range next {
+		var first uint64
+		first, next[i], err = db.ChangeLogRange(i)
+		if err != nil {
+			c.Conn.WriteError("ERR replication streams the change log, start the primary with -cdc")
+			return nil
+		}
+		if !full && (offsets[i] < first || offsets[i] > next[i]) {
+			full = true
+		}
+	}
+	if full {
+		//rows written while the snapshot is taken are replayed from here as well
+		offsets = next
+	}
+	l := &replicaLink{conn: c.Conn.Detach(), addr: c.Session().RemoteAddr, quit: make(chan struct{})}
+	Repl.lock.Lock()
+	Repl.replicas[l] = true
+	Repl.lock.Unlock()
+	go l.serve(db, full, offsets)
+	return nil
+}
+
+func cmdReplicaOf(c *Client, args ...[]byte) error {
+	if len(args) != 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	if strings.ToUpper(string(args[1])) == "NO" && strings.ToUpper(string(args[2])) == "ONE" {
+		Repl.ReplicaOf(nil, "")
+		c.Conn.WriteString("OK")
+		return nil
+	}
+	port, err := strconv.Atoi(string(args[2]))
+	if err != nil || port <= 0 || port > 0xFFFF {
+		c.Conn.WriteError("ERR Invalid master port")
+		return nil
+	}
+	Repl.ReplicaOf(c.DB(), net.JoinHostPort(string(args[1]), strconv.Itoa(port)))
+	c.Conn.WriteString("OK")
+	return nil
+}
+
+//cmdRole replies like redis, offsets being the sum of the next entries of all shards
+func cmdRole(c *Client, args ...[]byte) error {
+	if len(args) != 1 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	Repl.lock.Lock()
+	defer Repl.lock.Unlock()
+	if Repl.primary != "" {
+		host, port, _ := net.SplitHostPort(Repl.primary)
+		n, _ := strconv.Atoi(port)
+		c.Conn.WriteArray(5)
+		c.Conn.WriteBulk([]byte("slave"))
+		c.Conn.WriteBulk([]byte(host))
+		c.Conn.WriteInt(n)
+		c.Conn.WriteBulk([]byte(Repl.state))
+		c.Conn.WriteInt(int(sumOffsets(Repl.offsets)))
+		return nil
+	}
+	db := c.DB()
+	var offset uint64
+	for i := 0; i < db.Shards(); i++ {
+		if _, next, err := db.ChangeLogRange(i); err == nil {
+			offset += next
+		}
+	}
+	c.Conn.WriteArray(3)
+	c.Conn.WriteBulk([]byte("master"))
+	c.Conn.WriteInt(int(offset))
+	c.Conn.WriteArray(len(Repl.replicas))
+	for l := range Repl.replicas {
+		host, port, _ := net.SplitHostPort(l.addr)
+		l.lock.Lock()
+		sent := sumOffsets(l.sent)
+		l.lock.Unlock()
+		c.Conn.WriteArray(3)
+		c.Conn.WriteBulk([]byte(host))
+		c.Conn.WriteBulk([]byte(port))
+		c.Conn.WriteBulk([]byte(strconv.FormatUint(sent, 10)))
+	}
+	return nil
+}
+
+func sumOffsets(offsets []uint64) (ret uint64) {
+	for _, v := range offsets {
+		ret += v
+	}
+	return
+}
+
+//writeCommands lists the commands a replica refuses, they change data
+var writeCommands = map[string]bool{
+	"set": true, "del": true, "unlink": true, "hset": true, "hdel": true, "sadd": true, "srem": true,
+	"lpush": true, "lpop": true, "rpush": true, "rpop": true, "ltrim": true,
+	"zadd": true, "zrem": true, "zincrby": true, "zremrangebyscore": true, "zremrangebyrank": true,
+	"zremrangebylex": true, "zpopmin": true, "zpopmax": true, "bzpopmin": true, "bzpopmax": true,
+	"zunionstore": true, "zinterstore": true, "zdiffstore": true, "geoadd": true, "geosearchstore": true,
+	"xadd": true, "xtrim": true, "xdel": true, "xgroup": true, "xreadgroup": true, "xack": true,
+	"xclaim": true, "xautoclaim": true, "rename": true, "renamenx": true, "copy": true, "move": true,
+	"swapdb": true, "flushdb": true, "flushall": true, "restore": true,
+}
+
+//functionWrites lists the FUNCTION subcommands changing the libraries
+var functionWrites = map[string]bool{"LOAD": true, "DELETE": true, "FLUSH": true, "RESTORE": true}
+
+const errReadOnlyReplica = "READONLY You can't write against a read only replica."
+
+//shardingSpec describes how db maps keys to shards, as function/count
+func shardingSpec(db *command.RedisCommand) string {
+	return db.Sharding() + "/" + strconv.Itoa(db.Shards())
+}
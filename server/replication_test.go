@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Zealous-w/redcon"
+	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//detachedConn is the connection of a replica once PSYNC detached it
+type detachedConn struct {
+	redcon.DetachedConn
+	p    *testPrimary
+	conn net.Conn
+	rd   *bufio.Reader
+	buf  []byte
+}
+
+func (d *detachedConn) WriteArray(count int)  { d.buf = redcon.AppendArray(d.buf, count) }
+func (d *detachedConn) WriteBulk(bulk []byte) { d.buf = redcon.AppendBulk(d.buf, bulk) }
+func (d *detachedConn) Close() error          { return d.conn.Close() }
+
+func (d *detachedConn) WriteString(str string) {
+	d.p.record(str)
+	d.buf = redcon.AppendString(d.buf, str)
+}
+
+func (d *detachedConn) Flush() error {
+	_, err := d.conn.Write(d.buf)
+	d.buf = nil
+	return err
+}
+
+func (d *detachedConn) ReadCommand() (redcon.Command, error) {
+	args, err := readFrame(d.rd)
+	return redcon.Command{Args: args}, err
+}
+
+//psyncConn runs PSYNC for an accepted connection
+type psyncConn struct {
+	testConn
+	detached *detachedConn
+}
+
+func (c *psyncConn) Detach() redcon.DetachedConn {
+	return c.detached
+}
+
+//testPrimary serves PSYNC of db on a loopback port
+type testPrimary struct {
+	db      *command.RedisCommand
+	addr    string
+	lock    sync.Mutex
+	replies []string //first reply of every PSYNC served
+}
+
+func newTestPrimary(t *testing.T, maxEntries int) *testPrimary {
+	p := &testPrimary{db: newTestDB(t)}
+	p.db.EnableChangeLog(maxEntries, 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.addr = ln.Addr().String()
+	t.Cleanup(func() {
+		_ = ln.Close()
+		Repl.lock.Lock()
+		links := make([]*replicaLink, 0, len(Repl.replicas))
+		for l := range Repl.replicas {
+			links = append(links, l)
+		}
+		Repl.lock.Unlock()
+		for _, l := range links {
+			l.close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			rd := bufio.NewReader(conn)
+			args, err := readFrame(rd)
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			c := &psyncConn{detached: &detachedConn{p: p, conn: conn, rd: rd}}
+			c.ctx = NewSession(c, p.db)
+			_ = MsgCmd.Dispatcher(strings.ToLower(string(args[0])), &Client{Conn: c}, args...)
+			if c.buf != nil {
+				//refused before detaching
+				_, _ = conn.Write(c.buf)
+				_ = conn.Close()
+			}
+		}
+	}()
+	return p
+}
+
+func (p *testPrimary) record(reply string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.replies = append(p.replies, strings.Fields(reply)[0])
+}
+
+func (p *testPrimary) lastReply() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.replies) == 0 {
+		return ""
+	}
+	return p.replies[len(p.replies)-1]
+}
+
+func (p *testPrimary) do(args ...string) {
+	newTestConn(p.db).do(args...)
+}
+
+//waitReplica waits until r is connected and db has the value want for every key, "" for none
+func waitReplica(t *testing.T, r *replication, db *command.RedisCommand, want map[string]string) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		r.lock.Lock()
+		state := r.state
+		r.lock.Unlock()
+		done := state == "connected"
+		for k, v := range want {
+			done = done && string(db.Get([]byte(k))) == v
+		}
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replica state %s, want %v", state, want)
+		}
+	}
+}
+
+func TestPSyncFull(t *testing.T) {
+	p := newTestPrimary(t, 0)
+	p.do("set", "a", "1")
+	p.do("hset", "h", "f", "v")
+	p.do("set", "gone", "v")
+	p.do("del", "gone")
+
+	db := newTestDB(t)
+	db.Set([]byte("stale"), []byte("v"), 0)
+	r := newReplication()
+	r.ReplicaOf(db, p.addr)
+	defer r.ReplicaOf(nil, "")
+	waitReplica(t, r, db, map[string]string{"a": "1", "gone": "", "stale": ""})
+	if got := p.lastReply(); got != "FULLRESYNC" {
+		t.Fatalf("PSYNC = %s, want FULLRESYNC", got)
+	}
+	if got := newTestConn(db).do("hget", "h", "f"); got != "+v" {
+		t.Fatalf("HGET = %q", got)
+	}
+
+	//writes after the snapshot are streamed
+	p.do("set", "a", "2")
+	p.do("set", "b", "1")
+	waitReplica(t, r, db, map[string]string{"a": "2", "b": "1"})
+}
+
+func TestPSyncPartial(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		restart    bool //the primary starts with a new replication id meanwhile
+		trim       bool //the primary trims the entries the replica misses
+		want       string
+	}{
+		{"continue", 0, false, false, "CONTINUE"},
+		{"new replication id", 0, true, false, "FULLRESYNC"},
+		{"log trimmed", 1, false, true, "FULLRESYNC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPrimary(t, tt.maxEntries)
+			p.do("set", "a", "1")
+			db := newTestDB(t)
+			r := newReplication()
+			r.ReplicaOf(db, p.addr)
+			waitReplica(t, r, db, map[string]string{"a": "1"})
+			r.ReplicaOf(nil, "")
+
+			//written while the replica is away
+			want := map[string]string{"a": ""}
+			p.do("del", "a")
+			for i := 0; i < 64; i++ {
+				k := fmt.Sprintf("k%d", i)
+				p.do("set", k, "v")
+				want[k] = "v"
+			}
+			if tt.restart {
+				id := Repl.id
+				Repl.id = newReplication().id
+				defer func() { Repl.id = id }()
+			}
+			if tt.trim {
+				_, offsets := db.ReplicationOffsets()
+				for deadline := time.Now().Add(5 * time.Second); !trimmed(p.db, offsets); time.Sleep(50 * time.Millisecond) {
+					if time.Now().After(deadline) {
+						t.Fatal("the change log wasn't trimmed")
+					}
+				}
+			}
+
+			r.ReplicaOf(db, p.addr)
+			defer r.ReplicaOf(nil, "")
+			waitReplica(t, r, db, want)
+			if got := p.lastReply(); got != tt.want {
+				t.Fatalf("PSYNC = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+//trimmed reports whether db dropped an entry after one of offsets from its change logs
+func trimmed(db *command.RedisCommand, offsets []uint64) bool {
+	for i, v := range offsets {
+		if first, _, err := db.ChangeLogRange(i); err == nil && first > v {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPSyncRefused(t *testing.T) {
+	p := newTestPrimary(t, 0)
+	stores, closeDB := store.NewDBStore("leveldb", t.TempDir(), 2)
+	t.Cleanup(closeDB)
+	db := command.NewRedisCommand(stores, command.DATABASES_DEFAULT, "")
+	r := newReplication()
+	err := r.sync(db, p.addr, make(chan struct{}))
+	if err == nil || !strings.Contains(err.Error(), "the replica shards keys with") {
+		t.Fatalf("sync() = %v", err)
+	}
+}
@@ -0,0 +1,469 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Zealous-w/redcon"
+	"github.com/Zealous-w/tacodb/command"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+//luaScript is a script compiled once and run by EVAL and EVALSHA, the compiled function
+//is shared by the Lua states of all runs
+type luaScript struct {
+	sha   string
+	proto *lua.FunctionProto
+}
+
+//scriptCache holds the scripts of EVAL and SCRIPT LOAD by the SHA1 of their body
+type scriptCache struct {
+	lock    sync.RWMutex
+	scripts map[string]*luaScript
+}
+
+var Scripts = newScriptCache()
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{scripts: make(map[string]*luaScript)}
+}
+
+//scriptDenied lists the commands a script must not call
+var scriptDenied = map[string]bool{
+	"multi":    true,
+	"exec":     true,
+	"discard":  true,
+	"watch":    true,
+	"unwatch":  true,
+	"eval":     true,
+	"evalsha":  true,
+	"script":   true,
+	"fcall":    true,
+	"fcall_ro": true,
+	"function": true,
+}
+
+func sha1Hex(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//load compiles body unless it is cached already
+func (s *scriptCache) load(body []byte) (*luaScript, error) {
+	sha := sha1Hex(body)
+	if script := s.get(sha); script != nil {
+		return script, nil
+	}
+	chunk, err := parse.Parse(bytes.NewReader(body), "user_script")
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, "user_script")
+	if err != nil {
+		return nil, err
+	}
+	script := &luaScript{sha: sha, proto: proto}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.scripts[sha] = script
+	return script, nil
+}
+
+func (s *scriptCache) get(sha string) *luaScript {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.scripts[strings.ToLower(sha)]
+}
+
+func (s *scriptCache) flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.scripts = make(map[string]*luaScript)
+}
+
+func cmdEval(c *Client, args ...[]byte) error {
+	if len(args) < 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	script, err := Scripts.load(args[1])
+	if err != nil {
+		c.Conn.WriteError("ERR Error compiling script (new function): " + strings.TrimSpace(err.Error()))
+		return nil
+	}
+	runScript(c, script, args[2:]...)
+	return nil
+}
+
+func cmdEvalSha(c *Client, args ...[]byte) error {
+	if len(args) < 3 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	script := Scripts.get(string(args[1]))
+	if script == nil {
+		c.Conn.WriteError("NOSCRIPT No matching script. Please use EVAL.")
+		return nil
+	}
+	runScript(c, script, args[2:]...)
+	return nil
+}
+
+func cmdScript(c *Client, args ...[]byte) error {
+	if len(args) < 2 {
+		c.Conn.WriteError("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+		return nil
+	}
+	sub := strings.ToUpper(string(args[1]))
+	switch {
+	case sub == "LOAD" && len(args) == 3:
+		script, err := Scripts.load(args[2])
+		if err != nil {
+			c.Conn.WriteError("ERR Error compiling script (new function): " + strings.TrimSpace(err.Error()))
+			return nil
+		}
+		c.Conn.WriteBulk([]byte(script.sha))
+	case sub == "EXISTS" && len(args) > 2:
+		c.Conn.WriteArray(len(args) - 2)
+		for _, v := range args[2:] {
+			if Scripts.get(string(v)) != nil {
+				c.Conn.WriteInt(1)
+			} else {
+				c.Conn.WriteInt(0)
+			}
+		}
+	case sub == "KILL" && len(args) == 2:
+		killScripts(c, "SCRIPT")
+	case sub == "FLUSH" && len(args) <= 3:
+		if len(args) == 3 {
+			mode := strings.ToUpper(string(args[2]))
+			if mode != "ASYNC" && mode != "SYNC" {
+				c.Conn.WriteError("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+				return nil
+			}
+		}
+		Scripts.flush()
+		c.Conn.WriteString("OK")
+	default:
+		c.Conn.WriteError("ERR unknown subcommand or wrong number of arguments for '" + string(args[1]) + "'. Try SCRIPT HELP.")
+	}
+	return nil
+}
+
+func runScript(c *Client, script *luaScript, args ...[]byte) {
+	runLua(c, "f_"+script.sha, "SCRIPT", false, args, func(L *lua.LState, keys, argv *lua.LTable) error {
+		L.SetGlobal("KEYS", keys)
+		L.SetGlobal("ARGV", argv)
+		L.Push(L.NewFunctionFromProto(script.proto))
+		return L.PCall(0, 1, nil)
+	})
+}
+
+//runLua runs a script or function with args holding numkeys, the keys and the arguments. run is
+//given a fresh Lua state, with the redis table set up, and leaves the value to reply on its stack.
+//Writes are buffered like the ones of a MULTI transaction and committed once run returns, while
+//the shards of the KEYS are locked. Keys touched without declaring them are only safe from other
+//scripts when none is declared, in which case every shard is locked. A read only run refuses
+//writes and commits nothing. kind is the command killing the run, SCRIPT or FUNCTION
+func runLua(c *Client, name, kind string, readOnly bool, args [][]byte, run func(L *lua.LState, keys, argv *lua.LTable) error) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		c.Conn.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+	if numKeys < 0 {
+		c.Conn.WriteError("ERR Number of keys can't be negative")
+		return
+	}
+	if numKeys > len(args)-1 {
+		c.Conn.WriteError("ERR Number of keys can't be greater than number of args")
+		return
+	}
+	keys, argv := args[1:1+numKeys], args[1+numKeys:]
+	//a replica only changes by replication, its scripts run read only
+	readOnly = readOnly || Repl.IsReplica()
+
+	s := c.Session()
+	selected := s.DB
+	//inside EXEC the transaction already holds every lock and buffers the writes
+	if !c.exec {
+		if len(keys) == 0 {
+			shardLock.Lock()
+			defer shardLock.Unlock()
+		} else {
+			shards := make([]int, 0, len(keys))
+			for _, k := range keys {
+				shards = append(shards, selected.Shard(k))
+			}
+			defer shardLock.LockShards(shards...)()
+		}
+	}
+	if readOnly {
+		s.DB = selected.ReadOnly()
+	} else if !c.exec {
+		s.DB = c.DB().Multi()
+	}
+
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	L.SetContext(ctx)
+	r := Running.add(kind, cancel)
+	defer Running.remove(r)
+	reply := &replyConn{Conn: c.Conn}
+	client := &Client{Conn: reply, exec: true, signals: &pendingSignals{}}
+	redis := openScriptLibs(L)
+	L.SetField(redis, "call", L.NewFunction(func(L *lua.LState) int {
+		return scriptCall(L, r, client, reply, true)
+	}))
+	L.SetField(redis, "pcall", L.NewFunction(func(L *lua.LState) int {
+		return scriptCall(L, r, client, reply, false)
+	}))
+	err = run(L, luaArgs(L, keys), luaArgs(L, argv))
+
+	//like redis, the writes made before an error are kept. SELECT in a script doesn't change
+	//the database of the connection
+	tx := s.DB
+	s.DB = selected
+	if !readOnly && !c.exec {
+		if err := tx.Commit(); err != nil {
+			c.Conn.WriteError("ERR " + err.Error())
+			return
+		}
+	}
+	//the other shards are not locked, a client woken before the commit would miss the writes
+	client.signals.flush(c.signals)
+	if err != nil && r.isKilled() {
+		c.Conn.WriteError("ERR Script killed by user with " + kind + " KILL...")
+		return
+	}
+	if err != nil {
+		msg := err.Error()
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			if e := luaError(apiErr.Object); e != "" {
+				c.Conn.WriteError(e)
+				return
+			}
+			msg = apiErr.Object.String()
+		}
+		c.Conn.WriteError("ERR Error running script (call to " + name + "): " + msg)
+		return
+	}
+	writeLuaValue(c.Conn, L.Get(-1))
+}
+
+//openScriptLibs opens the Lua libraries redis offers to scripts and returns the redis table,
+//which gets call and pcall from runLua
+func openScriptLibs(L *lua.LState) *lua.LTable {
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	//scripts must not reach the file system
+	for _, name := range []string{"dofile", "loadfile", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	redis := L.NewTable()
+	L.SetField(redis, "sha1hex", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(sha1Hex([]byte(L.CheckString(1)))))
+		return 1
+	}))
+	L.SetField(redis, "error_reply", L.NewFunction(func(L *lua.LState) int {
+		L.Push(luaErrorTable(L, L.CheckString(1)))
+		return 1
+	}))
+	L.SetField(redis, "status_reply", L.NewFunction(func(L *lua.LState) int {
+		t := L.NewTable()
+		L.SetField(t, "ok", lua.LString(L.CheckString(1)))
+		L.Push(t)
+		return 1
+	}))
+	L.SetField(redis, "log", L.NewFunction(func(L *lua.LState) int {
+		parts := make([]string, 0, L.GetTop())
+		for i := 2; i <= L.GetTop(); i++ {
+			parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+		}
+		log.Printf("script: %s", strings.Join(parts, " "))
+		return 0
+	}))
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		L.SetField(redis, level, lua.LNumber(i))
+	}
+	L.SetGlobal("redis", redis)
+	return redis
+}
+
+func luaArgs(L *lua.LState, args [][]byte) *lua.LTable {
+	t := L.CreateTable(len(args), 0)
+	for _, v := range args {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+func luaErrorTable(L *lua.LState, msg string) *lua.LTable {
+	t := L.NewTable()
+	L.SetField(t, "err", lua.LString(msg))
+	return t
+}
+
+//luaError returns the message of an error reply table, "" for other values
+func luaError(v lua.LValue) string {
+	if t, ok := v.(*lua.LTable); ok {
+		if e, ok := t.RawGetString("err").(lua.LString); ok {
+			return string(e)
+		}
+	}
+	return ""
+}
+
+//scriptCall runs the command given by the arguments of redis.call or redis.pcall for the run r.
+//An error reply is raised as a Lua error by redis.call and returned by redis.pcall
+func scriptCall(L *lua.LState, r *scriptRun, client *Client, reply *replyConn, raise bool) int {
+	fail := func(msg string) int {
+		t := luaErrorTable(L, msg)
+		if raise {
+			L.Error(t, 1)
+		}
+		L.Push(t)
+		return 1
+	}
+	if L.GetTop() == 0 {
+		return fail("ERR Please specify at least one argument for this redis lib call")
+	}
+	args := make([][]byte, 0, L.GetTop())
+	for i := 1; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			args = append(args, []byte(v))
+		case lua.LNumber:
+			f := float64(v)
+			if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+				args = append(args, []byte(strconv.FormatInt(int64(f), 10)))
+			} else {
+				args = append(args, []byte(strconv.FormatFloat(f, 'g', 17, 64)))
+			}
+		default:
+			return fail("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	cmd := strings.ToLower(string(args[0]))
+	f, ok := MsgCmd.cmds[cmd]
+	if !ok {
+		return fail("ERR Unknown Redis command called from script")
+	}
+	if scriptDenied[cmd] {
+		return fail("ERR This Redis command is not allowed from script")
+	}
+	if writeCommands[cmd] && !r.write() {
+		L.RaiseError("script killed")
+	}
+	reply.buf = reply.buf[:0]
+	if err := f(client, args...); err != nil {
+		reply.WriteError("ERR '" + err.Error() + "'")
+	}
+	if client.Session().DB.WriteDenied() {
+		return fail("ERR " + command.ErrReadOnly.Error())
+	}
+	ret, _ := luaReply(L, reply.buf)
+	if e := luaError(ret); e != "" {
+		return fail(e)
+	}
+	L.Push(ret)
+	return 1
+}
+
+//luaReply converts the first reply in buf to a Lua value the way redis does: status and error
+//replies become tables with an ok or err field and null replies become false
+func luaReply(L *lua.LState, buf []byte) (lua.LValue, []byte) {
+	end := bytes.Index(buf, []byte("\r\n"))
+	if end < 1 {
+		return lua.LFalse, nil
+	}
+	line, rest := string(buf[1:end]), buf[end+2:]
+	switch buf[0] {
+	case '+':
+		t := L.NewTable()
+		L.SetField(t, "ok", lua.LString(line))
+		return t, rest
+	case '-':
+		return luaErrorTable(L, line), rest
+	case ':':
+		n, _ := strconv.ParseInt(line, 10, 64)
+		return lua.LNumber(n), rest
+	case '$':
+		n, _ := strconv.Atoi(line)
+		if n < 0 || len(rest) < n+2 {
+			return lua.LFalse, rest
+		}
+		return lua.LString(rest[:n]), rest[n+2:]
+	case '*':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return lua.LFalse, rest
+		}
+		t := L.CreateTable(n, 0)
+		for i := 0; i < n; i++ {
+			var v lua.LValue
+			v, rest = luaReply(L, rest)
+			t.Append(v)
+		}
+		return t, rest
+	}
+	return lua.LFalse, nil
+}
+
+//writeLuaValue replies the value returned by a script, converted the way redis does:
+//numbers are truncated to integers, false is null and arrays stop at their first nil
+func writeLuaValue(conn redcon.Conn, v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LString:
+		conn.WriteBulk([]byte(v))
+	case lua.LNumber:
+		conn.WriteInt(int(v))
+	case lua.LBool:
+		if v {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteNull()
+		}
+	case *lua.LTable:
+		if e := luaError(v); e != "" {
+			conn.WriteError(e)
+			return
+		}
+		if ok, is := v.RawGetString("ok").(lua.LString); is {
+			conn.WriteString(string(ok))
+			return
+		}
+		n := 0
+		for v.RawGetInt(n+1) != lua.LNil {
+			n++
+		}
+		conn.WriteArray(n)
+		for i := 1; i <= n; i++ {
+			writeLuaValue(conn, v.RawGetInt(i))
+		}
+	default:
+		conn.WriteNull()
+	}
+}
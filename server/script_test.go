@@ -0,0 +1,145 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	returnOne = "e0e1f9fabfc9d4800c877a703b823ac0578ff8db" //sha1 of "return 1"
+	setScript = "return redis.call('SET', KEYS[1], ARGV[1])"
+	setSha    = "d8f2fad9f8e86a53d2a6ebd960b33c4972cacc37"
+)
+
+//resetScripts forgets the scripts cached by a test
+func resetScripts(t *testing.T) {
+	Scripts.flush()
+	t.Cleanup(Scripts.flush)
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		//the conversions of Lua values to replies
+		{[]string{"eval", "return 1", "0"}, ":1"},
+		{[]string{"eval", "return 3.99", "0"}, ":3"},
+		{[]string{"eval", "return 'hello'", "0"}, "$5 hello"},
+		{[]string{"eval", "return true", "0"}, ":1"},
+		{[]string{"eval", "return false", "0"}, "$-1"},
+		{[]string{"eval", "return nil", "0"}, "$-1"},
+		{[]string{"eval", "return {1, 'x', {2, false}}", "0"}, "*3 :1 $1 x *2 :2 $-1"},
+		{[]string{"eval", "return {1, nil, 3}", "0"}, "*1 :1"},
+		{[]string{"eval", "return redis.error_reply('MY error')", "0"}, "-MY error"},
+		{[]string{"eval", "return redis.status_reply('FINE')", "0"}, "+FINE"},
+		{[]string{"eval", "return redis.sha1hex('return 1')", "0"}, "$40 " + returnOne},
+		{[]string{"eval", "return {KEYS[1], ARGV[1], #KEYS, #ARGV}", "1", "k", "a", "b"}, "*4 $1 k $1 a :1 :2"},
+		//the conversions of replies to Lua values
+		{[]string{"eval", setScript, "1", "k", "v"}, "+OK"},
+		{[]string{"get", "k"}, "+v"},
+		{[]string{"eval", "return redis.call('GET', KEYS[1])", "1", "k"}, "+v"},
+		{[]string{"eval", "return redis.call('GET', KEYS[1]) == false", "1", "nosuch"}, ":1"},
+		{[]string{"eval", "return redis.call('HSET', KEYS[1], 'f', 2.0)", "1", "h"}, "+OK"},
+		{[]string{"eval", "return redis.call('HGET', KEYS[1], 'f')", "1", "h"}, "+2"},
+		{[]string{"eval", "redis.call('RPUSH', KEYS[1], 'a', 'b'); return redis.call('LRANGE', KEYS[1], 0, -1)", "1", "l"}, "*2 $1 a $1 b"},
+		//redis.call raises the error replies, redis.pcall returns them
+		{[]string{"eval", "return redis.call('nosuch')", "0"}, "-ERR Unknown Redis command called from script"},
+		{[]string{"eval", "local r = redis.pcall('nosuch'); return {r['err']}", "0"}, "*1 $44 ERR Unknown Redis command called from script"},
+		{[]string{"eval", "return redis.pcall('multi')", "0"}, "-ERR This Redis command is not allowed from script"},
+		{[]string{"eval", "return redis.pcall('eval', 'return 1', '0')", "0"}, "-ERR This Redis command is not allowed from script"},
+		{[]string{"eval", "return redis.call()", "0"}, "-ERR Please specify at least one argument for this redis lib call"},
+		{[]string{"eval", "return redis.call('SET', 'k', {})", "0"}, "-ERR Lua redis lib command arguments must be strings or integers"},
+		//the writes made before an error are kept
+		{[]string{"eval", "redis.call('SET', 'a', '1'); redis.call('nosuch')", "0"}, "-ERR Unknown Redis command called from script"},
+		{[]string{"get", "a"}, "+1"},
+		//scripts don't reach the file system
+		{[]string{"eval", "return dofile == nil and require == nil", "0"}, ":1"},
+		{[]string{"eval", "return 1", "x"}, "-ERR value is not an integer or out of range"},
+		{[]string{"eval", "return 1", "-1"}, "-ERR Number of keys can't be negative"},
+		{[]string{"eval", "return 1", "2", "k"}, "-ERR Number of keys can't be greater than number of args"},
+		{[]string{"eval", "return 1"}, "-ERR wrong number of arguments for 'eval' command"},
+	}
+	resetScripts(t)
+	c := newTestConn(newTestDB(t))
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+	if got := c.do("eval", "return (", "0"); !strings.HasPrefix(got, "-ERR Error compiling script (new function): ") {
+		t.Errorf("EVAL of a syntax error = %q", got)
+	}
+	if got := c.do("eval", "error('boom')", "0"); !strings.HasPrefix(got, "-ERR Error running script (call to f_") || !strings.Contains(got, "boom") {
+		t.Errorf("EVAL of a raised error = %q", got)
+	}
+}
+
+func TestScript(t *testing.T) {
+	tests := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"evalsha", returnOne, "0"}, "-NOSCRIPT No matching script. Please use EVAL."},
+		//EVAL caches its script
+		{[]string{"eval", "return 1", "0"}, ":1"},
+		{[]string{"evalsha", returnOne, "0"}, ":1"},
+		{[]string{"evalsha", strings.ToUpper(returnOne), "0"}, ":1"},
+		{[]string{"script", "load", setScript}, "$40 " + setSha},
+		{[]string{"evalsha", setSha, "1", "k", "v"}, "+OK"},
+		{[]string{"get", "k"}, "+v"},
+		{[]string{"script", "exists", returnOne, setSha, "ffff"}, "*3 :1 :1 :0"},
+		{[]string{"script", "flush", "LAZY"}, "-ERR SCRIPT FLUSH only support SYNC|ASYNC option"},
+		{[]string{"script", "flush", "ASYNC"}, "+OK"},
+		{[]string{"script", "exists", returnOne, setSha}, "*2 :0 :0"},
+		{[]string{"evalsha", setSha, "1", "k", "v"}, "-NOSCRIPT No matching script. Please use EVAL."},
+		{[]string{"script", "load", "return 1"}, "$40 " + returnOne},
+		{[]string{"script", "flush"}, "+OK"},
+		{[]string{"script", "exists", returnOne}, "*1 :0"},
+		{[]string{"evalsha", returnOne}, "-ERR wrong number of arguments for 'evalsha' command"},
+		{[]string{"script", "exists"}, "-ERR unknown subcommand or wrong number of arguments for 'exists'. Try SCRIPT HELP."},
+		{[]string{"script", "nosuch"}, "-ERR unknown subcommand or wrong number of arguments for 'nosuch'. Try SCRIPT HELP."},
+		{[]string{"script"}, "-ERR wrong number of arguments for 'script' command"},
+	}
+	resetScripts(t)
+	c := newTestConn(newTestDB(t))
+	for _, tt := range tests {
+		if got := c.do(tt.cmd...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+	if got := c.do("script", "load", "return ("); !strings.HasPrefix(got, "-ERR Error compiling script (new function): ") {
+		t.Errorf("SCRIPT LOAD of a syntax error = %q", got)
+	}
+}
+
+//TestScriptWakesBlocked writes to a key a client is blocked on from a script or EXEC, the
+//client is only woken once the writes committed, so it pops what they added
+func TestScriptWakesBlocked(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes [][]string
+	}{
+		{"eval", [][]string{{"eval", "return redis.call('zadd', KEYS[1], 1, 'a')", "1", "z"}}},
+		{"undeclared key", [][]string{{"eval", "return redis.call('zadd', 'z', 1, 'a')", "0"}}},
+		{"exec", [][]string{{"multi"}, {"zadd", "z", "1", "a"}, {"exec"}}},
+		{"eval in exec", [][]string{{"multi"}, {"eval", "return redis.call('zadd', KEYS[1], 1, 'a')", "1", "z"}, {"exec"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetScripts(t)
+			db := newTestDB(t)
+			c := newTestConn(db)
+			done := make(chan string)
+			go func() { done <- c.do("bzpopmin", "z", "5") }()
+			waitBlocked(t, 1)
+			w := newTestConn(db)
+			for _, v := range tt.writes {
+				w.do(v...)
+			}
+			if got, want := <-done, reply("z", "a", "1"); got != want {
+				t.Errorf("BZPOPMIN = %q, want %q", got, want)
+			}
+		})
+	}
+}
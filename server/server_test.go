@@ -0,0 +1,46 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Zealous-w/tacodb/command"
+	"github.com/Zealous-w/tacodb/store"
+)
+
+//testConn is a client connection of a test, it keeps the replies written to it
+type testConn struct {
+	replyConn
+	ctx interface{}
+}
+
+func (c *testConn) RemoteAddr() string       { return "test" }
+func (c *testConn) Context() interface{}     { return c.ctx }
+func (c *testConn) SetContext(v interface{}) { c.ctx = v }
+
+//newTestDB serves a new LevelDB data directory
+func newTestDB(t *testing.T) *command.RedisCommand {
+	t.Helper()
+	db, closeDB := store.NewDBStore("leveldb", t.TempDir(), 0)
+	t.Cleanup(closeDB)
+	return command.NewRedisCommand(db, command.DATABASES_DEFAULT, "")
+}
+
+func newTestConn(db *command.RedisCommand) *testConn {
+	c := &testConn{}
+	c.ctx = NewSession(c, db)
+	return c
+}
+
+//do runs a command like a connection would and returns its replies, CRLF replaced by spaces
+func (c *testConn) do(args ...string) string {
+	c.buf = nil
+	argv := make([][]byte, 0, len(args))
+	for _, v := range args {
+		argv = append(argv, []byte(v))
+	}
+	if err := MsgCmd.Dispatcher(strings.ToLower(args[0]), &Client{Conn: c}, argv...); err != nil {
+		c.WriteError("ERR '" + err.Error() + "'")
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(c.buf), "\r\n", " "))
+}
@@ -2,17 +2,53 @@ package server
 
 import (
 	"bufio"
+
 	"github.com/Zealous-w/redcon"
+	"github.com/Zealous-w/tacodb/command"
 )
 
+//Session is the per connection state kept in the redcon connection context
 type Session struct {
 	RemoteAddr      string
+	DB              *command.RedisCommand //database selected by SELECT
+	multi           *multiState           //commands queued since MULTI, nil outside a transaction
+	watch           *command.Watch        //keys watched by WATCH
+	asking          bool                  //ASKING was sent, the next command may use a slot being imported
 	closeAfterReply bool
 	rBuf            *bufio.Reader
 	wBuf            *bufio.Writer
 }
 
+func NewSession(conn redcon.Conn, db *command.RedisCommand) *Session {
+	return &Session{
+		RemoteAddr: conn.RemoteAddr(),
+		DB:         db,
+	}
+}
+
+//Close releases what the connection holds once it is gone
+func (s *Session) Close() {
+	s.unwatch()
+}
+
 type Client struct {
 	Conn redcon.Conn
 	Cmds *redcon.Command
+	exec bool   //run by EXEC or a script, blocking commands must not wait
+	cmd  string //command run, the change log records it with the writes
+	//Signals of blocked clients held back until the buffered writes of EXEC or a script
+	//commit, nil sends them at once
+	signals *pendingSignals
+}
+
+func (c *Client) Session() *Session {
+	return c.Conn.Context().(*Session)
+}
+
+//DB returns the database selected by the connection
+func (c *Client) DB() *command.RedisCommand {
+	if c.cmd == "" {
+		return c.Session().DB
+	}
+	return c.Session().DB.Origin(c.cmd)
 }
@@ -102,3 +102,53 @@ func (d *BoltDB) Scan(key []byte) []*Pair {
 	}
 	return ret
 }
+
+func (d *BoltDB) RangeLimit(start, end []byte, limit int) (ret []*Pair) {
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_BUCKET_NAME))
+		if b == nil {
+			return errors.New(fmt.Sprintf("not found bucket %+v", BOLTDB_BUCKET_NAME))
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(start); k != nil && (end == nil || bytes.Compare(k, end) < 0); k, v = c.Next() {
+			ret = append(ret, &Pair{append([]byte{}, k...), append([]byte{}, v...)})
+			if limit > 0 && len(ret) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	return
+}
+
+func (d *BoltDB) RevRangeLimit(start, end []byte, limit int) (ret []*Pair) {
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_BUCKET_NAME))
+		if b == nil {
+			return errors.New(fmt.Sprintf("not found bucket %+v", BOLTDB_BUCKET_NAME))
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if end == nil {
+			k, v = c.Last()
+		} else if k, v = c.Seek(end); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && bytes.Compare(k, start) >= 0; k, v = c.Prev() {
+			ret = append(ret, &Pair{append([]byte{}, k...), append([]byte{}, v...)})
+			if limit > 0 && len(ret) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	return
+}
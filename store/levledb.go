@@ -102,3 +102,37 @@ func (c *LevelDB) Range(start, end []byte) []*Pair {
 	}
 	return ret
 }
+
+func (c *LevelDB) RangeLimit(start, end []byte, limit int) []*Pair {
+	ret := make([]*Pair, 0)
+	it := c.db.NewIterator(&util.Range{Start: start, Limit: end}, nil)
+	for it.Next() {
+		ret = append(ret, &Pair{append([]byte{}, it.Key()...), append([]byte{}, it.Value()...)})
+		if limit > 0 && len(ret) >= limit {
+			break
+		}
+	}
+	it.Release()
+	err := it.Error()
+	if err != nil {
+		return nil
+	}
+	return ret
+}
+
+func (c *LevelDB) RevRangeLimit(start, end []byte, limit int) []*Pair {
+	ret := make([]*Pair, 0)
+	it := c.db.NewIterator(&util.Range{Start: start, Limit: end}, nil)
+	for ok := it.Last(); ok; ok = it.Prev() {
+		ret = append(ret, &Pair{append([]byte{}, it.Key()...), append([]byte{}, it.Value()...)})
+		if limit > 0 && len(ret) >= limit {
+			break
+		}
+	}
+	it.Release()
+	err := it.Error()
+	if err != nil {
+		return nil
+	}
+	return ret
+}
@@ -2,12 +2,22 @@ package store
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 const (
-	CONST_STORE_NUM = 4 //2^CONST_STORE_NUM
+	CONST_STORE_NUM = 4 //2^CONST_STORE_NUM, the shards of a new data directory
 )
 
+//SHARDS_FILE records the number of shards in the directory of an engine. The shard of a key
+//depends on it, so a directory is always opened with the count it was written with and
+//only Reshard changes it. A directory without the file predates it and has the default count
+const SHARDS_FILE = "SHARDS"
+
 type Pair struct {
 	V0 []byte
 	V1 []byte
@@ -21,27 +31,160 @@ type IStore interface {
 	Del(tx interface{}, key []byte) error
 	Transaction(func(t interface{}) error) error
 	Scan(key []byte) []*Pair
-	Range(start, end []byte) []*Pair //[start, end)
+	Range(start, end []byte) []*Pair                    //[start, end)
+	RangeLimit(start, end []byte, limit int) []*Pair    //[start, end), at most limit pairs, limit <= 0 means no limit
+	RevRangeLimit(start, end []byte, limit int) []*Pair //[start, end) from end to start, at most limit pairs
+}
+
+//NewDBStore opens the shards of engine under path. shards is the count of a new directory,
+//0 takes the one of the directory or the default, any other count must match the directory
+func NewDBStore(engine, path string, shards int) ([]IStore, func()) {
+	count, err := LoadShards(engine, path, shards)
+	if err != nil {
+		panic(fmt.Sprintf("load shard count failed, err=%+v", err))
+	}
+	ret, close, err := openShards(engine, filepath.Join(path, engine), count)
+	if err != nil {
+		panic(err.Error())
+	}
+	return ret, close
 }
 
-func NewDBStore(engine, path string) ([]IStore, func()) {
-	ret := make([]IStore, 0, 1<<CONST_STORE_NUM)
-	for i:=0; i < 1<<CONST_STORE_NUM; i++ {
+func openShards(engine, dir string, count int) ([]IStore, func(), error) {
+	ret := make([]IStore, 0, count)
+	close := func() {
+		for _, v := range ret {
+			v.Close()
+		}
+	}
+	for i := 0; i < count; i++ {
+		var db IStore
 		switch engine {
 		case "boltdb":
-			ret = append(ret, NewBoltDB())
+			db = NewBoltDB()
 		case "leveldb":
-			ret = append(ret, NewLevelDB())
+			db = NewLevelDB()
+		default:
+			close()
+			return nil, nil, fmt.Errorf("unknown engine %s", engine)
 		}
-		err := ret[i].Open(path + "/" + engine + "/" + fmt.Sprintf("/%d", i))
-		if err != nil {
-			panic(fmt.Sprintf("open db failed, index=%d, err=%+v", i, err))
+		if err := db.Open(dir + "/" + fmt.Sprintf("/%d", i)); err != nil {
+			close()
+			return nil, nil, fmt.Errorf("open db failed, index=%d, err=%+v", i, err)
 		}
+		ret = append(ret, db)
 	}
-	close := func() {
-		for _, v := range ret {
-			v.Close()
+	return ret, close, nil
+}
+
+//LoadShards returns the shard count of the directory of engine under path, recording shards,
+//or the default when it is 0, for a new directory. It first completes an interrupted Reshard
+func LoadShards(engine, path string, shards int) (int, error) {
+	if shards < 0 || shards > 0xFFFF {
+		return 0, fmt.Errorf("invalid shard count %d", shards)
+	}
+	dir := filepath.Join(path, engine)
+	if err := finishReshard(dir); err != nil {
+		return 0, err
+	}
+	count, err := readShards(dir)
+	if os.IsNotExist(err) {
+		count = 1 << CONST_STORE_NUM
+		if _, err := os.Stat(dir); os.IsNotExist(err) && shards != 0 {
+			count = shards
+		}
+		err = writeShards(dir, count)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if shards != 0 && shards != count {
+		return 0, fmt.Errorf("the data directory has %d shards, not %d, change it with -reshard", count, shards)
+	}
+	return count, nil
+}
+
+func readShards(dir string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, SHARDS_FILE))
+	if err != nil {
+		return 0, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("invalid %s file in %s", SHARDS_FILE, dir)
+	}
+	return count, nil
+}
+
+//writeShards records count through a temporary file, the file is either complete or missing
+func writeShards(dir string, count int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, SHARDS_FILE+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(count)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, SHARDS_FILE))
+}
+
+//Reshard moves the data directory of engine under path into shards shards. The new shards are
+//filled by copy in a staging directory next to the old one, which replaces it once its shard
+//count is recorded: a crash before leaves the old directory as it was, one after is completed
+//by the next LoadShards. The directory must not be in use
+func Reshard(engine, path string, shards int, copy func(from, to []IStore) error) error {
+	count, err := LoadShards(engine, path, 0)
+	if err != nil {
+		return err
+	}
+	if shards < 1 || shards > 0xFFFF {
+		return fmt.Errorf("invalid shard count %d", shards)
+	}
+	dir := filepath.Join(path, engine)
+	staging := dir + ".reshard"
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	from, closeFrom, err := openShards(engine, dir, count)
+	if err != nil {
+		return err
+	}
+	to, closeTo, err := openShards(engine, staging, shards)
+	if err != nil {
+		closeFrom()
+		return err
+	}
+	err = copy(from, to)
+	closeTo()
+	closeFrom()
+	if err != nil {
+		return err
+	}
+	if err := writeShards(staging, shards); err != nil {
+		return err
+	}
+	return finishReshard(dir)
+}
+
+//finishReshard replaces dir by its complete staging directory, if there is one
+func finishReshard(dir string) error {
+	staging, old := dir+".reshard", dir+".old"
+	if _, err := readShards(staging); err != nil {
+		if _, err := os.Stat(dir); err == nil {
+			return os.RemoveAll(old)
+		}
+		return nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		if err := os.RemoveAll(old); err != nil {
+			return err
 		}
+		if err := os.Rename(dir, old); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		return err
 	}
- 	return ret, close
+	return os.RemoveAll(old)
 }
@@ -0,0 +1,15 @@
+package util
+
+//PrefixEnd returns the smallest key greater than every key with the given prefix,
+//nil means there is no upper bound
+func PrefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package util
+
+//HASH_SLOTS is the number of hash slots the keyspace of a redis cluster is split into
+const HASH_SLOTS = 16384
+
+//crc16 XMODEM as used by redis cluster: polynomial 0x1021, initial value 0
+var crc16Table [256]uint16
+
+func init() {
+	for i := range crc16Table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func CRC16(data []byte) uint16 {
+	var crc uint16
+	for _, v := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^v]
+	}
+	return crc
+}
+
+//HashTag returns the part of key that is hashed: what is between the first { and the
+//next }, or the whole key when there is no such part or it is empty
+func HashTag(key []byte) []byte {
+	for i, v := range key {
+		if v != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j == i+1 {
+					return key
+				}
+				return key[i+1 : j]
+			}
+		}
+		return key
+	}
+	return key
+}
+
+//HashSlot returns the cluster hash slot of key
+func HashSlot(key []byte) int {
+	return int(CRC16(HashTag(key)) & (HASH_SLOTS - 1))
+}
@@ -0,0 +1,53 @@
+package util
+
+import "testing"
+
+func TestHashTag(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"", ""},
+		{"user1000", "user1000"},
+		{"{user1000}.following", "user1000"},
+		{"{user1000}.followers", "user1000"},
+		//the examples of the hash tags section of the redis cluster specification
+		{"foo{}{bar}", "foo{}{bar}"},
+		{"foo{{bar}}zap", "{bar"},
+		{"foo{bar}{zap}", "bar"},
+		//an unclosed { or a lone } is part of the key
+		{"foo{bar", "foo{bar"},
+		{"foo}bar{", "foo}bar{"},
+		{"}{x}", "x"},
+	}
+	for _, tt := range tests {
+		if got := string(HashTag([]byte(tt.key))); got != tt.want {
+			t.Errorf("HashTag(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestHashSlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		//the check value of crc16 xmodem in the redis cluster specification is 0x31c3
+		{"123456789", 0x31c3},
+		{"", 0},
+		//the examples of CLUSTER KEYSLOT
+		{"somekey", 11058},
+		{"foo{hello}zz", 866},
+		{"hello", 866},
+		{"{123456789}", 0x31c3},
+		{"x{123456789}y", 0x31c3},
+	}
+	for _, tt := range tests {
+		if got := HashSlot([]byte(tt.key)); got != tt.want {
+			t.Errorf("HashSlot(%q) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+	if got := CRC16([]byte("123456789")); got != 0x31c3 {
+		t.Errorf("CRC16(123456789) = %x, want 31c3", got)
+	}
+}
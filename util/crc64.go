@@ -0,0 +1,12 @@
+package util
+
+import "hash/crc64"
+
+//crc64 Jones as used by redis: reflected, initial value 0 and no final xor
+var crc64JonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+//CRC64 returns the checksum redis puts at the end of RDB files and DUMP payloads
+func CRC64(crc uint64, data []byte) uint64 {
+	//crc64.Update inverts the value before and after the update
+	return ^crc64.Update(^crc, crc64JonesTable, data)
+}
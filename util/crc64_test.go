@@ -0,0 +1,22 @@
+package util
+
+import "testing"
+
+func TestCRC64(t *testing.T) {
+	tests := []struct {
+		crc  uint64
+		data string
+		want uint64
+	}{
+		{0, "", 0},
+		//the check value of crc-64-jones in src/crc64.c of redis
+		{0, "123456789", 0xe9c6d914c4b8d9ca},
+		//the checksum is computed incrementally over the parts of a payload
+		{CRC64(0, []byte("1234")), "56789", 0xe9c6d914c4b8d9ca},
+	}
+	for _, tt := range tests {
+		if got := CRC64(tt.crc, []byte(tt.data)); got != tt.want {
+			t.Errorf("CRC64(%x, %q) = %x, want %x", tt.crc, tt.data, got, tt.want)
+		}
+	}
+}
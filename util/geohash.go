@@ -0,0 +1,222 @@
+package util
+
+import "math"
+
+//geohash compatible with redis: 26 steps of interleaved latitude/longitude bits, 52 bits in total
+
+const (
+	GEO_STEP_MAX = 26
+
+	GEO_LAT_MIN  = -85.05112878
+	GEO_LAT_MAX  = 85.05112878
+	GEO_LONG_MIN = -180.0
+	GEO_LONG_MAX = 180.0
+
+	EARTH_RADIUS_IN_METERS = 6372797.560856
+	MERCATOR_MAX           = 20037726.37
+)
+
+type GeoArea struct {
+	LatMin, LatMax   float64
+	LongMin, LongMax float64
+}
+
+func interleave64(xlo, ylo uint32) uint64 {
+	B := []uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF}
+	S := []uint{1, 2, 4, 8, 16}
+	x, y := uint64(xlo), uint64(ylo)
+	for i := 4; i >= 0; i-- {
+		x = (x | (x << S[i])) & B[i]
+		y = (y | (y << S[i])) & B[i]
+	}
+	return x | (y << 1)
+}
+
+func deinterleave64(interleaved uint64) (uint32, uint32) {
+	B := []uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF, 0x00000000FFFFFFFF}
+	S := []uint{0, 1, 2, 4, 8, 16}
+	x, y := interleaved, interleaved>>1
+	for i := 0; i < 6; i++ {
+		x = (x | (x >> S[i])) & B[i]
+		y = (y | (y >> S[i])) & B[i]
+	}
+	return uint32(x), uint32(y)
+}
+
+func GeoValid(long, lat float64) bool {
+	return long >= GEO_LONG_MIN && long <= GEO_LONG_MAX && lat >= GEO_LAT_MIN && lat <= GEO_LAT_MAX
+}
+
+//GeoEncode returns the geohash of a point with step*2 bits
+func GeoEncode(long, lat float64, step uint) uint64 {
+	latOffset := (lat - GEO_LAT_MIN) / (GEO_LAT_MAX - GEO_LAT_MIN)
+	longOffset := (long - GEO_LONG_MIN) / (GEO_LONG_MAX - GEO_LONG_MIN)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return interleave64(uint32(latOffset), uint32(longOffset))
+}
+
+//GeoDecodeArea returns the cell covered by a geohash of step*2 bits
+func GeoDecodeArea(bits uint64, step uint) *GeoArea {
+	ilato, ilono := deinterleave64(bits)
+	latScale := GEO_LAT_MAX - GEO_LAT_MIN
+	longScale := GEO_LONG_MAX - GEO_LONG_MIN
+	cells := float64(uint64(1) << step)
+	return &GeoArea{
+		LatMin:  GEO_LAT_MIN + (float64(ilato)/cells)*latScale,
+		LatMax:  GEO_LAT_MIN + (float64(ilato+1)/cells)*latScale,
+		LongMin: GEO_LONG_MIN + (float64(ilono)/cells)*longScale,
+		LongMax: GEO_LONG_MIN + (float64(ilono+1)/cells)*longScale,
+	}
+}
+
+//GeoDecode returns the center of a full precision geohash
+func GeoDecode(bits uint64) (long, lat float64) {
+	area := GeoDecodeArea(bits, GEO_STEP_MAX)
+	long = math.Min(GEO_LONG_MAX, math.Max(GEO_LONG_MIN, (area.LongMin+area.LongMax)/2))
+	lat = math.Min(GEO_LAT_MAX, math.Max(GEO_LAT_MIN, (area.LatMin+area.LatMax)/2))
+	return
+}
+
+//GeoAlign converts a geohash of step*2 bits into the [min, max) range of full precision hashes inside it
+func GeoAlign(bits uint64, step uint) (uint64, uint64) {
+	shift := 2 * (GEO_STEP_MAX - step)
+	return bits << shift, (bits + 1) << shift
+}
+
+func geoMoveX(bits uint64, step uint, d int) uint64 {
+	x := bits & 0xaaaaaaaaaaaaaaaa
+	y := bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - step*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - step*2)
+	return x | y
+}
+
+func geoMoveY(bits uint64, step uint, d int) uint64 {
+	x := bits & 0xaaaaaaaaaaaaaaaa
+	y := bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - step*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= uint64(0x5555555555555555) >> (64 - step*2)
+	return x | y
+}
+
+//GeoNeighbors returns the cell itself followed by its 8 neighbors
+func GeoNeighbors(bits uint64, step uint) []uint64 {
+	ret := make([]uint64, 0, 9)
+	for _, dx := range []int{0, -1, 1} {
+		for _, dy := range []int{0, -1, 1} {
+			n := bits
+			if dx != 0 {
+				n = geoMoveX(n, step, dx)
+			}
+			if dy != 0 {
+				n = geoMoveY(n, step, dy)
+			}
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+//GeoEstimateSteps returns the coarsest step whose cells are about as large as the radius
+func GeoEstimateSteps(radius, lat float64) uint {
+	if radius == 0 {
+		return GEO_STEP_MAX
+	}
+	step := 1
+	for radius < MERCATOR_MAX {
+		radius *= 2
+		step++
+	}
+	step -= 2
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	if step < 1 {
+		step = 1
+	}
+	if step > GEO_STEP_MAX {
+		step = GEO_STEP_MAX
+	}
+	return uint(step)
+}
+
+//GeoBoundingBox returns the lat/long box enclosing a width*height rectangle in meters around a point
+func GeoBoundingBox(long, lat, width, height float64) *GeoArea {
+	dlat := rad2deg(height / 2 / EARTH_RADIUS_IN_METERS)
+	dlong := rad2deg(width / 2 / EARTH_RADIUS_IN_METERS / math.Cos(deg2rad(lat)))
+	return &GeoArea{
+		LatMin:  lat - dlat,
+		LatMax:  lat + dlat,
+		LongMin: long - dlong,
+		LongMax: long + dlong,
+	}
+}
+
+//GeoSearchCells returns the full precision [min, max) hash ranges to scan for a width*height box around a point,
+//the step is lowered until the center cell and its neighbors cover the whole box
+func GeoSearchCells(long, lat, width, height float64) [][2]uint64 {
+	box := GeoBoundingBox(long, lat, width, height)
+	step := GeoEstimateSteps(math.Sqrt(width*width+height*height)/2, lat)
+	for ; step > 1; step-- {
+		area := GeoDecodeArea(GeoEncode(long, lat, step), step)
+		dlat, dlong := area.LatMax-area.LatMin, area.LongMax-area.LongMin
+		if area.LatMin-dlat <= box.LatMin && area.LatMax+dlat >= box.LatMax &&
+			area.LongMin-dlong <= box.LongMin && area.LongMax+dlong >= box.LongMax {
+			break
+		}
+	}
+
+	seen := make(map[uint64]bool, 9)
+	ret := make([][2]uint64, 0, 9)
+	for _, cell := range GeoNeighbors(GeoEncode(long, lat, step), step) {
+		if seen[cell] {
+			continue
+		}
+		seen[cell] = true
+		min, max := GeoAlign(cell, step)
+		ret = append(ret, [2]uint64{min, max})
+	}
+	return ret
+}
+
+func deg2rad(d float64) float64 {
+	return d * math.Pi / 180.0
+}
+
+func rad2deg(r float64) float64 {
+	return r / (math.Pi / 180.0)
+}
+
+//GeoDistance returns the haversine distance in meters
+func GeoDistance(long1, lat1, long2, lat2 float64) float64 {
+	lat1r, lon1r := deg2rad(lat1), deg2rad(long1)
+	lat2r, lon2r := deg2rad(lat2), deg2rad(long2)
+	v := math.Sin((lon2r - lon1r) / 2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * EARTH_RADIUS_IN_METERS * math.Asin(math.Sqrt(a))
+}
+
+//GeoInBox reports whether (long2, lat2) lies in the width*height box centered at (long1, lat1)
+func GeoInBox(long1, lat1, long2, lat2, width, height float64) bool {
+	if GeoDistance(long1, lat1, long1, lat2) > height/2 {
+		return false
+	}
+	return GeoDistance(long1, lat2, long2, lat2) <= width/2
+}
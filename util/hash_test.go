@@ -0,0 +1,58 @@
+package util
+
+import "testing"
+
+func TestXXHash64(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"user1000", 0x3539c3d325d60b17},
+		//32 bytes and more go through the four accumulators
+		{"0123456789abcdefghijklmnopqrstuvwxyz", 0x69196c1b3af0bff9},
+	}
+	for _, tt := range tests {
+		if got := XXHash64([]byte(tt.data)); got != tt.want {
+			t.Errorf("XXHash64(%q) = %x, want %x", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestJumpHash(t *testing.T) {
+	tests := []struct {
+		from, to int
+	}{
+		{1, 2},
+		{4, 5},
+		{7, 8},
+		{10, 16},
+	}
+	for _, tt := range tests {
+		moved := 0
+		for i := uint64(0); i < 10000; i++ {
+			key := XXHash64([]byte{byte(i), byte(i >> 8)})
+			a, b := JumpHash(key, tt.from), JumpHash(key, tt.to)
+			if a < 0 || a >= tt.from || b < 0 || b >= tt.to {
+				t.Fatalf("JumpHash(%x) = %d among %d, %d among %d", key, a, tt.from, b, tt.to)
+			}
+			//a key only moves to one of the added buckets
+			if a != b {
+				if b < tt.from {
+					t.Fatalf("JumpHash(%x) moved from %d to %d growing %d to %d", key, a, b, tt.from, tt.to)
+				}
+				moved++
+			}
+		}
+		//about (to-from)/to of the keys move
+		want := 10000 * (tt.to - tt.from) / tt.to
+		if moved < want*8/10 || moved > want*12/10 {
+			t.Errorf("%d keys of 10000 moved growing %d to %d, want about %d", moved, tt.from, tt.to, want)
+		}
+	}
+	if got := JumpHash(12345, 1); got != 0 {
+		t.Errorf("JumpHash(12345, 1) = %d", got)
+	}
+}
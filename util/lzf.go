@@ -0,0 +1,50 @@
+package util
+
+import "errors"
+
+var ErrLZFCorrupt = errors.New("lzf data is corrupt")
+
+//LZFDecompress expands data compressed by liblzf into exactly size bytes
+func LZFDecompress(data []byte, size int) ([]byte, error) {
+	ret := make([]byte, 0, size)
+	for i := 0; i < len(data); {
+		ctrl := int(data[i])
+		i++
+		if ctrl < 32 {
+			//literal run of ctrl+1 bytes
+			n := ctrl + 1
+			if i+n > len(data) || len(ret)+n > size {
+				return nil, ErrLZFCorrupt
+			}
+			ret = append(ret, data[i:i+n]...)
+			i += n
+			continue
+		}
+		//back reference, the length lives in the top 3 bits and may continue in the next byte
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(data) {
+				return nil, ErrLZFCorrupt
+			}
+			n += int(data[i])
+			i++
+		}
+		n += 2
+		if i >= len(data) {
+			return nil, ErrLZFCorrupt
+		}
+		ref := len(ret) - ((ctrl&0x1F)<<8 | int(data[i])) - 1
+		i++
+		if ref < 0 || len(ret)+n > size {
+			return nil, ErrLZFCorrupt
+		}
+		//the reference may overlap the bytes being written, copy one at a time
+		for j := 0; j < n; j++ {
+			ret = append(ret, ret[ref+j])
+		}
+	}
+	if len(ret) != size {
+		return nil, ErrLZFCorrupt
+	}
+	return ret, nil
+}
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLZFDecompress(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		size int
+		want string
+		err  error
+	}{
+		{"literal", "\x02abc", 3, "abc", nil},
+		{"short back reference", "\x02abc\x20\x02", 6, "abcabc", nil},
+		{"overlapping back reference", "\x00a\xe0\x0a\x00", 20, strings.Repeat("a", 20), nil},
+		{"literal after reference", "\x01ab\x40\x01\x00c", 7, "abababc", nil},
+		{"empty", "", 0, "", nil},
+		{"truncated literal", "\x05abc", 6, "", ErrLZFCorrupt},
+		{"truncated reference", "\x00a\xe0", 20, "", ErrLZFCorrupt},
+		{"reference before the start", "\x00a\x20\x05", 4, "", ErrLZFCorrupt},
+		{"longer than size", "\x02abc", 2, "", ErrLZFCorrupt},
+		{"shorter than size", "\x02abc", 4, "", ErrLZFCorrupt},
+	}
+	for _, tt := range tests {
+		got, err := LZFDecompress([]byte(tt.data), tt.size)
+		if err != tt.err || (err == nil && string(got) != tt.want) {
+			t.Errorf("%s: LZFDecompress() = %q, %v, want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}